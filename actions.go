@@ -0,0 +1,1040 @@
+// Actions shared by the GUI buttons and the CLI subcommands
+
+package main
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/export"
+	"cmsv_api/hlsproxy"
+	"cmsv_api/journal"
+	"cmsv_api/playlist"
+	"cmsv_api/probe"
+	"cmsv_api/recorder"
+	"cmsv_api/relay"
+	"cmsv_api/rtsp"
+	"cmsv_api/webhook"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deviceKey returns the name a device is listed under in selectors and reports
+func deviceKey(d cmsv.Device) string {
+	return fmt.Sprintf("%s (%s)", d.VID, d.DID)
+}
+
+// deviceLinks generates the player links of every device, keyed by deviceKey
+func deviceLinks(client *cmsv.Client, jsession string, devices []cmsv.Device, account, password string) map[string]map[string]string {
+	allLinks := make(map[string]map[string]string)
+	for _, d := range devices {
+		allLinks[deviceKey(d)] = client.PlayerLinks(jsession, d.DID, d.VID, account, password)
+	}
+	return allLinks
+}
+
+// formatDeviceLinks renders the device list together with its player links
+func formatDeviceLinks(devices []cmsv.Device, allLinks map[string]map[string]string) string {
+	builder := strings.Builder{}
+
+	builder.WriteString(fmt.Sprintf("Found %d devices\n\n", len(devices)))
+	for _, d := range devices {
+		key := deviceKey(d)
+		builder.WriteString(fmt.Sprintf("Device: %s\n", key))
+		for name, link := range allLinks[key] {
+			builder.WriteString(fmt.Sprintf("  %s: %s\n", name, link))
+		}
+		builder.WriteString(strings.Repeat("-", 60) + "\n")
+	}
+
+	return builder.String()
+}
+
+// formatVehicleInfo renders the vehicle list, optionally preceded by the company tree
+func formatVehicleInfo(vehicleInfo *cmsv.VehicleResponse, showHierarchy bool) string {
+	builder := strings.Builder{}
+
+	// Build and display company hierarchy only if enabled
+	if showHierarchy {
+		builder.WriteString("=== COMPANY HIERARCHY ===\n")
+		hierarchy := buildCompanyHierarchy(vehicleInfo.Companys)
+		printCompanyTree(&builder, hierarchy, 2, "")
+		builder.WriteString("\n")
+	}
+
+	// Display vehicle information
+	builder.WriteString("=== VEHICLE INFORMATION ===\n")
+	for _, vehicle := range vehicleInfo.Vehicles {
+		builder.WriteString(fmt.Sprintf("Vehicle: %s (ID: %d)\n", vehicle.Name, vehicle.ID))
+		builder.WriteString(fmt.Sprintf("  Company: %s\n", vehicle.PName))
+		builder.WriteString(fmt.Sprintf("  Type: %s, Band: %s, Color: %s\n",
+			vehicle.VehicleType, vehicle.VehicleBand, vehicle.VehicleColor))
+		builder.WriteString(fmt.Sprintf("  Owner: %s\n", vehicle.OwnerName))
+		builder.WriteString(fmt.Sprintf("  Engine #: %s, Frame #: %s\n",
+			vehicle.EngineNum, vehicle.FrameNum))
+
+		// Display device information for each vehicle
+		builder.WriteString("  Devices:\n")
+		for _, device := range vehicle.DeviceList {
+			builder.WriteString(fmt.Sprintf("    - %s (%s)\n", device.ID, device.SIM))
+			builder.WriteString(fmt.Sprintf("      Channels: %d, Channel Name: %s\n", device.Channels, device.ChanName))
+			builder.WriteString(fmt.Sprintf("      Installed: %s\n", device.InstallTime))
+		}
+		builder.WriteString(strings.Repeat("-", 60) + "\n")
+	}
+
+	return builder.String()
+}
+
+// formatAlarms renders the alarm list shown by "GET DEVICE ALARMS"
+func formatAlarms(alarms []cmsv.Alarm) string {
+	builder := strings.Builder{}
+	builder.WriteString("=== DEVICE ALARMS ===\n")
+
+	if len(alarms) == 0 {
+		builder.WriteString("No alarms found for this device\n")
+		return builder.String()
+	}
+
+	builder.WriteString(fmt.Sprintf("Found %d alarms\n\n", len(alarms)))
+	for _, alarm := range alarms {
+		writeAlarm(&builder, alarm)
+	}
+	return builder.String()
+}
+
+// formatAlarmType renders an alarm type code with its catalog entry, e.g.
+// "620 Smoking [DSM, warning]"
+func formatAlarmType(code int) string {
+	t := config.AlarmTypes.Describe(code)
+	return fmt.Sprintf("%s [%s, %s]", t, t.Category, t.Severity)
+}
+
+// formatAlarmTypes renders the alarm type catalog as a table
+func formatAlarmTypes(types []cmsv.AlarmType) string {
+	builder := strings.Builder{}
+	builder.WriteString("=== ALARM TYPES ===\n")
+	builder.WriteString(fmt.Sprintf("%-6s %-9s %-9s %s\n", "Code", "Category", "Severity", "Name"))
+	for _, t := range types {
+		builder.WriteString(fmt.Sprintf("%-6d %-9s %-9s %s\n", t.Code, t.Category, t.Severity, t.Name))
+	}
+	return builder.String()
+}
+
+// writeAlarm writes the details of a single alarm followed by a separator line
+func writeAlarm(w io.Writer, alarm cmsv.Alarm) {
+	fmt.Fprintf(w, "Device: %s\n", alarm.DevIDNO)
+	fmt.Fprintf(w, "Time: %s\n", alarm.Time)
+	fmt.Fprintf(w, "Type: %s\n", formatAlarmType(alarm.Type))
+	fmt.Fprintf(w, "Description: %s\n", alarm.Desc)
+
+	if alarm.Gps.Lat != 0 && alarm.Gps.Lng != 0 {
+		fmt.Fprintf(w, "Location: %.6f, %.6f\n",
+			float64(alarm.Gps.Lat)/1000000.0, float64(alarm.Gps.Lng)/1000000.0)
+		fmt.Fprintf(w, "Mapped Location: %s, %s\n", alarm.Gps.MLat, alarm.Gps.MLng)
+		fmt.Fprintf(w, "Speed: %.1f km/h\n", float64(alarm.Gps.SP)/10.0)
+	}
+
+	status := "Unprocessed"
+	if alarm.HD == 1 {
+		status = "Processed"
+	}
+	fmt.Fprintf(w, "Status: %s\n", status)
+	fmt.Fprintln(w, strings.Repeat("-", 60))
+}
+
+// formatAlarmHistory renders the historical alarms found by an alarm history search
+func formatAlarmHistory(alarms []cmsv.AlarmDetail) string {
+	builder := strings.Builder{}
+	builder.WriteString("=== ALARM HISTORY ===\n")
+
+	if len(alarms) == 0 {
+		builder.WriteString("No alarms found for this search\n")
+		return builder.String()
+	}
+
+	builder.WriteString(fmt.Sprintf("Found %d alarms\n\n", len(alarms)))
+	for _, alarm := range alarms {
+		builder.WriteString(fmt.Sprintf("Vehicle: %s\n", alarm.VehiIDNO))
+		builder.WriteString(fmt.Sprintf("End Time: %s\n", alarm.EndTime))
+		writeAlarm(&builder, alarm.Alarm())
+	}
+	return builder.String()
+}
+
+// historyTimeLayouts are the accepted formats of alarm history begin/end times
+var historyTimeLayouts = []string{cmsv.TimeLayout, "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// parseHistoryTime parses a begin/end time in local time. A date without a
+// time means the start of the day, or its last second when endOfDay is set.
+func parseHistoryTime(s string, endOfDay bool) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range historyTimeLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" && endOfDay {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (use YYYY-MM-DD [HH:MM[:SS]])", s)
+}
+
+// parseAlarmTypes parses a comma-separated list of alarm type codes
+func parseAlarmTypes(s string) ([]int, error) {
+	var types []int
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		t, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alarm type %q", item)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// parseHandleStatus accepts "all", "processed" or "unprocessed"
+func parseHandleStatus(s string) (cmsv.HandleStatus, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "all":
+		return cmsv.HandleAll, nil
+	case "unprocessed":
+		return cmsv.HandleUnprocessed, nil
+	case "processed":
+		return cmsv.HandleProcessed, nil
+	}
+	return cmsv.HandleAll, fmt.Errorf("invalid handled filter %q (use all, processed or unprocessed)", s)
+}
+
+// formatDeviceStatus renders the real-time status of devices with the decoded status words
+func formatDeviceStatus(statuses []cmsv.DeviceStatus) string {
+	builder := strings.Builder{}
+	builder.WriteString("=== DEVICE STATUS ===\n")
+
+	if len(statuses) == 0 {
+		builder.WriteString("No status returned for this device\n")
+		return builder.String()
+	}
+
+	for _, s := range statuses {
+		online := "Offline"
+		if s.Online() {
+			online = "Online"
+		}
+		builder.WriteString(fmt.Sprintf("Device: %s (%s)\n", s.VID, s.ID))
+		builder.WriteString(fmt.Sprintf("  Status: %s, Network: %s, Last Update: %s\n", online, s.NetworkName(), s.GT))
+
+		if s.HasPosition() {
+			builder.WriteString(fmt.Sprintf("  Location: %.6f, %.6f\n", s.Latitude(), s.Longitude()))
+			builder.WriteString(fmt.Sprintf("  Mapped Location: %s, %s\n", s.MLat, s.MLng))
+		}
+		if s.PS != "" {
+			builder.WriteString(fmt.Sprintf("  Address: %s\n", s.PS))
+		}
+		builder.WriteString(fmt.Sprintf("  Speed: %.1f km/h, Heading: %d°, Satellites: %d\n", s.SpeedKmh(), s.HX, s.SN))
+		builder.WriteString(fmt.Sprintf("  Fuel: %.2f L, Mileage: %.3f km, Parked: %ds\n", s.FuelLiters(), s.MileageKm(), s.PK))
+		builder.WriteString(fmt.Sprintf("  Temperatures: %d, %d, %d, %d\n", s.T1, s.T2, s.T3, s.T4))
+		if s.DriverName != "" {
+			builder.WriteString(fmt.Sprintf("  Driver: %s (%s)\n", s.DriverName, s.DriverCertNo))
+		}
+
+		equipment := s.Equipment()
+		builder.WriteString(fmt.Sprintf("  Summary: %s\n", cmsv.StatusDescription(equipment)))
+		builder.WriteString(fmt.Sprintf("  Flags: %s\n", strings.Join(equipment.ActiveFlags(), ", ")))
+		builder.WriteString(strings.Repeat("-", 60) + "\n")
+	}
+
+	return builder.String()
+}
+
+// formatTrack renders a recorded track, one line per point
+func formatTrack(track *cmsv.Track) string {
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("=== TRACK %s ===\n", trackTitle(track)))
+
+	if len(track.Points) == 0 {
+		builder.WriteString("No positions recorded in this time range\n")
+		return builder.String()
+	}
+	builder.WriteString(formatTrackSummary(track) + "\n\n")
+
+	for _, p := range track.Points {
+		builder.WriteString(fmt.Sprintf("%s  %.6f, %.6f  %5.1f km/h  %3d° %-2s  %s\n",
+			p.Time().Format(cmsv.TimeLayout), p.Latitude(), p.Longitude(),
+			p.SpeedKmh(), p.HX, compassPoint(p.HX), cmsv.StatusDescription(p.Equipment())))
+	}
+	return builder.String()
+}
+
+// trackTitle names a track by its vehicle and device
+func trackTitle(track *cmsv.Track) string {
+	if vehicle := track.Vehicle(); vehicle != "" {
+		return fmt.Sprintf("%s (%s)", vehicle, track.Device)
+	}
+	return track.Device
+}
+
+// formatTrackSummary returns the time range, length and top speed of a track
+func formatTrackSummary(track *cmsv.Track) string {
+	first, last := track.Points[0], track.Points[len(track.Points)-1]
+	return fmt.Sprintf("%s to %s: %d points, %.2f km in %s, max speed %.1f km/h",
+		first.Time().Format(cmsv.TimeLayout), last.Time().Format(cmsv.TimeLayout),
+		len(track.Points), track.DistanceKm(), track.Duration().Round(time.Second), track.MaxSpeedKmh())
+}
+
+// formatTrackPoint renders one track point with its decoded status, as shown
+// by the track playback
+func formatTrackPoint(p cmsv.TrackPoint) string {
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("Time: %s\n", p.Time().Format(cmsv.TimeLayout)))
+	if p.HasPosition() {
+		builder.WriteString(fmt.Sprintf("Location: %.6f, %.6f\n", p.Latitude(), p.Longitude()))
+		builder.WriteString(fmt.Sprintf("Mapped Location: %s, %s\n", p.MLat, p.MLng))
+	}
+	if p.PS != "" {
+		builder.WriteString(fmt.Sprintf("Address: %s\n", p.PS))
+	}
+	builder.WriteString(fmt.Sprintf("Speed: %.1f km/h, Heading: %d° %s\n", p.SpeedKmh(), p.HX, compassPoint(p.HX)))
+	builder.WriteString(fmt.Sprintf("Fuel: %.2f L, Mileage: %.3f km, Parked: %ds\n", p.FuelLiters(), p.MileageKm(), p.PK))
+
+	equipment := p.Equipment()
+	builder.WriteString(fmt.Sprintf("Summary: %s\n", cmsv.StatusDescription(equipment)))
+	builder.WriteString(fmt.Sprintf("Flags: %s\n", strings.Join(equipment.ActiveFlags(), ", ")))
+	return builder.String()
+}
+
+// compassPoint returns the 8-point compass direction of a heading, e.g. "NE"
+func compassPoint(heading int) string {
+	points := []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}
+	return points[((heading%360+360)%360+22)/45%8]
+}
+
+// parseStreamType accepts "main"/"sub" or the numeric stream type 0/1
+func parseStreamType(s string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "main", "0":
+		return 0, nil
+	case "sub", "1":
+		return 1, nil
+	}
+	return 0, fmt.Errorf("invalid stream type %q (use main or sub)", s)
+}
+
+// streamLink generates a live stream link for one device channel. protocol is
+// one of "rtsp", "rtmp" or "hls"; an empty host uses the configured server.
+func streamLink(client *cmsv.Client, protocol, host, jsession, devIDNO string, channel, stream int) (string, error) {
+	switch strings.ToLower(protocol) {
+	case "rtsp":
+		return client.GenerateRTSPLink(cmsv.RTSPLinkOptions{
+			ServerHost: host,
+			JSession:   jsession,
+			DevIDNO:    devIDNO,
+			Channel:    channel,
+			Stream:     stream,
+			AVType:     1, // Live video
+		}), nil
+	case "rtmp":
+		return client.GenerateRTMPLink(cmsv.RTMPLinkOptions{
+			ServerHost: host,
+			JSession:   jsession,
+			DevIDNO:    devIDNO,
+			Channel:    channel,
+			Stream:     stream,
+			AVType:     1, // Live video
+		}), nil
+	case "hls":
+		return client.GenerateHLSLink(cmsv.HLSLinkOptions{
+			ServerHost:  host,
+			JSession:    jsession,
+			DevIDNO:     devIDNO,
+			Channel:     channel,
+			Stream:      stream,
+			RequestType: 1, // Real-time video
+		}), nil
+	}
+	return "", fmt.Errorf("unknown stream protocol %q (use rtsp, rtmp or hls)", protocol)
+}
+
+// fleetLinks generates the live stream links of the selected cameras of the
+// account. An empty host uses the configured server.
+func fleetLinks(ctx context.Context, session *cmsv.Session, host string, sel playlist.Selection) ([]playlist.Camera, error) {
+	info, err := session.VehicleInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("vehicle info fetch failed: %v", err)
+	}
+	jsession, err := session.JSession(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("login failed: %v", err)
+	}
+	return playlist.Cameras(info, sel, func(devIDNO string, channel, stream int, protocol string) (string, error) {
+		return streamLink(session.Client(), protocol, host, jsession, devIDNO, channel, stream)
+	})
+}
+
+// parseChannels parses a channel selection: comma-separated channel numbers
+// starting from 0, or "all" for every channel of the device
+func parseChannels(s string) (numbers []int, all bool, err error) {
+	if strings.EqualFold(strings.TrimSpace(s), "all") {
+		return nil, true, nil
+	}
+	for _, item := range splitList(s) {
+		n, err := strconv.Atoi(item)
+		if err != nil || n < 0 {
+			return nil, false, fmt.Errorf("invalid channel %q", item)
+		}
+		numbers = append(numbers, n)
+	}
+	if len(numbers) == 0 {
+		return nil, false, fmt.Errorf("no channel given")
+	}
+	return numbers, false, nil
+}
+
+// selectChannels returns the selected channels of a device, named from the
+// vehicle information, which may be nil
+func selectChannels(info *cmsv.VehicleResponse, devIDNO string, numbers []int, all bool) []cmsv.Channel {
+	channels := cmsv.DeviceChannels(info, devIDNO)
+	if all {
+		return channels
+	}
+	selected := make([]cmsv.Channel, 0, len(numbers))
+	for _, n := range numbers {
+		ch := cmsv.Channel{Number: n}
+		if n < len(channels) {
+			ch.Name = channels[n].Name
+		}
+		selected = append(selected, ch)
+	}
+	return selected
+}
+
+// channelLink is the live stream link of a device channel
+type channelLink struct {
+	cmsv.Channel
+	URL string `json:"url"`
+}
+
+// channelLinks generates the live stream links of several channels of a
+// device
+func channelLinks(client *cmsv.Client, protocol, host, jsession, devIDNO string, channels []cmsv.Channel, stream int) ([]channelLink, error) {
+	links := make([]channelLink, 0, len(channels))
+	for _, ch := range channels {
+		link, err := streamLink(client, protocol, host, jsession, devIDNO, ch.Number, stream)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, channelLink{Channel: ch, URL: link})
+	}
+	return links, nil
+}
+
+// formatChannelLinks lists links one per line, after their channel
+func formatChannelLinks(links []channelLink) string {
+	var b strings.Builder
+	for _, l := range links {
+		fmt.Fprintf(&b, "%s: %s\n", l.Label(), l.URL)
+	}
+	return b.String()
+}
+
+// videoClip is a recording cut to the searched time window, with the link
+// that plays it
+type videoClip struct {
+	cmsv.VideoClip
+	URL string `json:"url"`
+}
+
+// searchVideo finds the recordings in the query range and generates their
+// playback links. host overrides the media server host from server_url.
+func searchVideo(ctx context.Context, session *cmsv.Session, host string, q cmsv.VideoQuery) ([]videoClip, error) {
+	files, err := session.VideoFiles(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("video fetch failed: %v", err)
+	}
+	jsession, err := session.JSession(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("login failed: %v", err)
+	}
+
+	var clips []videoClip
+	for _, c := range cmsv.Clips(files, q.Begin, q.End) {
+		clips = append(clips, videoClip{
+			VideoClip: c,
+			URL: session.Client().GeneratePlaybackLink(cmsv.PlaybackLinkOptions{
+				ServerHost: host,
+				JSession:   jsession,
+				File:       c.File,
+				Begin:      c.Begin,
+				End:        c.End,
+			}),
+		})
+	}
+	return clips, nil
+}
+
+// alarmVideoQuery searches the configured location for the video around an
+// alarm, from alarm_video_before_seconds before to alarm_video_after_seconds after
+func alarmVideoQuery(alarm cmsv.Alarm) (cmsv.VideoQuery, error) {
+	q, err := cmsv.AlarmVideoQuery(alarm,
+		time.Duration(config.AlarmVideoBeforeSeconds)*time.Second,
+		time.Duration(config.AlarmVideoAfterSeconds)*time.Second)
+	q.Location = config.VideoLocation
+	return q, err
+}
+
+// formatVideoClips renders the recordings found by searchVideo
+func formatVideoClips(title string, clips []videoClip) string {
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("=== RECORDED VIDEO %s ===\n", title))
+
+	if len(clips) == 0 {
+		builder.WriteString("No recordings found in this time range\n")
+		return builder.String()
+	}
+
+	builder.WriteString(fmt.Sprintf("Found %d recordings\n\n", len(clips)))
+	for _, c := range clips {
+		kind := "normal"
+		if c.File.Type == cmsv.RecordAlarm {
+			kind = "alarm"
+		}
+		builder.WriteString(fmt.Sprintf("Channel %d: %s to %s (%s, %s recording on %s)\n",
+			c.File.Channel, c.Begin.Format(cmsv.TimeLayout), c.End.Format("15:04:05"),
+			c.End.Sub(c.Begin), kind, c.File.Location()))
+		builder.WriteString(fmt.Sprintf("  File: %s (%s to %s, %.1f MB)\n", c.File.File,
+			c.File.BeginTime().Format("15:04:05"), c.File.EndTime().Format("15:04:05"), float64(c.File.Len)/(1<<20)))
+		builder.WriteString(fmt.Sprintf("  Playback: %s\n", c.URL))
+		builder.WriteString(strings.Repeat("-", 60) + "\n")
+	}
+	return builder.String()
+}
+
+// createdDownload is the outcome of one download task created by createDownloads
+type createdDownload struct {
+	Clip   cmsv.VideoClip `json:"clip"`
+	TaskID string         `json:"taskId,omitempty"`
+	Exists bool           `json:"exists,omitempty"` // A task for this clip already exists
+}
+
+// createDownloads searches the recordings in the query range and creates a
+// download task for the part of every file inside the range. Clips that
+// already have a task are reported instead of failing the whole request.
+func createDownloads(ctx context.Context, session *cmsv.Session, q cmsv.VideoQuery, label string) ([]createdDownload, error) {
+	files, err := session.VideoFiles(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("video fetch failed: %v", err)
+	}
+
+	created := []createdDownload{}
+	for _, c := range cmsv.Clips(files, q.Begin, q.End) {
+		id, err := session.AddDownloadTask(ctx, cmsv.NewDownloadRequest(c, label))
+		switch {
+		case errors.Is(err, cmsv.ErrDownloadTaskExists):
+			created = append(created, createdDownload{Clip: c, Exists: true})
+		case err != nil:
+			return created, fmt.Errorf("download task failed: %v", err)
+		default:
+			created = append(created, createdDownload{Clip: c, TaskID: id})
+		}
+	}
+	return created, nil
+}
+
+// formatCreatedDownloads renders the result of createDownloads
+func formatCreatedDownloads(created []createdDownload) string {
+	builder := strings.Builder{}
+	builder.WriteString("=== NEW DOWNLOAD TASKS ===\n")
+	if len(created) == 0 {
+		builder.WriteString("No recordings found in this time range\n")
+		return builder.String()
+	}
+	for _, d := range created {
+		status := "task " + d.TaskID
+		if d.Exists {
+			status = "task already exists"
+		}
+		builder.WriteString(fmt.Sprintf("%s channel %d, %s to %s: %s\n", d.Clip.File.DevIDNO, d.Clip.File.Channel,
+			d.Clip.Begin.Format(cmsv.TimeLayout), d.Clip.End.Format("15:04:05"), status))
+	}
+	return builder.String()
+}
+
+// formatDownloadTasks renders the download task list
+func formatDownloadTasks(tasks []cmsv.DownloadTask) string {
+	builder := strings.Builder{}
+	builder.WriteString("=== DOWNLOAD TASKS ===\n")
+	if len(tasks) == 0 {
+		builder.WriteString("No download tasks\n")
+		return builder.String()
+	}
+
+	builder.WriteString(fmt.Sprintf("Found %d tasks\n\n", len(tasks)))
+	for _, t := range tasks {
+		builder.WriteString(fmt.Sprintf("Task %s: %s\n", t.ID, formatDownloadStatus(t)))
+		builder.WriteString(fmt.Sprintf("  Device: %s, Channel: %d\n", t.DevIDNO, t.Channel))
+		builder.WriteString(fmt.Sprintf("  Video: %s to %s (%.1f MB)\n", t.Begin, t.End, float64(t.Size)/(1<<20)))
+		if t.Label != "" {
+			builder.WriteString(fmt.Sprintf("  Label: %s\n", t.Label))
+		}
+		if t.URL != "" {
+			builder.WriteString(fmt.Sprintf("  URL: %s\n", t.URL))
+		}
+		builder.WriteString(strings.Repeat("-", 60) + "\n")
+	}
+	return builder.String()
+}
+
+// formatDownloadStatus describes the state of a task, e.g. "running, 40%"
+func formatDownloadStatus(t cmsv.DownloadTask) string {
+	if t.Status == cmsv.DownloadRunning {
+		return fmt.Sprintf("%s, %d%%", t.Status, t.Progress)
+	}
+	return t.Status.String()
+}
+
+// fetchDownload saves the file of a finished task in download_dir and returns
+// its path. An interrupted download is resumed.
+func fetchDownload(ctx context.Context, client *cmsv.Client, task cmsv.DownloadTask, progress func(done, total int64)) (string, error) {
+	if !task.Finished() {
+		return "", fmt.Errorf("download task %s is %s, not finished", task.ID, task.Status)
+	}
+	if err := os.MkdirAll(config.DownloadDir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(config.DownloadDir, task.FileName())
+	if err := client.DownloadFile(ctx, task.URL, path, progress); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// recorderOptions returns the recording settings of the config
+func recorderOptions() recorder.Options {
+	return recorder.Options{
+		Dir:        config.RecordDir,
+		Format:     config.RecordFormat,
+		Segment:    time.Duration(config.RecordSegmentSeconds) * time.Second,
+		Schedule:   config.RecordSchedule,
+		Pre:        time.Duration(config.RecordPreSeconds) * time.Second,
+		Post:       time.Duration(config.RecordPostSeconds) * time.Second,
+		QuotaBytes: int64(config.RecordQuotaMB) << 20,
+	}
+}
+
+// liveRTSPURL returns a fresh RTSP link of a live stream for a connection
+// attempt, with a new login when the media server rejected the session of
+// the previous one
+func liveRTSPURL(ctx context.Context, session *cmsv.Session, host, devIDNO string, channel, stream int, failure error) (string, error) {
+	login := session.JSession
+	var se *rtsp.StatusError
+	if errors.As(failure, &se) && se.Code == 401 {
+		login = session.Login // The media server rejected the session
+	}
+	jsession, err := login(ctx)
+	if err != nil {
+		return "", fmt.Errorf("login failed: %v", err)
+	}
+	return streamLink(session.Client(), "rtsp", host, jsession, devIDNO, channel, stream)
+}
+
+// recordSource returns a recorder source for the live stream of a device
+// channel
+func recordSource(session *cmsv.Session, host, devIDNO string, channel, stream int) recorder.Source {
+	return recorder.Source{
+		Device:  devIDNO,
+		Channel: channel,
+		URL: func(ctx context.Context, failure error) (string, error) {
+			return liveRTSPURL(ctx, session, host, devIDNO, channel, stream, failure)
+		},
+	}
+}
+
+// newRelay returns a stream relay pulling live streams from the media server
+// of host
+func newRelay(session *cmsv.Session, host string, logger *log.Logger) (*relay.Relay, error) {
+	linger := time.Duration(config.RelayLingerSeconds) * time.Second
+	if linger == 0 {
+		linger = -1 // Close at once
+	}
+	return relay.New(relay.Options{
+		URL: func(ctx context.Context, key relay.Key, failure error) (string, error) {
+			return liveRTSPURL(ctx, session, host, key.Device, key.Channel, key.Stream, failure)
+		},
+		Linger:     linger,
+		HLSSegment: time.Duration(config.RelayHLSSegmentSeconds) * time.Second,
+		Logger:     logger,
+	})
+}
+
+// formatSegment describes a finished recording file
+func formatSegment(seg recorder.Segment) string {
+	return fmt.Sprintf("%s  %s CH%d  %s  %.1f MB  %s\n",
+		seg.Begin.Format(cmsv.TimeLayout), seg.Device, seg.Channel+1,
+		seg.Duration().Round(time.Second), float64(seg.Size)/(1<<20), seg.Path)
+}
+
+// hlsProxyBaseURL returns the public URL of the HLS proxy
+func hlsProxyBaseURL() string {
+	if config.HLSProxyURL != "" {
+		return config.HLSProxyURL
+	}
+	return "http://" + config.HLSProxyListen
+}
+
+// hlsProxySigner returns the signer of HLS proxy links
+func hlsProxySigner() (*hlsproxy.Signer, error) {
+	signer, err := hlsproxy.NewSigner(config.HLSProxySecret)
+	if err != nil {
+		return nil, fmt.Errorf("%v (set hls_proxy_secret in the config)", err)
+	}
+	return signer, nil
+}
+
+// hlsShareLink issues an HLS proxy link to the live stream of a device
+// channel, valid for ttl
+func hlsShareLink(devIDNO string, channel, stream int, ttl time.Duration) (hlsproxy.Token, string, error) {
+	signer, err := hlsProxySigner()
+	if err != nil {
+		return hlsproxy.Token{}, "", err
+	}
+	token, raw := signer.Issue(devIDNO, channel, stream, ttl)
+	return token, hlsproxy.Link(hlsProxyBaseURL(), raw), nil
+}
+
+// parseShareToken returns the revocation of a proxy link, token or token ID
+func parseShareToken(signer *hlsproxy.Signer, s string) (hlsproxy.Revocation, error) {
+	if i := strings.Index(s, "/hls/"); i >= 0 {
+		s = strings.TrimSuffix(s[i+len("/hls/"):], ".m3u8")
+	}
+	if !strings.Contains(s, ".") {
+		if _, err := hex.DecodeString(s); err != nil || s == "" {
+			return hlsproxy.Revocation{}, fmt.Errorf("invalid token or token ID %q", s)
+		}
+		return hlsproxy.Revocation{ID: s}, nil
+	}
+	token, err := signer.Parse(s)
+	if err != nil {
+		return hlsproxy.Revocation{}, fmt.Errorf("%q: %v", s, err)
+	}
+	return hlsproxy.Revocation{ID: token.ID, Expires: &token.Expires}, nil
+}
+
+// formatRevocations lists revoked HLS proxy links
+func formatRevocations(list []hlsproxy.Revocation) string {
+	if len(list) == 0 {
+		return "No revoked links\n"
+	}
+	var b strings.Builder
+	for _, r := range list {
+		expires := "unknown expiry"
+		if r.Expires != nil {
+			expires = "expires " + r.Expires.Format(cmsv.TimeLayout)
+		}
+		fmt.Fprintf(&b, "%s  revoked %s, %s", r.ID, r.Revoked.Format(cmsv.TimeLayout), expires)
+		if r.Note != "" {
+			fmt.Fprintf(&b, "  (%s)", r.Note)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// linkCheck is the probe of a link, with the device channel it was
+// generated for
+type linkCheck struct {
+	Device  string `json:"device,omitempty"`
+	Channel *int   `json:"channel,omitempty"`
+	Stream  string `json:"stream,omitempty"`
+	URL     string `json:"url,omitempty"` // Links given to probe; generated ones carry the session
+	probe.Result
+}
+
+// probeOptions returns the probe settings, fetching HLS through client for
+// its handling of self-signed certificates
+func probeOptions(client *cmsv.Client, timeout time.Duration) probe.Options {
+	return probe.Options{Timeout: timeout, Get: client.Get}
+}
+
+// probeDeviceLink probes the live link of a device channel, with a new
+// login when the server rejected the session
+func probeDeviceLink(ctx context.Context, session *cmsv.Session, protocol, host, devIDNO string, channel, stream int, timeout time.Duration) linkCheck {
+	check := linkCheck{Device: devIDNO, Channel: &channel, Stream: []string{"main", "sub"}[stream]}
+	check.Protocol = strings.ToLower(protocol)
+	login := session.JSession
+	for attempt := 1; ; attempt++ {
+		jsession, err := login(ctx)
+		if err != nil {
+			check.Reason = fmt.Sprintf("login failed: %v", err)
+			return check
+		}
+		link, err := streamLink(session.Client(), protocol, host, jsession, devIDNO, channel, stream)
+		if err != nil {
+			check.Reason = err.Error()
+			return check
+		}
+		check.Result = probe.Probe(ctx, link, probeOptions(session.Client(), timeout))
+		if attempt == 1 && (check.Status == 401 || check.Status == 403) {
+			login = session.Login
+			continue
+		}
+		return check
+	}
+}
+
+// formatProbeResult describes a probe in one line
+func formatProbeResult(r probe.Result) string {
+	if !r.OK {
+		return "FAIL  " + r.Reason
+	}
+	return "OK    " + describeProbe(r)
+}
+
+// describeProbe returns the codec, picture size and latency of a successful
+// probe, or the reason of a failure
+func describeProbe(r probe.Result) string {
+	if !r.OK {
+		return r.Reason
+	}
+	var parts []string
+	if r.Codec != "" {
+		parts = append(parts, strings.TrimSpace(r.Codec+" "+r.Resolution()))
+	}
+	parts = append(parts, fmt.Sprintf("connect %dms", r.ConnectMs))
+	if r.Protocol == "hls" {
+		parts = append(parts, fmt.Sprintf("segment %dms", r.FirstFrameMs))
+		if r.SegmentAgeMs > 0 {
+			parts = append(parts, fmt.Sprintf("segment age %.1fs", float64(r.SegmentAgeMs)/1000))
+		}
+	} else {
+		parts = append(parts, fmt.Sprintf("first frame %dms", r.FirstFrameMs))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatLinkCheck describes a link check in one line
+func formatLinkCheck(c linkCheck) string {
+	target := c.URL
+	if c.Device != "" {
+		target = fmt.Sprintf("%s CH%d %s", c.Device, *c.Channel+1, c.Stream)
+	}
+	return fmt.Sprintf("%-5s %s  %s\n", c.Protocol, target, formatProbeResult(c.Result))
+}
+
+// hlsPlayerHTML returns an HTML video element that plays an HLS link
+func hlsPlayerHTML(hlsLink string) string {
+	return fmt.Sprintf(`<video controls preload="none" width="352" height="288" data-setup="{}">
+    <source src="%s" type="application/x-mpegURL">
+</video>`, hlsLink)
+}
+
+func saveToFile(account string, allLinks map[string]map[string]string) error {
+	filename := fmt.Sprintf("%s-%ddev-%s.txt", account, len(allLinks), time.Now().Format("2006-01-02"))
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for name, links := range allLinks {
+		fmt.Fprintf(f, "Device: %s\n", name)
+		for k, v := range links {
+			fmt.Fprintf(f, "  %s: %s\n", k, v)
+		}
+		fmt.Fprintln(f, strings.Repeat("-", 60))
+	}
+	return nil
+}
+
+// exportFileName suggests a file name for an export, e.g.
+// "alarm-history-2024-12-07.kml"
+func exportFileName(name string, format export.Format) string {
+	slug := strings.ToLower(strings.Join(strings.Fields(name), "-"))
+	return fmt.Sprintf("%s-%s%s", slug, time.Now().Format("2006-01-02"), format.Ext())
+}
+
+func buildCompanyHierarchy(companies []cmsv.Company) map[int][]cmsv.Company {
+	hierarchy := make(map[int][]cmsv.Company)
+
+	for _, company := range companies {
+		hierarchy[company.PID] = append(hierarchy[company.PID], company)
+	}
+
+	return hierarchy
+}
+
+func printCompanyTree(builder *strings.Builder, hierarchy map[int][]cmsv.Company, parentID int, prefix string) {
+	children, exists := hierarchy[parentID]
+	if !exists {
+		return
+	}
+
+	for i, company := range children {
+		isLast := i == len(children)-1
+
+		if isLast {
+			builder.WriteString(fmt.Sprintf("%s└── %s\n", prefix, company.Name))
+			printCompanyTree(builder, hierarchy, company.ID, prefix+"    ")
+		} else {
+			builder.WriteString(fmt.Sprintf("%s├── %s\n", prefix, company.Name))
+			printCompanyTree(builder, hierarchy, company.ID, prefix+"│   ")
+		}
+	}
+}
+
+// loggedAlarms remembers the alarms already written to the alarm journal,
+// queuedAlarms those queued for each webhook sink, by sink name. They are
+// kept apart so that a failing journal or sink is retried without repeating
+// the others.
+var (
+	loggedAlarms    = cmsv.NewAlarmDeduper(0)
+	queuedAlarms    = map[string]*cmsv.AlarmDeduper{}
+	queuedAlarmsMu  sync.Mutex
+	journaledAlarms []cmsv.Alarm // The last alarms of the journal file when it was opened
+)
+
+// sinkDeduper returns the deduper of a webhook sink. A new one starts with
+// the alarms already in the journal, so they are not delivered twice.
+func sinkDeduper(name string) *cmsv.AlarmDeduper {
+	queuedAlarmsMu.Lock()
+	defer queuedAlarmsMu.Unlock()
+	d, ok := queuedAlarms[name]
+	if !ok {
+		d = cmsv.NewAlarmDeduper(0)
+		d.Filter(journaledAlarms)
+		queuedAlarms[name] = d
+	}
+	return d
+}
+
+var (
+	alarmJournal     *journal.Journal
+	alarmJournalErr  error
+	alarmJournalOnce sync.Once
+)
+
+// journalOptions returns the journal settings from the configuration
+func journalOptions() journal.Options {
+	return journal.Options{
+		Path:         config.JournalFile,
+		MaxSize:      int64(config.JournalMaxSizeMB) * 1024 * 1024,
+		MaxAge:       time.Duration(config.JournalMaxAgeHours) * time.Hour,
+		MaxBackups:   config.JournalMaxBackups,
+		MaxBackupAge: time.Duration(config.JournalRetentionDays) * 24 * time.Hour,
+	}
+}
+
+// openAlarmJournal opens the alarm journal on first use. Alarms already in
+// the current journal file are marked as logged and queued so they are not
+// written or delivered twice.
+func openAlarmJournal() (*journal.Journal, error) {
+	alarmJournalOnce.Do(func() {
+		alarmJournal, alarmJournalErr = journal.Open(journalOptions())
+		if alarmJournalErr != nil {
+			return
+		}
+		var existing []cmsv.Alarm
+		for entry, err := range journal.ReadFile(alarmJournal.Path()) {
+			if err != nil {
+				break
+			}
+			existing = append(existing, entry.Alarm)
+		}
+		loggedAlarms.Filter(existing)
+		journaledAlarms = existing[max(0, len(existing)-cmsv.DefaultDedupCapacity):]
+	})
+	return alarmJournal, alarmJournalErr
+}
+
+var (
+	alarmSinks     []*webhook.Sink
+	alarmSinksErr  error
+	alarmSinksOnce sync.Once
+)
+
+// webhookSinks creates the webhook sinks of the configuration on first use,
+// ordered by their number
+func webhookSinks(logger *log.Logger) ([]*webhook.Sink, error) {
+	alarmSinksOnce.Do(func() {
+		numbers := slices.Sorted(maps.Keys(config.Webhooks))
+		for _, n := range numbers {
+			hook := config.Webhooks[n]
+			sink, err := webhook.NewSink(webhook.Options{
+				Name:       hook.Name,
+				URL:        hook.URL,
+				Secret:     hook.Secret,
+				Filter:     webhook.Filter{Devices: hook.Devices, Types: hook.Types},
+				QueueDir:   config.WebhookQueueDir,
+				Catalog:    config.AlarmTypes,
+				MaxBackoff: time.Duration(config.WebhookMaxBackoffSeconds) * time.Second,
+				Logger:     logger,
+			})
+			if err != nil {
+				alarmSinksErr = err
+				return
+			}
+			alarmSinks = append(alarmSinks, sink)
+		}
+	})
+	return alarmSinks, alarmSinksErr
+}
+
+// startWebhooks delivers the queued alarms of every webhook sink in the
+// background until ctx is cancelled
+func startWebhooks(ctx context.Context, logger *log.Logger) error {
+	sinks, err := webhookSinks(logger)
+	if err != nil {
+		return err
+	}
+	for _, sink := range sinks {
+		go sink.Run(ctx)
+	}
+	return nil
+}
+
+// recordAlarms writes the alarms not recorded before to the alarm journal
+// and queues them for the webhook sinks
+func recordAlarms(alarms []cmsv.Alarm) {
+	// A failure of one does not stop the other; alarms that could not be
+	// stored are forgotten so that the next poll tries again
+	if j, err := openAlarmJournal(); err != nil {
+		fmt.Printf("Failed to write log: %v\n", err)
+	} else if fresh := loggedAlarms.Filter(alarms); len(fresh) > 0 {
+		if n, err := j.WriteAlarms("alarms", fresh); err != nil {
+			loggedAlarms.Forget(fresh[n:]) // The written ones stay logged
+			fmt.Printf("Failed to write log: %v\n", err)
+		}
+	}
+
+	// Sinks not created yet (e.g. a one-shot command) log nowhere
+	sinks, err := webhookSinks(nil)
+	if err != nil {
+		fmt.Printf("Failed to queue webhooks: %v\n", err)
+		return
+	}
+	for _, sink := range sinks {
+		queued := sinkDeduper(sink.Name())
+		fresh := queued.Filter(alarms)
+		if len(fresh) == 0 {
+			continue
+		}
+		if _, err := sink.Enqueue(fresh); err != nil {
+			queued.Forget(fresh)
+			fmt.Printf("Failed to queue webhook: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,2154 @@
+package main
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/export"
+	"cmsv_api/gateway"
+	"cmsv_api/geo"
+	"cmsv_api/geofence"
+	"cmsv_api/hlsproxy"
+	"cmsv_api/journal"
+	"cmsv_api/playlist"
+	"cmsv_api/probe"
+	"cmsv_api/recorder"
+	"cmsv_api/relay"
+	"cmsv_api/rtmp"
+	"cmsv_api/rtsp"
+	"cmsv_api/simulator"
+	"cmsv_api/webhook"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cliCommand is a headless subcommand of the cmsv_api binary
+type cliCommand struct {
+	name    string
+	args    string
+	summary string
+	run     func(env *cliEnv, fs *flag.FlagSet, args []string) error
+}
+
+// cliEnv holds the flags shared by all subcommands and the state derived from them
+type cliEnv struct {
+	configPath string
+	account    string
+	password   string
+	jsession   string
+	jsonOutput bool
+	verbose    bool
+
+	ctx    context.Context
+	client *cmsv.Client
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// errUsage signals that the command line was invalid and usage has been printed
+var errUsage = errors.New("usage error")
+
+func cliCommands() []cliCommand {
+	return []cliCommand{
+		{name: "login", summary: "Log in and print the jsession", run: cmdLogin},
+		{name: "devices", summary: "List devices with their player links", run: cmdDevices},
+		{name: "vehicles", summary: "Show vehicle and company information", run: cmdVehicles},
+		{name: "alarms", args: "[--device ID] [--to-map N] [--page N] [--page-size N] [--all] [--watch 5s] [--export FILE]", summary: "Show current device alarms, or watch for new ones", run: cmdAlarms},
+		{name: "history", args: "--device ID,... [--begin TIME] [--end TIME] [--type N,...] [--handled all|processed|unprocessed] [--all] [--export FILE]", summary: "Search historical alarms", run: cmdHistory},
+		{name: "track", args: "--device ID [--begin TIME] [--end TIME] [--distance KM] [--all] [--export FILE]", summary: "Show the recorded GPS track of a device", run: cmdTrack},
+		{name: "videos", args: "--device ID [--channel N] [--begin TIME] [--end TIME] [--around TIME] [--location device|server|download] | --alarm GUID", summary: "Search recorded video and print playback links", run: cmdVideos},
+		{name: "downloads", args: "list|create|cancel|fetch [--device ID] [--channel N] [--begin TIME] [--end TIME] [--around TIME] [--id ID,...] [--wait]", summary: "Manage server-side video download tasks and fetch finished files", run: cmdDownloads},
+		{name: "record", args: "--device ID,... [--channel N,...|all] [--stream main|sub] [--format ts|mp4] [--segment 5m] [--schedule HH:MM-HH:MM,...] [--alarms] [--pre 10s] [--post 30s] [--quota-mb N] [--duration D]", summary: "Record live streams to segmented files", run: cmdRecord},
+		{name: "relay", args: "[--listen ADDR] [--hls-listen ADDR] [--host HOST] [--linger 5s] [--hls-segment 2s]", summary: "Share live streams with local viewers over one upstream connection per channel", run: cmdRelay},
+		{name: "hls-proxy", args: "serve [--listen ADDR] [--host HOST] | token --device ID [--channel N] [--stream main|sub] [--ttl 1h] | revoke LINK|TOKEN|ID... [--note TEXT] | revoked", summary: "Share HLS streams through signed, expiring links that hide the session", run: cmdHLSProxy},
+		{name: "journal", args: "import [--from alarms.log]", summary: "Import the legacy alarms.log into the alarm journal", run: cmdJournal},
+		{name: "webhooks", args: "status|flush", summary: "Show or deliver the queued webhook payloads", run: cmdWebhooks},
+		{name: "alarm-types", args: "[--category NAME]", summary: "List the alarm type catalog", run: cmdAlarmTypes},
+		{name: "status", args: "[--device ID,...] [--vehicle PLATE,...] [--geo] [--driver] [--export FILE]", summary: "Show real-time device status", run: cmdStatus},
+		{name: "geofence", args: "[--zones FILE,...] [--device ID,...] [--interval 30s] [--log] [--check]", summary: "Watch device positions for zone enter, exit and dwell events", run: cmdGeofence},
+		{name: "serve", args: "[--listen ADDR] [--api-key KEY,...] [--host HOST]", summary: "Serve the fleet as a JSON REST API", run: cmdServe},
+		{name: "simulate", args: "[--listen ADDR] [--rtsp-listen ADDR] [--rtmp-listen ADDR] [--hls-listen ADDR] [--fleet FILE] [--tick 1s] [--speed N] [--fault ACTION=CODE[:COUNT],...]", summary: "Run a fake CMSV server for offline development", run: cmdSimulate},
+		{name: "links", args: "rtsp|rtmp|hls --device ID [--channel N,...|all] [--stream main|sub]", summary: "Generate a live stream link", run: cmdLinks},
+		{name: "export-links", args: "[--output FILE] [--format m3u|xspf|csv|json] [--company NAME,...] [--device ID,...] [--channel N,...|all] [--stream main,sub] [--protocol rtsp,rtmp,hls] [--online]", summary: "Export the stream links of the fleet as playlists or a CSV/JSON table", run: cmdExportLinks},
+		{name: "probe", args: "URL... | --device ID,... | --all [--channel N,...|all] [--stream main|sub] [--protocol rtsp,rtmp,hls] [--timeout 20s] [--parallel 4]", summary: "Check that stream links play, with codec, resolution and latency", run: cmdProbe},
+	}
+}
+
+// runCLI runs a subcommand and returns the process exit code
+func runCLI(args []string) int {
+	env := &cliEnv{ctx: context.Background(), stdout: os.Stdout, stderr: os.Stderr}
+	commands := cliCommands()
+
+	name := args[0]
+	if name == "help" || name == "-h" || name == "--help" {
+		printCLIUsage(env.stdout, commands)
+		return 0
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		fs := env.flagSet(cmd)
+		err := cmd.run(env, fs, args[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		if errors.Is(err, errUsage) {
+			return 2
+		}
+		if err != nil {
+			fmt.Fprintf(env.stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(env.stderr, "Unknown command %q\n\n", name)
+	printCLIUsage(env.stderr, commands)
+	return 2
+}
+
+func printCLIUsage(w io.Writer, commands []cliCommand) {
+	fmt.Fprintln(w, "Usage: cmsv_api [command] [flags]")
+	fmt.Fprintln(w, "\nWithout a command the graphical interface is started.")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w, "\nRun 'cmsv_api <command> -h' for the flags of a command.")
+	fmt.Fprintln(w, "Credentials can also be given with the CMSV_ACCOUNT, CMSV_PASSWORD and CMSV_JSESSION environment variables.")
+}
+
+// flagSet creates the flag set of a command with the shared flags registered
+func (env *cliEnv) flagSet(cmd cliCommand) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(env.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(env.stderr, "Usage: cmsv_api %s %s\n\n%s\n\nFlags:\n", cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&env.configPath, "config", defaultConfigPath, "path of the configuration file")
+	fs.StringVar(&env.account, "account", os.Getenv("CMSV_ACCOUNT"), "CMSV account")
+	fs.StringVar(&env.password, "password", os.Getenv("CMSV_PASSWORD"), "CMSV password")
+	fs.StringVar(&env.jsession, "jsession", os.Getenv("CMSV_JSESSION"), "reuse an existing jsession instead of logging in")
+	fs.BoolVar(&env.jsonOutput, "json", false, "print JSON instead of human-readable text")
+	fs.BoolVar(&env.verbose, "verbose", false, "trace API requests and responses to stderr")
+	return fs
+}
+
+// parse parses the command flags, loads the configuration and creates the client
+func (env *cliEnv) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+
+	if err := loadConfig(env.configPath); err != nil {
+		return fmt.Errorf("loading config: %v", err)
+	}
+
+	var logger *log.Logger
+	if env.verbose {
+		logger = log.New(env.stderr, "", log.LstdFlags)
+	}
+	client, err := newClient(logger)
+	if err != nil {
+		return err
+	}
+	env.client = client
+	return nil
+}
+
+// session returns a session manager for the given credentials, seeded with
+// the jsession from the command line when there is one
+func (env *cliEnv) session() (*cmsv.Session, error) {
+	if env.jsession == "" && (env.account == "" || env.password == "") {
+		return nil, fmt.Errorf("please provide --account and --password (or --jsession)")
+	}
+	session := env.client.NewSession(env.account, env.password)
+	if env.jsession != "" {
+		session.SetJSession(env.jsession)
+	}
+	return session, nil
+}
+
+// print writes v as indented JSON when --json is set and text otherwise
+func (env *cliEnv) print(v any, text string) error {
+	if env.jsonOutput {
+		enc := json.NewEncoder(env.stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(v)
+	}
+	_, err := io.WriteString(env.stdout, text)
+	return err
+}
+
+func cmdLogin(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	env.jsession = "" // always perform a fresh login
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+	jsession, err := session.Login(env.ctx)
+	if err != nil {
+		return fmt.Errorf("login failed: %v", err)
+	}
+	return env.print(map[string]string{"jsession": jsession}, jsession+"\n")
+}
+
+func cmdDevices(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+
+	devices, err := session.Devices(env.ctx)
+	if err != nil {
+		return fmt.Errorf("device fetch failed: %v", err)
+	}
+	jsession, err := session.JSession(env.ctx)
+	if err != nil {
+		return err
+	}
+	allLinks := deviceLinks(env.client, jsession, devices, env.account, env.password)
+
+	type deviceWithLinks struct {
+		cmsv.Device
+		Links map[string]string `json:"links"`
+	}
+	result := make([]deviceWithLinks, 0, len(devices))
+	for _, d := range devices {
+		result = append(result, deviceWithLinks{Device: d, Links: allLinks[deviceKey(d)]})
+	}
+	return env.print(result, formatDeviceLinks(devices, allLinks))
+}
+
+func cmdVehicles(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	hierarchy := fs.Bool("hierarchy", false, "include the company hierarchy (default from show_company_hierarchy)")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+
+	vehicleInfo, err := session.VehicleInfo(env.ctx)
+	if err != nil {
+		return fmt.Errorf("vehicle info fetch failed: %v", err)
+	}
+
+	showHierarchy := config.ShowCompanyHierarchy
+	if flagWasSet(fs, "hierarchy") {
+		showHierarchy = *hierarchy
+	}
+	return env.print(vehicleInfo, formatVehicleInfo(vehicleInfo, showHierarchy))
+}
+
+func cmdAlarms(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	device := fs.String("device", "", "device ID (empty for all devices)")
+	toMap := fs.Int("to-map", 0, "coordinate system: 0=WGS84, 1=Google (GCJ-02), 2=Baidu (BD-09)")
+	page := fs.Int("page", 0, "page to fetch (default: whatever the server returns first)")
+	pageSize := fs.Int("page-size", 0, "alarms per page (default alarm_page_size from the config)")
+	all := fs.Bool("all", false, "walk every page and print all alarms (JSON output is a plain array)")
+	logFile := fs.Bool("log", false, "record new alarms in the alarm journal and send them to the configured webhooks")
+	watch := fs.Duration("watch", 0, "poll at this interval and print only new alarms until interrupted (e.g. 5s)")
+	exp := addExportFlags(fs)
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if err := exp.validate(); err != nil {
+		return err
+	}
+	if exp.file != "" && *watch > 0 {
+		return fmt.Errorf("--export cannot be combined with --watch")
+	}
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+
+	query := cmsv.AlarmQuery{DevIDNO: *device, ToMap: *toMap, Page: *page, PageSize: *pageSize}
+	if query.PageSize == 0 {
+		query.PageSize = config.AlarmPageSize
+	}
+
+	if *watch > 0 {
+		return watchAlarms(env, session.NewAlarmPoller(query), *watch, *logFile)
+	}
+
+	if *all {
+		var alarms []cmsv.Alarm
+		for alarm, err := range session.Alarms(env.ctx, query) {
+			if err != nil {
+				return fmt.Errorf("alarm fetch failed: %v", err)
+			}
+			alarms = append(alarms, alarm)
+		}
+		if *logFile {
+			recordAlarms(alarms)
+			env.flushWebhooks()
+		}
+		if exp.file != "" {
+			return exp.write(env, export.FromAlarms(alarms, config.AlarmTypes), "Alarms")
+		}
+		return env.print(alarms, formatAlarms(alarms))
+	}
+
+	alarmData, err := session.AlarmPage(env.ctx, query)
+	if err != nil {
+		return fmt.Errorf("alarm fetch failed: %v", err)
+	}
+	if *logFile {
+		recordAlarms(alarmData.AlarmList)
+		env.flushWebhooks()
+	}
+	if exp.file != "" {
+		return exp.write(env, export.FromAlarms(alarmData.AlarmList, config.AlarmTypes), "Alarms")
+	}
+
+	text := formatAlarms(alarmData.AlarmList)
+	if p := alarmData.Pagination; p.TotalPages > 0 {
+		text += fmt.Sprintf("Page %d of %d (%d alarms)\n", p.CurrentPage, p.TotalPages, p.TotalRecords)
+	}
+	return env.print(alarmData, text)
+}
+
+// watchAlarms prints the new alarms of every poll until interrupted. JSON
+// output is one alarm object per line.
+func watchAlarms(env *cliEnv, poller *cmsv.AlarmPoller, interval time.Duration, logFile bool) error {
+	ctx, stop := signal.NotifyContext(env.ctx, os.Interrupt)
+	defer stop()
+
+	if logFile {
+		if err := startWebhooks(ctx, log.New(env.stderr, "", log.LstdFlags)); err != nil {
+			return err
+		}
+	}
+
+	events, unsubscribe := poller.Subscribe(1)
+	defer unsubscribe()
+	go poller.Run(ctx, interval)
+
+	enc := json.NewEncoder(env.stdout)
+	enc.SetEscapeHTML(false)
+	for {
+		var event cmsv.NewAlarms
+		select {
+		case <-ctx.Done():
+			return nil
+		case event = <-events:
+		}
+
+		if event.Err != nil {
+			fmt.Fprintf(env.stderr, "Alarm poll failed: %v\n", event.Err)
+			continue
+		}
+		if logFile {
+			recordAlarms(event.Alarms)
+		}
+		for _, alarm := range event.Alarms {
+			if env.jsonOutput {
+				if err := enc.Encode(alarm); err != nil {
+					return err
+				}
+				continue
+			}
+			writeAlarm(env.stdout, alarm)
+		}
+	}
+}
+
+// flushWebhooks tries once to deliver the queued webhook payloads. Payloads
+// that cannot be delivered stay queued for the next run.
+func (env *cliEnv) flushWebhooks() {
+	sinks, err := webhookSinks(nil)
+	if err != nil {
+		fmt.Fprintf(env.stderr, "Webhooks: %v\n", err)
+		return
+	}
+	for _, sink := range sinks {
+		ctx, cancel := context.WithTimeout(env.ctx, webhook.DefaultTimeout)
+		if err := sink.Flush(ctx); err != nil {
+			fmt.Fprintf(env.stderr, "Webhook %s: delivery failed, alarms stay queued: %v\n", sink.Name(), err)
+		}
+		cancel()
+	}
+}
+
+func cmdWebhooks(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	// Accept the action before or after the flags
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if action == "" && fs.NArg() > 0 {
+		action = fs.Arg(0)
+	}
+	if action != "status" && action != "flush" {
+		fs.Usage()
+		return errUsage
+	}
+
+	sinks, err := webhookSinks(nil)
+	if err != nil {
+		return err
+	}
+	if action == "flush" {
+		env.flushWebhooks()
+	}
+
+	type sinkStatus struct {
+		Name    string `json:"name"`
+		Pending int    `json:"pending"`
+	}
+	var statuses []sinkStatus
+	builder := strings.Builder{}
+	if len(sinks) == 0 {
+		builder.WriteString("No webhooks configured\n")
+	}
+	for _, sink := range sinks {
+		pending, err := sink.Pending()
+		if err != nil {
+			return err
+		}
+		statuses = append(statuses, sinkStatus{Name: sink.Name(), Pending: len(pending)})
+		builder.WriteString(fmt.Sprintf("%s: %d payloads queued\n", sink.Name(), len(pending)))
+	}
+	return env.print(statuses, builder.String())
+}
+
+func cmdHistory(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	devices := fs.String("device", "", "comma-separated device IDs (required)")
+	begin := fs.String("begin", "", "start of the time range, YYYY-MM-DD [HH:MM[:SS]] (default today 00:00)")
+	end := fs.String("end", "", "end of the time range, YYYY-MM-DD [HH:MM[:SS]] (default now)")
+	types := fs.String("type", "", "comma-separated alarm type codes (empty for all types)")
+	handled := fs.String("handled", "all", "handled filter: all, processed or unprocessed")
+	toMap := fs.Int("to-map", 0, "coordinate system: 0=WGS84, 1=Google (GCJ-02), 2=Baidu (BD-09)")
+	page := fs.Int("page", 1, "page to fetch")
+	pageSize := fs.Int("page-size", 0, "alarms per page (default alarm_page_size from the config)")
+	all := fs.Bool("all", false, "walk every page and print all alarms (JSON output is a plain array)")
+	exp := addExportFlags(fs)
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if *devices == "" {
+		fs.Usage()
+		return errUsage
+	}
+	if err := exp.validate(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	query := cmsv.AlarmHistoryQuery{
+		DevIDNO:  splitList(*devices),
+		Begin:    time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local),
+		End:      now,
+		ToMap:    *toMap,
+		Page:     *page,
+		PageSize: *pageSize,
+	}
+	if query.PageSize == 0 {
+		query.PageSize = config.AlarmPageSize
+	}
+
+	var err error
+	if *begin != "" {
+		if query.Begin, err = parseHistoryTime(*begin, false); err != nil {
+			return err
+		}
+	}
+	if *end != "" {
+		if query.End, err = parseHistoryTime(*end, true); err != nil {
+			return err
+		}
+	}
+	if query.Types, err = parseAlarmTypes(*types); err != nil {
+		return err
+	}
+	if query.Handled, err = parseHandleStatus(*handled); err != nil {
+		return err
+	}
+	// Report range problems before logging in
+	if err := query.Validate(); err != nil {
+		return err
+	}
+
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+
+	if *all {
+		var alarms []cmsv.AlarmDetail
+		for alarm, err := range session.AlarmHistory(env.ctx, query) {
+			if err != nil {
+				return fmt.Errorf("alarm history search failed: %v", err)
+			}
+			alarms = append(alarms, alarm)
+		}
+		if exp.file != "" {
+			return exp.write(env, export.FromAlarmDetails(alarms, config.AlarmTypes), "Alarm history")
+		}
+		return env.print(alarms, formatAlarmHistory(alarms))
+	}
+
+	history, err := session.AlarmHistoryPage(env.ctx, query)
+	if err != nil {
+		return fmt.Errorf("alarm history search failed: %v", err)
+	}
+	if exp.file != "" {
+		return exp.write(env, export.FromAlarmDetails(history.Alarms, config.AlarmTypes), "Alarm history")
+	}
+
+	text := formatAlarmHistory(history.Alarms)
+	if p := history.Pagination; p.TotalPages > 0 {
+		text += fmt.Sprintf("Page %d of %d (%d alarms)\n", p.CurrentPage, p.TotalPages, p.TotalRecords)
+	}
+	return env.print(history, text)
+}
+
+func cmdTrack(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	device := fs.String("device", "", "device ID (required)")
+	begin := fs.String("begin", "", "start of the time range, YYYY-MM-DD [HH:MM[:SS]] (default today 00:00)")
+	end := fs.String("end", "", "end of the time range, YYYY-MM-DD [HH:MM[:SS]] (default now)")
+	distance := fs.Float64("distance", 0, "skip points closer than this many km to the previous one")
+	parkTime := fs.Duration("park-time", 0, "only report stops of at least this long (e.g. 5m)")
+	geoAddress := fs.Bool("geo", false, "resolve the address of every point (slow)")
+	toMap := fs.Int("to-map", 0, "coordinate system: 0=WGS84, 1=Google (GCJ-02), 2=Baidu (BD-09)")
+	page := fs.Int("page", 1, "page to fetch")
+	pageSize := fs.Int("page-size", 0, "points per page (default alarm_page_size from the config)")
+	all := fs.Bool("all", false, "walk every page and print the whole track (JSON output is a plain array)")
+	exp := addExportFlags(fs)
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if *device == "" {
+		fs.Usage()
+		return errUsage
+	}
+	if err := exp.validate(); err != nil {
+		return err
+	}
+	exp.tracks = true // A track export is a line, not just waypoints
+
+	now := time.Now()
+	query := cmsv.TrackQuery{
+		DevIDNO:    *device,
+		Begin:      time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local),
+		End:        now,
+		DistanceKm: *distance,
+		ParkTime:   *parkTime,
+		GeoAddress: *geoAddress,
+		ToMap:      *toMap,
+		Page:       *page,
+		PageSize:   *pageSize,
+	}
+	if query.PageSize == 0 {
+		query.PageSize = cmsv.DefaultPageSize
+	}
+	var err error
+	if *begin != "" {
+		if query.Begin, err = parseHistoryTime(*begin, false); err != nil {
+			return err
+		}
+	}
+	if *end != "" {
+		if query.End, err = parseHistoryTime(*end, true); err != nil {
+			return err
+		}
+	}
+	// Report range problems before logging in
+	if err := query.Validate(); err != nil {
+		return err
+	}
+
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+
+	if *all {
+		track, err := session.Track(env.ctx, query)
+		if err != nil {
+			return fmt.Errorf("track fetch failed: %v", err)
+		}
+		if exp.file != "" {
+			return exp.write(env, export.FromTrack(track), "Track "+trackTitle(track))
+		}
+		return env.print(track.Points, formatTrack(track))
+	}
+
+	res, err := session.TrackPage(env.ctx, query)
+	if err != nil {
+		return fmt.Errorf("track fetch failed: %v", err)
+	}
+	track := cmsv.NewTrack(query.DevIDNO, query.Begin, query.End, query.ToMap, res.Tracks)
+	if exp.file != "" {
+		return exp.write(env, export.FromTrack(track), "Track "+trackTitle(track))
+	}
+
+	text := formatTrack(track)
+	if p := res.Pagination; p.TotalPages > 0 {
+		text += fmt.Sprintf("Page %d of %d (%d points)\n", p.CurrentPage, p.TotalPages, p.TotalRecords)
+	}
+	return env.print(res, text)
+}
+
+func cmdVideos(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	device := fs.String("device", "", "device ID (required unless --alarm is given)")
+	channel := fs.Int("channel", cmsv.AllChannels, "channel number (starts from 0; default all channels)")
+	begin := fs.String("begin", "", "start of the time range, YYYY-MM-DD [HH:MM[:SS]] (default today 00:00)")
+	end := fs.String("end", "", "end of the time range, YYYY-MM-DD [HH:MM[:SS]] (default now)")
+	around := fs.String("around", "", "search around this time instead of --begin/--end")
+	before := fs.Duration("before", 0, "video before --around or the alarm (default alarm_video_before_seconds from the config)")
+	after := fs.Duration("after", 0, "video after --around or the alarm (default alarm_video_after_seconds from the config)")
+	alarmGUID := fs.String("alarm", "", "GUID of a current alarm to show the video of")
+	location := fs.String("location", "", "where to search: device, server or download (default video_location from the config)")
+	recType := fs.String("type", "all", "recording type: all, normal or alarm")
+	stream := fs.String("stream", "all", "stream type: all, main or sub")
+	host := fs.String("host", "", "media server host used in playback links (default from server_url)")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if *device == "" && *alarmGUID == "" {
+		fs.Usage()
+		return errUsage
+	}
+	if *before > 0 {
+		config.AlarmVideoBeforeSeconds = int(before.Seconds())
+	}
+	if *after > 0 {
+		config.AlarmVideoAfterSeconds = int(after.Seconds())
+	}
+	if *location != "" {
+		loc, err := cmsv.ParseVideoLocation(*location)
+		if err != nil {
+			return err
+		}
+		config.VideoLocation = loc
+	}
+
+	query := cmsv.VideoQuery{
+		DevIDNO:  *device,
+		Channel:  *channel,
+		Location: config.VideoLocation,
+	}
+	switch strings.ToLower(*recType) {
+	case "all":
+		query.RecordType = cmsv.RecordAll
+	case "normal":
+		query.RecordType = cmsv.RecordNormal
+	case "alarm":
+		query.RecordType = cmsv.RecordAlarm
+	default:
+		return fmt.Errorf("invalid recording type %q (use all, normal or alarm)", *recType)
+	}
+	query.Stream = -1
+	if strings.ToLower(*stream) != "all" {
+		streamType, err := parseStreamType(*stream)
+		if err != nil {
+			return err
+		}
+		query.Stream = streamType
+	}
+
+	var err error
+	if *alarmGUID == "" {
+		if query.Begin, query.End, err = videoRange(*begin, *end, *around); err != nil {
+			return err
+		}
+		// Report range problems before logging in
+		if err := query.Validate(); err != nil {
+			return err
+		}
+	}
+
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+
+	title := *device
+	if *alarmGUID != "" {
+		alarm, err := findAlarm(env.ctx, session, *device, *alarmGUID)
+		if err != nil {
+			return err
+		}
+		aq, err := alarmVideoQuery(alarm)
+		if err != nil {
+			return err
+		}
+		aq.Channel, aq.RecordType, aq.Stream = query.Channel, query.RecordType, query.Stream
+		query = aq
+		title = fmt.Sprintf("%s: %s at %s", alarm.DevIDNO, formatAlarmType(alarm.Type), alarm.Time)
+	}
+
+	clips, err := searchVideo(env.ctx, session, *host, query)
+	if err != nil {
+		return err
+	}
+	if clips == nil {
+		clips = []videoClip{}
+	}
+	return env.print(clips, formatVideoClips(title, clips))
+}
+
+func cmdDownloads(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	device := fs.String("device", "", "device ID (required for create)")
+	channel := fs.Int("channel", cmsv.AllChannels, "create: channel number (starts from 0; default all channels)")
+	begin := fs.String("begin", "", "create: start of the video, YYYY-MM-DD [HH:MM[:SS]] (default today 00:00)")
+	end := fs.String("end", "", "create: end of the video, YYYY-MM-DD [HH:MM[:SS]] (default now)")
+	around := fs.String("around", "", "create: the video around this time instead of --begin/--end")
+	location := fs.String("location", "", "create: where the video is stored: device, server or download (default video_location from the config)")
+	label := fs.String("label", "", "create: label shown in the task list")
+	status := fs.String("status", "", "list: only tasks in this state: waiting, running, finished or failed")
+	ids := fs.String("id", "", "cancel, fetch: comma-separated task IDs")
+	wait := fs.Bool("wait", false, "fetch: wait for unfinished tasks, polling every download_poll_seconds")
+	dir := fs.String("dir", "", "fetch: folder for the files (default download_dir from the config)")
+
+	// Accept the action before or after the flags
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if action == "" && fs.NArg() > 0 {
+		action = fs.Arg(0)
+	}
+	if *dir != "" {
+		config.DownloadDir = *dir
+	}
+
+	switch action {
+	case "list":
+		query := cmsv.DownloadTaskQuery{DevIDNO: *device, PageSize: cmsv.DefaultPageSize}
+		if *status != "" {
+			s, err := parseDownloadStatus(*status)
+			if err != nil {
+				return err
+			}
+			query.Status = &s
+		}
+		session, err := env.session()
+		if err != nil {
+			return err
+		}
+		tasks := []cmsv.DownloadTask{}
+		for t, err := range session.DownloadTasks(env.ctx, query) {
+			if err != nil {
+				return fmt.Errorf("download task fetch failed: %v", err)
+			}
+			tasks = append(tasks, t)
+		}
+		return env.print(tasks, formatDownloadTasks(tasks))
+
+	case "create":
+		if *device == "" {
+			fs.Usage()
+			return errUsage
+		}
+		query := cmsv.VideoQuery{DevIDNO: *device, Channel: *channel, Location: config.VideoLocation, RecordType: cmsv.RecordAll, Stream: -1}
+		if *location != "" {
+			loc, err := cmsv.ParseVideoLocation(*location)
+			if err != nil {
+				return err
+			}
+			query.Location = loc
+		}
+		var err error
+		if query.Begin, query.End, err = videoRange(*begin, *end, *around); err != nil {
+			return err
+		}
+		// Report range problems before logging in
+		if err := query.Validate(); err != nil {
+			return err
+		}
+		session, err := env.session()
+		if err != nil {
+			return err
+		}
+		created, err := createDownloads(env.ctx, session, query, *label)
+		if err != nil {
+			return err
+		}
+		return env.print(created, formatCreatedDownloads(created))
+
+	case "cancel":
+		if *ids == "" {
+			fs.Usage()
+			return errUsage
+		}
+		session, err := env.session()
+		if err != nil {
+			return err
+		}
+		if err := session.CancelDownloadTasks(env.ctx, splitList(*ids)); err != nil {
+			return fmt.Errorf("download task cancel failed: %v", err)
+		}
+		return env.print(map[string]any{"cancelled": splitList(*ids)}, "Cancelled "+strings.Join(splitList(*ids), ", ")+"\n")
+
+	case "fetch":
+		if *ids == "" {
+			fs.Usage()
+			return errUsage
+		}
+		session, err := env.session()
+		if err != nil {
+			return err
+		}
+		var paths []string
+		for _, id := range splitList(*ids) {
+			task, err := session.DownloadTask(env.ctx, id)
+			if err != nil {
+				return fmt.Errorf("download task fetch failed: %v", err)
+			}
+			if *wait && !task.Done() {
+				interval := time.Duration(config.DownloadPollSeconds) * time.Second
+				task, err = session.WaitDownloadTask(env.ctx, id, interval, func(t cmsv.DownloadTask) {
+					fmt.Fprintf(env.stderr, "Task %s: %s\n", t.ID, formatDownloadStatus(t))
+				})
+				if err != nil {
+					return err
+				}
+			}
+			path, err := fetchDownload(env.ctx, env.client, task, downloadProgress(env.stderr, task.FileName()))
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+		}
+		return env.print(paths, strings.Join(paths, "\n")+"\n")
+	}
+
+	fs.Usage()
+	return errUsage
+}
+
+// parseDownloadStatus parses a download task state name
+func parseDownloadStatus(s string) (cmsv.DownloadStatus, error) {
+	for _, status := range []cmsv.DownloadStatus{cmsv.DownloadWaiting, cmsv.DownloadRunning, cmsv.DownloadFinished, cmsv.DownloadFailed} {
+		if strings.EqualFold(s, status.String()) {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid task status %q (use waiting, running, finished or failed)", s)
+}
+
+// downloadProgress prints the progress of a file download to w, at most
+// once per percent
+func downloadProgress(w io.Writer, name string) func(done, total int64) {
+	last := int64(-1)
+	return func(done, total int64) {
+		if total <= 0 {
+			return
+		}
+		if percent := done * 100 / total; percent != last {
+			last = percent
+			fmt.Fprintf(w, "\r%s: %d%% (%.1f of %.1f MB)", name, percent, float64(done)/(1<<20), float64(total)/(1<<20))
+			if done == total {
+				fmt.Fprintln(w)
+			}
+		}
+	}
+}
+
+func cmdRecord(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	devices := fs.String("device", "", "comma-separated device IDs (required)")
+	channels := fs.String("channel", "0", "comma-separated channel numbers (start from 0), or all for every channel of each device")
+	stream := fs.String("stream", "main", "stream type: main or sub")
+	host := fs.String("host", "", "RTSP server host (default from server_url)")
+	dir := fs.String("dir", "", "recordings folder (default record_dir from the config)")
+	format := fs.String("format", "", "file format: ts or mp4 (default record_format from the config)")
+	segment := fs.Duration("segment", 0, "file length (default record_segment_seconds from the config)")
+	schedule := fs.String("schedule", "", "daily recording windows, e.g. 08:00-18:00,22:00-06:00 (default record_schedule from the config)")
+	alarms := fs.Bool("alarms", false, "record around the alarms of the devices; without a schedule, record only around alarms")
+	interval := fs.Duration("interval", 5*time.Second, "alarm polling interval with --alarms")
+	pre := fs.Duration("pre", -1, "video kept from before an alarm (default record_pre_seconds from the config)")
+	post := fs.Duration("post", -1, "recording after an alarm (default record_post_seconds from the config)")
+	quota := fs.Int("quota-mb", -1, "total size of the recordings in MB, 0 for no limit (default record_quota_mb from the config)")
+	duration := fs.Duration("duration", 0, "stop after this long (default: until interrupted)")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	deviceIDs := splitList(*devices)
+	if len(deviceIDs) == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	numbers, allChannels, err := parseChannels(*channels)
+	if err != nil {
+		return err
+	}
+	streamType, err := parseStreamType(*stream)
+	if err != nil {
+		return err
+	}
+
+	opts := recorderOptions()
+	if *dir != "" {
+		opts.Dir = *dir
+	}
+	if *format != "" {
+		opts.Format = *format
+	}
+	if *segment > 0 {
+		opts.Segment = *segment
+	}
+	if *schedule != "" {
+		if opts.Schedule, err = recorder.ParseSchedule(*schedule); err != nil {
+			return err
+		}
+	}
+	if *pre >= 0 {
+		opts.Pre = *pre
+	}
+	if *post >= 0 {
+		opts.Post = *post
+	}
+	if *quota >= 0 {
+		opts.QuotaBytes = int64(*quota) << 20
+	}
+	opts.TriggerOnly = *alarms
+	opts.Logger = log.New(env.stderr, "", log.LstdFlags)
+	enc := json.NewEncoder(env.stdout)
+	enc.SetEscapeHTML(false)
+	var mu sync.Mutex
+	opts.OnSegment = func(seg recorder.Segment) {
+		mu.Lock()
+		defer mu.Unlock()
+		if env.jsonOutput {
+			enc.Encode(seg)
+			return
+		}
+		io.WriteString(env.stdout, formatSegment(seg))
+	}
+	rec, err := recorder.NewRecorder(opts)
+	if err != nil {
+		return err
+	}
+
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+	if _, err := session.JSession(env.ctx); err != nil {
+		return fmt.Errorf("login failed: %v", err)
+	}
+	var info *cmsv.VehicleResponse
+	if allChannels {
+		if info, err = session.VehicleInfo(env.ctx); err != nil {
+			return fmt.Errorf("vehicle info fetch failed: %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(env.ctx, os.Interrupt)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	if *alarms {
+		poller := session.NewAlarmPoller(cmsv.AlarmQuery{PageSize: config.AlarmPageSize})
+		events, unsubscribe := poller.Subscribe(1)
+		defer unsubscribe()
+		go poller.Run(ctx, *interval)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event := <-events:
+					if event.Err != nil {
+						opts.Logger.Printf("Alarm poll failed: %v", event.Err)
+						continue
+					}
+					for _, alarm := range event.Alarms {
+						if !slices.Contains(deviceIDs, alarm.DevIDNO) {
+							continue
+						}
+						at, err := alarm.Timestamp()
+						if err != nil {
+							at = time.Now()
+						}
+						opts.Logger.Printf("Recording %s around %s at %s", alarm.DevIDNO, formatAlarmType(alarm.Type), at.Format(cmsv.TimeLayout))
+						rec.Trigger(alarm.DevIDNO, at)
+					}
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	streams := 0
+	for _, device := range deviceIDs {
+		for _, ch := range selectChannels(info, device, numbers, allChannels) {
+			channel := ch.Number
+			streams++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec.Record(ctx, recordSource(session, *host, device, channel, streamType))
+			}()
+		}
+	}
+	mode := "continuously"
+	switch {
+	case len(opts.Schedule) > 0 && *alarms:
+		mode = "during " + opts.Schedule.String() + " and around alarms"
+	case len(opts.Schedule) > 0:
+		mode = "during " + opts.Schedule.String()
+	case *alarms:
+		mode = "around alarms"
+	}
+	fmt.Fprintf(env.stderr, "Recording %d streams %s to %s\n", streams, mode, opts.Dir)
+	wg.Wait()
+	return nil
+}
+
+func cmdRelay(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	listen := fs.String("listen", "", "RTSP address to listen on, or off (default relay_rtsp_listen from the config)")
+	hlsListen := fs.String("hls-listen", "", "HLS address to listen on, or off (default relay_hls_listen from the config)")
+	host := fs.String("host", "", "RTSP server host of the devices (default from server_url)")
+	linger := fs.Duration("linger", -1, "how long a stream stays open after its last viewer leaves (default relay_linger_seconds from the config)")
+	hlsSegment := fs.Duration("hls-segment", 0, "HLS segment length (default relay_hls_segment_seconds from the config)")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if *listen == "off" {
+		config.RelayRTSPListen = ""
+	} else if *listen != "" {
+		config.RelayRTSPListen = *listen
+	}
+	if *hlsListen == "off" {
+		config.RelayHLSListen = ""
+	} else if *hlsListen != "" {
+		config.RelayHLSListen = *hlsListen
+	}
+	if *linger >= 0 {
+		config.RelayLingerSeconds = int(linger.Seconds())
+	}
+	if *hlsSegment > 0 {
+		config.RelayHLSSegmentSeconds = max(int(hlsSegment.Seconds()), 1)
+	}
+	if config.RelayRTSPListen == "" && config.RelayHLSListen == "" {
+		return fmt.Errorf("nothing to serve: set relay_rtsp_listen or relay_hls_listen in the config")
+	}
+
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+	if _, err := session.JSession(env.ctx); err != nil {
+		return fmt.Errorf("login failed: %v", err)
+	}
+
+	logger := log.New(env.stderr, "", log.LstdFlags)
+	rel, err := newRelay(session, *host, logger)
+	if err != nil {
+		return err
+	}
+	defer rel.Close()
+
+	ctx, stop := signal.NotifyContext(env.ctx, os.Interrupt)
+	defer stop()
+
+	errc := make(chan error, 2)
+	var media *rtsp.Server
+	if config.RelayRTSPListen != "" {
+		media = &rtsp.Server{Handler: rel.OpenStream, Logger: logger}
+		defer media.Close()
+		go func() {
+			errc <- media.ListenAndServe(config.RelayRTSPListen)
+		}()
+		logger.Printf("Relaying RTSP on rtsp://%s/<device>/<channel>/<main|sub>", config.RelayRTSPListen)
+	}
+	var server *http.Server
+	if config.RelayHLSListen != "" {
+		server = &http.Server{
+			Addr:              config.RelayHLSListen,
+			Handler:           rel,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			errc <- server.ListenAndServe()
+		}()
+		logger.Printf("Relaying HLS on http://%s/<device>/<channel>/<main|sub>/index.m3u8", config.RelayHLSListen)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	rel.Close() // Ends the requests waiting for a first HLS segment
+	if server != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+	return nil
+}
+
+func cmdHLSProxy(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	listen := fs.String("listen", "", "serve: address to listen on (default hls_proxy_listen from the config)")
+	host := fs.String("host", "", "serve: HLS server host (default from server_url)")
+	device := fs.String("device", "", "token: device ID")
+	channel := fs.Int("channel", 0, "token: channel number (starts from 0)")
+	stream := fs.String("stream", "main", "token: stream type: main or sub")
+	ttl := fs.Duration("ttl", 0, "token: lifetime of the link (default hls_proxy_token_minutes from the config)")
+	note := fs.String("note", "", "revoke: reason kept in the revocation list")
+
+	// Accept the action before or after the flags
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	// Links to revoke may come before more flags
+	var rest []string
+	for fs.NArg() > 0 {
+		rest = append(rest, fs.Arg(0))
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return errUsage
+		}
+	}
+	if action == "" && len(rest) > 0 {
+		action, rest = rest[0], rest[1:]
+	}
+	if *listen != "" {
+		config.HLSProxyListen = *listen
+	}
+
+	switch action {
+	case "serve":
+		return serveHLSProxy(env, *host)
+
+	case "token":
+		if *device == "" || *channel < 0 {
+			fs.Usage()
+			return errUsage
+		}
+		streamType, err := parseStreamType(*stream)
+		if err != nil {
+			return err
+		}
+		if *ttl <= 0 {
+			*ttl = time.Duration(config.HLSProxyTokenMinutes) * time.Minute
+		}
+		token, link, err := hlsShareLink(*device, *channel, streamType, *ttl)
+		if err != nil {
+			return err
+		}
+		out := struct {
+			hlsproxy.Token
+			URL string `json:"url"`
+		}{token, link}
+		text := fmt.Sprintf("%s\nToken ID: %s (revoke with: hls-proxy revoke %s)\nExpires:  %s\n",
+			link, token.ID, token.ID, token.Expires.Format(cmsv.TimeLayout))
+		return env.print(out, text)
+
+	case "revoke":
+		if len(rest) == 0 {
+			fs.Usage()
+			return errUsage
+		}
+		signer, err := hlsProxySigner()
+		if err != nil {
+			return err
+		}
+		list, err := hlsproxy.OpenRevocationList(config.HLSProxyRevocations)
+		if err != nil {
+			return err
+		}
+		var revoked []hlsproxy.Revocation
+		for _, arg := range rest {
+			r, err := parseShareToken(signer, arg)
+			if err != nil {
+				return err
+			}
+			r.Note = *note
+			r.Revoked = time.Now().Truncate(time.Second)
+			revoked = append(revoked, r)
+		}
+		var b strings.Builder
+		for _, r := range revoked {
+			if err := list.Revoke(r); err != nil {
+				return err
+			}
+			fmt.Fprintf(&b, "Revoked %s\n", r.ID)
+		}
+		return env.print(revoked, b.String())
+
+	case "revoked":
+		list, err := hlsproxy.OpenRevocationList(config.HLSProxyRevocations)
+		if err != nil {
+			return err
+		}
+		revocations := list.List()
+		return env.print(revocations, formatRevocations(revocations))
+	}
+	fs.Usage()
+	return errUsage
+}
+
+// serveHLSProxy runs the HLS proxy until interrupted
+func serveHLSProxy(env *cliEnv, host string) error {
+	signer, err := hlsProxySigner()
+	if err != nil {
+		return err
+	}
+	revocations, err := hlsproxy.OpenRevocationList(config.HLSProxyRevocations)
+	if err != nil {
+		return err
+	}
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+	if _, err := session.JSession(env.ctx); err != nil {
+		return fmt.Errorf("login failed: %v", err)
+	}
+
+	logger := log.New(env.stderr, "", log.LstdFlags)
+	revocations.Logger = logger
+	proxy, err := hlsproxy.New(hlsproxy.Options{
+		Session:     session,
+		Signer:      signer,
+		Revocations: revocations,
+		StreamHost:  host,
+		Logger:      logger,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(env.ctx, os.Interrupt)
+	defer stop()
+
+	server := &http.Server{
+		Addr:              config.HLSProxyListen,
+		Handler:           proxy,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.ListenAndServe()
+	}()
+	logger.Printf("HLS proxy listening on http://%s, links use %s", config.HLSProxyListen, hlsProxyBaseURL())
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// videoRange returns the searched time range: the window around around if it
+// is set, otherwise begin to end, which default to today
+func videoRange(begin, end, around string) (time.Time, time.Time, error) {
+	if around != "" {
+		t, err := parseHistoryTime(around, false)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		return t.Add(-time.Duration(config.AlarmVideoBeforeSeconds) * time.Second),
+			t.Add(time.Duration(config.AlarmVideoAfterSeconds) * time.Second), nil
+	}
+
+	now := time.Now()
+	from, to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local), now
+	var err error
+	if begin != "" {
+		if from, err = parseHistoryTime(begin, false); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if end != "" {
+		if to, err = parseHistoryTime(end, true); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	return from, to, nil
+}
+
+// findAlarm looks up a current alarm by its GUID
+func findAlarm(ctx context.Context, session *cmsv.Session, device, guid string) (cmsv.Alarm, error) {
+	for alarm, err := range session.Alarms(ctx, cmsv.AlarmQuery{DevIDNO: device, PageSize: config.AlarmPageSize}) {
+		if err != nil {
+			return cmsv.Alarm{}, fmt.Errorf("alarm fetch failed: %v", err)
+		}
+		if alarm.GUID == guid {
+			return alarm, nil
+		}
+	}
+	return cmsv.Alarm{}, fmt.Errorf("alarm %s is not among the current alarms", guid)
+}
+
+func cmdJournal(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	from := fs.String("from", "alarms.log", "legacy text log to import")
+
+	// Accept the action before or after the flags
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if action == "" && fs.NArg() > 0 {
+		action = fs.Arg(0)
+	}
+	if action != "import" {
+		fs.Usage()
+		return errUsage
+	}
+
+	f, err := os.Open(*from)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	j, err := openAlarmJournal()
+	if err != nil {
+		return err
+	}
+	defer j.Close()
+
+	// The legacy log repeats alarms on every refresh; keep the first copy
+	imported, skipped := 0, 0
+	for entry, err := range journal.ReadLegacy(f) {
+		if err != nil {
+			return fmt.Errorf("%s: %v", *from, err)
+		}
+		if len(loggedAlarms.Filter([]cmsv.Alarm{entry.Alarm})) == 0 {
+			skipped++
+			continue
+		}
+		if _, err := j.Write(entry); err != nil {
+			return err
+		}
+		imported++
+	}
+
+	return env.print(map[string]any{
+		"journal":  j.Path(),
+		"imported": imported,
+		"skipped":  skipped,
+	}, fmt.Sprintf("Imported %d alarms into %s (%d duplicates skipped)\n", imported, j.Path(), skipped))
+}
+
+func cmdAlarmTypes(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	category := fs.String("category", "", "only list one category: ADAS, DSM, BSD, GPS, Video, IO, Platform or Other")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+
+	types := config.AlarmTypes.Types()
+	if *category != "" {
+		want, err := cmsv.ParseAlarmCategory(*category)
+		if err != nil {
+			return err
+		}
+		types = slices.DeleteFunc(types, func(t cmsv.AlarmType) bool { return t.Category != want })
+	}
+	return env.print(types, formatAlarmTypes(types))
+}
+
+func cmdStatus(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	devices := fs.String("device", "", "comma-separated device IDs (empty for all devices)")
+	vehicles := fs.String("vehicle", "", "comma-separated license plates, used when --device is empty")
+	geo := fs.Bool("geo", false, "resolve the geographic address")
+	driver := fs.Bool("driver", false, "include driver information")
+	toMap := fs.Int("to-map", 0, "coordinate system: 0=WGS84, 1=Google (GCJ-02), 2=Baidu (BD-09)")
+	language := fs.String("lang", "en", "address language: en or zh")
+	exp := addExportFlags(fs)
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if err := exp.validate(); err != nil {
+		return err
+	}
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+
+	statuses, err := session.DeviceStatus(env.ctx, cmsv.DeviceStatusQuery{
+		DevIDNO:    splitList(*devices),
+		VehiIDNO:   splitList(*vehicles),
+		GeoAddress: *geo,
+		Driver:     *driver,
+		ToMap:      *toMap,
+		Language:   *language,
+	})
+	if err != nil {
+		return fmt.Errorf("device status fetch failed: %v", err)
+	}
+	if exp.file != "" {
+		return exp.write(env, export.FromStatuses(statuses), "Vehicle positions")
+	}
+	return env.print(statuses, formatDeviceStatus(statuses))
+}
+
+func cmdGeofence(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	zoneFiles := fs.String("zones", "", "comma-separated GeoJSON or KML zone files (default geofence_zones from the config)")
+	devices := fs.String("device", "", "comma-separated device IDs (empty for all devices)")
+	interval := fs.Duration("interval", 0, "device status polling interval (default geofence_interval_seconds from the config)")
+	logFile := fs.Bool("log", false, "record events in the alarm journal and send them to the configured webhooks")
+	check := fs.Bool("check", false, "print the zones every device is in and exit")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+
+	paths := config.GeofenceZones
+	if *zoneFiles != "" {
+		paths = splitList(*zoneFiles)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no zone files: set geofence_zones in the config or pass --zones")
+	}
+	zones, err := geofence.LoadFiles(paths, config.GeofenceDatum)
+	if err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		*interval = time.Duration(config.GeofenceIntervalSeconds) * time.Second
+	}
+
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+	query := cmsv.DeviceStatusQuery{DevIDNO: splitList(*devices), Language: "en"}
+
+	// The first poll sets the starting state of every device
+	monitor := geofence.NewMonitor(zones)
+	statuses, err := session.DeviceStatus(env.ctx, query)
+	if err != nil {
+		return fmt.Errorf("device status fetch failed: %v", err)
+	}
+	monitor.UpdateStatuses(statuses, time.Now())
+
+	if *check {
+		type deviceZones struct {
+			Device  string   `json:"device"`
+			Vehicle string   `json:"vehicle"`
+			Zones   []string `json:"zones"`
+		}
+		var result []deviceZones
+		builder := strings.Builder{}
+		for _, s := range statuses {
+			entry := deviceZones{Device: s.ID, Vehicle: s.VID, Zones: []string{}}
+			var names []string
+			for _, z := range monitor.Inside(s.ID) {
+				entry.Zones = append(entry.Zones, z.ID)
+				names = append(names, z.Name)
+			}
+			result = append(result, entry)
+
+			where := "outside all zones"
+			if !s.HasPosition() {
+				where = "no position"
+			} else if len(names) > 0 {
+				where = strings.Join(names, ", ")
+			}
+			builder.WriteString(fmt.Sprintf("%s (%s): %s\n", s.VID, s.ID, where))
+		}
+		return env.print(result, builder.String())
+	}
+
+	ctx, stop := signal.NotifyContext(env.ctx, os.Interrupt)
+	defer stop()
+	if *logFile {
+		if err := startWebhooks(ctx, log.New(env.stderr, "", log.LstdFlags)); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(env.stderr, "Watching %d devices in %d zones every %s\n", len(statuses), len(zones), *interval)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	enc := json.NewEncoder(env.stdout)
+	enc.SetEscapeHTML(false)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		statuses, err := session.DeviceStatus(ctx, query)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(env.stderr, "Device status poll failed: %v\n", err)
+			}
+			continue
+		}
+		alarms := geofence.Alarms(monitor.UpdateStatuses(statuses, time.Now()))
+		if *logFile {
+			recordAlarms(alarms)
+		}
+		for _, alarm := range alarms {
+			if env.jsonOutput {
+				if err := enc.Encode(alarm); err != nil {
+					return err
+				}
+				continue
+			}
+			writeAlarm(env.stdout, alarm)
+		}
+	}
+}
+
+func cmdLinks(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	device := fs.String("device", "", "device ID (required)")
+	channel := fs.String("channel", "0", "comma-separated channel numbers (start from 0), or all for every channel of the device")
+	stream := fs.String("stream", "sub", "stream type: main or sub")
+	host := fs.String("host", "", "streaming server host (default from server_url)")
+
+	// Accept the protocol before or after the flags
+	var protocol string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		protocol, args = args[0], args[1:]
+	}
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if protocol == "" && fs.NArg() > 0 {
+		protocol = fs.Arg(0)
+	}
+	if protocol == "" || *device == "" {
+		fs.Usage()
+		return errUsage
+	}
+
+	numbers, allChannels, err := parseChannels(*channel)
+	if err != nil {
+		return err
+	}
+	streamType, err := parseStreamType(*stream)
+	if err != nil {
+		return err
+	}
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+	jsession, err := session.JSession(env.ctx)
+	if err != nil {
+		return fmt.Errorf("login failed: %v", err)
+	}
+
+	if !allChannels && len(numbers) == 1 {
+		link, err := streamLink(env.client, protocol, *host, jsession, *device, numbers[0], streamType)
+		if err != nil {
+			return err
+		}
+		return env.print(map[string]any{
+			"protocol": strings.ToLower(protocol),
+			"device":   *device,
+			"channel":  numbers[0],
+			"stream":   streamType,
+			"url":      link,
+		}, link+"\n")
+	}
+
+	// Several channels are listed with their names
+	info, err := session.VehicleInfo(env.ctx)
+	if err != nil {
+		return fmt.Errorf("vehicle info fetch failed: %v", err)
+	}
+	links, err := channelLinks(env.client, protocol, *host, jsession, *device, selectChannels(info, *device, numbers, allChannels), streamType)
+	if err != nil {
+		return err
+	}
+	result := make([]map[string]any, 0, len(links))
+	for _, l := range links {
+		result = append(result, map[string]any{
+			"protocol": strings.ToLower(protocol),
+			"device":   *device,
+			"channel":  l.Number,
+			"name":     l.Name,
+			"stream":   streamType,
+			"url":      l.URL,
+		})
+	}
+	return env.print(result, formatChannelLinks(links))
+}
+
+func cmdExportLinks(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	output := fs.String("output", "-", "file to write, - for stdout")
+	format := fs.String("format", "", "m3u, xspf, csv or json (default from the file extension, m3u on stdout)")
+	companies := fs.String("company", "", "comma-separated company names or IDs, including their sub-companies (default all)")
+	devices := fs.String("device", "", "comma-separated device IDs (default all)")
+	channels := fs.String("channel", "all", "comma-separated channel numbers (start from 0), or all for every channel of each device")
+	streams := fs.String("stream", "main,sub", "comma-separated stream types: main, sub")
+	protocols := fs.String("protocol", "rtsp,rtmp,hls", "comma-separated protocols: rtsp, rtmp, hls")
+	online := fs.Bool("online", false, "only devices that are online now")
+	host := fs.String("host", "", "streaming server host (default from server_url)")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+
+	var f playlist.Format
+	var err error
+	switch {
+	case *format != "":
+		f, err = playlist.ParseFormat(*format)
+	case *output == "-" && env.jsonOutput:
+		f = playlist.JSON
+	case *output == "-":
+		f = playlist.M3U
+	default:
+		f, err = playlist.FormatForFile(*output)
+	}
+	if err != nil {
+		return err
+	}
+	sel := playlist.Selection{
+		Companies: splitList(*companies),
+		Devices:   splitList(*devices),
+		Protocols: splitList(strings.ToLower(*protocols)),
+	}
+	numbers, allChannels, err := parseChannels(*channels)
+	if err != nil {
+		return err
+	}
+	if !allChannels {
+		sel.Channels = numbers
+	}
+	for _, item := range splitList(*streams) {
+		stream, err := parseStreamType(item)
+		if err != nil {
+			return err
+		}
+		sel.Streams = append(sel.Streams, stream)
+	}
+
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+	if *online {
+		fleet, err := session.Devices(env.ctx)
+		if err != nil {
+			return fmt.Errorf("device fetch failed: %v", err)
+		}
+		onlineDevices := map[string]bool{}
+		for _, d := range fleet {
+			onlineDevices[d.DID] = d.Online == 1
+		}
+		sel.Filter = func(devIDNO string) bool { return onlineDevices[devIDNO] }
+	}
+	cameras, err := fleetLinks(env.ctx, session, *host, sel)
+	if err != nil {
+		return err
+	}
+
+	opts := playlist.Options{Name: "CMSV live streams"}
+	if *output == "-" {
+		return playlist.Write(env.stdout, f, cameras, opts)
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := playlist.Write(file, f, cameras, opts); err != nil {
+		file.Close()
+		return fmt.Errorf("export failed: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return env.print(map[string]any{
+		"file":    *output,
+		"format":  f,
+		"cameras": len(cameras),
+	}, fmt.Sprintf("Exported the links of %d camera streams to %s\n", len(cameras), *output))
+}
+
+func cmdProbe(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	devices := fs.String("device", "", "comma-separated device IDs to probe")
+	all := fs.Bool("all", false, "probe every device of the account; offline devices are reported without probing")
+	channels := fs.String("channel", "0", "comma-separated channel numbers (start from 0), or all for every channel of each device")
+	stream := fs.String("stream", "sub", "stream type: main or sub")
+	protocols := fs.String("protocol", "rtsp", "comma-separated protocols to probe: rtsp, rtmp, hls")
+	host := fs.String("host", "", "streaming server host (default from server_url)")
+	timeout := fs.Duration("timeout", probe.DefaultTimeout, "time limit of each probe")
+	parallel := fs.Int("parallel", 4, "number of links probed at once")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	// Links may come before more flags
+	var urls []string
+	for fs.NArg() > 0 {
+		urls = append(urls, fs.Arg(0))
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return errUsage
+		}
+	}
+	deviceIDs := splitList(*devices)
+	if len(urls) == 0 && len(deviceIDs) == 0 && !*all {
+		fs.Usage()
+		return errUsage
+	}
+	numbers, allChannels, err := parseChannels(*channels)
+	if err != nil {
+		return err
+	}
+	streamType, err := parseStreamType(*stream)
+	if err != nil {
+		return err
+	}
+	protocolList := splitList(strings.ToLower(*protocols))
+	for _, p := range protocolList {
+		if p != "rtsp" && p != "rtmp" && p != "hls" {
+			return fmt.Errorf("unknown stream protocol %q (use rtsp, rtmp or hls)", p)
+		}
+	}
+	if *parallel < 1 {
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+
+	// One job per link; offline devices of the fleet get their result at once
+	var jobs []func(ctx context.Context) linkCheck
+	for _, u := range urls {
+		jobs = append(jobs, func(ctx context.Context) linkCheck {
+			return linkCheck{URL: u, Result: probe.Probe(ctx, u, probeOptions(env.client, *timeout))}
+		})
+	}
+	var session *cmsv.Session
+	if len(deviceIDs) > 0 || *all {
+		if session, err = env.session(); err != nil {
+			return err
+		}
+	}
+	var info *cmsv.VehicleResponse
+	if allChannels {
+		if info, err = session.VehicleInfo(env.ctx); err != nil {
+			return fmt.Errorf("vehicle info fetch failed: %v", err)
+		}
+	}
+	offline := map[string]bool{}
+	if *all {
+		fleet, err := session.Devices(env.ctx)
+		if err != nil {
+			return fmt.Errorf("device fetch failed: %v", err)
+		}
+		for _, d := range fleet {
+			if !slices.Contains(deviceIDs, d.DID) {
+				deviceIDs = append(deviceIDs, d.DID)
+			}
+			offline[d.DID] = d.Online != 1
+		}
+	}
+	for _, device := range deviceIDs {
+		for _, ch := range selectChannels(info, device, numbers, allChannels) {
+			channel := ch.Number
+			for _, protocol := range protocolList {
+				if offline[device] {
+					jobs = append(jobs, func(context.Context) linkCheck {
+						return linkCheck{Device: device, Channel: &channel, Stream: []string{"main", "sub"}[streamType],
+							Result: probe.Result{Protocol: protocol, Reason: "the device is offline"}}
+					})
+					continue
+				}
+				jobs = append(jobs, func(ctx context.Context) linkCheck {
+					return probeDeviceLink(ctx, session, protocol, *host, device, channel, streamType, *timeout)
+				})
+			}
+		}
+	}
+
+	// Probe in parallel, printing the results in order as they complete
+	results := make([]chan linkCheck, len(jobs))
+	sem := make(chan struct{}, *parallel)
+	for i, job := range jobs {
+		results[i] = make(chan linkCheck, 1)
+		go func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] <- job(env.ctx)
+		}()
+	}
+	checks := make([]linkCheck, 0, len(jobs))
+	failed := 0
+	for _, result := range results {
+		check := <-result
+		checks = append(checks, check)
+		if !check.OK {
+			failed++
+		}
+		if !env.jsonOutput {
+			io.WriteString(env.stdout, formatLinkCheck(check))
+		}
+	}
+	if env.jsonOutput {
+		if err := env.print(checks, ""); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d links do not play", failed, len(checks))
+	}
+	return nil
+}
+
+func cmdServe(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	listen := fs.String("listen", "", "address to listen on (default gateway_listen from the config)")
+	apiKeys := fs.String("api-key", "", "comma-separated API keys (default gateway_api_keys from the config)")
+	host := fs.String("host", "", "streaming server host used in CMSV stream URLs (default from server_url)")
+	links := fs.String("links", "", "stream URLs of /devices/{id}/streams: none, relay, hls-proxy or cmsv (default gateway_stream_links from the config)")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if *listen != "" {
+		config.GatewayListen = *listen
+	}
+	if *links != "" {
+		config.GatewayStreamLinks = strings.ToLower(*links)
+	}
+	streamLinks, err := gatewayStreamLinks(config.GatewayStreamLinks)
+	if err != nil {
+		return err
+	}
+	if *apiKeys != "" {
+		config.GatewayAPIKeys = splitList(*apiKeys)
+	}
+	if len(config.GatewayAPIKeys) == 0 {
+		return fmt.Errorf("no API keys: set gateway_api_keys in the config or pass --api-key")
+	}
+
+	session, err := env.session()
+	if err != nil {
+		return err
+	}
+	// Log in up front so bad credentials fail here and not on the first request
+	if _, err := session.JSession(env.ctx); err != nil {
+		return fmt.Errorf("login failed: %v", err)
+	}
+
+	logger := log.New(env.stderr, "", log.LstdFlags)
+	gw, err := gateway.New(gateway.Options{
+		Session:    session,
+		Catalog:    config.AlarmTypes,
+		APIKeys:    config.GatewayAPIKeys,
+		StreamHost: *host,
+		Logger:     logger,
+
+		Links:         streamLinks,
+		ExposeSession: config.GatewayStreamLinks == "cmsv",
+	})
+	if err != nil {
+		return err
+	}
+
+	if config.GatewayStreamLinks == "cmsv" {
+		logger.Printf("Stream URLs carry the CMSV session: every API key holder gets access to the whole account")
+	}
+
+	ctx, stop := signal.NotifyContext(env.ctx, os.Interrupt)
+	defer stop()
+
+	server := &http.Server{
+		Addr:              config.GatewayListen,
+		Handler:           gw,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.ListenAndServe()
+	}()
+	logger.Printf("REST gateway listening on http://%s", config.GatewayListen)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// gatewayStreamLinks returns the stream URL function of the REST gateway for
+// a gateway_stream_links mode. It is nil for none and cmsv.
+func gatewayStreamLinks(mode string) (func(devIDNO string, channel, stream int) (string, string, string, error), error) {
+	switch mode {
+	case "", "none", "cmsv":
+		return nil, nil
+	case "relay":
+		if config.RelayRTSPListen == "" && config.RelayHLSListen == "" {
+			return nil, fmt.Errorf("gateway_stream_links = relay needs relay_rtsp_listen or relay_hls_listen")
+		}
+		return func(devIDNO string, channel, stream int) (string, string, string, error) {
+			path := relay.Key{Device: devIDNO, Channel: channel, Stream: stream}.Path()
+			var rtspURL, hlsURL string
+			if config.RelayRTSPListen != "" {
+				rtspURL = "rtsp://" + config.RelayRTSPListen + path
+			}
+			if config.RelayHLSListen != "" {
+				hlsURL = "http://" + config.RelayHLSListen + path + "/index.m3u8"
+			}
+			return rtspURL, "", hlsURL, nil
+		}, nil
+	case "hls-proxy":
+		if _, err := hlsProxySigner(); err != nil {
+			return nil, err
+		}
+		return func(devIDNO string, channel, stream int) (string, string, string, error) {
+			_, link, err := hlsShareLink(devIDNO, channel, stream, time.Duration(config.HLSProxyTokenMinutes)*time.Minute)
+			return "", "", link, err
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid gateway_stream_links %q (use none, relay, hls-proxy or cmsv)", mode)
+}
+
+func cmdSimulate(env *cliEnv, fs *flag.FlagSet, args []string) error {
+	listen := fs.String("listen", "127.0.0.1:18080", "address to listen on")
+	rtspListen := fs.String("rtsp-listen", "", "also serve live video test patterns over RTSP on this address (set rtsp_port to its port)")
+	rtmpListen := fs.String("rtmp-listen", "", "also serve them over RTMP on this address (set rtmp_port to its port)")
+	hlsListen := fs.String("hls-listen", "", "also serve them over HLS with a self-signed HTTPS certificate on this address (set hls_port to its port)")
+	fleetFile := fs.String("fleet", "", "JSON fleet file (default: a built-in fleet of three vehicles)")
+	tick := fs.Duration("tick", time.Second, "how often the fleet moves")
+	speed := fs.Float64("speed", 1, "simulated seconds per real second")
+	faults := fs.String("fault", "", "comma-separated ACTION=CODE[:COUNT] result codes to inject (ACTION * for all)")
+	seed := fs.Uint64("seed", 0, "random seed of the speed variation (default random)")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if *tick <= 0 {
+		return fmt.Errorf("--tick must be positive")
+	}
+
+	fleet := simulator.DefaultFleet()
+	if *fleetFile != "" {
+		var err error
+		if fleet, err = simulator.LoadFleet(*fleetFile); err != nil {
+			return err
+		}
+	}
+	// Credentials given on the command line are the only ones accepted
+	if env.account != "" {
+		fleet.Account, fleet.Password = env.account, env.password
+	}
+	injected, err := parseFaults(*faults)
+	if err != nil {
+		return err
+	}
+
+	logger := log.New(env.stderr, "", log.LstdFlags)
+	sim := simulator.New(simulator.Options{Fleet: &fleet, TimeScale: *speed, Seed: *seed, Logger: logger})
+	for _, f := range injected {
+		sim.InjectFault(f)
+	}
+
+	ctx, stop := signal.NotifyContext(env.ctx, os.Interrupt)
+	defer stop()
+	go sim.Run(ctx, *tick)
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           sim,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 4)
+	go func() {
+		errc <- server.ListenAndServe()
+	}()
+	logger.Printf("CMSV simulator listening on http://%s with %d vehicles", *listen, len(fleet.Vehicles))
+	if *rtspListen != "" {
+		media := &rtsp.Server{Handler: sim.OpenStream, Logger: logger}
+		defer media.Close()
+		go func() {
+			errc <- media.ListenAndServe(*rtspListen)
+		}()
+		logger.Printf("RTSP media server listening on rtsp://%s", *rtspListen)
+	}
+	if *rtmpListen != "" {
+		media := &rtmp.Server{Handler: sim.OpenStream, Logger: logger}
+		defer media.Close()
+		go func() {
+			errc <- media.ListenAndServe(*rtmpListen)
+		}()
+		logger.Printf("RTMP media server listening on rtmp://%s", *rtmpListen)
+	}
+	if *hlsListen != "" {
+		cert, err := simulator.SelfSignedCertificate()
+		if err != nil {
+			return err
+		}
+		hls := &http.Server{
+			Addr:              *hlsListen,
+			Handler:           sim.HLSHandler(),
+			TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}},
+			ReadHeaderTimeout: 10 * time.Second,
+			ErrorLog:          log.New(io.Discard, "", 0), // Players rejecting the certificate
+		}
+		defer hls.Close()
+		go func() {
+			errc <- hls.ListenAndServeTLS("", "")
+		}()
+		logger.Printf("HLS server listening on https://%s", *hlsListen)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// parseFaults parses a comma-separated list of ACTION=CODE[:COUNT] faults
+func parseFaults(s string) ([]simulator.Fault, error) {
+	var faults []simulator.Fault
+	for _, item := range splitList(s) {
+		action, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault %q (use ACTION=CODE[:COUNT])", item)
+		}
+		code, count, _ := strings.Cut(value, ":")
+		f := simulator.Fault{Action: strings.TrimSpace(action)}
+		var err error
+		if f.Code, err = strconv.Atoi(strings.TrimSpace(code)); err != nil {
+			return nil, fmt.Errorf("invalid fault %q: bad result code", item)
+		}
+		if count != "" {
+			if f.Count, err = strconv.Atoi(strings.TrimSpace(count)); err != nil || f.Count < 0 {
+				return nil, fmt.Errorf("invalid fault %q: bad count", item)
+			}
+		}
+		faults = append(faults, f)
+	}
+	return faults, nil
+}
+
+// exportFlags are the --export flags of the alarm and status commands
+type exportFlags struct {
+	file   string
+	format string
+	datum  string
+	tracks bool
+
+	parsedFormat export.Format
+	parsedDatum  geo.Datum
+}
+
+func addExportFlags(fs *flag.FlagSet) *exportFlags {
+	e := &exportFlags{}
+	fs.StringVar(&e.file, "export", "", "write the positions to this file instead of printing them (- for stdout)")
+	fs.StringVar(&e.format, "export-format", "", "export format: geojson, kml or gpx (default from the file extension)")
+	fs.StringVar(&e.datum, "datum", "wgs84", "datum of the exported coordinates: wgs84, gcj02 or bd09")
+	fs.BoolVar(&e.tracks, "tracks", false, "also export a track per device through its points")
+	return e
+}
+
+// validate checks the export flags before anything is fetched
+func (e *exportFlags) validate() error {
+	if e.file == "" {
+		return nil
+	}
+	var err error
+	switch {
+	case e.format != "":
+		e.parsedFormat, err = export.ParseFormat(e.format)
+	case e.file == "-":
+		err = fmt.Errorf("--export-format is required when exporting to stdout")
+	default:
+		e.parsedFormat, err = export.FormatForFile(e.file)
+	}
+	if err != nil {
+		return err
+	}
+	e.parsedDatum, err = geo.ParseDatum(e.datum)
+	return err
+}
+
+// write exports the points and reports where they went
+func (e *exportFlags) write(env *cliEnv, points []export.Point, name string) error {
+	opts := export.Options{Name: name, Datum: e.parsedDatum, Tracks: e.tracks}
+	if e.file == "-" {
+		return export.Write(env.stdout, e.parsedFormat, points, opts)
+	}
+
+	f, err := os.Create(e.file)
+	if err != nil {
+		return err
+	}
+	if err := export.Write(f, e.parsedFormat, points, opts); err != nil {
+		f.Close()
+		return fmt.Errorf("export failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return env.print(map[string]any{
+		"file":   e.file,
+		"format": e.parsedFormat,
+		"points": len(points),
+	}, fmt.Sprintf("Exported %d points to %s\n", len(points), e.file))
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// flagWasSet reports whether a flag was given explicitly on the command line
+func flagWasSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,84 @@
+package cmsv
+
+import (
+	"context"
+	"iter"
+	"net/url"
+	"strconv"
+)
+
+// AlarmQuery selects the alarms returned by StandardApiAction_vehicleAlarm
+type AlarmQuery struct {
+	DevIDNO  string // Device number; empty for all devices
+	ToMap    int    // Map coordinates: 0=WGS84, 1=Google (GCJ-02), 2=Baidu (BD-09)
+	Page     int    // 1-based page number; 0 lets the server decide
+	PageSize int    // Records per page (default DefaultPageSize when paging)
+}
+
+func (q AlarmQuery) values(jsession string) url.Values {
+	params := url.Values{
+		"jsession": {jsession},
+		"DevIDNO":  {q.DevIDNO},
+		"toMap":    {strconv.Itoa(q.ToMap)},
+	}
+	if q.Page > 0 {
+		pageSize := q.PageSize
+		if pageSize <= 0 {
+			pageSize = DefaultPageSize
+		}
+		params.Set("currentPage", strconv.Itoa(q.Page))
+		params.Set("pageRecords", strconv.Itoa(pageSize))
+	}
+	return params
+}
+
+// AlarmPage returns one page of current alarms together with the pagination
+// reported by the server
+func (c *Client) AlarmPage(ctx context.Context, jsession string, q AlarmQuery) (*AlarmResponse, error) {
+	data, err := c.getJSON(ctx, c.actionURL("vehicleAlarm", q.values(jsession)))
+	if err != nil {
+		return nil, err
+	}
+	var res AlarmResponse
+	if err := decode("alarm request", data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// DeviceAlarms returns the current alarms of a device. An empty devIDNO
+// returns the alarms of all devices. toMap selects the map coordinate system
+// (0=WGS84, 1=Google, 2=Baidu).
+func (c *Client) DeviceAlarms(ctx context.Context, jsession, devIDNO string, toMap int) (*AlarmResponse, error) {
+	return c.AlarmPage(ctx, jsession, AlarmQuery{DevIDNO: devIDNO, ToMap: toMap})
+}
+
+// AlarmPage returns one page of current alarms
+func (s *Session) AlarmPage(ctx context.Context, q AlarmQuery) (*AlarmResponse, error) {
+	var alarms *AlarmResponse
+	err := s.Do(ctx, func(jsession string) (err error) {
+		alarms, err = s.client.AlarmPage(ctx, jsession, q)
+		return err
+	})
+	return alarms, err
+}
+
+// DeviceAlarms returns the current alarms of a device, or of all devices
+// when devIDNO is empty
+func (s *Session) DeviceAlarms(ctx context.Context, devIDNO string, toMap int) (*AlarmResponse, error) {
+	return s.AlarmPage(ctx, AlarmQuery{DevIDNO: devIDNO, ToMap: toMap})
+}
+
+// Alarms iterates over every current alarm matching q, starting at q.Page
+// (default 1). Pages are fetched lazily as the iteration advances; stopping
+// the loop early stops fetching.
+func (s *Session) Alarms(ctx context.Context, q AlarmQuery) iter.Seq2[Alarm, error] {
+	return paginate(ctx, q.Page, func(ctx context.Context, page int) ([]Alarm, Pagination, error) {
+		q.Page = page
+		res, err := s.AlarmPage(ctx, q)
+		if err != nil {
+			return nil, Pagination{}, err
+		}
+		return res.AlarmList, res.Pagination, nil
+	})
+}
@@ -0,0 +1,266 @@
+package cmsv
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// AlarmCategory groups alarm types by the subsystem that raises them
+type AlarmCategory string
+
+const (
+	CategoryADAS     AlarmCategory = "ADAS"     // Advanced driver assistance (forward camera)
+	CategoryDSM      AlarmCategory = "DSM"      // Driver state monitoring (cabin camera)
+	CategoryBSD      AlarmCategory = "BSD"      // Blind spot detection
+	CategoryGPS      AlarmCategory = "GPS"      // Position, speed and driving time
+	CategoryVideo    AlarmCategory = "Video"    // Cameras and recording storage
+	CategoryIO       AlarmCategory = "IO"       // Inputs, buttons and sensors
+	CategoryPlatform AlarmCategory = "Platform" // Raised by the platform rather than the device
+	CategoryOther    AlarmCategory = "Other"    // Unknown codes
+)
+
+var alarmCategories = []AlarmCategory{
+	CategoryADAS, CategoryDSM, CategoryBSD, CategoryGPS, CategoryVideo, CategoryIO, CategoryPlatform, CategoryOther,
+}
+
+// ParseAlarmCategory returns the category with the given name, ignoring case
+func ParseAlarmCategory(s string) (AlarmCategory, error) {
+	for _, c := range alarmCategories {
+		if strings.EqualFold(string(c), strings.TrimSpace(s)) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown alarm category %q", s)
+}
+
+// AlarmSeverity is the default importance of an alarm type
+type AlarmSeverity int
+
+const (
+	SeverityInfo AlarmSeverity = iota
+	SeverityWarning
+	SeverityCritical
+)
+
+func (s AlarmSeverity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityCritical:
+		return "critical"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// MarshalText encodes the severity by name
+func (s AlarmSeverity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a severity name
+func (s *AlarmSeverity) UnmarshalText(text []byte) error {
+	severity, err := ParseAlarmSeverity(string(text))
+	if err != nil {
+		return err
+	}
+	*s = severity
+	return nil
+}
+
+// ParseAlarmSeverity accepts "info", "warning" or "critical"
+func ParseAlarmSeverity(s string) (AlarmSeverity, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "info":
+		return SeverityInfo, nil
+	case "warning", "warn":
+		return SeverityWarning, nil
+	case "critical", "crit":
+		return SeverityCritical, nil
+	}
+	return 0, fmt.Errorf("unknown alarm severity %q (use info, warning or critical)", s)
+}
+
+// AlarmType describes one alarm type code
+type AlarmType struct {
+	Code     int           `json:"code"`
+	Name     string        `json:"name"`
+	Category AlarmCategory `json:"category"`
+	Severity AlarmSeverity `json:"severity"`
+	End      bool          `json:"end,omitempty"` // Code reports the end of the alarm
+}
+
+// String returns the code with its name, e.g. "620 Smoking"
+func (t AlarmType) String() string {
+	return fmt.Sprintf("%d %s", t.Code, t.Name)
+}
+
+// alarmEndOffset is added to a start code to get the code that reports the
+// end of the alarm (e.g. 11 overspeed / 61 overspeed end, 620 / 670 smoking)
+const alarmEndOffset = 50
+
+// defaultAlarmTypes are the built-in CMSV/JT808 alarm types. Only start
+// codes are listed; end codes are derived with alarmEndOffset.
+var defaultAlarmTypes = []AlarmType{
+	{1, "Custom alarm", CategoryPlatform, SeverityInfo, false},
+	{2, "Emergency button", CategoryIO, SeverityCritical, false},
+	{4, "Video loss", CategoryVideo, SeverityWarning, false},
+	{8, "Illegal ignition", CategoryIO, SeverityWarning, false},
+	{9, "Temperature alarm", CategoryIO, SeverityWarning, false},
+	{10, "Storage failure", CategoryVideo, SeverityWarning, false},
+	{11, "Overspeed", CategoryGPS, SeverityWarning, false},
+	{13, "Illegal displacement", CategoryGPS, SeverityWarning, false},
+	{14, "Parking timeout", CategoryGPS, SeverityInfo, false},
+	{15, "Motion detection", CategoryVideo, SeverityInfo, false},
+	{19, "IO input 1", CategoryIO, SeverityInfo, false},
+	{20, "IO input 2", CategoryIO, SeverityInfo, false},
+	{21, "IO input 3", CategoryIO, SeverityInfo, false},
+	{22, "IO input 4", CategoryIO, SeverityInfo, false},
+	{23, "IO input 5", CategoryIO, SeverityInfo, false},
+	{24, "IO input 6", CategoryIO, SeverityInfo, false},
+	{25, "IO input 7", CategoryIO, SeverityInfo, false},
+	{26, "IO input 8", CategoryIO, SeverityInfo, false},
+	{27, "Zone entry", CategoryPlatform, SeverityInfo, false},
+	{28, "Zone exit", CategoryPlatform, SeverityInfo, false},
+	{49, "Fatigue driving (driving time)", CategoryGPS, SeverityWarning, false},
+
+	{600, "Forward collision warning", CategoryADAS, SeverityCritical, false},
+	{601, "Lane departure warning", CategoryADAS, SeverityWarning, false},
+	{602, "Following distance too close", CategoryADAS, SeverityWarning, false},
+	{603, "Pedestrian collision warning", CategoryADAS, SeverityCritical, false},
+	{604, "Frequent lane changes", CategoryADAS, SeverityWarning, false},
+	{605, "Road sign limit exceeded", CategoryADAS, SeverityWarning, false},
+	{606, "Obstacle warning", CategoryADAS, SeverityWarning, false},
+
+	{618, "Fatigue driving", CategoryDSM, SeverityCritical, false},
+	{619, "Phone call", CategoryDSM, SeverityWarning, false},
+	{620, "Smoking", CategoryDSM, SeverityWarning, false},
+	{621, "Distracted driving", CategoryDSM, SeverityWarning, false},
+	{622, "Driver abnormal", CategoryDSM, SeverityCritical, false},
+
+	{632, "Rear approach", CategoryBSD, SeverityWarning, false},
+	{633, "Left rear approach", CategoryBSD, SeverityWarning, false},
+	{634, "Right rear approach", CategoryBSD, SeverityWarning, false},
+
+	// Raised by the client-side geofence monitor, not by the server
+	{AlarmGeofenceEnter, "Geofence entry", CategoryPlatform, SeverityInfo, false},
+	{AlarmGeofenceExit, "Geofence exit", CategoryPlatform, SeverityInfo, false},
+	{AlarmGeofenceDwell, "Geofence dwell", CategoryPlatform, SeverityWarning, false},
+}
+
+// Alarm type codes of the client-side geofence events. They are outside the
+// range used by CMSV devices and servers.
+const (
+	AlarmGeofenceEnter = 1901
+	AlarmGeofenceExit  = 1902
+	AlarmGeofenceDwell = 1903
+)
+
+// AlarmCatalog maps alarm type codes to their names, categories and
+// severities. The zero value is empty; NewAlarmCatalog returns a catalog with
+// the built-in types. It is safe for concurrent use.
+type AlarmCatalog struct {
+	mu    sync.RWMutex
+	types map[int]AlarmType
+}
+
+// NewAlarmCatalog returns a catalog holding the built-in alarm types
+func NewAlarmCatalog() *AlarmCatalog {
+	c := &AlarmCatalog{types: make(map[int]AlarmType, len(defaultAlarmTypes))}
+	for _, t := range defaultAlarmTypes {
+		c.types[t.Code] = t
+	}
+	return c
+}
+
+// Set adds or replaces an alarm type
+func (c *AlarmCatalog) Set(t AlarmType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.types == nil {
+		c.types = make(map[int]AlarmType)
+	}
+	c.types[t.Code] = t
+}
+
+// Override updates an alarm type from a "Name[,Category[,Severity]]" spec,
+// as used by the alarm_type_<code> configuration keys. Omitted fields keep
+// the current value, or Other/warning for a new code.
+func (c *AlarmCatalog) Override(code int, spec string) error {
+	t, ok := c.Lookup(code)
+	if !ok {
+		t = AlarmType{Code: code, Category: CategoryOther, Severity: SeverityWarning}
+	}
+
+	fields := strings.Split(spec, ",")
+	if name := strings.TrimSpace(fields[0]); name != "" {
+		t.Name = name
+	}
+	if t.Name == "" {
+		return fmt.Errorf("alarm type %d: missing name", code)
+	}
+	if len(fields) > 1 && strings.TrimSpace(fields[1]) != "" {
+		category, err := ParseAlarmCategory(fields[1])
+		if err != nil {
+			return fmt.Errorf("alarm type %d: %v", code, err)
+		}
+		t.Category = category
+	}
+	if len(fields) > 2 && strings.TrimSpace(fields[2]) != "" {
+		severity, err := ParseAlarmSeverity(fields[2])
+		if err != nil {
+			return fmt.Errorf("alarm type %d: %v", code, err)
+		}
+		t.Severity = severity
+	}
+	if len(fields) > 3 {
+		return fmt.Errorf("alarm type %d: too many fields in %q", code, spec)
+	}
+
+	c.Set(t)
+	return nil
+}
+
+// Lookup returns the alarm type of a code. A code without its own entry that
+// is alarmEndOffset above a known code is reported as the end of that alarm.
+func (c *AlarmCatalog) Lookup(code int) (AlarmType, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if t, ok := c.types[code]; ok {
+		return t, true
+	}
+	if start, ok := c.types[code-alarmEndOffset]; ok && !start.End {
+		return AlarmType{
+			Code:     code,
+			Name:     start.Name + " (end)",
+			Category: start.Category,
+			Severity: SeverityInfo,
+			End:      true,
+		}, true
+	}
+	return AlarmType{}, false
+}
+
+// Describe returns the alarm type of a code, or an "Unknown alarm" entry in
+// CategoryOther for codes the catalog does not know
+func (c *AlarmCatalog) Describe(code int) AlarmType {
+	if t, ok := c.Lookup(code); ok {
+		return t
+	}
+	return AlarmType{Code: code, Name: "Unknown alarm", Category: CategoryOther, Severity: SeverityWarning}
+}
+
+// Types returns every explicitly listed alarm type ordered by code
+func (c *AlarmCatalog) Types() []AlarmType {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	types := make([]AlarmType, 0, len(c.types))
+	for _, t := range c.types {
+		types = append(types, t)
+	}
+	slices.SortFunc(types, func(a, b AlarmType) int { return a.Code - b.Code })
+	return types
+}
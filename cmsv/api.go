@@ -0,0 +1,57 @@
+package cmsv
+
+import (
+	"context"
+	"net/url"
+)
+
+// Login authenticates with the server and returns a new jsession
+func (c *Client) Login(ctx context.Context, account, password string) (string, error) {
+	data, err := c.getJSON(ctx, c.actionURL("login", url.Values{
+		"account":  {account},
+		"password": {password},
+	}))
+	if err != nil {
+		return "", err
+	}
+	var res LoginResponse
+	if err := decode("login", data, &res); err != nil {
+		return "", err
+	}
+	return res.JSession, nil
+}
+
+// Logout invalidates a jsession
+func (c *Client) Logout(ctx context.Context, jsession string) error {
+	data, err := c.getJSON(ctx, c.actionURL("logout", url.Values{"jsession": {jsession}}))
+	if err != nil {
+		return err
+	}
+	return decode("logout", data, nil)
+}
+
+// Devices returns the online status of all devices the session can access
+func (c *Client) Devices(ctx context.Context, jsession string) ([]Device, error) {
+	data, err := c.getJSON(ctx, c.actionURL("getDeviceOlStatus", url.Values{"jsession": {jsession}}))
+	if err != nil {
+		return nil, err
+	}
+	var res StatusResponse
+	if err := decode("online status request", data, &res); err != nil {
+		return nil, err
+	}
+	return res.Onlines, nil
+}
+
+// VehicleInfo returns the companies and vehicles visible to the session
+func (c *Client) VehicleInfo(ctx context.Context, jsession string) (*VehicleResponse, error) {
+	data, err := c.getJSON(ctx, c.actionURL("queryUserVehicle", url.Values{"jsession": {jsession}}))
+	if err != nil {
+		return nil, err
+	}
+	var res VehicleResponse
+	if err := decode("vehicle info request", data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
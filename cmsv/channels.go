@@ -0,0 +1,69 @@
+package cmsv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultChannels is the number of channels assumed for a device the vehicle
+// information does not describe
+const DefaultChannels = 4
+
+// Channel is a video channel of a device
+type Channel struct {
+	Number int    `json:"channel"`        // Starts from 0
+	Name   string `json:"name,omitempty"` // Camera name, if the server has one
+}
+
+// Label names the channel for lists, e.g. "CH1 Front". Channels named only
+// by their number, as many servers do, are "CH1".
+func (c Channel) Label() string {
+	number := fmt.Sprintf("CH%d", c.Number+1)
+	if c.Name == "" || strings.EqualFold(strings.ReplaceAll(c.Name, " ", ""), number) {
+		return number
+	}
+	return number + " " + c.Name
+}
+
+// ChannelList returns the channels of the device with their names. The
+// names come from cn, comma-separated in channel order; a device without a
+// channel count has one channel.
+func (d VehicleDevice) ChannelList() []Channel {
+	names := strings.Split(d.ChanName, ",")
+	channels := make([]Channel, max(d.Channels, 1))
+	for i := range channels {
+		channels[i].Number = i
+		if i < len(names) {
+			channels[i].Name = strings.TrimSpace(names[i])
+		}
+	}
+	return channels
+}
+
+// FindDevice returns the device with the ID from the vehicles
+func (r *VehicleResponse) FindDevice(devIDNO string) (VehicleDevice, bool) {
+	for _, v := range r.Vehicles {
+		for _, d := range v.DeviceList {
+			if d.ID == devIDNO {
+				return d, true
+			}
+		}
+	}
+	return VehicleDevice{}, false
+}
+
+// DeviceChannels returns the channels of a device from the vehicle
+// information, or DefaultChannels unnamed channels when the vehicle
+// information does not list the device
+func DeviceChannels(info *VehicleResponse, devIDNO string) []Channel {
+	if info != nil {
+		if d, ok := info.FindDevice(devIDNO); ok {
+			return d.ChannelList()
+		}
+	}
+	channels := make([]Channel, DefaultChannels)
+	for i := range channels {
+		channels[i].Number = i
+	}
+	return channels
+}
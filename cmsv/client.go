@@ -0,0 +1,206 @@
+// Package cmsv is a client for the CMSV (Commercial Vehicle Monitoring System)
+// StandardApiAction web API and its RTSP, RTMP and HLS streaming servers.
+package cmsv
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Default ports used by a stock CMSV installation
+const (
+	DefaultAPIPort  = 443
+	DefaultRTMPPort = 1935
+	DefaultRTSPPort = 6604
+	DefaultHLSPort  = 16604
+)
+
+// Options configures a Client. Zero values fall back to the CMSV defaults.
+type Options struct {
+	BaseURL    string       // Server URL, e.g. "https://ahd.samsonix.com"
+	APIPort    int          // Web API port (default 443)
+	RTMPPort   int          // RTMP server port (default 1935)
+	RTSPPort   int          // RTSP server port (default 6604)
+	HLSPort    int          // HLS server port (default 16604)
+	HTTPClient *http.Client // HTTP client used for API requests
+	Logger     *log.Logger  // Debug logger for requests and raw responses (nil disables logging)
+	UserAgent  string       // User-Agent header sent with every request
+}
+
+// Client talks to a single CMSV server. A Client holds no session state and is
+// safe for concurrent use, so several clients pointing at different servers
+// can live in one process.
+type Client struct {
+	baseURL   *url.URL
+	apiPort   int
+	rtmpPort  int
+	rtspPort  int
+	hlsPort   int
+	http      *http.Client
+	insecure  *http.Client
+	logger    *log.Logger
+	userAgent string
+}
+
+// NewClient creates a Client from the given options
+func NewClient(opts Options) (*Client, error) {
+	if opts.BaseURL == "" {
+		return nil, fmt.Errorf("cmsv: base URL is required")
+	}
+
+	base, err := url.Parse(strings.TrimRight(opts.BaseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("cmsv: invalid base URL: %v", err)
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("cmsv: base URL must include scheme and host: %q", opts.BaseURL)
+	}
+
+	c := &Client{
+		baseURL:   base,
+		apiPort:   opts.APIPort,
+		rtmpPort:  opts.RTMPPort,
+		rtspPort:  opts.RTSPPort,
+		hlsPort:   opts.HLSPort,
+		http:      opts.HTTPClient,
+		logger:    opts.Logger,
+		userAgent: opts.UserAgent,
+	}
+
+	if c.apiPort == 0 {
+		c.apiPort = DefaultAPIPort
+	}
+	if c.rtmpPort == 0 {
+		c.rtmpPort = DefaultRTMPPort
+	}
+	if c.rtspPort == 0 {
+		c.rtspPort = DefaultRTSPPort
+	}
+	if c.hlsPort == 0 {
+		c.hlsPort = DefaultHLSPort
+	}
+	if c.http == nil {
+		c.http = &http.Client{}
+	}
+	if c.userAgent == "" {
+		c.userAgent = "GoClient"
+	}
+	c.insecure = insecureCopy(c.http)
+
+	// Apply the API port unless the URL already names one or it is the scheme default
+	if base.Port() == "" && !isDefaultPort(base.Scheme, c.apiPort) {
+		base.Host = net.JoinHostPort(base.Hostname(), strconv.Itoa(c.apiPort))
+	}
+
+	return c, nil
+}
+
+func isDefaultPort(scheme string, port int) bool {
+	return (scheme == "https" && port == 443) || (scheme == "http" && port == 80)
+}
+
+// BaseURL returns the server URL the client talks to
+func (c *Client) BaseURL() string {
+	return c.baseURL.String()
+}
+
+// Hostname returns the server host without scheme, path or port. It is used
+// as the default host for the streaming servers.
+func (c *Client) Hostname() string {
+	return c.baseURL.Hostname()
+}
+
+// RTMPPort returns the configured RTMP port
+func (c *Client) RTMPPort() int { return c.rtmpPort }
+
+// RTSPPort returns the configured RTSP port
+func (c *Client) RTSPPort() int { return c.rtspPort }
+
+// HLSPort returns the configured HLS port
+func (c *Client) HLSPort() int { return c.hlsPort }
+
+// actionURL builds the URL of a StandardApiAction endpoint
+func (c *Client) actionURL(action string, params url.Values) string {
+	u := *c.baseURL
+	u.Path = strings.TrimRight(u.Path, "/") + "/StandardApiAction_" + action + ".action"
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+func (c *Client) logf(format string, args ...any) {
+	if c.logger != nil {
+		c.logger.Printf(format, args...)
+	}
+}
+
+// getJSON performs a GET request and returns the raw response body. If the
+// server presents a certificate that cannot be verified the request is
+// retried once without verification, matching the behaviour of the CMSV
+// desktop clients.
+func (c *Client) getJSON(ctx context.Context, rawURL string) ([]byte, error) {
+	c.logf("Requesting: %s", rawURL)
+
+	resp, err := c.do(ctx, c.http, rawURL)
+	if err != nil && isCertError(err) {
+		resp, err = c.do(ctx, c.insecure, rawURL)
+	}
+	if err != nil {
+		c.logf("HTTP request error: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.logf("Raw response: %s", string(data))
+	return data, nil
+}
+
+// Get requests a URL of the CMSV servers, such as an HLS playlist. Like API
+// requests, it is retried without certificate verification when the
+// certificate cannot be verified. The caller closes the response body.
+func (c *Client) Get(ctx context.Context, rawURL string) (*http.Response, error) {
+	c.logf("Requesting: %s", rawURL)
+	resp, err := c.do(ctx, c.http, rawURL)
+	if err != nil && isCertError(err) {
+		resp, err = c.do(ctx, c.insecure, rawURL)
+	}
+	return resp, err
+}
+
+func (c *Client) do(ctx context.Context, hc *http.Client, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	return hc.Do(req)
+}
+
+// insecureCopy returns a copy of hc that skips certificate verification
+func insecureCopy(hc *http.Client) *http.Client {
+	insecure := *hc
+	insecure.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	return &insecure
+}
+
+func isCertError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "x509:") || strings.Contains(msg, "certificate signed by unknown authority")
+}
@@ -0,0 +1,193 @@
+package cmsv
+
+import (
+	"cmsv_api/geo"
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DeviceStatus is the real-time status of a device returned by
+// StandardApiAction_getDeviceStatus. Raw fields keep the server's integer
+// scaling; use the helper methods for normalized units.
+type DeviceStatus struct {
+	ID           string `json:"id"`     // Device number
+	VID          string `json:"vid"`    // License plate
+	Abbr         string `json:"abbr"`   // Abbreviation
+	Lng          int    `json:"lng"`    // Longitude in micro-degrees (0 if invalid)
+	Lat          int    `json:"lat"`    // Latitude in micro-degrees (0 if invalid)
+	FT           int    `json:"ft"`     // Manufacturer type
+	SP           int    `json:"sp"`     // Speed in 0.1 km/h
+	OL           int    `json:"ol"`     // Online status: 1=online
+	GT           string `json:"gt"`     // Location upload time
+	PT           int    `json:"pt"`     // Communication protocol type
+	DT           int    `json:"dt"`     // Hard disk type: 1=SD card, 2=hard disk, 3=SSD card
+	AC           int    `json:"ac"`     // Audio type
+	Net          int    `json:"net"`    // Network type: 0=3G, 1=WIFI, 2=wired, 3=4G, 4=5G
+	GW           string `json:"gw"`     // Gateway server number
+	S1           int    `json:"s1"`     // Status word 1
+	S2           int    `json:"s2"`     // Status word 2
+	S3           int    `json:"s3"`     // Status word 3
+	S4           int    `json:"s4"`     // Status word 4
+	T1           int    `json:"t1"`     // Temperature sensor 1
+	T2           int    `json:"t2"`     // Temperature sensor 2
+	T3           int    `json:"t3"`     // Temperature sensor 3
+	T4           int    `json:"t4"`     // Temperature sensor 4
+	HX           int    `json:"hx"`     // Direction in degrees, 0 is north, clockwise
+	MLng         string `json:"mlng"`   // Converted map longitude
+	MLat         string `json:"mlat"`   // Converted map latitude
+	PK           int    `json:"pk"`     // Parking duration in seconds
+	LC           int    `json:"lc"`     // Mileage in meters
+	YL           int    `json:"yl"`     // Oil quantity in 0.01 liters
+	ViceYL       int    `json:"viceYl"` // Secondary oil quantity in 0.01 liters
+	PS           string `json:"ps"`     // Resolved address or "lat,lng"
+	TSP          int    `json:"tsp"`    // Tachograph speed in 0.1 km/h
+	DriverName   string `json:"dn"`     // Driver name
+	DriverCertNo string `json:"jn"`     // Driver certificate code
+	LT           int    `json:"lt"`     // Login type: 0=linux, 1=windows, 2=web, 3=Android, 4=iOS
+	UST          int    `json:"ust"`    // Usage status: 0=normal, 1=maintenance, 2=disabled, 3=overdue
+	SN           int    `json:"sn"`     // Number of satellites
+	LG           int    `json:"lg"`     // Location type (2 = long positioning, 808-2019)
+}
+
+// DeviceStatusResponse is returned by StandardApiAction_getDeviceStatus
+type DeviceStatusResponse struct {
+	Result int            `json:"result"`
+	Status []DeviceStatus `json:"status"`
+}
+
+// Online reports whether the device is online
+func (s DeviceStatus) Online() bool {
+	return s.OL == 1
+}
+
+// Latitude returns the latitude in degrees
+func (s DeviceStatus) Latitude() float64 {
+	return float64(s.Lat) / 1000000.0
+}
+
+// Longitude returns the longitude in degrees
+func (s DeviceStatus) Longitude() float64 {
+	return float64(s.Lng) / 1000000.0
+}
+
+// HasPosition reports whether the device reported a valid location
+func (s DeviceStatus) HasPosition() bool {
+	return s.Lat != 0 || s.Lng != 0
+}
+
+// Coord returns the raw position in the datum reported by the device in
+// the PositioningCoordType bits of s4
+func (s DeviceStatus) Coord() geo.Coord {
+	return geo.FromMicroDegrees(s.Lat, s.Lng, s.Equipment().Datum())
+}
+
+// MapCoord parses the converted map position. toMap is the value the
+// status was requested with.
+func (s DeviceStatus) MapCoord(toMap int) (geo.Coord, error) {
+	return geo.ParseMapCoord(s.MLat, s.MLng, geo.Datum(toMap))
+}
+
+// SpeedKmh returns the speed in km/h
+func (s DeviceStatus) SpeedKmh() float64 {
+	return float64(s.SP) / 10.0
+}
+
+// TachographSpeedKmh returns the tachograph speed in km/h
+func (s DeviceStatus) TachographSpeedKmh() float64 {
+	return float64(s.TSP) / 10.0
+}
+
+// FuelLiters returns the oil quantity in liters
+func (s DeviceStatus) FuelLiters() float64 {
+	return float64(s.YL) / 100.0
+}
+
+// SecondaryFuelLiters returns the secondary oil quantity in liters
+func (s DeviceStatus) SecondaryFuelLiters() float64 {
+	return float64(s.ViceYL) / 100.0
+}
+
+// MileageKm returns the mileage in kilometers
+func (s DeviceStatus) MileageKm() float64 {
+	return float64(s.LC) / 1000.0
+}
+
+// Equipment decodes the s1-s4 status words
+func (s DeviceStatus) Equipment() EquipmentStatus {
+	return ParseEquipmentStatus(s.S1, s.S2, s.S3, s.S4)
+}
+
+// NetworkName returns the name of the network type
+func (s DeviceStatus) NetworkName() string {
+	switch s.Net {
+	case 0:
+		return "3G"
+	case 1:
+		return "WIFI"
+	case 2:
+		return "Wired"
+	case 3:
+		return "4G"
+	case 4:
+		return "5G"
+	}
+	return "Unknown"
+}
+
+// DeviceStatusQuery selects the devices and options of a device status request
+type DeviceStatusQuery struct {
+	DevIDNO    []string // Device numbers; if empty VehiIDNO is used
+	VehiIDNO   []string // License plates; if both are empty all devices are queried
+	GeoAddress bool     // Resolve the geographic address into PS
+	Driver     bool     // Include driver information
+	ToMap      int      // Map coordinates: 0=WGS84, 1=Google (GCJ-02), 2=Baidu (BD-09)
+	Language   string   // Address language: "zh" or "en"
+}
+
+func (q DeviceStatusQuery) values(jsession string) url.Values {
+	params := url.Values{
+		"jsession": {jsession},
+		"toMap":    {strconv.Itoa(q.ToMap)},
+	}
+	if len(q.DevIDNO) > 0 {
+		params.Set("devIdno", strings.Join(q.DevIDNO, ","))
+	}
+	if len(q.VehiIDNO) > 0 {
+		params.Set("vehiIdno", strings.Join(q.VehiIDNO, ","))
+	}
+	if q.GeoAddress {
+		params.Set("geoaddress", "1")
+	}
+	if q.Driver {
+		params.Set("driver", "1")
+	}
+	if q.Language != "" {
+		params.Set("language", q.Language)
+	}
+	return params
+}
+
+// DeviceStatus returns the real-time status of the selected devices
+func (c *Client) DeviceStatus(ctx context.Context, jsession string, q DeviceStatusQuery) ([]DeviceStatus, error) {
+	data, err := c.getJSON(ctx, c.actionURL("getDeviceStatus", q.values(jsession)))
+	if err != nil {
+		return nil, err
+	}
+	var res DeviceStatusResponse
+	if err := decode("device status request", data, &res); err != nil {
+		return nil, err
+	}
+	return res.Status, nil
+}
+
+// DeviceStatus returns the real-time status of the selected devices
+func (s *Session) DeviceStatus(ctx context.Context, q DeviceStatusQuery) ([]DeviceStatus, error) {
+	var status []DeviceStatus
+	err := s.Do(ctx, func(jsession string) (err error) {
+		status, err = s.client.DeviceStatus(ctx, jsession, q)
+		return err
+	})
+	return status, err
+}
@@ -0,0 +1,471 @@
+package cmsv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DownloadStatus is the state of a server-side download task
+type DownloadStatus int
+
+const (
+	DownloadWaiting  DownloadStatus = 0 // Waiting for the device to come online or upload
+	DownloadRunning  DownloadStatus = 1 // The device is uploading the file to the download server
+	DownloadFinished DownloadStatus = 2 // The file can be fetched from DownloadTask.URL
+	DownloadFailed   DownloadStatus = 3 // The upload failed or the task was cancelled
+)
+
+// String returns the status name, e.g. "running"
+func (s DownloadStatus) String() string {
+	switch s {
+	case DownloadWaiting:
+		return "waiting"
+	case DownloadRunning:
+		return "running"
+	case DownloadFinished:
+		return "finished"
+	case DownloadFailed:
+		return "failed"
+	}
+	return strconv.Itoa(int(s))
+}
+
+// DownloadRequest creates a task that copies part of a recorded file from
+// the device to the download server with StandardApiAction_addDownloadTask
+type DownloadRequest struct {
+	File  VideoFile // File found by VideoFiles
+	Begin time.Time // Start of the part to download; zero for the start of the file
+	End   time.Time // End of the part to download; zero for the end of the file
+	Label string    // Free text shown in the task list
+}
+
+// NewDownloadRequest requests the part of a file cut by Clips
+func NewDownloadRequest(c VideoClip, label string) DownloadRequest {
+	return DownloadRequest{File: c.File, Begin: c.Begin, End: c.End, Label: label}
+}
+
+// Validate checks the request locally before it is sent
+func (r DownloadRequest) Validate() error {
+	const op = "download task"
+	if r.File.DevIDNO == "" || r.File.File == "" {
+		return &ResultError{Op: op, Code: 7}
+	}
+	begin, end := r.segment()
+	if begin.After(end) {
+		return &ResultError{Op: op, Code: 9}
+	}
+	return nil
+}
+
+// segment returns the part to download, limited to the file
+func (r DownloadRequest) segment() (time.Time, time.Time) {
+	begin, end := r.File.BeginTime(), r.File.EndTime()
+	if r.Begin.After(begin) {
+		begin = r.Begin
+	}
+	if !r.End.IsZero() && r.End.Before(end) {
+		end = r.End
+	}
+	return begin, end
+}
+
+// Whole reports whether the request covers the whole file
+func (r DownloadRequest) Whole() bool {
+	begin, end := r.segment()
+	return begin.Equal(r.File.BeginTime()) && end.Equal(r.File.EndTime())
+}
+
+func (r DownloadRequest) values(jsession string) url.Values {
+	begin, end := r.segment()
+	downloadType := "2" // Segment
+	if r.Whole() {
+		downloadType = "1" // Whole file
+	}
+	return url.Values{
+		"jsession": {jsession},
+		"did":      {r.File.DevIDNO},
+		"chn":      {strconv.Itoa(r.File.Channel)},
+		"fbtm":     {r.File.BeginTime().Format(TimeLayout)},
+		"fetm":     {r.File.EndTime().Format(TimeLayout)},
+		"sbtm":     {begin.Format(TimeLayout)},
+		"setm":     {end.Format(TimeLayout)},
+		"lab":      {r.Label},
+		"fph":      {r.File.File},
+		"vtp":      {strconv.Itoa(r.File.Type)},
+		"len":      {strconv.FormatInt(r.File.Len, 10)},
+		"dtp":      {downloadType},
+		"loc":      {strconv.Itoa(r.File.Loc)},
+	}
+}
+
+// AddDownloadTaskResponse is returned by StandardApiAction_addDownloadTask
+type AddDownloadTaskResponse struct {
+	Result int    `json:"result"`
+	TaskID string `json:"taskTag"`
+}
+
+// DownloadTask is a server-side download task
+type DownloadTask struct {
+	ID        string         `json:"taskTag"`
+	DevIDNO   string         `json:"did"`
+	VehiIDNO  string         `json:"vid"`
+	Channel   int            `json:"chn"`
+	File      string         `json:"fph"`  // Path of the recording on the device
+	FileBegin string         `json:"fbtm"` // Start of the recording
+	FileEnd   string         `json:"fetm"` // End of the recording
+	Begin     string         `json:"sbtm"` // Start of the downloaded part
+	End       string         `json:"setm"` // End of the downloaded part
+	Label     string         `json:"lab"`
+	Size      int64          `json:"len"` // Size of the downloaded file in bytes
+	Status    DownloadStatus `json:"stu"`
+	Progress  int            `json:"prg"` // Upload progress in percent
+	Created   string         `json:"ctm"`
+	URL       string         `json:"dph"` // Download URL, once the task has finished
+}
+
+// Finished reports whether the file can be fetched
+func (t DownloadTask) Finished() bool {
+	return t.Status == DownloadFinished && t.URL != ""
+}
+
+// Done reports whether the task will not change anymore
+func (t DownloadTask) Done() bool {
+	return t.Status == DownloadFinished || t.Status == DownloadFailed
+}
+
+// FileName returns a local file name for the download, e.g.
+// "013300000001_CH1_20250603-101500.264"
+func (t DownloadTask) FileName() string {
+	begin, err := time.ParseInLocation(TimeLayout, t.Begin, time.Local)
+	stamp := t.ID
+	if err == nil {
+		stamp = begin.Format("20060102-150405")
+	}
+	ext := ".264"
+	if i := strings.LastIndex(t.File, "."); i >= 0 && !strings.Contains(t.File[i:], "/") {
+		ext = t.File[i:]
+	}
+	return fmt.Sprintf("%s_CH%d_%s%s", t.DevIDNO, t.Channel+1, stamp, ext)
+}
+
+// DownloadTaskQuery selects tasks from StandardApiAction_queryDownloadTask
+type DownloadTaskQuery struct {
+	DevIDNO  string          // Device number; empty for every device
+	Begin    time.Time       // Tasks created after this time; zero for no limit
+	End      time.Time       // Tasks created before this time; zero for no limit
+	Status   *DownloadStatus // Only tasks in this state; nil for every state
+	Page     int             // 1-based page number (default 1)
+	PageSize int             // Records per page (default DefaultPageSize)
+}
+
+func (q DownloadTaskQuery) values(jsession string) url.Values {
+	page := max(q.Page, 1)
+	pageSize := q.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	params := url.Values{
+		"jsession":    {jsession},
+		"currentPage": {strconv.Itoa(page)},
+		"pageRecords": {strconv.Itoa(pageSize)},
+	}
+	if q.DevIDNO != "" {
+		params.Set("devIdno", q.DevIDNO)
+	}
+	if !q.Begin.IsZero() {
+		params.Set("begintime", q.Begin.Format(TimeLayout))
+	}
+	if !q.End.IsZero() {
+		params.Set("endtime", q.End.Format(TimeLayout))
+	}
+	if q.Status != nil {
+		params.Set("status", strconv.Itoa(int(*q.Status)))
+	}
+	return params
+}
+
+// DownloadTaskResponse is returned by StandardApiAction_queryDownloadTask
+type DownloadTaskResponse struct {
+	Result     int            `json:"result"`
+	Tasks      []DownloadTask `json:"infos"`
+	Pagination Pagination     `json:"pagination"`
+}
+
+// AddDownloadTask creates a download task and returns its ID. A task for the
+// same part of the same file fails with ErrDownloadTaskExists (code 11).
+func (c *Client) AddDownloadTask(ctx context.Context, jsession string, r DownloadRequest) (string, error) {
+	if err := r.Validate(); err != nil {
+		return "", err
+	}
+	data, err := c.getJSON(ctx, c.actionURL("addDownloadTask", r.values(jsession)))
+	if err != nil {
+		return "", err
+	}
+	var res AddDownloadTaskResponse
+	if err := decode("download task", data, &res); err != nil {
+		return "", err
+	}
+	return res.TaskID, nil
+}
+
+// DownloadTaskPage returns one page of download tasks
+func (c *Client) DownloadTaskPage(ctx context.Context, jsession string, q DownloadTaskQuery) (*DownloadTaskResponse, error) {
+	data, err := c.getJSON(ctx, c.actionURL("queryDownloadTask", q.values(jsession)))
+	if err != nil {
+		return nil, err
+	}
+	var res DownloadTaskResponse
+	if err := decode("download task query", data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// CancelDownloadTasks cancels and removes download tasks
+func (c *Client) CancelDownloadTasks(ctx context.Context, jsession string, ids []string) error {
+	if len(ids) == 0 {
+		return &ResultError{Op: "download task cancel", Code: 7}
+	}
+	data, err := c.getJSON(ctx, c.actionURL("delDownloadTasklist", url.Values{
+		"jsession": {jsession},
+		"taskTag":  {strings.Join(ids, ",")},
+	}))
+	if err != nil {
+		return err
+	}
+	return decode("download task cancel", data, nil)
+}
+
+// AddDownloadTask creates a download task and returns its ID
+func (s *Session) AddDownloadTask(ctx context.Context, r DownloadRequest) (string, error) {
+	var id string
+	err := s.Do(ctx, func(jsession string) (err error) {
+		id, err = s.client.AddDownloadTask(ctx, jsession, r)
+		return err
+	})
+	return id, err
+}
+
+// DownloadTaskPage returns one page of download tasks
+func (s *Session) DownloadTaskPage(ctx context.Context, q DownloadTaskQuery) (*DownloadTaskResponse, error) {
+	var res *DownloadTaskResponse
+	err := s.Do(ctx, func(jsession string) (err error) {
+		res, err = s.client.DownloadTaskPage(ctx, jsession, q)
+		return err
+	})
+	return res, err
+}
+
+// DownloadTasks iterates over every download task matching q, starting at
+// q.Page. Pages are fetched lazily as the iteration advances.
+func (s *Session) DownloadTasks(ctx context.Context, q DownloadTaskQuery) iter.Seq2[DownloadTask, error] {
+	return paginate(ctx, q.Page, func(ctx context.Context, page int) ([]DownloadTask, Pagination, error) {
+		q.Page = page
+		res, err := s.DownloadTaskPage(ctx, q)
+		if err != nil {
+			return nil, Pagination{}, err
+		}
+		return res.Tasks, res.Pagination, nil
+	})
+}
+
+// DownloadTask returns one task by its ID
+func (s *Session) DownloadTask(ctx context.Context, id string) (DownloadTask, error) {
+	for t, err := range s.DownloadTasks(ctx, DownloadTaskQuery{}) {
+		if err != nil {
+			return DownloadTask{}, err
+		}
+		if t.ID == id {
+			return t, nil
+		}
+	}
+	return DownloadTask{}, &ResultError{Op: "download task query", Code: 27}
+}
+
+// CancelDownloadTasks cancels and removes download tasks
+func (s *Session) CancelDownloadTasks(ctx context.Context, ids []string) error {
+	return s.Do(ctx, func(jsession string) error {
+		return s.client.CancelDownloadTasks(ctx, jsession, ids)
+	})
+}
+
+// WaitDownloadTask polls a task every interval until it has finished or
+// failed. progress, if set, is called with the task after every poll.
+func (s *Session) WaitDownloadTask(ctx context.Context, id string, interval time.Duration, progress func(DownloadTask)) (DownloadTask, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		t, err := s.DownloadTask(ctx, id)
+		if err != nil {
+			return t, err
+		}
+		if progress != nil {
+			progress(t)
+		}
+		if t.Done() {
+			if t.Status == DownloadFailed {
+				return t, fmt.Errorf("download task %s failed", id)
+			}
+			return t, nil
+		}
+		select {
+		case <-ctx.Done():
+			return t, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// DownloadFile fetches rawURL into path. The data is written to path.part
+// first and renamed when complete; an existing path.part is resumed with a
+// Range request. progress, if set, is called with the bytes written so far
+// and the total size, or -1 when the server does not report it. A relative
+// URL is resolved against the server URL.
+func (c *Client) DownloadFile(ctx context.Context, rawURL, path string, progress func(done, total int64)) error {
+	if u, err := url.Parse(rawURL); err == nil && !u.IsAbs() {
+		rawURL = c.baseURL.ResolveReference(u).String()
+	}
+	part := path + ".part"
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+
+	resp, err := c.getRange(ctx, c.http, rawURL, offset)
+	if err != nil && isCertError(err) {
+		resp, err = c.getRange(ctx, c.insecure, rawURL, offset)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// restart drops a partial file that does not match the remote one and
+	// downloads it again from the start
+	restart := func(reason string) error {
+		resp.Body.Close()
+		if offset == 0 {
+			return fmt.Errorf("download failed: %s", reason)
+		}
+		c.logf("Restarting the download of %s: %s", path, reason)
+		if err := os.Remove(part); err != nil {
+			return err
+		}
+		return c.DownloadFile(ctx, rawURL, path, progress)
+	}
+
+	total := int64(-1)
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, size, ok := contentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			return restart(fmt.Sprintf("the server sent the range %q for byte %d", resp.Header.Get("Content-Range"), offset))
+		}
+		flags |= os.O_APPEND
+		total = size
+	case http.StatusOK:
+		// The server ignored the range: start over
+		offset = 0
+		flags |= os.O_TRUNC
+		total = resp.ContentLength
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Nothing left after the partial file: it is complete if it has the
+		// size of the remote file
+		_, size, ok := contentRange(resp.Header.Get("Content-Range"))
+		if offset > 0 && ok && size == offset {
+			return os.Rename(part, path)
+		}
+		return restart(fmt.Sprintf("the partial file has %d bytes, the server %q", offset, resp.Header.Get("Content-Range")))
+	default:
+		return fmt.Errorf("download failed: HTTP %s", resp.Status)
+	}
+
+	f, err := os.OpenFile(part, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	w := &progressWriter{w: f, done: offset, total: total, progress: progress}
+	if progress != nil {
+		progress(offset, total)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		f.Close()
+		return fmt.Errorf("download interrupted after %d bytes, run again to resume: %v", w.done, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if total >= 0 && w.done != total {
+		return fmt.Errorf("download incomplete: %d of %d bytes, run again to resume", w.done, total)
+	}
+	return os.Rename(part, path)
+}
+
+// contentRange parses a Content-Range header, "bytes START-END/SIZE" or
+// "bytes */SIZE", returning -1 for a start or size that is not given
+func contentRange(header string) (start, size int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rng, total, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+	start, size = -1, -1
+	if rng != "*" {
+		first, _, _ := strings.Cut(rng, "-")
+		n, err := strconv.ParseInt(first, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		start = n
+	}
+	if total != "*" {
+		n, err := strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		size = n
+	}
+	return start, size, true
+}
+
+func (c *Client) getRange(ctx context.Context, hc *http.Client, rawURL string, offset int64) (*http.Response, error) {
+	c.logf("Downloading: %s (from byte %d)", rawURL, offset)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return hc.Do(req)
+}
+
+// progressWriter reports the bytes written through it
+type progressWriter struct {
+	w        io.Writer
+	done     int64
+	total    int64
+	progress func(done, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	if p.progress != nil {
+		p.progress(p.done, p.total)
+	}
+	return n, err
+}
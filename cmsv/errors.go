@@ -0,0 +1,163 @@
+package cmsv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Errors for the result codes documented in the "Common Error Codes" table.
+// A failed request returns a *ResultError that wraps one of these, so callers
+// can test for a condition with errors.Is and get the raw code with errors.As.
+var (
+	ErrInvalidCredentials   = errors.New("the username or password is invalid")
+	ErrUserDisabled         = errors.New("user disabled")
+	ErrUserExpired          = errors.New("the user has expired")
+	ErrSessionNotFound      = errors.New("session does not exist")
+	ErrSystem               = errors.New("system exception")
+	ErrInvalidParameters    = errors.New("the request parameters are incorrect")
+	ErrNoDevicePermission   = errors.New("no permission to operate the vehicle or equipment")
+	ErrBeginAfterEnd        = errors.New("the start time must not be greater than the end time")
+	ErrTimeOutOfRange       = errors.New("query time out of range")
+	ErrDownloadTaskExists   = errors.New("the video download task already exists")
+	ErrAccountExists        = errors.New("account already exists")
+	ErrNoPermission         = errors.New("no permission to operate")
+	ErrDeviceLimitReached   = errors.New("maximum number of managed devices reached")
+	ErrDeviceExists         = errors.New("device already exists")
+	ErrVehicleExists        = errors.New("vehicle already exists")
+	ErrDeviceInUse          = errors.New("device already in use")
+	ErrVehicleNotFound      = errors.New("vehicle not present")
+	ErrDeviceNotFound       = errors.New("device does not exist")
+	ErrDeviceNotInCompany   = errors.New("the device does not belong to the current company")
+	ErrDeviceCountMismatch  = errors.New("the number of registered devices does not match")
+	ErrNetwork              = errors.New("network connection exception")
+	ErrRuleExists           = errors.New("rule name already exists")
+	ErrRuleNotFound         = errors.New("rule does not exist")
+	ErrInfoNotFound         = errors.New("information does not exist")
+	ErrSessionExists        = errors.New("session number already exists")
+	ErrCompanyNotFound      = errors.New("company does not exist")
+	ErrDeviceOffline        = errors.New("device not online")
+	ErrAlreadyLoggedIn      = errors.New("single sign-on user, already logged in")
+	ErrUnknown              = errors.New("unknown error")
+	ErrNameInUse            = errors.New("name already in use")
+	ErrNoDeviceFeedback     = errors.New("no feedback received from the device")
+	ErrDeviceConnectionLost = errors.New("device connection lost")
+	ErrNoStoragePath        = errors.New("no storage path defined")
+)
+
+// resultCode describes one documented result code
+type resultCode struct {
+	desc string
+	err  error
+}
+
+// webResultCodes are the codes returned by the web API
+var webResultCodes = map[int]resultCode{
+	1:  {"The username or password is invalid", ErrInvalidCredentials},
+	2:  {"The username or password is invalid", ErrInvalidCredentials},
+	3:  {"User disabled", ErrUserDisabled},
+	4:  {"The user has expired", ErrUserExpired},
+	5:  {"Session does not exist", ErrSessionNotFound},
+	6:  {"System exception", ErrSystem},
+	7:  {"The request parameters are incorrect", ErrInvalidParameters},
+	8:  {"No permission to operate the vehicle or equipment", ErrNoDevicePermission},
+	9:  {"The start time must not be greater than the end time", ErrBeginAfterEnd},
+	10: {"Query time out of range", ErrTimeOutOfRange},
+	11: {"The video download task already exists", ErrDownloadTaskExists},
+	12: {"Account already exists", ErrAccountExists},
+	13: {"No permission to operate", ErrNoPermission},
+	14: {"Number of managed devices (maximum number of additions reached)", ErrDeviceLimitReached},
+	15: {"Device already exists", ErrDeviceExists},
+	16: {"Vehicle already exists", ErrVehicleExists},
+	17: {"Device already in use", ErrDeviceInUse},
+	18: {"Vehicle not present", ErrVehicleNotFound},
+	19: {"Device does not exist", ErrDeviceNotFound},
+	20: {"The device does not belong to the current company", ErrDeviceNotInCompany},
+	21: {"The number of registered devices does not match", ErrDeviceCountMismatch},
+	24: {"Network connection exception", ErrNetwork},
+	25: {"Rule name already exists", ErrRuleExists},
+	26: {"Rule does not exist", ErrRuleNotFound},
+	27: {"Information does not exist", ErrInfoNotFound},
+	28: {"Session number already exists", ErrSessionExists},
+	29: {"Company does not exist", ErrCompanyNotFound},
+	32: {"Device not online", ErrDeviceOffline},
+	34: {"Single sign-on user, already logged in", ErrAlreadyLoggedIn},
+}
+
+// serverResultCodes are the codes returned when the response carries "cmsserver":1
+var serverResultCodes = map[int]resultCode{
+	2:  {"The username or password is invalid", ErrInvalidCredentials},
+	3:  {"Invalid username or password", ErrInvalidCredentials},
+	4:  {"User disabled", ErrUserDisabled},
+	5:  {"Information does not exist", ErrInfoNotFound},
+	6:  {"Unknown error", ErrUnknown},
+	7:  {"Name already in use", ErrNameInUse},
+	21: {"Device does not exist", ErrDeviceNotFound},
+	22: {"No feedback received from the device", ErrNoDeviceFeedback},
+	23: {"Device not online", ErrDeviceOffline},
+	26: {"Device connection lost", ErrDeviceConnectionLost},
+	27: {"No storage path defined", ErrNoStoragePath},
+}
+
+// ResultError is returned when the server answers with a non-zero result code
+type ResultError struct {
+	Op     string // Operation that failed, e.g. "login"
+	Code   int    // Result code returned by the server
+	Server bool   // Code comes from the server error table ("cmsserver":1)
+}
+
+func (e *ResultError) Error() string {
+	if desc := e.Description(); desc != "" {
+		return fmt.Sprintf("%s failed: %s (result code %d)", e.Op, desc, e.Code)
+	}
+	return fmt.Sprintf("%s failed (result code %d)", e.Op, e.Code)
+}
+
+// Description returns the documented description of the result code, or an
+// empty string for undocumented codes
+func (e *ResultError) Description() string {
+	return ResultDescription(e.Code, e.Server)
+}
+
+// Unwrap returns the sentinel error for the result code, if it is documented
+func (e *ResultError) Unwrap() error {
+	if rc, ok := lookupResultCode(e.Code, e.Server); ok {
+		return rc.err
+	}
+	return nil
+}
+
+// ResultDescription returns the documented description of a web (server=false)
+// or server (server=true) result code
+func ResultDescription(code int, server bool) string {
+	rc, _ := lookupResultCode(code, server)
+	return rc.desc
+}
+
+func lookupResultCode(code int, server bool) (resultCode, bool) {
+	if server {
+		rc, ok := serverResultCodes[code]
+		return rc, ok
+	}
+	rc, ok := webResultCodes[code]
+	return rc, ok
+}
+
+// decode unmarshals an API response into v after turning a non-zero result
+// code into a *ResultError
+func decode(op string, data []byte, v any) error {
+	var base struct {
+		Result    int `json:"result"`
+		CmsServer int `json:"cmsserver"`
+	}
+	if err := json.Unmarshal(data, &base); err != nil {
+		return fmt.Errorf("%s: invalid response: %v", op, err)
+	}
+	if base.Result != 0 {
+		return &ResultError{Op: op, Code: base.Result, Server: base.CmsServer == 1}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
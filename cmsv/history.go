@@ -0,0 +1,176 @@
+package cmsv
+
+import (
+	"context"
+	"iter"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeLayout is the date-time format used by the API for query parameters
+// and timestamps
+const TimeLayout = "2006-01-02 15:04:05"
+
+// HandleStatus filters alarms by whether they have been processed
+type HandleStatus int
+
+const (
+	HandleAll         HandleStatus = iota // Processed and unprocessed alarms
+	HandleUnprocessed                     // Only alarms not yet processed
+	HandleProcessed                       // Only processed alarms
+)
+
+// AlarmHistoryQuery selects historical alarms from StandardApiAction_queryAlarmDetail
+type AlarmHistoryQuery struct {
+	DevIDNO  []string      // Device numbers; at least one is required
+	Begin    time.Time     // Start of the time range
+	End      time.Time     // End of the time range
+	Types    []int         // Alarm type codes; empty for all types
+	Handled  HandleStatus  // Processed/unprocessed filter
+	ToMap    int           // Map coordinates: 0=WGS84, 1=Google (GCJ-02), 2=Baidu (BD-09)
+	MaxRange time.Duration // Longest allowed range, checked before querying (0 = no local limit)
+	Page     int           // 1-based page number (default 1)
+	PageSize int           // Records per page (default DefaultPageSize)
+}
+
+// Validate checks the query locally before it is sent. Problems are reported
+// with the errors the server uses: ErrInvalidParameters (code 7) when no
+// device is given, ErrBeginAfterEnd (code 9) and ErrTimeOutOfRange (code 10)
+// for a missing or too long time range.
+func (q AlarmHistoryQuery) Validate() error {
+	const op = "alarm history query"
+	if len(q.DevIDNO) == 0 {
+		return &ResultError{Op: op, Code: 7}
+	}
+	if q.Begin.IsZero() || q.End.IsZero() {
+		return &ResultError{Op: op, Code: 10}
+	}
+	if q.Begin.After(q.End) {
+		return &ResultError{Op: op, Code: 9}
+	}
+	if q.MaxRange > 0 && q.End.Sub(q.Begin) > q.MaxRange {
+		return &ResultError{Op: op, Code: 10}
+	}
+	return nil
+}
+
+func (q AlarmHistoryQuery) values(jsession string) url.Values {
+	page := max(q.Page, 1)
+	pageSize := q.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+
+	params := url.Values{
+		"jsession":    {jsession},
+		"devIdno":     {strings.Join(q.DevIDNO, ",")},
+		"begintime":   {q.Begin.Format(TimeLayout)},
+		"endtime":     {q.End.Format(TimeLayout)},
+		"toMap":       {strconv.Itoa(q.ToMap)},
+		"currentPage": {strconv.Itoa(page)},
+		"pageRecords": {strconv.Itoa(pageSize)},
+	}
+	if len(q.Types) > 0 {
+		types := make([]string, len(q.Types))
+		for i, t := range q.Types {
+			types[i] = strconv.Itoa(t)
+		}
+		params.Set("armType", strings.Join(types, ","))
+	}
+	switch q.Handled {
+	case HandleUnprocessed:
+		params.Set("handle", "0")
+	case HandleProcessed:
+		params.Set("handle", "1")
+	}
+	return params
+}
+
+// AlarmDetail is a historical alarm record. An alarm spans from its start
+// to its end time, with a position recorded at both ends.
+type AlarmDetail struct {
+	GUID      string   `json:"guid"`
+	DevIDNO   string   `json:"did"`
+	VehiIDNO  string   `json:"vid"`
+	Type      int      `json:"atp"`
+	Info      int      `json:"info"`
+	Desc      string   `json:"desc"`
+	HD        int      `json:"hd"`
+	Img       string   `json:"img"`
+	P1        int      `json:"p1"`
+	P2        int      `json:"p2"`
+	P3        int      `json:"p3"`
+	P4        int      `json:"p4"`
+	BeginTime string   `json:"bTimeStr"`
+	EndTime   string   `json:"eTimeStr"`
+	StartGps  AlarmGPS `json:"sgps"`
+	EndGps    AlarmGPS `json:"egps"`
+}
+
+// Alarm converts the record to the Alarm shape used by current alarms, using
+// the start time and start position
+func (d AlarmDetail) Alarm() Alarm {
+	return Alarm{
+		DevIDNO: d.DevIDNO,
+		Desc:    d.Desc,
+		GUID:    d.GUID,
+		HD:      d.HD,
+		Img:     d.Img,
+		Info:    d.Info,
+		P1:      d.P1,
+		P2:      d.P2,
+		P3:      d.P3,
+		P4:      d.P4,
+		Time:    d.BeginTime,
+		Type:    d.Type,
+		Gps:     d.StartGps,
+	}
+}
+
+// AlarmHistoryResponse is returned by StandardApiAction_queryAlarmDetail
+type AlarmHistoryResponse struct {
+	Result     int           `json:"result"`
+	Alarms     []AlarmDetail `json:"alarms"`
+	Pagination Pagination    `json:"pagination"`
+}
+
+// AlarmHistoryPage returns one page of historical alarms
+func (c *Client) AlarmHistoryPage(ctx context.Context, jsession string, q AlarmHistoryQuery) (*AlarmHistoryResponse, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := c.getJSON(ctx, c.actionURL("queryAlarmDetail", q.values(jsession)))
+	if err != nil {
+		return nil, err
+	}
+	var res AlarmHistoryResponse
+	if err := decode("alarm history query", data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// AlarmHistoryPage returns one page of historical alarms
+func (s *Session) AlarmHistoryPage(ctx context.Context, q AlarmHistoryQuery) (*AlarmHistoryResponse, error) {
+	var res *AlarmHistoryResponse
+	err := s.Do(ctx, func(jsession string) (err error) {
+		res, err = s.client.AlarmHistoryPage(ctx, jsession, q)
+		return err
+	})
+	return res, err
+}
+
+// AlarmHistory iterates over every historical alarm matching q, starting at
+// q.Page. Pages are fetched lazily as the iteration advances.
+func (s *Session) AlarmHistory(ctx context.Context, q AlarmHistoryQuery) iter.Seq2[AlarmDetail, error] {
+	return paginate(ctx, q.Page, func(ctx context.Context, page int) ([]AlarmDetail, Pagination, error) {
+		q.Page = page
+		res, err := s.AlarmHistoryPage(ctx, q)
+		if err != nil {
+			return nil, Pagination{}, err
+		}
+		return res.Alarms, res.Pagination, nil
+	})
+}
@@ -0,0 +1,231 @@
+package cmsv
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RTSPLinkOptions contains the parameters needed to build an RTSP URL
+type RTSPLinkOptions struct {
+	ServerHost string // RTSP server hostname
+	ServerPort int    // RTSP server port (default 6604)
+	JSession   string // Session token from login
+	DevIDNO    string // Device ID number
+	Channel    int    // Channel number (starts from 0)
+	Stream     int    // Stream type (0=main stream, 1=sub stream)
+	AVType     int    // 1=live video, 2=listening
+}
+
+// GenerateRTSPLink creates a properly formatted RTSP URL for video streaming
+func GenerateRTSPLink(opts RTSPLinkOptions) string {
+	// Set default port if not specified
+	if opts.ServerPort == 0 {
+		opts.ServerPort = DefaultRTSPPort
+	}
+
+	// Default to live video if not specified
+	if opts.AVType == 0 {
+		opts.AVType = 1
+	}
+
+	// Format the RTSP URL according to the API documentation
+	return fmt.Sprintf("rtsp://%s:%d/3/3?AVType=%d&jsession=%s&DevIDNO=%s&Channel=%d&Stream=%d",
+		opts.ServerHost,
+		opts.ServerPort,
+		opts.AVType,
+		opts.JSession,
+		opts.DevIDNO,
+		opts.Channel,
+		opts.Stream)
+}
+
+// HLSLinkOptions contains the parameters needed to build an HLS URL
+type HLSLinkOptions struct {
+	ServerHost  string // HLS server hostname
+	ServerPort  int    // HLS server port (default 16604)
+	JSession    string // Session token from login
+	DevIDNO     string // Device ID number
+	Channel     int    // Channel number (starts from 0)
+	Stream      int    // Stream type (0=main stream, 1=sub stream)
+	RequestType int    // 1 for real-time video
+}
+
+// GenerateHLSLink creates a properly formatted HLS URL for video streaming
+// HLS(HTTP Live streaming) is a streaming media transmission protocol based on HTTP, which is proposed by Apple as a protocol interaction method for transmitting audio and video.
+// Provides the real- time video request address based on the HLS protocol. Currently supports h264, does not support h265.
+func GenerateHLSLink(opts HLSLinkOptions) string {
+	// Set default port if not specified
+	if opts.ServerPort == 0 {
+		opts.ServerPort = DefaultHLSPort
+	}
+
+	// Default to real-time video if not specified
+	if opts.RequestType == 0 {
+		opts.RequestType = 1
+	}
+
+	// Format the HLS URL according to the API documentation
+	return fmt.Sprintf("https://%s:%d/hls/%d_%s_%d_%d.m3u8?jsession=%s",
+		opts.ServerHost,
+		opts.ServerPort,
+		opts.RequestType,
+		opts.DevIDNO,
+		opts.Channel,
+		opts.Stream,
+		opts.JSession)
+}
+
+// RTMPLinkOptions contains the parameters needed to build an RTMP URL
+type RTMPLinkOptions struct {
+	ServerHost string // RTMP server hostname
+	ServerPort int    // RTMP server port (default 1935)
+	JSession   string // Session token from login
+	DevIDNO    string // Device ID number
+	Channel    int    // Channel number (starts from 0)
+	Stream     int    // Stream type (0=main stream, 1=sub stream)
+	AVType     int    // 1=live video, 2=listening
+}
+
+// GenerateRTMPLink creates a properly formatted RTMP URL for video streaming
+func GenerateRTMPLink(opts RTMPLinkOptions) string {
+	// Set default port if not specified
+	if opts.ServerPort == 0 {
+		opts.ServerPort = DefaultRTMPPort
+	}
+
+	// Default to live video if not specified
+	if opts.AVType == 0 {
+		opts.AVType = 1
+	}
+
+	// Format the RTMP URL according to the API documentation
+	return fmt.Sprintf("rtmp://%s:%d/3/3?AVType=%d&jsession=%s&DevIDNO=%s&Channel=%d&Stream=%d",
+		opts.ServerHost,
+		opts.ServerPort,
+		opts.AVType,
+		opts.JSession,
+		opts.DevIDNO,
+		opts.Channel,
+		opts.Stream)
+}
+
+// PlaybackLinkOptions contains the parameters needed to build the playback
+// URL of a recorded file
+type PlaybackLinkOptions struct {
+	ServerHost string    // Media server hostname
+	ServerPort int       // Media server port (default 6604)
+	JSession   string    // Session token from login
+	File       VideoFile // File found by VideoFiles
+	Begin      time.Time // Start playing here; zero plays from the start of the file
+	End        time.Time // Stop playing here; zero plays to the end of the file
+}
+
+// GeneratePlaybackLink creates the HTTP URL that streams a recorded file from
+// the media server. The server fetches files stored on the device on demand.
+func GeneratePlaybackLink(opts PlaybackLinkOptions) string {
+	// Set default port if not specified
+	if opts.ServerPort == 0 {
+		opts.ServerPort = DefaultRTSPPort
+	}
+
+	// Playback offsets are seconds from the start of the file; 0 means the whole file
+	f := opts.File
+	playBeg, playEnd := 0, 0
+	if !opts.Begin.IsZero() {
+		playBeg = max(int(opts.Begin.Sub(f.BeginTime()).Seconds()), 0)
+	}
+	if !opts.End.IsZero() {
+		playEnd = max(int(opts.End.Sub(f.BeginTime()).Seconds()), 0)
+	}
+
+	params := url.Values{
+		"DownType": {"5"}, // Playback
+		"DevIDNO":  {f.DevIDNO},
+		"FILELOC":  {strconv.Itoa(f.Loc)},
+		"FILESVR":  {strconv.Itoa(f.Svr)},
+		"FILECHN":  {strconv.Itoa(f.Channel)},
+		"FILEBEG":  {strconv.Itoa(f.Beg)},
+		"FILEEND":  {strconv.Itoa(f.End)},
+		"PLAYIFRM": {"0"},
+		"PLAYFILE": {f.File},
+		"PLAYBEG":  {strconv.Itoa(playBeg)},
+		"PLAYEND":  {strconv.Itoa(playEnd)},
+		"PLAYCHN":  {strconv.Itoa(f.Channel)},
+		"jsession": {opts.JSession},
+	}
+	return fmt.Sprintf("http://%s:%d/3/5?%s", opts.ServerHost, opts.ServerPort, params.Encode())
+}
+
+// GenerateRTSPLink fills in the server host and port from the client
+// configuration when they are not set and builds the RTSP URL
+func (c *Client) GenerateRTSPLink(opts RTSPLinkOptions) string {
+	if opts.ServerHost == "" {
+		opts.ServerHost = c.Hostname()
+	}
+	if opts.ServerPort == 0 {
+		opts.ServerPort = c.rtspPort
+	}
+	return GenerateRTSPLink(opts)
+}
+
+// GenerateRTMPLink fills in the server host and port from the client
+// configuration when they are not set and builds the RTMP URL
+func (c *Client) GenerateRTMPLink(opts RTMPLinkOptions) string {
+	if opts.ServerHost == "" {
+		opts.ServerHost = c.Hostname()
+	}
+	if opts.ServerPort == 0 {
+		opts.ServerPort = c.rtmpPort
+	}
+	return GenerateRTMPLink(opts)
+}
+
+// GenerateHLSLink fills in the server host and port from the client
+// configuration when they are not set and builds the HLS URL
+func (c *Client) GenerateHLSLink(opts HLSLinkOptions) string {
+	if opts.ServerHost == "" {
+		opts.ServerHost = c.Hostname()
+	}
+	if opts.ServerPort == 0 {
+		opts.ServerPort = c.hlsPort
+	}
+	return GenerateHLSLink(opts)
+}
+
+// GeneratePlaybackLink fills in the server host and port from the client
+// configuration when they are not set and builds the playback URL. Playback
+// uses the media server port of RTSP.
+func (c *Client) GeneratePlaybackLink(opts PlaybackLinkOptions) string {
+	if opts.ServerHost == "" {
+		opts.ServerHost = c.Hostname()
+	}
+	if opts.ServerPort == 0 {
+		opts.ServerPort = c.rtspPort
+	}
+	return GeneratePlaybackLink(opts)
+}
+
+// webPlayerURL returns the server URL over plain HTTP, which the web player requires
+func (c *Client) webPlayerURL() string {
+	return strings.Replace(c.BaseURL(), "https://", "http://", 1)
+}
+
+// PlayerLinks returns the web player and live video API links for a device
+func (c *Client) PlayerLinks(jsession, did, vid, account, password string) map[string]string {
+	return map[string]string{
+		"Web Player ID": fmt.Sprintf("%s/808gps/open/player/video.html?lang=en&devIdno=%s&account=%s&password=%s",
+			c.webPlayerURL(), did, url.QueryEscape(account), url.QueryEscape(password)),
+		"Web Player VI": fmt.Sprintf("%s/808gps/open/player/video.html?lang=en&vehiIdno=%s&account=%s&password=%s",
+			c.webPlayerURL(), vid, url.QueryEscape(account), url.QueryEscape(password)),
+		"Live API": c.actionURL("realTimeVedio", url.Values{
+			"jsession": {jsession},
+			"DevIDNO":  {did},
+			"Chn":      {"1"},
+			"Sec":      {"300"},
+			"Label":    {"test"},
+		}),
+	}
+}
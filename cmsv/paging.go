@@ -0,0 +1,49 @@
+package cmsv
+
+import (
+	"context"
+	"iter"
+)
+
+// DefaultPageSize is the number of records requested per page when a query
+// does not set one
+const DefaultPageSize = 50
+
+// pageFetcher fetches one page of records
+type pageFetcher[T any] func(ctx context.Context, page int) ([]T, Pagination, error)
+
+// paginate walks every page starting at first, fetching each page only when
+// the previous one has been consumed. Iteration stops after the last page,
+// after an empty page, or after the first error, which is yielded with a
+// zero record.
+func paginate[T any](ctx context.Context, first int, fetch pageFetcher[T]) iter.Seq2[T, error] {
+	if first < 1 {
+		first = 1
+	}
+	return func(yield func(T, error) bool) {
+		for page := first; ; page++ {
+			if err := ctx.Err(); err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+
+			records, pagination, err := fetch(ctx, page)
+			if err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+			for _, record := range records {
+				if !yield(record, nil) {
+					return
+				}
+			}
+
+			// Servers that ignore paging report no page count: everything was returned at once
+			if len(records) == 0 || pagination.TotalPages == 0 || page >= pagination.TotalPages {
+				return
+			}
+		}
+	}
+}
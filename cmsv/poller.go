@@ -0,0 +1,243 @@
+package cmsv
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultDedupCapacity is the number of alarm keys an AlarmDeduper remembers
+// when no capacity is given
+const DefaultDedupCapacity = 10000
+
+// AlarmKey returns the key alarms are de-duplicated by: the GUID, or the
+// device, type and time for records without one
+func AlarmKey(a Alarm) string {
+	if a.GUID != "" {
+		return a.GUID
+	}
+	return a.DevIDNO + "|" + a.Time + "|" + strconv.Itoa(a.Type)
+}
+
+// AlarmDeduper remembers which alarms have been seen. The oldest keys are
+// forgotten once capacity is reached. It is safe for concurrent use.
+type AlarmDeduper struct {
+	mu       sync.Mutex
+	seen     map[string]struct{}
+	order    []string // ring buffer of keys in insertion order
+	next     int
+	capacity int
+}
+
+// NewAlarmDeduper returns a deduper remembering up to capacity alarms
+// (DefaultDedupCapacity if capacity <= 0)
+func NewAlarmDeduper(capacity int) *AlarmDeduper {
+	if capacity <= 0 {
+		capacity = DefaultDedupCapacity
+	}
+	return &AlarmDeduper{
+		seen:     make(map[string]struct{}, capacity),
+		order:    make([]string, 0, capacity),
+		capacity: capacity,
+	}
+}
+
+// Filter returns the alarms not seen before, in their original order, and
+// marks them as seen. Duplicates within alarms are returned once.
+func (d *AlarmDeduper) Filter(alarms []Alarm) []Alarm {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var fresh []Alarm
+	for _, a := range alarms {
+		key := AlarmKey(a)
+		if _, ok := d.seen[key]; ok {
+			continue
+		}
+		d.add(key)
+		fresh = append(fresh, a)
+	}
+	return fresh
+}
+
+// Forget forgets the alarms, so that Filter returns them again, e.g. after
+// they failed to be stored
+func (d *AlarmDeduper) Forget(alarms []Alarm) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	forgotten := false
+	for _, a := range alarms {
+		key := AlarmKey(a)
+		if _, ok := d.seen[key]; ok {
+			delete(d.seen, key)
+			forgotten = true
+		}
+	}
+	if !forgotten {
+		return
+	}
+
+	// Drop the keys from the ring too, or an alarm seen again would be
+	// evicted early when its old slot comes up
+	order := make([]string, 0, d.capacity)
+	for _, key := range slices.Concat(d.order[d.next:], d.order[:d.next]) {
+		if _, ok := d.seen[key]; ok {
+			order = append(order, key)
+		}
+	}
+	d.order, d.next = order, 0
+}
+
+// Seen reports whether an alarm has been seen
+func (d *AlarmDeduper) Seen(a Alarm) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.seen[AlarmKey(a)]
+	return ok
+}
+
+// Reset forgets every alarm
+func (d *AlarmDeduper) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clear(d.seen)
+	d.order = d.order[:0]
+	d.next = 0
+}
+
+func (d *AlarmDeduper) add(key string) {
+	if len(d.order) < d.capacity {
+		d.order = append(d.order, key)
+	} else {
+		delete(d.seen, d.order[d.next])
+		d.order[d.next] = key
+		d.next = (d.next + 1) % d.capacity
+	}
+	d.seen[key] = struct{}{}
+}
+
+// NewAlarms is published by an AlarmPoller after every poll
+type NewAlarms struct {
+	Time   time.Time // When the poll finished
+	Alarms []Alarm   // Alarms not seen in earlier polls; empty if nothing changed
+	Err    error     // Poll error; Alarms is empty when set
+}
+
+// alarmSubscription is one subscriber of an AlarmPoller
+type alarmSubscription struct {
+	ch   chan NewAlarms
+	done chan struct{}
+}
+
+// AlarmPoller polls the current alarm list and reports only the alarms it
+// has not seen before. The first poll reports every current alarm.
+type AlarmPoller struct {
+	session *Session
+	dedup   *AlarmDeduper
+
+	mu    sync.Mutex
+	query AlarmQuery
+	subs  map[*alarmSubscription]struct{}
+}
+
+// NewAlarmPoller returns a poller for the alarms matching q. Every page of
+// the query is fetched on each poll.
+func (s *Session) NewAlarmPoller(q AlarmQuery) *AlarmPoller {
+	return &AlarmPoller{
+		session: s,
+		dedup:   NewAlarmDeduper(0),
+		query:   q,
+		subs:    make(map[*alarmSubscription]struct{}),
+	}
+}
+
+// SetQuery changes the query used by the next poll. Alarms already seen
+// stay seen.
+func (p *AlarmPoller) SetQuery(q AlarmQuery) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.query = q
+}
+
+// Subscribe returns a channel receiving the result of every poll and a
+// function that cancels the subscription. The channel is never closed.
+// Polls wait for subscribers to receive, so a subscriber must keep reading
+// until it cancels.
+func (p *AlarmPoller) Subscribe(buffer int) (<-chan NewAlarms, func()) {
+	sub := &alarmSubscription{ch: make(chan NewAlarms, buffer), done: make(chan struct{})}
+
+	p.mu.Lock()
+	p.subs[sub] = struct{}{}
+	p.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			p.mu.Lock()
+			delete(p.subs, sub)
+			p.mu.Unlock()
+			close(sub.done)
+		})
+	}
+}
+
+// Poll fetches the current alarms, publishes the result to the subscribers
+// and returns the alarms not seen before
+func (p *AlarmPoller) Poll(ctx context.Context) ([]Alarm, error) {
+	p.mu.Lock()
+	query := p.query
+	p.mu.Unlock()
+
+	var alarms []Alarm
+	var err error
+	for alarm, iterErr := range p.session.Alarms(ctx, query) {
+		if iterErr != nil {
+			err = iterErr
+			break
+		}
+		alarms = append(alarms, alarm)
+	}
+
+	event := NewAlarms{Time: time.Now(), Err: err}
+	if err == nil {
+		event.Alarms = p.dedup.Filter(alarms)
+	}
+	p.publish(ctx, event)
+	return event.Alarms, err
+}
+
+// Run polls every interval until ctx is cancelled. Poll errors are only
+// reported to the subscribers; Run returns the context error.
+func (p *AlarmPoller) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.Poll(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *AlarmPoller) publish(ctx context.Context, event NewAlarms) {
+	p.mu.Lock()
+	subs := make([]*alarmSubscription, 0, len(p.subs))
+	for sub := range p.subs {
+		subs = append(subs, sub)
+	}
+	p.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.ch <- event:
+		case <-sub.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cmsv
+
+import (
+	"strconv"
+	"testing"
+)
+
+func testAlarm(n int) Alarm {
+	return Alarm{GUID: "alarm-" + strconv.Itoa(n)}
+}
+
+func TestAlarmDeduperFilter(t *testing.T) {
+	d := NewAlarmDeduper(10)
+	fresh := d.Filter([]Alarm{testAlarm(1), testAlarm(2), testAlarm(1)})
+	if len(fresh) != 2 || fresh[0].GUID != "alarm-1" || fresh[1].GUID != "alarm-2" {
+		t.Errorf("Filter = %v, want alarm-1 and alarm-2 once", fresh)
+	}
+	if fresh := d.Filter([]Alarm{testAlarm(2), testAlarm(3)}); len(fresh) != 1 || fresh[0].GUID != "alarm-3" {
+		t.Errorf("Filter = %v, want only alarm-3", fresh)
+	}
+
+	// Records without GUID are told apart by device, time and type
+	a := Alarm{DevIDNO: "000000447007", Time: "2024-05-01 08:00:00", Type: 2}
+	b := a
+	b.Type = 11
+	if fresh := d.Filter([]Alarm{a, b, a}); len(fresh) != 2 {
+		t.Errorf("Filter = %v, want 2 alarms without GUID", fresh)
+	}
+}
+
+func TestAlarmDeduperCapacity(t *testing.T) {
+	d := NewAlarmDeduper(3)
+	for n := 1; n <= 4; n++ {
+		d.Filter([]Alarm{testAlarm(n)})
+	}
+	if d.Seen(testAlarm(1)) {
+		t.Error("the oldest alarm is still remembered past the capacity")
+	}
+	for n := 2; n <= 4; n++ {
+		if !d.Seen(testAlarm(n)) {
+			t.Errorf("alarm-%d is forgotten", n)
+		}
+	}
+}
+
+func TestAlarmDeduperForget(t *testing.T) {
+	d := NewAlarmDeduper(4)
+	d.Filter([]Alarm{testAlarm(1), testAlarm(2), testAlarm(3)})
+	d.Forget([]Alarm{testAlarm(1), testAlarm(9)})
+	if d.Seen(testAlarm(1)) {
+		t.Fatal("a forgotten alarm is still seen")
+	}
+	if fresh := d.Filter([]Alarm{testAlarm(1), testAlarm(2)}); len(fresh) != 1 || fresh[0].GUID != "alarm-1" {
+		t.Fatalf("Filter = %v, want the forgotten alarm-1 again", fresh)
+	}
+
+	// alarm-1 is now the newest key: filling the ring evicts alarm-2 first,
+	// not alarm-1 through the slot it had before Forget
+	d.Filter([]Alarm{testAlarm(4), testAlarm(5)})
+	if !d.Seen(testAlarm(1)) {
+		t.Error("alarm-1 was evicted through the slot it had before Forget")
+	}
+	if d.Seen(testAlarm(2)) {
+		t.Error("alarm-2 is still remembered past the capacity")
+	}
+	if fresh := d.Filter([]Alarm{testAlarm(1)}); len(fresh) != 0 {
+		t.Errorf("Filter = %v, want alarm-1 reported only once", fresh)
+	}
+}
+
+func TestAlarmDeduperReset(t *testing.T) {
+	d := NewAlarmDeduper(3)
+	d.Filter([]Alarm{testAlarm(1), testAlarm(2)})
+	d.Reset()
+	if fresh := d.Filter([]Alarm{testAlarm(1), testAlarm(2)}); len(fresh) != 2 {
+		t.Errorf("Filter after Reset = %v, want both alarms", fresh)
+	}
+}
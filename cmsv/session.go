@@ -0,0 +1,180 @@
+package cmsv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// SessionLifetime is how long the server keeps an idle jsession alive. The
+// lifetime is extended every time the session is used.
+const SessionLifetime = 4 * time.Hour
+
+// Session shares one jsession between all calls made with the same
+// credentials. It logs in lazily, logs in again once the session has been
+// idle for longer than SessionLifetime, and transparently retries a request
+// after re-login when the server reports that the session does not exist
+// (result code 5). A Session is safe for concurrent use.
+type Session struct {
+	client   *Client
+	account  string
+	password string
+
+	mu       sync.Mutex
+	jsession string
+	lastUsed time.Time
+	lifetime time.Duration
+	now      func() time.Time
+}
+
+// NewSession creates a session manager for the given credentials. No
+// request is made until the session is first used.
+func (c *Client) NewSession(account, password string) *Session {
+	return &Session{
+		client:   c,
+		account:  account,
+		password: password,
+		lifetime: SessionLifetime,
+		now:      time.Now,
+	}
+}
+
+// Client returns the client the session belongs to
+func (s *Session) Client() *Client {
+	return s.client
+}
+
+// Account returns the account the session logs in with
+func (s *Session) Account() string {
+	return s.account
+}
+
+// SetJSession seeds the session with an existing jsession, for example one
+// obtained by an earlier process. It is replaced by a fresh login once it
+// expires, provided the session has credentials.
+func (s *Session) SetJSession(jsession string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jsession = jsession
+	s.lastUsed = s.now()
+}
+
+// Login forces a new login and replaces the current jsession
+func (s *Session) Login(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loginLocked(ctx)
+}
+
+func (s *Session) loginLocked(ctx context.Context) (string, error) {
+	if s.account == "" {
+		return "", errors.New("cmsv: session has no credentials to log in with")
+	}
+	jsession, err := s.client.Login(ctx, s.account, s.password)
+	if err != nil {
+		return "", err
+	}
+	s.jsession = jsession
+	s.lastUsed = s.now()
+	return jsession, nil
+}
+
+// JSession returns a jsession that is expected to be valid, logging in if
+// there is none yet or the current one has been idle for too long
+func (s *Session) JSession(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.jsession != "" && s.now().Sub(s.lastUsed) < s.lifetime {
+		return s.jsession, nil
+	}
+	if s.jsession != "" && s.account == "" {
+		// Seeded without credentials: let the server decide whether it is still valid
+		return s.jsession, nil
+	}
+	return s.loginLocked(ctx)
+}
+
+// touch records that jsession was used successfully
+func (s *Session) touch(jsession string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jsession == jsession {
+		s.lastUsed = s.now()
+	}
+}
+
+// invalidate forgets jsession unless another caller already replaced it
+func (s *Session) invalidate(jsession string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jsession == jsession {
+		s.jsession = ""
+	}
+}
+
+// Do runs fn with a valid jsession. If fn fails because the session does not
+// exist on the server, the session logs in again and fn is retried once.
+func (s *Session) Do(ctx context.Context, fn func(jsession string) error) error {
+	jsession, err := s.JSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(jsession)
+	if errors.Is(err, ErrSessionNotFound) && s.account != "" {
+		s.invalidate(jsession)
+		if jsession, err = s.JSession(ctx); err != nil {
+			return err
+		}
+		err = fn(jsession)
+	}
+	if err == nil {
+		s.touch(jsession)
+	}
+	return err
+}
+
+// Logout ends the session on the server
+func (s *Session) Logout(ctx context.Context) error {
+	s.mu.Lock()
+	jsession := s.jsession
+	s.jsession = ""
+	s.mu.Unlock()
+
+	if jsession == "" {
+		return nil
+	}
+	return s.client.Logout(ctx, jsession)
+}
+
+// Devices returns the online status of all devices
+func (s *Session) Devices(ctx context.Context) ([]Device, error) {
+	var devices []Device
+	err := s.Do(ctx, func(jsession string) (err error) {
+		devices, err = s.client.Devices(ctx, jsession)
+		return err
+	})
+	return devices, err
+}
+
+// VehicleInfo returns the companies and vehicles visible to the account
+func (s *Session) VehicleInfo(ctx context.Context) (*VehicleResponse, error) {
+	var info *VehicleResponse
+	err := s.Do(ctx, func(jsession string) (err error) {
+		info, err = s.client.VehicleInfo(ctx, jsession)
+		return err
+	})
+	return info, err
+}
+
+// Channels returns the video channels of a device with their names, from the
+// vehicle information
+func (s *Session) Channels(ctx context.Context, devIDNO string) ([]Channel, error) {
+	info, err := s.VehicleInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return DeviceChannels(info, devIDNO), nil
+}
@@ -0,0 +1,148 @@
+package cmsv_test
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/simulator"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// simulate starts a simulated CMSV server that accepts account demo with
+// password secret
+func simulate(t *testing.T) (*simulator.Simulator, *cmsv.Client) {
+	t.Helper()
+	fleet := simulator.DefaultFleet()
+	fleet.Account, fleet.Password = "demo", "secret"
+	sim := simulator.New(simulator.Options{Fleet: &fleet, Start: time.Date(2024, 5, 1, 8, 0, 0, 0, time.Local), Seed: 1})
+	srv := httptest.NewServer(sim)
+	t.Cleanup(srv.Close)
+	client, err := cmsv.NewClient(cmsv.Options{BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sim, client
+}
+
+func TestSimulatorLogin(t *testing.T) {
+	_, client := simulate(t)
+	ctx := context.Background()
+
+	if _, err := client.NewSession("demo", "wrong").Login(ctx); !errors.Is(err, cmsv.ErrInvalidCredentials) {
+		t.Errorf("Login with a wrong password: %v, want ErrInvalidCredentials", err)
+	}
+
+	session := client.NewSession("demo", "secret")
+	jsession, err := session.Login(ctx)
+	if err != nil || jsession == "" {
+		t.Fatalf("Login = %q, %v", jsession, err)
+	}
+	if got, err := session.JSession(ctx); err != nil || got != jsession {
+		t.Errorf("JSession = %q, %v; want the login jsession %q", got, err, jsession)
+	}
+	devices, err := session.Devices(ctx)
+	if err != nil || len(devices) != 3 {
+		t.Errorf("Devices = %v, %v; want the 3 devices of the fleet", devices, err)
+	}
+}
+
+func TestSimulatorAlarmPages(t *testing.T) {
+	sim, client := simulate(t)
+	ctx := context.Background()
+	session := client.NewSession("demo", "secret")
+
+	var guids []string
+	for i := range 7 {
+		device := "013300000001"
+		if i%2 == 1 {
+			device = "013300000002"
+		}
+		guid, err := sim.RaiseAlarm(device, 2, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		guids = append(guids, guid)
+	}
+
+	res, err := session.AlarmPage(ctx, cmsv.AlarmQuery{Page: 3, PageSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := cmsv.Pagination{TotalPages: 3, CurrentPage: 3, PageRecords: 3, TotalRecords: 7}
+	if res.Pagination != want || len(res.AlarmList) != 1 {
+		t.Errorf("page 3 = %d alarms, %+v; want 1 alarm, %+v", len(res.AlarmList), res.Pagination, want)
+	}
+
+	// Alarms walks all pages, newest alarm first
+	var got []string
+	for a, err := range session.Alarms(ctx, cmsv.AlarmQuery{PageSize: 3}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, a.GUID)
+	}
+	if len(got) != len(guids) {
+		t.Fatalf("Alarms = %d alarms, want %d", len(got), len(guids))
+	}
+	for i, guid := range got {
+		if want := guids[len(guids)-1-i]; guid != want {
+			t.Errorf("alarm %d = %s, want %s", i, guid, want)
+		}
+	}
+
+	// Stopping early fetches no further pages: the fault injected during the
+	// first page is still there afterwards
+	for _, err := range session.Alarms(ctx, cmsv.AlarmQuery{DevIDNO: "013300000002", PageSize: 2}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		sim.InjectFault(simulator.Fault{Action: "vehicleAlarm", Code: 6, Count: 1})
+		break
+	}
+	if _, err := session.AlarmPage(ctx, cmsv.AlarmQuery{}); !errors.Is(err, cmsv.ErrSystem) {
+		t.Errorf("AlarmPage after stopping early: %v, want the unused fault", err)
+	}
+}
+
+func TestSimulatorSessionExpiry(t *testing.T) {
+	sim, client := simulate(t)
+	ctx := context.Background()
+	session := client.NewSession("demo", "secret")
+	if _, err := sim.RaiseAlarm("013300000001", 2, ""); err != nil {
+		t.Fatal(err)
+	}
+	before, err := session.Login(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server reports the session as gone once: the session logs in
+	// again and retries the request
+	sim.InjectFault(simulator.Fault{Action: "vehicleAlarm", Code: 5, Count: 1})
+	res, err := session.AlarmPage(ctx, cmsv.AlarmQuery{})
+	if err != nil || len(res.AlarmList) != 1 {
+		t.Fatalf("AlarmPage after the session expired = %v, %v", res, err)
+	}
+	after, err := session.JSession(ctx)
+	if err != nil || after == before {
+		t.Errorf("jsession %q after the expiry, want a new one instead of %q", after, before)
+	}
+
+	// The old jsession really is gone on the server
+	sim.ExpireSessions()
+	if _, err := client.AlarmPage(ctx, after, cmsv.AlarmQuery{}); !errors.Is(err, cmsv.ErrSessionNotFound) {
+		t.Errorf("AlarmPage with an expired jsession: %v, want ErrSessionNotFound", err)
+	}
+	if _, err := session.AlarmPage(ctx, cmsv.AlarmQuery{}); err != nil {
+		t.Errorf("AlarmPage after ExpireSessions: %v", err)
+	}
+
+	// A session seeded without credentials cannot log in again
+	seeded := client.NewSession("", "")
+	seeded.SetJSession(after)
+	if _, err := seeded.AlarmPage(ctx, cmsv.AlarmQuery{}); !errors.Is(err, cmsv.ErrSessionNotFound) {
+		t.Errorf("AlarmPage of a seeded session: %v, want ErrSessionNotFound", err)
+	}
+}
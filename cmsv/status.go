@@ -0,0 +1,333 @@
+package cmsv
+
+import (
+	"cmsv_api/geo"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// EquipmentStatus represents the bit-by-bit status flags for equipment
+type EquipmentStatus struct {
+	// S1 flags (32 bits)
+	GPSValid           bool // s1:0 - GPS positioning status (0=invalid, 1=valid)
+	ACCStatus          bool // s1:1 - ACC status (0=off, 1=on)
+	LeftTurn           bool // s1:2 - Left turn status
+	RightTurn          bool // s1:3 - Right turn status
+	FatigueWarning     bool // s1:4 - Fatigue driving warning
+	ForwardRotation    bool // s1:5 - Positive rotation state
+	ReverseState       bool // s1:6 - Reverse state
+	GPSAntennaPresent  bool // s1:7 - GPS antenna present
+	HardDriveStatus    int  // s1:8-9 - Hard drive status (0=not present, 1=present, 2=power down)
+	ThreeGModuleStatus int  // s1:10-12 - 3G module status (0-5)
+	QuiescentState     bool // s1:13 - Quiescent state
+	OverspeedState     bool // s1:14 - Overspeed state
+	GPSSupplement      bool // s1:15 - GPS supplement
+	BatteryStatus      bool // s1:16 - Battery status
+	NightState         bool // s1:17 - Night state
+	OvercrowdingStatus bool // s1:18 - Overcrowding status
+	ParkingACCStatus   bool // s1:19 - Parking ACC status
+	IO1Status          bool // s1:20 - IO1 status
+	IO2Status          bool // s1:21 - IO2 status
+	IO3Status          bool // s1:22 - IO3 status
+	IO4Status          bool // s1:23 - IO4 status
+	IO5Status          bool // s1:24 - IO5 status
+	IO6Status          bool // s1:25 - IO6 status
+	IO7Status          bool // s1:26 - IO7 status
+	IO8Status          bool // s1:27 - IO8 status
+	Drive2Status       bool // s1:28 - Drive 2 status
+	HardDisk2Status    int  // s1:29-30 - Hard disk 2 status
+	HardDiskInvalid    bool // s1:31 - Hard disk status
+
+	// S2 flags (32 bits)
+	OutOfAreaAlarm            bool // s2:0 - Out of area alarm
+	LineAlarm                 bool // s2:1 - Line alarm
+	HighSpeedInAreaAlarm      bool // s2:2 - High speed in area
+	LowSpeedInAreaAlarm       bool // s2:3 - Low speed in area
+	HighSpeedOutsideAreaAlarm bool // s2:4 - High speed outside area
+	LowSpeedOutsideAreaAlarm  bool // s2:5 - Low speed outside area
+	ParkingInAreaAlarm        bool // s2:6 - Parking in area alarm
+	OutOfAreaParkingAlarm     bool // s2:7 - Out of area parking alarm
+	DailyFlowWarning          bool // s2:8 - Daily flow warning
+	DailyFlowExceeded         bool // s2:9 - Daily flow exceeded
+	MonthlyTrafficWarning     bool // s2:10 - Monthly traffic warning
+	MonthlyFlowExceeded       bool // s2:11 - Monthly flow exceeded
+	BackupBatteryPowered      bool // s2:12 - Host powered by backup battery
+	DoorOpen                  bool // s2:13 - Door open
+	VehicleFortification      bool // s2:14 - Vehicle fortification
+	BatteryVoltageLow         bool // s2:15 - Battery voltage too low
+	EngineStatus              bool // s2:17 - Engine status
+	LastValidGPSInfo          bool // s2:18 - Last valid GPS information
+	OnBoardStatus             bool // s2:19 - On board status (0=no load, 1=heavy load)
+	OperationStatus           bool // s2:20 - Operation status (1=shutdown)
+	LatLngNotEncrypted        bool // s2:21 - Latitude and longitude not encrypted
+	NormalOilCircuit          bool // s2:22 - Normal oil circuit (1=disconnected)
+	CircuitOK                 bool // s2:23 - Circuit OK (1=disconnected)
+	DoorUnlock                bool // s2:24 - Door unlock (1=locked)
+	AreaOverspeedPlatform     bool // s2:25 - Area overspeed alarm (platform)
+	AreaOverspeedPlatform2    bool // s2:26 - Area overspeed alarm (platform)
+	IntoAreaAlarm             bool // s2:27 - Into area alarm (platform)
+	LineOffset                bool // s2:28 - Line offset (platform)
+	TimePeriodOverspeed       bool // s2:29 - Time period overspeed (platform)
+	TimePeriodLowSpeed        bool // s2:30 - Time period low speed (platform)
+	FatigueDriving            bool // s2:31 - Fatigue driving (platform)
+
+	// S3 flags (32 bits)
+	VideoLostChannels    uint8 // s3:0-7 - Channel video lost
+	VideoChannels        uint8 // s3:8-15 - Channel video
+	IOInputs916          uint8 // s3:16-23 - IO inputs 9-16
+	IOOutput14           uint8 // s3:24-27 - IO output 1-4
+	PositioningType      uint8 // s3:28-29 - Positioning (0=GPS, 1=base station, 2=WiFi)
+	AbnormalDrivingState bool  // s3:30 - Abnormal driving state (passenger cars forbidden)
+	MountainForbidden    bool  // s3:31 - Mountain forbidden line
+
+	// S4 flags (32 bits)
+	PositioningCoordType      uint8 // s4:0-2 - Positioning type (0=WGS84, 1=GCJ-02, 2=BD09)
+	EmergencyAlarm            bool  // s4:3 - Emergency alarm
+	AreaOverspeedAlarm        bool  // s4:4 - Area overspeed alarm
+	FatigueDrivingReport      bool  // s4:5 - Fatigue driving report
+	DangerousDrivingAlarm     bool  // s4:6 - Dangerous driving behavior alarm
+	GNSSModuleFault           bool  // s4:7 - GNSS module fault alarm
+	GNSSAntennaDisconnected   bool  // s4:8 - GNSS antenna not connected/cut off
+	GNSSAntennaShortCircuit   bool  // s4:9 - GNSS antenna short circuit
+	TerminalLCDFault          bool  // s4:10 - Terminal LCD/display failure
+	TTSModuleFault            bool  // s4:11 - TTS module fault
+	CameraFailure             bool  // s4:12 - Camera failure
+	CumulativeDrivingOvertime bool  // s4:13 - Cumulative driving overtime
+	OvertimeParking           bool  // s4:14 - Overtime parking
+	IntoArea                  bool  // s4:15 - Into area
+	RouteAlarm                bool  // s4:16 - Route alarm
+	TravelTimeAbnormal        bool  // s4:17 - Insufficient/excessive travel time
+	RouteDeviationAlarm       bool  // s4:18 - Route deviation alarm
+	VSSFailure                bool  // s4:19 - Vehicle VSS failure
+	FuelQuantityAbnormal      bool  // s4:20 - Abnormal fuel quantity
+	VehicleTheftAlarm         bool  // s4:21 - Vehicle theft alarm
+	IllegalIgnitionAlarm      bool  // s4:22 - Illegal ignition alarm
+	IllegalDisplacementAlarm  bool  // s4:23 - Illegal displacement alarm
+	CollisionRolloverAlarm    bool  // s4:24 - Collision rollover alarm
+	OvertimeStop              bool  // s4:25 - Overtime stop (platform)
+	KeyPointNotReachedAlarm   bool  // s4:26 - Key point not reached (platform)
+	LineOverspeedAlarm        bool  // s4:27 - Line overspeed alarm (platform)
+	LineLowSpeedAlarm         bool  // s4:28 - Line low speed alarm (platform)
+	RoadOverspeedAlarm        bool  // s4:29 - Road overspeed alarm (platform)
+	OutOfAreaAlarmPlatform    bool  // s4:30 - Out of area alarm (platform)
+	KeyPointNotLeaveAlarm     bool  // s4:31 - Key points not leave alarm (platform)
+}
+
+// ParseEquipmentStatus parses the s1, s2, s3, s4 integers into a structured EquipmentStatus
+func ParseEquipmentStatus(s1, s2, s3, s4 int) EquipmentStatus {
+	status := EquipmentStatus{}
+
+	// Parse S1 flags
+	status.GPSValid = (s1 & 0x01) != 0
+	status.ACCStatus = (s1 & 0x02) != 0
+	status.LeftTurn = (s1 & 0x04) != 0
+	status.RightTurn = (s1 & 0x08) != 0
+	status.FatigueWarning = (s1 & 0x10) != 0
+	status.ForwardRotation = (s1 & 0x20) != 0
+	status.ReverseState = (s1 & 0x40) != 0
+	status.GPSAntennaPresent = (s1 & 0x80) != 0
+	status.HardDriveStatus = (s1 >> 8) & 0x03
+	status.ThreeGModuleStatus = (s1 >> 10) & 0x07
+	status.QuiescentState = (s1 & 0x2000) != 0
+	status.OverspeedState = (s1 & 0x4000) != 0
+	status.GPSSupplement = (s1 & 0x8000) != 0
+	status.BatteryStatus = (s1 & 0x10000) != 0
+	status.NightState = (s1 & 0x20000) != 0
+	status.OvercrowdingStatus = (s1 & 0x40000) != 0
+	status.ParkingACCStatus = (s1 & 0x80000) != 0
+	status.IO1Status = (s1 & 0x100000) != 0
+	status.IO2Status = (s1 & 0x200000) != 0
+	status.IO3Status = (s1 & 0x400000) != 0
+	status.IO4Status = (s1 & 0x800000) != 0
+	status.IO5Status = (s1 & 0x1000000) != 0
+	status.IO6Status = (s1 & 0x2000000) != 0
+	status.IO7Status = (s1 & 0x4000000) != 0
+	status.IO8Status = (s1 & 0x8000000) != 0
+	status.Drive2Status = (s1 & 0x10000000) != 0
+	status.HardDisk2Status = (s1 >> 29) & 0x03
+	status.HardDiskInvalid = (s1 & 0x80000000) != 0
+
+	// Parse S2 flags
+	status.OutOfAreaAlarm = (s2 & 0x01) != 0
+	status.LineAlarm = (s2 & 0x02) != 0
+	status.HighSpeedInAreaAlarm = (s2 & 0x04) != 0
+	status.LowSpeedInAreaAlarm = (s2 & 0x08) != 0
+	status.HighSpeedOutsideAreaAlarm = (s2 & 0x10) != 0
+	status.LowSpeedOutsideAreaAlarm = (s2 & 0x20) != 0
+	status.ParkingInAreaAlarm = (s2 & 0x40) != 0
+	status.OutOfAreaParkingAlarm = (s2 & 0x80) != 0
+	status.DailyFlowWarning = (s2 & 0x100) != 0
+	status.DailyFlowExceeded = (s2 & 0x200) != 0
+	status.MonthlyTrafficWarning = (s2 & 0x400) != 0
+	status.MonthlyFlowExceeded = (s2 & 0x800) != 0
+	status.BackupBatteryPowered = (s2 & 0x1000) != 0
+	status.DoorOpen = (s2 & 0x2000) != 0
+	status.VehicleFortification = (s2 & 0x4000) != 0
+	status.BatteryVoltageLow = (s2 & 0x8000) != 0
+	status.EngineStatus = (s2 & 0x20000) != 0
+	status.LastValidGPSInfo = (s2 & 0x40000) != 0
+	status.OnBoardStatus = (s2 & 0x80000) != 0
+	status.OperationStatus = (s2 & 0x100000) != 0
+	status.LatLngNotEncrypted = (s2 & 0x200000) != 0
+	status.NormalOilCircuit = (s2 & 0x400000) != 0
+	status.CircuitOK = (s2 & 0x800000) != 0
+	status.DoorUnlock = (s2 & 0x1000000) != 0
+	status.AreaOverspeedPlatform = (s2 & 0x2000000) != 0
+	status.AreaOverspeedPlatform2 = (s2 & 0x4000000) != 0
+	status.IntoAreaAlarm = (s2 & 0x8000000) != 0
+	status.LineOffset = (s2 & 0x10000000) != 0
+	status.TimePeriodOverspeed = (s2 & 0x20000000) != 0
+	status.TimePeriodLowSpeed = (s2 & 0x40000000) != 0
+	status.FatigueDriving = (s2 & 0x80000000) != 0
+
+	// Parse S3 flags
+	status.VideoLostChannels = uint8(s3 & 0xFF)
+	status.VideoChannels = uint8((s3 >> 8) & 0xFF)
+	status.IOInputs916 = uint8((s3 >> 16) & 0xFF)
+	status.IOOutput14 = uint8((s3 >> 24) & 0x0F)
+	status.PositioningType = uint8((s3 >> 28) & 0x03)
+	status.AbnormalDrivingState = (s3 & 0x40000000) != 0
+	status.MountainForbidden = (s3 & 0x80000000) != 0
+
+	// Parse S4 flags
+	status.PositioningCoordType = uint8(s4 & 0x07)
+	status.EmergencyAlarm = (s4 & 0x08) != 0
+	status.AreaOverspeedAlarm = (s4 & 0x10) != 0
+	status.FatigueDrivingReport = (s4 & 0x20) != 0
+	status.DangerousDrivingAlarm = (s4 & 0x40) != 0
+	status.GNSSModuleFault = (s4 & 0x80) != 0
+	status.GNSSAntennaDisconnected = (s4 & 0x100) != 0
+	status.GNSSAntennaShortCircuit = (s4 & 0x200) != 0
+	status.TerminalLCDFault = (s4 & 0x400) != 0
+	status.TTSModuleFault = (s4 & 0x800) != 0
+	status.CameraFailure = (s4 & 0x1000) != 0
+	status.CumulativeDrivingOvertime = (s4 & 0x2000) != 0
+	status.OvertimeParking = (s4 & 0x4000) != 0
+	status.IntoArea = (s4 & 0x8000) != 0
+	status.RouteAlarm = (s4 & 0x10000) != 0
+	status.TravelTimeAbnormal = (s4 & 0x20000) != 0
+	status.RouteDeviationAlarm = (s4 & 0x40000) != 0
+	status.VSSFailure = (s4 & 0x80000) != 0
+	status.FuelQuantityAbnormal = (s4 & 0x100000) != 0
+	status.VehicleTheftAlarm = (s4 & 0x200000) != 0
+	status.IllegalIgnitionAlarm = (s4 & 0x400000) != 0
+	status.IllegalDisplacementAlarm = (s4 & 0x800000) != 0
+	status.CollisionRolloverAlarm = (s4 & 0x1000000) != 0
+	status.OvertimeStop = (s4 & 0x2000000) != 0
+	status.KeyPointNotReachedAlarm = (s4 & 0x4000000) != 0
+	status.LineOverspeedAlarm = (s4 & 0x8000000) != 0
+	status.LineLowSpeedAlarm = (s4 & 0x10000000) != 0
+	status.RoadOverspeedAlarm = (s4 & 0x20000000) != 0
+	status.OutOfAreaAlarmPlatform = (s4 & 0x40000000) != 0
+	status.KeyPointNotLeaveAlarm = (s4 & 0x80000000) != 0
+
+	return status
+}
+
+// StatusDescription returns a short human-readable summary of the most relevant
+// status flags and alarms
+func StatusDescription(status EquipmentStatus) string {
+	var descriptions []string
+
+	// Build status descriptions for relevant flags
+	if status.GPSValid {
+		descriptions = append(descriptions, "GPS Valid")
+	}
+
+	if status.ACCStatus {
+		descriptions = append(descriptions, "ACC On")
+	}
+
+	if status.LeftTurn {
+		descriptions = append(descriptions, "Left Turn")
+	}
+
+	if status.RightTurn {
+		descriptions = append(descriptions, "Right Turn")
+	}
+
+	if status.QuiescentState {
+		descriptions = append(descriptions, "Quiescent")
+	}
+
+	if status.OverspeedState {
+		descriptions = append(descriptions, "Overspeeding")
+	}
+
+	if status.BatteryStatus {
+		descriptions = append(descriptions, "Battery Low")
+	}
+
+	if status.NightState {
+		descriptions = append(descriptions, "Night Mode")
+	}
+
+	if status.DoorOpen {
+		descriptions = append(descriptions, "Door Open")
+	}
+
+	// Add important alarms
+	var alarms []string
+	if status.EmergencyAlarm {
+		alarms = append(alarms, "Emergency")
+	}
+	if status.AreaOverspeedAlarm {
+		alarms = append(alarms, "Area Overspeed")
+	}
+	if status.FatigueDrivingReport {
+		alarms = append(alarms, "Fatigue Driving")
+	}
+	if status.DangerousDrivingAlarm {
+		alarms = append(alarms, "Dangerous Driving")
+	}
+	if status.VehicleTheftAlarm {
+		alarms = append(alarms, "Vehicle Theft")
+	}
+	if status.IllegalIgnitionAlarm {
+		alarms = append(alarms, "Illegal Ignition")
+	}
+	if status.CollisionRolloverAlarm {
+		alarms = append(alarms, "Collision/Rollover")
+	}
+
+	if len(alarms) > 0 {
+		descriptions = append(descriptions, fmt.Sprintf("ALARMS: %s", strings.Join(alarms, ", ")))
+	}
+
+	return strings.Join(descriptions, ", ")
+}
+
+// Datum returns the datum of the device's raw position from the
+// PositioningCoordType bits. Unknown values are treated as WGS84.
+func (status EquipmentStatus) Datum() geo.Datum {
+	d := geo.Datum(status.PositioningCoordType)
+	if !d.Valid() {
+		return geo.WGS84
+	}
+	return d
+}
+
+// ActiveFlags lists the set flags of the status by field name. Multi-bit
+// fields with a non-zero value are listed as "Name=value".
+func (status EquipmentStatus) ActiveFlags() []string {
+	var flags []string
+
+	v := reflect.ValueOf(status)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Bool:
+			if field.Bool() {
+				flags = append(flags, t.Field(i).Name)
+			}
+		case reflect.Int, reflect.Uint8:
+			if !field.IsZero() {
+				flags = append(flags, fmt.Sprintf("%s=%v", t.Field(i).Name, field.Interface()))
+			}
+		}
+	}
+
+	return flags
+}
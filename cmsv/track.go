@@ -0,0 +1,218 @@
+package cmsv
+
+import (
+	"cmsv_api/geo"
+	"context"
+	"iter"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrackQuery selects the GPS track of one device from StandardApiAction_queryTrackDetail
+type TrackQuery struct {
+	DevIDNO    string        // Device number (required)
+	Begin      time.Time     // Start of the time range
+	End        time.Time     // End of the time range
+	DistanceKm float64       // Skip points closer than this to the previous one (0 = every point)
+	ParkTime   time.Duration // Only report stops of at least this long (0 = server default)
+	GeoAddress bool          // Resolve the address of every point (slow)
+	ToMap      int           // Map coordinates: 0=WGS84, 1=Google (GCJ-02), 2=Baidu (BD-09)
+	MaxRange   time.Duration // Longest allowed range, checked before querying (0 = no local limit)
+	Page       int           // 1-based page number (default 1)
+	PageSize   int           // Records per page (default DefaultPageSize)
+}
+
+// Validate checks the query locally before it is sent, with the same errors
+// as AlarmHistoryQuery.Validate
+func (q TrackQuery) Validate() error {
+	const op = "track query"
+	if q.DevIDNO == "" {
+		return &ResultError{Op: op, Code: 7}
+	}
+	if q.Begin.IsZero() || q.End.IsZero() {
+		return &ResultError{Op: op, Code: 10}
+	}
+	if q.Begin.After(q.End) {
+		return &ResultError{Op: op, Code: 9}
+	}
+	if q.MaxRange > 0 && q.End.Sub(q.Begin) > q.MaxRange {
+		return &ResultError{Op: op, Code: 10}
+	}
+	return nil
+}
+
+func (q TrackQuery) values(jsession string) url.Values {
+	page := max(q.Page, 1)
+	pageSize := q.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+
+	params := url.Values{
+		"jsession":    {jsession},
+		"devIdno":     {q.DevIDNO},
+		"begintime":   {q.Begin.Format(TimeLayout)},
+		"endtime":     {q.End.Format(TimeLayout)},
+		"distance":    {strconv.FormatFloat(q.DistanceKm, 'f', -1, 64)},
+		"toMap":       {strconv.Itoa(q.ToMap)},
+		"currentPage": {strconv.Itoa(page)},
+		"pageRecords": {strconv.Itoa(pageSize)},
+	}
+	if q.ParkTime > 0 {
+		params.Set("parkTime", strconv.Itoa(int(q.ParkTime.Seconds())))
+	}
+	if q.GeoAddress {
+		params.Set("geoaddress", "1")
+	}
+	return params
+}
+
+// TrackPoint is one recorded position. Track records carry the same fields
+// as a device status, so all DeviceStatus helpers apply.
+type TrackPoint struct {
+	DeviceStatus
+}
+
+// Time returns the GPS time of the point in local time, or the zero time if
+// it cannot be parsed
+func (p TrackPoint) Time() time.Time {
+	gt, _, _ := strings.Cut(strings.TrimSpace(p.GT), ".")
+	t, err := time.ParseInLocation(TimeLayout, gt, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// TrackResponse is returned by StandardApiAction_queryTrackDetail
+type TrackResponse struct {
+	Result     int          `json:"result"`
+	Tracks     []TrackPoint `json:"tracks"`
+	Pagination Pagination   `json:"pagination"`
+}
+
+// TrackPage returns one page of track points
+func (c *Client) TrackPage(ctx context.Context, jsession string, q TrackQuery) (*TrackResponse, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := c.getJSON(ctx, c.actionURL("queryTrackDetail", q.values(jsession)))
+	if err != nil {
+		return nil, err
+	}
+	var res TrackResponse
+	if err := decode("track query", data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// TrackPage returns one page of track points
+func (s *Session) TrackPage(ctx context.Context, q TrackQuery) (*TrackResponse, error) {
+	var res *TrackResponse
+	err := s.Do(ctx, func(jsession string) (err error) {
+		res, err = s.client.TrackPage(ctx, jsession, q)
+		return err
+	})
+	return res, err
+}
+
+// TrackPoints iterates over every track point matching q, starting at
+// q.Page. Pages are fetched lazily as the iteration advances.
+func (s *Session) TrackPoints(ctx context.Context, q TrackQuery) iter.Seq2[TrackPoint, error] {
+	return paginate(ctx, q.Page, func(ctx context.Context, page int) ([]TrackPoint, Pagination, error) {
+		q.Page = page
+		res, err := s.TrackPage(ctx, q)
+		if err != nil {
+			return nil, Pagination{}, err
+		}
+		return res.Tracks, res.Pagination, nil
+	})
+}
+
+// Track fetches every page of a track query
+func (s *Session) Track(ctx context.Context, q TrackQuery) (*Track, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	var points []TrackPoint
+	for p, err := range s.TrackPoints(ctx, q) {
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return NewTrack(q.DevIDNO, q.Begin, q.End, q.ToMap, points), nil
+}
+
+// Track is the recorded route of a device over a time range, in time order
+type Track struct {
+	Device string
+	Begin  time.Time
+	End    time.Time
+	ToMap  int // Datum of the points' mlat/mlng
+	Points []TrackPoint
+}
+
+// NewTrack creates a track, sorting the points by time
+func NewTrack(device string, begin, end time.Time, toMap int, points []TrackPoint) *Track {
+	points = slices.Clone(points)
+	slices.SortStableFunc(points, func(a, b TrackPoint) int { return a.Time().Compare(b.Time()) })
+	return &Track{Device: device, Begin: begin, End: end, ToMap: toMap, Points: points}
+}
+
+// Vehicle returns the plate reported with the points, if any
+func (t *Track) Vehicle() string {
+	for _, p := range t.Points {
+		if p.VID != "" {
+			return p.VID
+		}
+	}
+	return ""
+}
+
+// Duration returns the time between the first and the last point
+func (t *Track) Duration() time.Duration {
+	if len(t.Points) < 2 {
+		return 0
+	}
+	return t.Points[len(t.Points)-1].Time().Sub(t.Points[0].Time())
+}
+
+// DistanceKm returns the length of the track. The odometer difference is used
+// when the device reports one, otherwise the distance between the points.
+func (t *Track) DistanceKm() float64 {
+	if len(t.Points) < 2 {
+		return 0
+	}
+	first, last := t.Points[0], t.Points[len(t.Points)-1]
+	if first.LC > 0 && last.LC > first.LC {
+		return float64(last.LC-first.LC) / 1000
+	}
+
+	meters := 0.0
+	var prev *geo.Coord
+	for _, p := range t.Points {
+		if !p.HasPosition() {
+			continue
+		}
+		c := p.Coord()
+		if prev != nil {
+			meters += geo.Distance(*prev, c)
+		}
+		prev = &c
+	}
+	return meters / 1000
+}
+
+// MaxSpeedKmh returns the highest speed of the track
+func (t *Track) MaxSpeedKmh() float64 {
+	speed := 0.0
+	for _, p := range t.Points {
+		speed = max(speed, p.SpeedKmh())
+	}
+	return speed
+}
@@ -0,0 +1,143 @@
+package cmsv
+
+import "cmsv_api/geo"
+
+// LoginResponse is returned by StandardApiAction_login
+type LoginResponse struct {
+	Result      int    `json:"result"`
+	JSession    string `json:"jsession"`
+	Privileges  string `json:"pri"`
+	AccountName string `json:"account_name"`
+}
+
+// Device is a device entry from the online status list
+type Device struct {
+	VID    string `json:"vid"`
+	DID    string `json:"did"`
+	Online int    `json:"online"`
+}
+
+// StatusResponse is returned by StandardApiAction_getDeviceOlStatus
+type StatusResponse struct {
+	Result  int      `json:"result"`
+	Onlines []Device `json:"onlines"`
+}
+
+// Company is a company or fleet node of the user's company tree
+type Company struct {
+	ID   int    `json:"id"`
+	Name string `json:"nm"`
+	PID  int    `json:"pId"`
+}
+
+// VehicleDevice is a device installed in a vehicle
+type VehicleDevice struct {
+	ID          string `json:"id"`
+	Channels    int    `json:"cc"`
+	ChanName    string `json:"cn"`
+	SIM         string `json:"sim"`
+	InstallTime string `json:"ist"`
+}
+
+// Vehicle is a vehicle entry returned by StandardApiAction_queryUserVehicle
+type Vehicle struct {
+	ID           int             `json:"id"`
+	Name         string          `json:"nm"`
+	PID          int             `json:"pid"`
+	PName        string          `json:"pnm"`
+	DeviceList   []VehicleDevice `json:"dl"`
+	VehicleType  string          `json:"vehiType"`
+	VehicleColor string          `json:"vehiColor"`
+	VehicleBand  string          `json:"vehiBand"`
+	OwnerName    string          `json:"ownerName"`
+	EngineNum    string          `json:"engineNum"`
+	FrameNum     string          `json:"frameNum"`
+}
+
+// VehicleResponse is returned by StandardApiAction_queryUserVehicle
+type VehicleResponse struct {
+	Result   int       `json:"result"`
+	Companys []Company `json:"companys"`
+	Vehicles []Vehicle `json:"vehicles"`
+}
+
+// AlarmGPS is the position attached to an alarm. Lat and Lng are in
+// micro-degrees, SP is the speed in 0.1 km/h.
+type AlarmGPS struct {
+	DCT  int    `json:"dct"`
+	GD   int    `json:"gd"`
+	GT   string `json:"gt"`
+	HX   int    `json:"hx"`
+	Lat  int    `json:"lat"`
+	LC   int    `json:"lc"`
+	LID  int    `json:"lid"`
+	Lng  int    `json:"lng"`
+	MLat string `json:"mlat"`
+	MLng string `json:"mlng"`
+	SP   int    `json:"sp"`
+}
+
+// Latitude returns the latitude in degrees
+func (g AlarmGPS) Latitude() float64 {
+	return float64(g.Lat) / 1000000.0
+}
+
+// Longitude returns the longitude in degrees
+func (g AlarmGPS) Longitude() float64 {
+	return float64(g.Lng) / 1000000.0
+}
+
+// HasPosition reports whether the alarm carries a valid location
+func (g AlarmGPS) HasPosition() bool {
+	return g.Lat != 0 || g.Lng != 0
+}
+
+// Coord returns the raw alarm position, which is in WGS84
+func (g AlarmGPS) Coord() geo.Coord {
+	return geo.FromMicroDegrees(g.Lat, g.Lng, geo.WGS84)
+}
+
+// MapCoord parses the converted map position. toMap is the value the alarm
+// was requested with.
+func (g AlarmGPS) MapCoord(toMap int) (geo.Coord, error) {
+	return geo.ParseMapCoord(g.MLat, g.MLng, geo.Datum(toMap))
+}
+
+// SpeedKmh returns the speed in km/h
+func (g AlarmGPS) SpeedKmh() float64 {
+	return float64(g.SP) / 10.0
+}
+
+// Alarm is a single alarm record returned by StandardApiAction_vehicleAlarm
+type Alarm struct {
+	DevIDNO string   `json:"DevIDNO"`
+	Desc    string   `json:"desc"`
+	GUID    string   `json:"guid"`
+	HD      int      `json:"hd"`
+	Img     string   `json:"img"`
+	Info    int      `json:"info"`
+	P1      int      `json:"p1"`
+	P2      int      `json:"p2"`
+	P3      int      `json:"p3"`
+	P4      int      `json:"p4"`
+	SrcTm   string   `json:"srcTm"`
+	StType  int      `json:"stType"`
+	Time    string   `json:"time"`
+	Type    int      `json:"type"`
+	Gps     AlarmGPS `json:"Gps"`
+}
+
+// Pagination describes the page returned by paged endpoints
+type Pagination struct {
+	TotalPages   int `json:"totalPages"`
+	CurrentPage  int `json:"currentPage"`
+	PageRecords  int `json:"pageRecords"`
+	TotalRecords int `json:"totalRecords"`
+}
+
+// AlarmResponse is returned by StandardApiAction_vehicleAlarm
+type AlarmResponse struct {
+	Result     int        `json:"result"`
+	AlarmList  []Alarm    `json:"alarmlist"`
+	Pagination Pagination `json:"pagination"`
+}
@@ -0,0 +1,286 @@
+package cmsv
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VideoLocation is where recorded video is searched
+type VideoLocation int
+
+const (
+	VideoOnDevice         VideoLocation = 1 // Storage of the device (SD card or hard disk)
+	VideoOnStorageServer  VideoLocation = 2 // Storage server
+	VideoOnDownloadServer VideoLocation = 4 // Download server
+)
+
+// String returns the name used by ParseVideoLocation
+func (l VideoLocation) String() string {
+	switch l {
+	case VideoOnDevice:
+		return "device"
+	case VideoOnStorageServer:
+		return "server"
+	case VideoOnDownloadServer:
+		return "download"
+	}
+	return strconv.Itoa(int(l))
+}
+
+// ParseVideoLocation parses "device", "server" or "download", or the number
+// of a location
+func ParseVideoLocation(s string) (VideoLocation, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "device", "1":
+		return VideoOnDevice, nil
+	case "server", "storage", "2":
+		return VideoOnStorageServer, nil
+	case "download", "4":
+		return VideoOnDownloadServer, nil
+	}
+	return 0, fmt.Errorf("unknown video location %q (use device, server or download)", s)
+}
+
+// Record types of VideoQuery.RecordType and VideoFile.Type
+const (
+	RecordAll    = -1 // Normal and alarm recordings
+	RecordNormal = 0  // Continuous recording
+	RecordAlarm  = 1  // Recording triggered by an alarm
+)
+
+// AllChannels searches every channel in VideoQuery.Channel
+const AllChannels = -1
+
+// VideoQuery searches the recorded video files of a device with
+// StandardApiAction_getVideoFileInfo. The server searches one day at a time;
+// ranges that cross midnight are split into one request per day.
+type VideoQuery struct {
+	DevIDNO    string        // Device number (required)
+	Channel    int           // Channel number (starts from 0), or AllChannels
+	Begin      time.Time     // Start of the time range
+	End        time.Time     // End of the time range
+	Location   VideoLocation // Where to search (default VideoOnDevice)
+	RecordType int           // RecordAll, RecordNormal or RecordAlarm
+	Stream     int           // -1=all, 0=main stream, 1=sub stream
+	MaxRange   time.Duration // Longest allowed range, checked before querying (0 = no local limit)
+}
+
+// Validate checks the query locally before it is sent, with the same errors
+// as AlarmHistoryQuery.Validate
+func (q VideoQuery) Validate() error {
+	const op = "video search"
+	if q.DevIDNO == "" || q.Channel < AllChannels {
+		return &ResultError{Op: op, Code: 7}
+	}
+	if q.Begin.IsZero() || q.End.IsZero() {
+		return &ResultError{Op: op, Code: 10}
+	}
+	if q.Begin.After(q.End) {
+		return &ResultError{Op: op, Code: 9}
+	}
+	if q.MaxRange > 0 && q.End.Sub(q.Begin) > q.MaxRange {
+		return &ResultError{Op: op, Code: 10}
+	}
+	return nil
+}
+
+// days returns the request parameters of every day in the range
+func (q VideoQuery) days(jsession string) []url.Values {
+	location := q.Location
+	if location == 0 {
+		location = VideoOnDevice
+	}
+
+	var days []url.Values
+	// A range ending at midnight does not reach into the next day
+	for begin := q.Begin; begin.Equal(q.Begin) || begin.Before(q.End); {
+		midnight := time.Date(begin.Year(), begin.Month(), begin.Day(), 0, 0, 0, 0, begin.Location())
+		next := midnight.AddDate(0, 0, 1)
+		end := next.Add(-time.Second)
+		if q.End.Before(end) {
+			end = q.End
+		}
+		days = append(days, url.Values{
+			"jsession": {jsession},
+			"DevIDNO":  {q.DevIDNO},
+			"LOC":      {strconv.Itoa(int(location))},
+			"CHN":      {strconv.Itoa(q.Channel)},
+			"YEAR":     {strconv.Itoa(begin.Year())},
+			"MON":      {strconv.Itoa(int(begin.Month()))},
+			"DAY":      {strconv.Itoa(begin.Day())},
+			"RECTYPE":  {strconv.Itoa(q.RecordType)},
+			"FILEATTR": {"2"}, // Video files, not pictures
+			"BEG":      {strconv.Itoa(secondOfDay(begin))},
+			"END":      {strconv.Itoa(secondOfDay(end))},
+			"ARM1":     {"0"},
+			"ARM2":     {"0"},
+			"RES":      {"0"},
+			"STREAM":   {strconv.Itoa(q.Stream)},
+			"STORE":    {"0"},
+		})
+		begin = next
+	}
+	return days
+}
+
+func secondOfDay(t time.Time) int {
+	return t.Hour()*3600 + t.Minute()*60 + t.Second()
+}
+
+// VideoFile is one recorded file. Begin and end are seconds of the day.
+type VideoFile struct {
+	DevIDNO     string `json:"devIdno"`
+	VehiIDNO    string `json:"vehiIdno"`
+	File        string `json:"file"` // Path of the file on the device or server
+	Channel     int    `json:"chn"`
+	ChnMask     int    `json:"chnMask"` // Channels in the file, for files that hold several
+	Year        int    `json:"year"`    // Two or four digits
+	Mon         int    `json:"mon"`
+	Day         int    `json:"day"`
+	Beg         int    `json:"beg"`
+	End         int    `json:"end"`
+	Len         int64  `json:"len"` // File size in bytes
+	Loc         int    `json:"loc"` // VideoLocation of the file
+	Svr         int    `json:"svr"` // Storage server ID
+	Type        int    `json:"type"`
+	Stream      int    `json:"stream"`
+	PlaybackURL string `json:"PlaybackUrl"`
+	DownURL     string `json:"DownUrl"`
+}
+
+// day returns midnight of the recording day in local time
+func (f VideoFile) day() time.Time {
+	year := f.Year
+	if year < 100 {
+		year += 2000
+	}
+	return time.Date(year, time.Month(f.Mon), f.Day, 0, 0, 0, 0, time.Local)
+}
+
+// BeginTime returns when the recording starts
+func (f VideoFile) BeginTime() time.Time {
+	return f.day().Add(time.Duration(f.Beg) * time.Second)
+}
+
+// EndTime returns when the recording ends
+func (f VideoFile) EndTime() time.Time {
+	return f.day().Add(time.Duration(f.End) * time.Second)
+}
+
+// Duration returns the length of the recording
+func (f VideoFile) Duration() time.Duration {
+	return time.Duration(f.End-f.Beg) * time.Second
+}
+
+// Location returns where the file is stored
+func (f VideoFile) Location() VideoLocation {
+	return VideoLocation(f.Loc)
+}
+
+// VideoFileResponse is returned by StandardApiAction_getVideoFileInfo
+type VideoFileResponse struct {
+	Result int         `json:"result"`
+	Files  []VideoFile `json:"files"`
+}
+
+// VideoFiles returns the files recorded in the query range, sorted by
+// channel and start time
+func (c *Client) VideoFiles(ctx context.Context, jsession string, q VideoQuery) ([]VideoFile, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	var files []VideoFile
+	for _, params := range q.days(jsession) {
+		data, err := c.getJSON(ctx, c.actionURL("getVideoFileInfo", params))
+		if err != nil {
+			return nil, err
+		}
+		var res VideoFileResponse
+		if err := decode("video search", data, &res); err != nil {
+			return nil, err
+		}
+		files = append(files, res.Files...)
+	}
+	slices.SortStableFunc(files, func(a, b VideoFile) int {
+		if a.Channel != b.Channel {
+			return a.Channel - b.Channel
+		}
+		return a.BeginTime().Compare(b.BeginTime())
+	})
+	return files, nil
+}
+
+// VideoFiles returns the files recorded in the query range, sorted by
+// channel and start time
+func (s *Session) VideoFiles(ctx context.Context, q VideoQuery) ([]VideoFile, error) {
+	var files []VideoFile
+	err := s.Do(ctx, func(jsession string) (err error) {
+		files, err = s.client.VideoFiles(ctx, jsession, q)
+		return err
+	})
+	return files, err
+}
+
+// VideoClip is the part of a recorded file that falls into a time window
+type VideoClip struct {
+	File  VideoFile `json:"file"`
+	Begin time.Time `json:"begin"`
+	End   time.Time `json:"end"`
+}
+
+// Clips cuts the files to the window from begin to end. Files outside the
+// window are dropped.
+func Clips(files []VideoFile, begin, end time.Time) []VideoClip {
+	var clips []VideoClip
+	for _, f := range files {
+		clip := VideoClip{File: f, Begin: f.BeginTime(), End: f.EndTime()}
+		if clip.Begin.Before(begin) {
+			clip.Begin = begin
+		}
+		if clip.End.After(end) {
+			clip.End = end
+		}
+		if clip.End.After(clip.Begin) {
+			clips = append(clips, clip)
+		}
+	}
+	return clips
+}
+
+// Timestamp returns when the alarm happened, from the time or, if missing,
+// the source time of the alarm
+func (a Alarm) Timestamp() (time.Time, error) {
+	when := a.Time
+	if when == "" {
+		when = a.SrcTm
+	}
+	when, _, _ = strings.Cut(strings.TrimSpace(when), ".")
+	t, err := time.ParseInLocation(TimeLayout, when, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("alarm %s has no valid time: %q", a.GUID, a.Time)
+	}
+	return t, nil
+}
+
+// AlarmVideoQuery searches every channel of the alarm's device for video
+// recorded from before the alarm until after it
+func AlarmVideoQuery(a Alarm, before, after time.Duration) (VideoQuery, error) {
+	t, err := a.Timestamp()
+	if err != nil {
+		return VideoQuery{}, err
+	}
+	return VideoQuery{
+		DevIDNO:    a.DevIDNO,
+		Channel:    AllChannels,
+		Begin:      t.Add(-before),
+		End:        t.Add(after),
+		Location:   VideoOnDevice,
+		RecordType: RecordAll,
+		Stream:     -1,
+	}, nil
+}
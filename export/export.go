@@ -0,0 +1,277 @@
+// Package export writes alarm locations and device positions to map formats:
+// GeoJSON feature collections, KML placemarks styled by alarm category and
+// GPX waypoints and tracks.
+package export
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/geo"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Format is an export file format
+type Format string
+
+const (
+	GeoJSON Format = "geojson"
+	KML     Format = "kml"
+	GPX     Format = "gpx"
+)
+
+// Formats lists the supported formats
+var Formats = []Format{GeoJSON, KML, GPX}
+
+// ParseFormat parses a format name or file extension such as "kml" or ".gpx"
+func ParseFormat(s string) (Format, error) {
+	name := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(s), "."))
+	if name == "json" {
+		return GeoJSON, nil
+	}
+	for _, f := range Formats {
+		if string(f) == name {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown export format %q (use geojson, kml or gpx)", s)
+}
+
+// FormatForFile returns the format matching the extension of a file name
+func FormatForFile(name string) (Format, error) {
+	ext := filepath.Ext(name)
+	if ext == "" {
+		return "", fmt.Errorf("cannot tell the export format of %q, add an extension", name)
+	}
+	return ParseFormat(ext)
+}
+
+// Ext returns the file extension of the format, including the dot
+func (f Format) Ext() string {
+	return "." + string(f)
+}
+
+// Kind tells what a point describes
+type Kind string
+
+const (
+	KindAlarm    Kind = "alarm"
+	KindPosition Kind = "position"
+	KindTrack    Kind = "track" // Recorded track point
+)
+
+// Point is one exported location
+type Point struct {
+	Kind      Kind
+	Device    string
+	Vehicle   string
+	Time      time.Time
+	Coord     geo.Coord
+	SpeedKmh  float64
+	Heading   int
+	Desc      string
+	GUID      string          // Alarms only
+	AlarmType *cmsv.AlarmType // Alarms only
+}
+
+// Name returns a short label: the alarm type for alarms, the vehicle or
+// device for positions
+func (p Point) Name() string {
+	if p.AlarmType != nil {
+		return p.AlarmType.String()
+	}
+	if p.Vehicle != "" {
+		return p.Vehicle
+	}
+	return p.Device
+}
+
+// Category returns the alarm category, or an empty string for positions
+func (p Point) Category() cmsv.AlarmCategory {
+	if p.AlarmType == nil {
+		return ""
+	}
+	return p.AlarmType.Category
+}
+
+// Options configures an export
+type Options struct {
+	Name   string    // Document name
+	Datum  geo.Datum // Output datum (default WGS84, which GeoJSON, KML and GPX expect)
+	Tracks bool      // Also connect the points of every device into a track, in time order
+}
+
+// Write exports points in the given format
+func Write(w io.Writer, f Format, points []Point, opts Options) error {
+	switch f {
+	case GeoJSON:
+		return WriteGeoJSON(w, points, opts)
+	case KML:
+		return WriteKML(w, points, opts)
+	case GPX:
+		return WriteGPX(w, points, opts)
+	}
+	return fmt.Errorf("unknown export format %q", f)
+}
+
+var defaultCatalog = cmsv.NewAlarmCatalog()
+
+// FromAlarms converts alarms with a position. catalog names the alarm types;
+// nil uses the built-in catalog.
+func FromAlarms(alarms []cmsv.Alarm, catalog *cmsv.AlarmCatalog) []Point {
+	if catalog == nil {
+		catalog = defaultCatalog
+	}
+	var points []Point
+	for _, a := range alarms {
+		if !a.Gps.HasPosition() {
+			continue
+		}
+		t := catalog.Describe(a.Type)
+		points = append(points, Point{
+			Kind:      KindAlarm,
+			Device:    a.DevIDNO,
+			Time:      parseTime(a.Time),
+			Coord:     a.Gps.Coord(),
+			SpeedKmh:  a.Gps.SpeedKmh(),
+			Heading:   a.Gps.HX,
+			Desc:      a.Desc,
+			GUID:      a.GUID,
+			AlarmType: &t,
+		})
+	}
+	return points
+}
+
+// FromAlarmDetails converts historical alarms, located at their start position
+func FromAlarmDetails(alarms []cmsv.AlarmDetail, catalog *cmsv.AlarmCatalog) []Point {
+	var points []Point
+	for _, d := range alarms {
+		for _, p := range FromAlarms([]cmsv.Alarm{d.Alarm()}, catalog) {
+			p.Vehicle = d.VehiIDNO
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// FromStatuses converts the positions of device statuses
+func FromStatuses(statuses []cmsv.DeviceStatus) []Point {
+	var points []Point
+	for _, s := range statuses {
+		if !s.HasPosition() {
+			continue
+		}
+		points = append(points, Point{
+			Kind:     KindPosition,
+			Device:   s.ID,
+			Vehicle:  s.VID,
+			Time:     parseTime(s.GT),
+			Coord:    s.Coord(),
+			SpeedKmh: s.SpeedKmh(),
+			Heading:  s.HX,
+			Desc:     cmsv.StatusDescription(s.Equipment()),
+		})
+	}
+	return points
+}
+
+// FromTrack converts the points of a recorded track. Export them with
+// Options.Tracks to connect them into a line.
+func FromTrack(track *cmsv.Track) []Point {
+	vehicle := track.Vehicle()
+	var points []Point
+	for _, p := range track.Points {
+		if !p.HasPosition() {
+			continue
+		}
+		points = append(points, Point{
+			Kind:     KindTrack,
+			Device:   track.Device,
+			Vehicle:  vehicle,
+			Time:     p.Time(),
+			Coord:    p.Coord(),
+			SpeedKmh: p.SpeedKmh(),
+			Heading:  p.HX,
+			Desc:     cmsv.StatusDescription(p.Equipment()),
+		})
+	}
+	return points
+}
+
+// parseTime parses a server time such as "2024-12-07 11:58:30" or
+// "2024-12-07 11:58:30.0" in local time. Unparsable times are left zero.
+func parseTime(s string) time.Time {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), ".")
+	t, err := time.ParseInLocation(cmsv.TimeLayout, s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// track is the time-ordered points of one device
+type track struct {
+	device string
+	name   string
+	points []Point
+}
+
+// tracks groups the points by device. Devices with fewer than two points
+// are left out.
+func tracks(points []Point) []track {
+	byDevice := make(map[string]*track)
+	var order []string
+	for _, p := range points {
+		t, ok := byDevice[p.Device]
+		if !ok {
+			t = &track{device: p.Device, name: p.Device}
+			byDevice[p.Device] = t
+			order = append(order, p.Device)
+		}
+		if p.Vehicle != "" {
+			t.name = p.Vehicle
+		}
+		t.points = append(t.points, p)
+	}
+
+	var result []track
+	for _, device := range order {
+		t := byDevice[device]
+		if len(t.points) < 2 {
+			continue
+		}
+		slices.SortStableFunc(t.points, func(a, b Point) int { return a.Time.Compare(b.Time) })
+		result = append(result, *t)
+	}
+	return result
+}
+
+// description is the human-readable summary used by KML and GPX
+func description(p Point) string {
+	var parts []string
+	if p.Vehicle != "" {
+		parts = append(parts, fmt.Sprintf("Vehicle: %s", p.Vehicle))
+	}
+	parts = append(parts, fmt.Sprintf("Device: %s", p.Device))
+	if !p.Time.IsZero() {
+		parts = append(parts, fmt.Sprintf("Time: %s", p.Time.Format(cmsv.TimeLayout)))
+	}
+	parts = append(parts, fmt.Sprintf("Speed: %.1f km/h", p.SpeedKmh))
+	if p.AlarmType != nil {
+		parts = append(parts, fmt.Sprintf("Category: %s, severity: %s", p.AlarmType.Category, p.AlarmType.Severity))
+	}
+	if p.Desc != "" {
+		parts = append(parts, fmt.Sprintf("Description: %s", p.Desc))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// round6 rounds degrees to six decimals, about 0.1 m
+func round6(deg float64) float64 {
+	return math.Round(deg*1e6) / 1e6
+}
@@ -0,0 +1,105 @@
+package export
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Name     string           `json:"name,omitempty"`
+	Datum    string           `json:"datum,omitempty"` // Foreign member, set when not WGS84
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string          `json:"type"`
+	Geometry   geoJSONGeometry `json:"geometry"`
+	Properties map[string]any  `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// WriteGeoJSON writes the points as a GeoJSON FeatureCollection of Point
+// features, followed by one LineString per device when opts.Tracks is set.
+// Coordinates are [lng, lat] as the format requires.
+func WriteGeoJSON(w io.Writer, points []Point, opts Options) error {
+	fc := geoJSONCollection{Type: "FeatureCollection", Name: opts.Name, Features: []geoJSONFeature{}}
+	if opts.Datum != 0 {
+		fc.Datum = opts.Datum.String()
+	}
+
+	for _, p := range points {
+		fc.Features = append(fc.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONGeometry{Type: "Point", Coordinates: lngLat(p, opts)},
+			Properties: geoJSONProperties(p),
+		})
+	}
+
+	if opts.Tracks {
+		for _, t := range tracks(points) {
+			coords := make([][]float64, len(t.points))
+			for i, p := range t.points {
+				coords[i] = lngLat(p, opts)
+			}
+			props := map[string]any{"kind": "track", "device": t.device, "points": len(t.points)}
+			if t.name != t.device {
+				props["vehicle"] = t.name
+			}
+			if start := t.points[0].Time; !start.IsZero() {
+				props["start"] = start.Format(time.RFC3339)
+			}
+			if end := t.points[len(t.points)-1].Time; !end.IsZero() {
+				props["end"] = end.Format(time.RFC3339)
+			}
+			fc.Features = append(fc.Features, geoJSONFeature{
+				Type:       "Feature",
+				Geometry:   geoJSONGeometry{Type: "LineString", Coordinates: coords},
+				Properties: props,
+			})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(fc)
+}
+
+func geoJSONProperties(p Point) map[string]any {
+	props := map[string]any{
+		"kind":     p.Kind,
+		"device":   p.Device,
+		"speedKmh": p.SpeedKmh,
+		"heading":  p.Heading,
+	}
+	if p.Vehicle != "" {
+		props["vehicle"] = p.Vehicle
+	}
+	if !p.Time.IsZero() {
+		props["time"] = p.Time.Format(time.RFC3339)
+	}
+	if p.Desc != "" {
+		props["description"] = p.Desc
+	}
+	if p.GUID != "" {
+		props["guid"] = p.GUID
+	}
+	if t := p.AlarmType; t != nil {
+		props["alarmType"] = t.Code
+		props["alarmName"] = t.Name
+		props["category"] = t.Category
+		props["severity"] = t.Severity
+	}
+	return props
+}
+
+// lngLat returns the position in the output datum as [lng, lat]
+func lngLat(p Point, opts Options) []float64 {
+	c := p.Coord.To(opts.Datum)
+	return []float64{round6(c.Lng), round6(c.Lat)}
+}
@@ -0,0 +1,100 @@
+package export
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+type gpxDocument struct {
+	XMLName   xml.Name     `xml:"gpx"`
+	XMLNS     string       `xml:"xmlns,attr"`
+	Version   string       `xml:"version,attr"`
+	Creator   string       `xml:"creator,attr"`
+	Metadata  *gpxMetadata `xml:"metadata,omitempty"`
+	Waypoints []gpxPoint   `xml:"wpt"`
+	Tracks    []gpxTrack   `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name string `xml:"name,omitempty"`
+	Desc string `xml:"desc,omitempty"`
+	Time string `xml:"time,omitempty"`
+}
+
+type gpxPoint struct {
+	Lat  string `xml:"lat,attr"`
+	Lon  string `xml:"lon,attr"`
+	Time string `xml:"time,omitempty"`
+	Name string `xml:"name,omitempty"`
+	Desc string `xml:"desc,omitempty"`
+	Type string `xml:"type,omitempty"`
+}
+
+type gpxTrack struct {
+	Name    string          `xml:"name"`
+	Desc    string          `xml:"desc,omitempty"`
+	Segment gpxTrackSegment `xml:"trkseg"`
+}
+
+type gpxTrackSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+// WriteGPX writes the points as GPX 1.1 waypoints, typed by alarm category
+// (or "position"). With opts.Tracks every device also gets a track through
+// its points in time order.
+func WriteGPX(w io.Writer, points []Point, opts Options) error {
+	doc := gpxDocument{
+		XMLNS:    "http://www.topografix.com/GPX/1/1",
+		Version:  "1.1",
+		Creator:  "cmsv_api",
+		Metadata: &gpxMetadata{Name: opts.Name, Time: time.Now().UTC().Format(time.RFC3339)},
+	}
+	if opts.Datum != 0 {
+		doc.Metadata.Desc = fmt.Sprintf("Coordinates in %s", opts.Datum)
+	}
+
+	for _, p := range points {
+		wpt := gpxPosition(p, opts)
+		wpt.Name = p.Name()
+		wpt.Desc = description(p)
+		wpt.Type = string(p.Kind)
+		if category := p.Category(); category != "" {
+			wpt.Type = string(category)
+		}
+		doc.Waypoints = append(doc.Waypoints, wpt)
+	}
+
+	if opts.Tracks {
+		for _, t := range tracks(points) {
+			trk := gpxTrack{Name: t.name, Desc: fmt.Sprintf("Device: %s", t.device)}
+			for _, p := range t.points {
+				trk.Segment.Points = append(trk.Segment.Points, gpxPosition(p, opts))
+			}
+			doc.Tracks = append(doc.Tracks, trk)
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// gpxPosition returns the position and time of a point. GPX times are UTC.
+func gpxPosition(p Point, opts Options) gpxPoint {
+	ll := lngLat(p, opts)
+	pt := gpxPoint{Lat: fmt.Sprintf("%.6f", ll[1]), Lon: fmt.Sprintf("%.6f", ll[0])}
+	if !p.Time.IsZero() {
+		pt.Time = p.Time.UTC().Format(time.RFC3339)
+	}
+	return pt
+}
@@ -0,0 +1,232 @@
+package export
+
+import (
+	"cmsv_api/cmsv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// categoryColors are the KML icon colors of the alarm categories, in the
+// aabbggrr order KML uses
+var categoryColors = map[cmsv.AlarmCategory]string{
+	cmsv.CategoryADAS:     "ff0000ff", // Red
+	cmsv.CategoryDSM:      "ff0080ff", // Orange
+	cmsv.CategoryBSD:      "ff00ffff", // Yellow
+	cmsv.CategoryGPS:      "ffff8000", // Blue
+	cmsv.CategoryVideo:    "ffff00aa", // Purple
+	cmsv.CategoryIO:       "ff00c000", // Green
+	cmsv.CategoryPlatform: "ff808080", // Grey
+	cmsv.CategoryOther:    "ffffffff", // White
+}
+
+// Styles for device positions and tracks
+const (
+	positionStyle = "position"
+	trackStyle    = "track"
+	positionColor = "ffffaa00" // Light blue
+	trackColor    = "ccff5500"
+)
+
+type kmlDocument struct {
+	XMLName xml.Name `xml:"kml"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Doc     kmlDoc   `xml:"Document"`
+}
+
+type kmlDoc struct {
+	Name        string      `xml:"name,omitempty"`
+	Description string      `xml:"description,omitempty"`
+	Styles      []kmlStyle  `xml:"Style"`
+	Folders     []kmlFolder `xml:"Folder"`
+}
+
+type kmlStyle struct {
+	ID        string        `xml:"id,attr"`
+	IconStyle *kmlIconStyle `xml:"IconStyle,omitempty"`
+	LineStyle *kmlLineStyle `xml:"LineStyle,omitempty"`
+}
+
+type kmlIconStyle struct {
+	Color string  `xml:"color"`
+	Scale float64 `xml:"scale,omitempty"`
+}
+
+type kmlLineStyle struct {
+	Color string `xml:"color"`
+	Width int    `xml:"width"`
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name         string         `xml:"name"`
+	Description  string         `xml:"description,omitempty"`
+	TimeStamp    *kmlTimeStamp  `xml:"TimeStamp,omitempty"`
+	StyleURL     string         `xml:"styleUrl,omitempty"`
+	ExtendedData *kmlData       `xml:"ExtendedData,omitempty"`
+	Point        *kmlPoint      `xml:"Point,omitempty"`
+	LineString   *kmlLineString `xml:"LineString,omitempty"`
+}
+
+type kmlTimeStamp struct {
+	When string `xml:"when"`
+}
+
+type kmlData struct {
+	Data []kmlDataField `xml:"Data"`
+}
+
+type kmlDataField struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlLineString struct {
+	Tessellate  int    `xml:"tessellate"`
+	Coordinates string `xml:"coordinates"`
+}
+
+// WriteKML writes the points as KML placemarks. Alarms are grouped in one
+// folder per category and styled with the category color; device positions
+// share their own style. With opts.Tracks every device also gets a line
+// through its points.
+func WriteKML(w io.Writer, points []Point, opts Options) error {
+	doc := kmlDoc{Name: opts.Name}
+	if opts.Datum != 0 {
+		doc.Description = fmt.Sprintf("Coordinates in %s", opts.Datum)
+	}
+
+	folders := make(map[string]*kmlFolder)
+	var order []string
+	usedCategories := make(map[cmsv.AlarmCategory]bool)
+	for _, p := range points {
+		folder := "Positions"
+		style := positionStyle
+		if category := p.Category(); category != "" {
+			folder = string(category) + " alarms"
+			style = categoryStyle(category)
+			usedCategories[category] = true
+		}
+		f, ok := folders[folder]
+		if !ok {
+			f = &kmlFolder{Name: folder}
+			folders[folder] = f
+			order = append(order, folder)
+		}
+		f.Placemarks = append(f.Placemarks, kmlPlacemark{
+			Name:         p.Name(),
+			Description:  description(p),
+			TimeStamp:    kmlTime(p.Time),
+			StyleURL:     "#" + style,
+			ExtendedData: kmlExtendedData(p),
+			Point:        &kmlPoint{Coordinates: kmlCoord(p, opts)},
+		})
+	}
+
+	// Styles of the categories in use, in catalog order, then positions and tracks
+	for _, category := range []cmsv.AlarmCategory{
+		cmsv.CategoryADAS, cmsv.CategoryDSM, cmsv.CategoryBSD, cmsv.CategoryGPS,
+		cmsv.CategoryVideo, cmsv.CategoryIO, cmsv.CategoryPlatform, cmsv.CategoryOther,
+	} {
+		if usedCategories[category] {
+			doc.Styles = append(doc.Styles, kmlStyle{
+				ID:        categoryStyle(category),
+				IconStyle: &kmlIconStyle{Color: categoryColors[category], Scale: 1.1},
+			})
+		}
+	}
+	if _, ok := folders["Positions"]; ok {
+		doc.Styles = append(doc.Styles, kmlStyle{ID: positionStyle, IconStyle: &kmlIconStyle{Color: positionColor}})
+	}
+
+	for _, name := range order {
+		doc.Folders = append(doc.Folders, *folders[name])
+	}
+
+	if opts.Tracks {
+		trackList := tracks(points)
+		if len(trackList) > 0 {
+			doc.Styles = append(doc.Styles, kmlStyle{ID: trackStyle, LineStyle: &kmlLineStyle{Color: trackColor, Width: 3}})
+		}
+		tracksFolder := kmlFolder{Name: "Tracks"}
+		for _, t := range trackList {
+			coords := make([]string, len(t.points))
+			for i, p := range t.points {
+				coords[i] = kmlCoord(p, opts)
+			}
+			tracksFolder.Placemarks = append(tracksFolder.Placemarks, kmlPlacemark{
+				Name:        t.name,
+				Description: fmt.Sprintf("Device: %s\nPoints: %d", t.device, len(t.points)),
+				StyleURL:    "#" + trackStyle,
+				LineString:  &kmlLineString{Tessellate: 1, Coordinates: strings.Join(coords, " ")},
+			})
+		}
+		if len(tracksFolder.Placemarks) > 0 {
+			doc.Folders = append(doc.Folders, tracksFolder)
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(kmlDocument{XMLNS: "http://www.opengis.net/kml/2.2", Doc: doc}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func categoryStyle(category cmsv.AlarmCategory) string {
+	return "alarm-" + strings.ToLower(string(category))
+}
+
+func kmlTime(t time.Time) *kmlTimeStamp {
+	if t.IsZero() {
+		return nil
+	}
+	return &kmlTimeStamp{When: t.Format(time.RFC3339)}
+}
+
+// kmlCoord formats the position in the output datum as "lng,lat"
+func kmlCoord(p Point, opts Options) string {
+	ll := lngLat(p, opts)
+	return fmt.Sprintf("%.6f,%.6f", ll[0], ll[1])
+}
+
+func kmlExtendedData(p Point) *kmlData {
+	data := &kmlData{}
+	add := func(name, value string) {
+		if value != "" {
+			data.Data = append(data.Data, kmlDataField{Name: name, Value: value})
+		}
+	}
+	add("kind", string(p.Kind))
+	add("device", p.Device)
+	add("vehicle", p.Vehicle)
+	if !p.Time.IsZero() {
+		add("time", p.Time.Format(time.RFC3339))
+	}
+	add("speedKmh", fmt.Sprintf("%.1f", p.SpeedKmh))
+	add("heading", fmt.Sprint(p.Heading))
+	add("description", p.Desc)
+	add("guid", p.GUID)
+	if t := p.AlarmType; t != nil {
+		add("alarmType", fmt.Sprint(t.Code))
+		add("alarmName", t.Name)
+		add("category", string(t.Category))
+		add("severity", t.Severity.String())
+	}
+	return data
+}
@@ -0,0 +1,355 @@
+// Package gateway serves the fleet of a CMSV account through a plain JSON
+// REST API. CMSV sessions are handled internally; clients authenticate to
+// the gateway with API keys.
+package gateway
+
+import (
+	"cmsv_api/cmsv"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIKeyHeader is the request header carrying the API key. Keys are also
+// accepted as "Authorization: Bearer <key>".
+const APIKeyHeader = "X-API-Key"
+
+// Options configures a gateway
+type Options struct {
+	Session    *cmsv.Session      // CMSV session shared by all requests
+	Catalog    *cmsv.AlarmCatalog // Alarm type names (default: built-in catalog)
+	APIKeys    []string           // Accepted API keys; at least one is required
+	StreamHost string             // Host used in CMSV stream URLs (default: the CMSV server)
+	Logger     *log.Logger        // Requests are logged here when set
+
+	// Links returns session-free URLs of a live stream, e.g. of the relay or
+	// the HLS proxy. Empty URLs are left out of the response
+	Links func(devIDNO string, channel, stream int) (rtsp, rtmp, hls string, err error)
+	// ExposeSession returns the CMSV server's stream URLs when Links is nil.
+	// They carry the account's jsession, which grants every API key holder
+	// the whole account until the session expires
+	ExposeSession bool
+}
+
+// Server is the REST gateway
+type Server struct {
+	opts Options
+	mux  *http.ServeMux
+}
+
+// New creates a gateway
+func New(opts Options) (*Server, error) {
+	if opts.Session == nil {
+		return nil, errors.New("gateway: a CMSV session is required")
+	}
+	var keys []string
+	for _, key := range opts.APIKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("gateway: at least one API key is required")
+	}
+	opts.APIKeys = keys
+	if opts.Catalog == nil {
+		opts.Catalog = cmsv.NewAlarmCatalog()
+	}
+
+	s := &Server{opts: opts, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /healthz", s.handleHealth)
+	s.mux.Handle("GET /devices", s.auth(s.handleDevices))
+	s.mux.Handle("GET /devices/{id}/status", s.auth(s.handleDeviceStatus))
+	s.mux.Handle("GET /devices/{id}/streams", s.auth(s.handleDeviceStreams))
+	s.mux.Handle("GET /vehicles", s.auth(s.handleVehicles))
+	s.mux.Handle("GET /alarms", s.auth(s.handleAlarms))
+	s.mux.Handle("GET /alarm-types", s.auth(s.handleAlarmTypes))
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.mux.ServeHTTP(rec, r)
+	if s.opts.Logger != nil {
+		s.opts.Logger.Printf("%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// auth rejects requests without a valid API key
+func (s *Server) auth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(APIKeyHeader)
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && key == "" {
+			key = strings.TrimSpace(bearer)
+		}
+		if !s.validKey(key) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cmsv"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid API key")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (s *Server) validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	valid := false
+	for _, k := range s.opts.APIKeys {
+		// Compare every key so the response time does not depend on which one matched
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := s.opts.Session.Devices(r.Context())
+	if err != nil {
+		writeCMSVError(w, err)
+		return
+	}
+	result := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		result = append(result, newDevice(d))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleVehicles(w http.ResponseWriter, r *http.Request) {
+	res, err := s.opts.Session.VehicleInfo(r.Context())
+	if err != nil {
+		writeCMSVError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newFleet(res))
+}
+
+func (s *Server) handleDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	query := cmsv.DeviceStatusQuery{
+		DevIDNO:    []string{r.PathValue("id")},
+		GeoAddress: boolParam(r, "geo"),
+		Driver:     boolParam(r, "driver"),
+		Language:   r.URL.Query().Get("lang"),
+	}
+	toMap, err := intParam(r, "toMap", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query.ToMap = toMap
+
+	statuses, err := s.opts.Session.DeviceStatus(r.Context(), query)
+	if err != nil {
+		writeCMSVError(w, err)
+		return
+	}
+	if len(statuses) == 0 {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, newStatus(statuses[0], toMap))
+}
+
+// handleAlarms returns current alarms. Without a page parameter every page
+// is collected.
+func (s *Server) handleAlarms(w http.ResponseWriter, r *http.Request) {
+	page, err := intParam(r, "page", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pageSize, err := intParam(r, "pageSize", cmsv.DefaultPageSize)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := cmsv.AlarmQuery{DevIDNO: r.URL.Query().Get("device"), Page: page, PageSize: pageSize}
+
+	result := AlarmList{Alarms: []Alarm{}}
+	if page > 0 {
+		res, err := s.opts.Session.AlarmPage(r.Context(), query)
+		if err != nil {
+			writeCMSVError(w, err)
+			return
+		}
+		for _, a := range res.AlarmList {
+			result.Alarms = append(result.Alarms, newAlarm(a, s.opts.Catalog))
+		}
+		result.Page = &Page{
+			Page:       page,
+			PageSize:   pageSize,
+			TotalPages: res.Pagination.TotalPages,
+			Total:      res.Pagination.TotalRecords,
+		}
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	for a, err := range s.opts.Session.Alarms(r.Context(), query) {
+		if err != nil {
+			writeCMSVError(w, err)
+			return
+		}
+		result.Alarms = append(result.Alarms, newAlarm(a, s.opts.Catalog))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleAlarmTypes(w http.ResponseWriter, r *http.Request) {
+	types := s.opts.Catalog.Types()
+	result := make([]AlarmType, 0, len(types))
+	for _, t := range types {
+		result = append(result, AlarmType{Code: t.Code, Name: t.Name, Category: string(t.Category), Severity: t.Severity.String()})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleDeviceStreams returns the live stream URLs of a device. Without a
+// channel parameter every channel listed in the vehicle information is returned.
+// URLs come from Options.Links. The CMSV server's own URLs embed the account's
+// jsession and are only returned with Options.ExposeSession; otherwise the
+// channels are listed without URLs.
+func (s *Server) handleDeviceStreams(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	stream := strings.ToLower(r.URL.Query().Get("stream"))
+	streamType := 1
+	switch stream {
+	case "", "sub":
+		stream = "sub"
+	case "main":
+		streamType = 0
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid stream %q (use main or sub)", stream))
+		return
+	}
+
+	var channels []Stream
+	if r.URL.Query().Has("channel") {
+		channel, err := intParam(r, "channel", 0)
+		if err != nil || channel < 0 {
+			writeError(w, http.StatusBadRequest, "invalid channel")
+			return
+		}
+		channels = append(channels, Stream{Channel: channel})
+	} else {
+		res, err := s.opts.Session.VehicleInfo(r.Context())
+		if err != nil {
+			writeCMSVError(w, err)
+			return
+		}
+		device, ok := res.FindDevice(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "device not found")
+			return
+		}
+		for _, ch := range device.ChannelList() {
+			channels = append(channels, Stream{Channel: ch.Number, Name: ch.Name})
+		}
+	}
+
+	switch {
+	case s.opts.Links != nil:
+		for i := range channels {
+			rtsp, rtmp, hls, err := s.opts.Links(id, channels[i].Channel, streamType)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			channels[i].RTSP, channels[i].RTMP, channels[i].HLS = rtsp, rtmp, hls
+		}
+	case s.opts.ExposeSession:
+		jsession, err := s.opts.Session.JSession(r.Context())
+		if err != nil {
+			writeCMSVError(w, err)
+			return
+		}
+		client := s.opts.Session.Client()
+		for i := range channels {
+			ch := channels[i].Channel
+			channels[i].RTSP = client.GenerateRTSPLink(cmsv.RTSPLinkOptions{
+				ServerHost: s.opts.StreamHost, JSession: jsession, DevIDNO: id, Channel: ch, Stream: streamType, AVType: 1,
+			})
+			channels[i].RTMP = client.GenerateRTMPLink(cmsv.RTMPLinkOptions{
+				ServerHost: s.opts.StreamHost, JSession: jsession, DevIDNO: id, Channel: ch, Stream: streamType, AVType: 1,
+			})
+			channels[i].HLS = client.GenerateHLSLink(cmsv.HLSLinkOptions{
+				ServerHost: s.opts.StreamHost, JSession: jsession, DevIDNO: id, Channel: ch, Stream: streamType, RequestType: 1,
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, Streams{Device: id, Stream: stream, Streams: channels})
+}
+
+func boolParam(r *http.Request, name string) bool {
+	switch strings.ToLower(r.URL.Query().Get(name)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+func intParam(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeCMSVError maps an error of the CMSV API to an HTTP status
+func writeCMSVError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	switch {
+	case errors.Is(err, cmsv.ErrDeviceNotFound), errors.Is(err, cmsv.ErrVehicleNotFound), errors.Is(err, cmsv.ErrInfoNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, cmsv.ErrNoDevicePermission), errors.Is(err, cmsv.ErrNoPermission), errors.Is(err, cmsv.ErrDeviceNotInCompany):
+		status = http.StatusForbidden
+	case errors.Is(err, cmsv.ErrInvalidParameters), errors.Is(err, cmsv.ErrBeginAfterEnd), errors.Is(err, cmsv.ErrTimeOutOfRange):
+		status = http.StatusBadRequest
+	case errors.Is(err, cmsv.ErrDeviceOffline), errors.Is(err, cmsv.ErrNoDeviceFeedback), errors.Is(err, cmsv.ErrDeviceConnectionLost):
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, status, err.Error())
+}
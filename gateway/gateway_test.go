@@ -0,0 +1,355 @@
+package gateway
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/geo"
+	"cmsv_api/simulator"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testKey    = "key-for-tests"
+	testDevice = "013300000001"
+)
+
+// testGateway serves a gateway in front of a simulated CMSV server
+func testGateway(t *testing.T, opts Options) (*httptest.Server, *simulator.Simulator, *cmsv.Session) {
+	t.Helper()
+	sim := simulator.New(simulator.Options{Start: time.Date(2024, 5, 1, 8, 0, 0, 0, time.Local), Seed: 1})
+	cmsvSrv := httptest.NewServer(sim)
+	t.Cleanup(cmsvSrv.Close)
+	client, err := cmsv.NewClient(cmsv.Options{BaseURL: cmsvSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Step(3 * time.Minute) // Get the vehicles moving
+
+	opts.Session = client.NewSession("demo", "demo")
+	if opts.APIKeys == nil {
+		opts.APIKeys = []string{"other-key", testKey}
+	}
+	gw, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gw)
+	t.Cleanup(srv.Close)
+	return srv, sim, opts.Session
+}
+
+// get requests a gateway path with the test key and decodes the JSON
+// response into v unless v is nil. It returns the status and the raw body.
+func get(t *testing.T, srv *httptest.Server, path string, v any) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	req.Header.Set(APIKeyHeader, testKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Fatalf("GET %s: %v in %s", path, err, body)
+		}
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestNewRequiresKeys(t *testing.T) {
+	client, _ := cmsv.NewClient(cmsv.Options{BaseURL: "http://127.0.0.1"})
+	if _, err := New(Options{Session: client.NewSession("demo", "demo"), APIKeys: []string{" ", ""}}); err == nil {
+		t.Error("New accepts blank API keys only")
+	}
+	if _, err := New(Options{APIKeys: []string{testKey}}); err == nil {
+		t.Error("New accepts no session")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	srv, _, _ := testGateway(t, Options{})
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		want   int
+	}{
+		{"no key", "/devices", nil, http.StatusUnauthorized},
+		{"wrong key", "/devices", map[string]string{APIKeyHeader: "guess"}, http.StatusUnauthorized},
+		{"prefix of a key", "/devices", map[string]string{APIKeyHeader: testKey[:5]}, http.StatusUnauthorized},
+		{"wrong bearer", "/alarms", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"basic auth", "/alarms", map[string]string{"Authorization": "Basic " + testKey}, http.StatusUnauthorized},
+		{"API key header", "/devices", map[string]string{APIKeyHeader: testKey}, http.StatusOK},
+		{"second key", "/devices", map[string]string{APIKeyHeader: "other-key"}, http.StatusOK},
+		{"bearer", "/alarm-types", map[string]string{"Authorization": "Bearer " + testKey}, http.StatusOK},
+		{"health check without key", "/healthz", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized {
+				if resp.Header.Get("WWW-Authenticate") == "" {
+					t.Error("no WWW-Authenticate header")
+				}
+				var e map[string]string
+				if json.NewDecoder(resp.Body).Decode(&e) != nil || e["error"] == "" {
+					t.Error(`no {"error": ...} body`)
+				}
+			}
+		})
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestStatusUnits(t *testing.T) {
+	srv, _, session := testGateway(t, Options{})
+
+	var status Status
+	if code, body := get(t, srv, "/devices/"+testDevice+"/status?toMap=1&driver=1", &status); code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	raw, err := session.DeviceStatus(context.Background(), cmsv.DeviceStatusQuery{DevIDNO: []string{testDevice}})
+	if err != nil || len(raw) != 1 {
+		t.Fatalf("DeviceStatus = %v, %v", raw, err)
+	}
+	st := raw[0]
+
+	if !status.Online || status.ID != testDevice || status.Vehicle != st.VID {
+		t.Errorf("status = %+v, want online device %s of %s", status, testDevice, st.VID)
+	}
+	// The server sends speed in 0.1 km/h, fuel in 0.01 l, mileage in m and
+	// positions in micro-degrees
+	if st.SP == 0 || !near(status.SpeedKmh, float64(st.SP)/10) {
+		t.Errorf("speedKmh = %v, want %v from sp %d", status.SpeedKmh, float64(st.SP)/10, st.SP)
+	}
+	if !near(status.FuelLiters, float64(st.YL)/100) {
+		t.Errorf("fuelLiters = %v, want %v from yl %d", status.FuelLiters, float64(st.YL)/100, st.YL)
+	}
+	if st.LC == 0 || !near(status.MileageKm, float64(st.LC)/1000) {
+		t.Errorf("mileageKm = %v, want %v from lc %d", status.MileageKm, float64(st.LC)/1000, st.LC)
+	}
+	if status.Position == nil || !near(status.Position.Lat, float64(st.Lat)/1e6) || !near(status.Position.Lng, float64(st.Lng)/1e6) {
+		t.Fatalf("position = %+v, want %d, %d in degrees", status.Position, st.Lat, st.Lng)
+	}
+
+	// toMap=1 adds the GCJ-02 position next to the WGS84 one
+	want := geo.Coord{Lat: status.Position.Lat, Lng: status.Position.Lng}.To(geo.GCJ02)
+	if status.MapDatum != "GCJ-02" || status.MapPosition == nil ||
+		math.Abs(status.MapPosition.Lat-want.Lat) > 2e-6 || math.Abs(status.MapPosition.Lng-want.Lng) > 2e-6 {
+		t.Errorf("mapPosition = %+v %s, want %v GCJ-02", status.MapPosition, status.MapDatum, want)
+	}
+	if status.Driver == nil || status.Driver.Name == "" {
+		t.Errorf("driver = %+v, want the driver with driver=1", status.Driver)
+	}
+	if status.Flags == nil || status.Temperatures == nil {
+		t.Error("flags and temperatures must be lists, not null")
+	}
+}
+
+func TestAlarmUnits(t *testing.T) {
+	srv, sim, _ := testGateway(t, Options{})
+	sim.ClearFaults()
+	guid, err := sim.RaiseAlarm(testDevice, 618, "Fatigue driving")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list AlarmList
+	if code, body := get(t, srv, "/alarms?device="+testDevice, &list); code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	var alarm *Alarm
+	for i := range list.Alarms {
+		if list.Alarms[i].GUID == guid {
+			alarm = &list.Alarms[i]
+		}
+	}
+	if alarm == nil {
+		t.Fatalf("alarm %s not in %+v", guid, list.Alarms)
+	}
+	var raw cmsv.Alarm
+	for _, a := range sim.Alarms() {
+		if a.GUID == guid {
+			raw = a
+		}
+	}
+	if alarm.Type.Code != 618 || alarm.Type.Name == "" || alarm.Type.Category == "" || alarm.Type.Severity == "" {
+		t.Errorf("type = %+v, want the catalog entry of 618", alarm.Type)
+	}
+	if !near(alarm.SpeedKmh, float64(raw.Gps.SP)/10) {
+		t.Errorf("speedKmh = %v, want %v from sp %d", alarm.SpeedKmh, float64(raw.Gps.SP)/10, raw.Gps.SP)
+	}
+	if alarm.Position == nil || !near(alarm.Position.Lat, float64(raw.Gps.Lat)/1e6) || !near(alarm.Position.Lng, float64(raw.Gps.Lng)/1e6) {
+		t.Errorf("position = %+v, want %d, %d in degrees", alarm.Position, raw.Gps.Lat, raw.Gps.Lng)
+	}
+
+	// A single page carries its paging information
+	var page AlarmList
+	if code, body := get(t, srv, "/alarms?page=1&pageSize=1", &page); code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	if len(page.Alarms) != 1 || page.Page == nil || page.Page.Page != 1 || page.Page.PageSize != 1 || page.Page.Total < 1 {
+		t.Errorf("page = %+v, want one alarm with paging", page.Page)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	links := func(devIDNO string, channel, stream int) (string, string, string, error) {
+		return fmt.Sprintf("rtsp://relay.example/%s/%d/%d", devIDNO, channel, stream), "",
+			fmt.Sprintf("https://proxy.example/hls/%s-%d-%d.m3u8", devIDNO, channel, stream), nil
+	}
+	tests := []struct {
+		name    string
+		opts    Options
+		rtsp    string // URL of channel 0, "" for none
+		rtmp    bool
+		session bool // The URLs carry the jsession
+	}{
+		{"no links by default", Options{}, "", false, false},
+		{"session-free links", Options{Links: links}, "rtsp://relay.example/" + testDevice + "/0/1", false, false},
+		{"links win over the session", Options{Links: links, ExposeSession: true}, "rtsp://relay.example/" + testDevice + "/0/1", false, false},
+		{"CMSV links when allowed", Options{ExposeSession: true}, "rtsp://", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _, session := testGateway(t, tt.opts)
+			var streams Streams
+			code, body := get(t, srv, "/devices/"+testDevice+"/streams", &streams)
+			if code != http.StatusOK {
+				t.Fatalf("status %d: %s", code, body)
+			}
+			jsession, err := session.JSession(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if leaked := strings.Contains(body, jsession); leaked != tt.session {
+				t.Errorf("response contains the jsession: %v, want %v\n%s", leaked, tt.session, body)
+			}
+
+			if streams.Device != testDevice || streams.Stream != "sub" || len(streams.Streams) != 4 {
+				t.Fatalf("streams = %+v, want the 4 sub streams of %s", streams, testDevice)
+			}
+			ch := streams.Streams[0]
+			if ch.Channel != 0 || ch.Name == "" {
+				t.Errorf("channel = %+v, want channel 0 with its name", ch)
+			}
+			if !strings.HasPrefix(ch.RTSP, tt.rtsp) || (tt.rtsp == "") != (ch.RTSP == "") || (ch.RTMP != "") != tt.rtmp {
+				t.Errorf("channel = %+v, want RTSP %q and RTMP %v", ch, tt.rtsp, tt.rtmp)
+			}
+			if tt.rtsp == "" && strings.Contains(body, `"hls"`) {
+				t.Errorf("URLs listed without links:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestStreamsParameters(t *testing.T) {
+	srv, _, _ := testGateway(t, Options{Links: func(devIDNO string, channel, stream int) (string, string, string, error) {
+		return "", "", fmt.Sprintf("https://proxy.example/%d/%d", channel, stream), nil
+	}})
+
+	var streams Streams
+	if code, body := get(t, srv, "/devices/"+testDevice+"/streams?channel=2&stream=main", &streams); code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	if streams.Stream != "main" || len(streams.Streams) != 1 || streams.Streams[0].HLS != "https://proxy.example/2/0" {
+		t.Errorf("streams = %+v, want the main stream of channel 2", streams)
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/devices/" + testDevice + "/streams?stream=thumbnail", http.StatusBadRequest},
+		{"/devices/" + testDevice + "/streams?channel=-1", http.StatusBadRequest},
+		{"/devices/" + testDevice + "/streams?channel=one", http.StatusBadRequest},
+		{"/devices/999999999999/streams", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code, body := get(t, srv, tt.path, nil); code != tt.want {
+			t.Errorf("GET %s: status %d, want %d: %s", tt.path, code, tt.want, body)
+		}
+	}
+}
+
+func TestCMSVErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault simulator.Fault
+		want  int
+	}{
+		{"device not found", simulator.Fault{Code: 19}, http.StatusNotFound},
+		{"vehicle not present", simulator.Fault{Code: 18}, http.StatusNotFound},
+		{"no device permission", simulator.Fault{Code: 8}, http.StatusForbidden},
+		{"device of another company", simulator.Fault{Code: 20}, http.StatusForbidden},
+		{"invalid parameters", simulator.Fault{Code: 7}, http.StatusBadRequest},
+		{"device offline", simulator.Fault{Code: 32}, http.StatusServiceUnavailable},
+		{"system exception", simulator.Fault{Code: 6}, http.StatusBadGateway},
+		{"undocumented code", simulator.Fault{Code: 99}, http.StatusBadGateway},
+		{"server table code", simulator.Fault{Code: 5, Server: true}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, sim, _ := testGateway(t, Options{})
+			tt.fault.Action = "getDeviceStatus"
+			sim.InjectFault(tt.fault)
+			code, body := get(t, srv, "/devices/"+testDevice+"/status", nil)
+			if code != tt.want {
+				t.Errorf("status %d, want %d: %s", code, tt.want, body)
+			}
+			var e map[string]string
+			if json.Unmarshal([]byte(body), &e) != nil || e["error"] == "" {
+				t.Errorf(`body %s, want {"error": ...}`, body)
+			}
+		})
+	}
+}
+
+func TestSessionRenewal(t *testing.T) {
+	srv, sim, _ := testGateway(t, Options{})
+	if code, body := get(t, srv, "/devices", nil); code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+
+	// An expired CMSV session is renewed without the client noticing
+	sim.ExpireSessions()
+	var devices []Device
+	if code, body := get(t, srv, "/devices", &devices); code != http.StatusOK {
+		t.Fatalf("after the session expired: status %d: %s", code, body)
+	}
+	if len(devices) != 3 {
+		t.Errorf("devices = %+v, want the 3 of the fleet", devices)
+	}
+
+	// An unknown device has an empty status list
+	if code, _ := get(t, srv, "/devices/999999999999/status", nil); code != http.StatusNotFound {
+		t.Errorf("unknown device: status %d, want 404", code)
+	}
+}
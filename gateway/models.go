@@ -0,0 +1,248 @@
+package gateway
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/geo"
+)
+
+// Position is a location in WGS84 degrees
+type Position struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Device is a device with its online state
+type Device struct {
+	ID      string `json:"id"`
+	Vehicle string `json:"vehicle"`
+	Online  bool   `json:"online"`
+}
+
+// VehicleDevice is a device installed in a vehicle
+type VehicleDevice struct {
+	ID           string   `json:"id"`
+	SIM          string   `json:"sim,omitempty"`
+	Channels     int      `json:"channels"`
+	ChannelNames []string `json:"channelNames,omitempty"` // By channel number, "" if unnamed
+	InstallTime  string   `json:"installTime,omitempty"`
+}
+
+// Vehicle is a vehicle with its company and devices
+type Vehicle struct {
+	ID        int             `json:"id"`
+	Name      string          `json:"name"`
+	CompanyID int             `json:"companyId"`
+	Company   string          `json:"company"`
+	Type      string          `json:"type,omitempty"`
+	Color     string          `json:"color,omitempty"`
+	Brand     string          `json:"brand,omitempty"`
+	Owner     string          `json:"owner,omitempty"`
+	EngineNo  string          `json:"engineNo,omitempty"`
+	FrameNo   string          `json:"frameNo,omitempty"`
+	Devices   []VehicleDevice `json:"devices"`
+}
+
+// Company is a node of the company tree
+type Company struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentID int    `json:"parentId"`
+}
+
+// Fleet is the /vehicles response
+type Fleet struct {
+	Companies []Company `json:"companies"`
+	Vehicles  []Vehicle `json:"vehicles"`
+}
+
+// Driver identifies the driver reported by a device
+type Driver struct {
+	Name          string `json:"name"`
+	CertificateNo string `json:"certificateNo,omitempty"`
+}
+
+// Status is the real-time status of a device in normalized units
+type Status struct {
+	ID            string    `json:"id"`
+	Vehicle       string    `json:"vehicle"`
+	Online        bool      `json:"online"`
+	UpdatedAt     string    `json:"updatedAt"`
+	Position      *Position `json:"position"`
+	MapPosition   *Position `json:"mapPosition,omitempty"` // In the datum requested with toMap
+	MapDatum      string    `json:"mapDatum,omitempty"`
+	Address       string    `json:"address,omitempty"`
+	SpeedKmh      float64   `json:"speedKmh"`
+	TachographKmh float64   `json:"tachographSpeedKmh"`
+	HeadingDeg    int       `json:"headingDeg"`
+	FuelLiters    float64   `json:"fuelLiters"`
+	MileageKm     float64   `json:"mileageKm"`
+	ParkedSeconds int       `json:"parkedSeconds"`
+	Satellites    int       `json:"satellites"`
+	Network       string    `json:"network"`
+	Temperatures  []int     `json:"temperatures"`
+	Driver        *Driver   `json:"driver,omitempty"`
+	Summary       string    `json:"summary"`
+	Flags         []string  `json:"flags"`
+}
+
+// AlarmType is the catalog entry of an alarm type
+type AlarmType struct {
+	Code     int    `json:"code"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Severity string `json:"severity"`
+}
+
+// Alarm is an alarm in normalized units
+type Alarm struct {
+	GUID        string    `json:"guid"`
+	Device      string    `json:"device"`
+	Time        string    `json:"time"`
+	Type        AlarmType `json:"type"`
+	Description string    `json:"description,omitempty"`
+	Handled     bool      `json:"handled"`
+	Position    *Position `json:"position"`
+	SpeedKmh    float64   `json:"speedKmh"`
+	Image       string    `json:"image,omitempty"`
+}
+
+// Page describes the page of a paged response
+type Page struct {
+	Page       int `json:"page"`
+	PageSize   int `json:"pageSize"`
+	TotalPages int `json:"totalPages"`
+	Total      int `json:"total"`
+}
+
+// AlarmList is the /alarms response
+type AlarmList struct {
+	Alarms []Alarm `json:"alarms"`
+	Page   *Page   `json:"page,omitempty"`
+}
+
+// Stream holds the live stream URLs of one channel
+type Stream struct {
+	Channel int    `json:"channel"`
+	Name    string `json:"name,omitempty"`
+	RTSP    string `json:"rtsp,omitempty"`
+	RTMP    string `json:"rtmp,omitempty"`
+	HLS     string `json:"hls,omitempty"`
+}
+
+// Streams is the /devices/{id}/streams response
+type Streams struct {
+	Device  string   `json:"device"`
+	Stream  string   `json:"stream"` // "main" or "sub"
+	Streams []Stream `json:"streams"`
+}
+
+func newDevice(d cmsv.Device) Device {
+	return Device{ID: d.DID, Vehicle: d.VID, Online: d.Online == 1}
+}
+
+func newFleet(res *cmsv.VehicleResponse) Fleet {
+	fleet := Fleet{Companies: []Company{}, Vehicles: []Vehicle{}}
+	for _, c := range res.Companys {
+		fleet.Companies = append(fleet.Companies, Company{ID: c.ID, Name: c.Name, ParentID: c.PID})
+	}
+	for _, v := range res.Vehicles {
+		vehicle := Vehicle{
+			ID:        v.ID,
+			Name:      v.Name,
+			CompanyID: v.PID,
+			Company:   v.PName,
+			Type:      v.VehicleType,
+			Color:     v.VehicleColor,
+			Brand:     v.VehicleBand,
+			Owner:     v.OwnerName,
+			EngineNo:  v.EngineNum,
+			FrameNo:   v.FrameNum,
+			Devices:   []VehicleDevice{},
+		}
+		for _, d := range v.DeviceList {
+			vehicle.Devices = append(vehicle.Devices, VehicleDevice{
+				ID:           d.ID,
+				SIM:          d.SIM,
+				Channels:     d.Channels,
+				ChannelNames: channelNames(d),
+				InstallTime:  d.InstallTime,
+			})
+		}
+		fleet.Vehicles = append(fleet.Vehicles, vehicle)
+	}
+	return fleet
+}
+
+func newStatus(s cmsv.DeviceStatus, toMap int) Status {
+	status := Status{
+		ID:            s.ID,
+		Vehicle:       s.VID,
+		Online:        s.Online(),
+		UpdatedAt:     s.GT,
+		Address:       s.PS,
+		SpeedKmh:      s.SpeedKmh(),
+		TachographKmh: s.TachographSpeedKmh(),
+		HeadingDeg:    s.HX,
+		FuelLiters:    s.FuelLiters(),
+		MileageKm:     s.MileageKm(),
+		ParkedSeconds: s.PK,
+		Satellites:    s.SN,
+		Network:       s.NetworkName(),
+		Temperatures:  []int{s.T1, s.T2, s.T3, s.T4},
+	}
+	if s.HasPosition() {
+		status.Position = newPosition(s.Coord().WGS84())
+		if c, err := s.MapCoord(toMap); err == nil {
+			status.MapPosition = newPosition(c)
+			status.MapDatum = c.Datum.String()
+		}
+	}
+	if s.DriverName != "" {
+		status.Driver = &Driver{Name: s.DriverName, CertificateNo: s.DriverCertNo}
+	}
+
+	equipment := s.Equipment()
+	status.Summary = cmsv.StatusDescription(equipment)
+	status.Flags = equipment.ActiveFlags()
+	if status.Flags == nil {
+		status.Flags = []string{}
+	}
+	return status
+}
+
+func newAlarm(a cmsv.Alarm, catalog *cmsv.AlarmCatalog) Alarm {
+	t := catalog.Describe(a.Type)
+	alarm := Alarm{
+		GUID:        a.GUID,
+		Device:      a.DevIDNO,
+		Time:        a.Time,
+		Type:        AlarmType{Code: t.Code, Name: t.Name, Category: string(t.Category), Severity: t.Severity.String()},
+		Description: a.Desc,
+		Handled:     a.HD == 1,
+		SpeedKmh:    a.Gps.SpeedKmh(),
+		Image:       a.Img,
+	}
+	if a.Gps.HasPosition() {
+		alarm.Position = newPosition(a.Gps.Coord())
+	}
+	return alarm
+}
+
+func newPosition(c geo.Coord) *Position {
+	return &Position{Lat: c.Lat, Lng: c.Lng}
+}
+
+// channelNames returns the channel names of a device by channel number, or
+// nil when no channel is named
+func channelNames(d cmsv.VehicleDevice) []string {
+	var names []string
+	named := false
+	for _, ch := range d.ChannelList() {
+		names = append(names, ch.Name)
+		named = named || ch.Name != ""
+	}
+	if !named {
+		return nil
+	}
+	return names
+}
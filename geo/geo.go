@@ -0,0 +1,176 @@
+// Package geo converts coordinates between the datums used by CMSV servers:
+// WGS84 (GPS), GCJ-02 (the Chinese "Mars" datum used by Google and Amap maps
+// in China) and BD-09 (Baidu maps). Conversions are done locally, so they
+// also work for stored positions and exports.
+package geo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Datum is a geodetic datum. The values match the toMap request parameter
+// and the PositioningCoordType status bits.
+type Datum int
+
+const (
+	WGS84 Datum = iota // GPS coordinates
+	GCJ02              // Chinese national datum (Google and Amap maps in China)
+	BD09               // Baidu maps
+)
+
+func (d Datum) String() string {
+	switch d {
+	case WGS84:
+		return "WGS84"
+	case GCJ02:
+		return "GCJ-02"
+	case BD09:
+		return "BD-09"
+	}
+	return fmt.Sprintf("Datum(%d)", int(d))
+}
+
+// Valid reports whether d is a known datum
+func (d Datum) Valid() bool {
+	return d >= WGS84 && d <= BD09
+}
+
+// ParseDatum parses a datum name such as "wgs84", "gcj-02" or "bd09", or a
+// toMap number
+func ParseDatum(s string) (Datum, error) {
+	switch strings.ToLower(strings.NewReplacer("-", "", "_", "", " ", "").Replace(s)) {
+	case "wgs84", "gps", "0":
+		return WGS84, nil
+	case "gcj02", "google", "amap", "1":
+		return GCJ02, nil
+	case "bd09", "baidu", "2":
+		return BD09, nil
+	}
+	return 0, fmt.Errorf("unknown datum %q (use wgs84, gcj02 or bd09)", s)
+}
+
+// Coord is a position in degrees together with its datum
+type Coord struct {
+	Lat   float64
+	Lng   float64
+	Datum Datum
+}
+
+// IsZero reports whether c is the 0,0 position CMSV uses for "no position"
+func (c Coord) IsZero() bool {
+	return c.Lat == 0 && c.Lng == 0
+}
+
+// String formats the position as "lat, lng" with six decimals
+func (c Coord) String() string {
+	return fmt.Sprintf("%.6f, %.6f", c.Lat, c.Lng)
+}
+
+// To converts c to another datum. The zero position is never shifted.
+func (c Coord) To(d Datum) Coord {
+	if c.Datum == d || c.IsZero() {
+		c.Datum = d
+		return c
+	}
+	// Go through GCJ-02, which both other datums are defined against
+	switch c.Datum {
+	case WGS84:
+		c.Lat, c.Lng = wgs84ToGCJ02(c.Lat, c.Lng)
+	case BD09:
+		c.Lat, c.Lng = bd09ToGCJ02(c.Lat, c.Lng)
+	}
+	switch d {
+	case WGS84:
+		c.Lat, c.Lng = gcj02ToWGS84(c.Lat, c.Lng)
+	case BD09:
+		c.Lat, c.Lng = gcj02ToBD09(c.Lat, c.Lng)
+	}
+	c.Datum = d
+	return c
+}
+
+// WGS84 returns c converted to WGS84
+func (c Coord) WGS84() Coord {
+	return c.To(WGS84)
+}
+
+// MicroDegrees returns the position as integer micro-degrees, the scaling
+// of the server's lat and lng fields
+func (c Coord) MicroDegrees() (lat, lng int) {
+	return MicroDegrees(c.Lat), MicroDegrees(c.Lng)
+}
+
+// FromMicroDegrees creates a coordinate from the server's integer lat and
+// lng fields (e.g. 23004510 = 23.004510°)
+func FromMicroDegrees(lat, lng int, d Datum) Coord {
+	return Coord{Lat: float64(lat) / 1e6, Lng: float64(lng) / 1e6, Datum: d}
+}
+
+// MicroDegrees rounds degrees to integer micro-degrees
+func MicroDegrees(deg float64) int {
+	return int(math.Round(deg * 1e6))
+}
+
+// ErrNoPosition is returned when a map position is empty
+var ErrNoPosition = errors.New("no position")
+
+// ParseMapCoord parses the server's mlat and mlng strings. d is the datum
+// requested with toMap.
+func ParseMapCoord(mlat, mlng string, d Datum) (Coord, error) {
+	mlat, mlng = strings.TrimSpace(mlat), strings.TrimSpace(mlng)
+	if mlat == "" && mlng == "" {
+		return Coord{}, ErrNoPosition
+	}
+	lat, err := strconv.ParseFloat(mlat, 64)
+	if err != nil {
+		return Coord{}, fmt.Errorf("invalid map latitude %q", mlat)
+	}
+	lng, err := strconv.ParseFloat(mlng, 64)
+	if err != nil {
+		return Coord{}, fmt.Errorf("invalid map longitude %q", mlng)
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return Coord{}, fmt.Errorf("map position %s, %s out of range", mlat, mlng)
+	}
+	return Coord{Lat: lat, Lng: lng, Datum: d}, nil
+}
+
+// FormatDegrees formats one coordinate with six decimals, like the server's
+// mlat and mlng strings
+func FormatDegrees(deg float64) string {
+	return strconv.FormatFloat(deg, 'f', 6, 64)
+}
+
+// EarthRadius is the mean earth radius in meters
+const EarthRadius = 6371000.0
+
+// Distance returns the great-circle distance between two points in meters.
+// Both points are converted to WGS84 first.
+func Distance(a, b Coord) float64 {
+	a, b = a.WGS84(), b.WGS84()
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLat := lat2 - lat1
+	dLng := radians(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(h))
+}
+
+// Bearing returns the initial heading from a to b in whole degrees, 0 is
+// north and the angle grows clockwise
+func Bearing(a, b Coord) int {
+	a, b = a.WGS84(), b.WGS84()
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLng := radians(b.Lng - a.Lng)
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+	deg := math.Atan2(y, x) * 180 / math.Pi
+	return (int(math.Round(deg)) + 360) % 360
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
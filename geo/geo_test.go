@@ -0,0 +1,120 @@
+package geo
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParseDatum(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Datum
+		err  bool
+	}{
+		{"wgs84", WGS84, false},
+		{"GPS", WGS84, false},
+		{"0", WGS84, false},
+		{"gcj-02", GCJ02, false},
+		{"GCJ_02", GCJ02, false},
+		{"google", GCJ02, false},
+		{"bd09", BD09, false},
+		{"BD-09", BD09, false},
+		{"2", BD09, false},
+		{"3", 0, true},
+		{"mercator", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDatum(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseDatum(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseMapCoord(t *testing.T) {
+	tests := []struct {
+		name       string
+		mlat, mlng string
+		want       Coord
+		err        error // nil for any error when wantErr is set
+		wantErr    bool
+	}{
+		{"valid", "39.916404", "116.410244", Coord{Lat: 39.916404, Lng: 116.410244, Datum: GCJ02}, nil, false},
+		{"spaces", " -33.8688 ", "151.2093 ", Coord{Lat: -33.8688, Lng: 151.2093, Datum: GCJ02}, nil, false},
+		{"empty", "", "", Coord{}, ErrNoPosition, true},
+		{"blank", " ", "  ", Coord{}, ErrNoPosition, true},
+		{"latitude only", "39.9", "", Coord{}, nil, true},
+		{"latitude not a number", "north", "116.4", Coord{}, nil, true},
+		{"longitude not a number", "39.9", "116,4", Coord{}, nil, true},
+		{"latitude out of range", "90.5", "116.4", Coord{}, nil, true},
+		{"longitude out of range", "39.9", "-180.1", Coord{}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMapCoord(tt.mlat, tt.mlng, GCJ02)
+			if !tt.wantErr {
+				if err != nil || got != tt.want {
+					t.Errorf("ParseMapCoord = %v, %v; want %v", got, err, tt.want)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ParseMapCoord = %v, want an error", got)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && errors.Is(err, ErrNoPosition) {
+				t.Errorf("error = %v, want an invalid position rather than no position", err)
+			}
+		})
+	}
+}
+
+func TestMicroDegrees(t *testing.T) {
+	c := FromMicroDegrees(23004510, 113123456, WGS84)
+	if c.Lat != 23.00451 || c.Lng != 113.123456 || c.Datum != WGS84 {
+		t.Errorf("FromMicroDegrees = %v %s", c, c.Datum)
+	}
+	if lat, lng := c.MicroDegrees(); lat != 23004510 || lng != 113123456 {
+		t.Errorf("MicroDegrees = %d, %d", lat, lng)
+	}
+	if got := MicroDegrees(-0.0000005); got != -1 {
+		t.Errorf("MicroDegrees(-0.0000005) = %d, want -1", got)
+	}
+	if got := FormatDegrees(39.9164042815); got != "39.916404" {
+		t.Errorf("FormatDegrees = %s", got)
+	}
+}
+
+func TestDistanceAndBearing(t *testing.T) {
+	// One degree of latitude along a meridian
+	a := Coord{Lat: 30, Lng: 120}
+	b := Coord{Lat: 31, Lng: 120}
+	want := EarthRadius * math.Pi / 180
+	if d := Distance(a, b); math.Abs(d-want) > 0.01 {
+		t.Errorf("Distance = %.2f m, want %.2f m", d, want)
+	}
+	tests := []struct {
+		to   Coord
+		want int
+	}{
+		{Coord{Lat: 31, Lng: 120}, 0},
+		{Coord{Lat: 30, Lng: 121}, 90},
+		{Coord{Lat: 29, Lng: 120}, 180},
+		{Coord{Lat: 30, Lng: 119}, 270},
+	}
+	for _, tt := range tests {
+		if got := Bearing(a, tt.to); got != tt.want {
+			t.Errorf("Bearing to %v = %d, want %d", tt.to, got, tt.want)
+		}
+	}
+
+	// The same place given in different datums is no distance apart
+	gcj := a.To(GCJ02)
+	if d := Distance(a, gcj); d > 0.01 {
+		t.Errorf("Distance between the WGS84 and GCJ-02 forms of a point = %.4f m", d)
+	}
+}
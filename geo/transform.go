@@ -0,0 +1,91 @@
+package geo
+
+import "math"
+
+// Krasovsky 1940 ellipsoid used by GCJ-02
+const (
+	krasovskyA  = 6378245.0
+	krasovskyEE = 0.00669342162296594323
+
+	// bdOffset is the scaling of the BD-09 shift
+	bdOffset = math.Pi * 3000.0 / 180.0
+)
+
+// OutOfChina reports whether a WGS84 or GCJ-02 point lies outside the
+// rough bounding box of China, where GCJ-02 equals WGS84
+func OutOfChina(lat, lng float64) bool {
+	return lng < 72.004 || lng > 137.8347 || lat < 0.8293 || lat > 55.8271
+}
+
+// wgs84ToGCJ02 applies the GCJ-02 offset
+func wgs84ToGCJ02(lat, lng float64) (float64, float64) {
+	if OutOfChina(lat, lng) {
+		return lat, lng
+	}
+	dLat, dLng := gcj02Delta(lat, lng)
+	return lat + dLat, lng + dLng
+}
+
+// gcj02ToWGS84 removes the GCJ-02 offset. The offset has no closed-form
+// inverse, so the WGS84 point is refined until it maps onto the input
+// within about a millimetre.
+func gcj02ToWGS84(lat, lng float64) (float64, float64) {
+	if OutOfChina(lat, lng) {
+		return lat, lng
+	}
+	wLat, wLng := lat, lng
+	for range 30 {
+		gLat, gLng := wgs84ToGCJ02(wLat, wLng)
+		dLat, dLng := gLat-lat, gLng-lng
+		wLat -= dLat
+		wLng -= dLng
+		if math.Abs(dLat) < 1e-9 && math.Abs(dLng) < 1e-9 {
+			break
+		}
+	}
+	return wLat, wLng
+}
+
+// gcj02ToBD09 applies the Baidu offset
+func gcj02ToBD09(lat, lng float64) (float64, float64) {
+	z := math.Sqrt(lng*lng+lat*lat) + 0.00002*math.Sin(lat*bdOffset)
+	theta := math.Atan2(lat, lng) + 0.000003*math.Cos(lng*bdOffset)
+	return z*math.Sin(theta) + 0.006, z*math.Cos(theta) + 0.0065
+}
+
+// bd09ToGCJ02 removes the Baidu offset
+func bd09ToGCJ02(lat, lng float64) (float64, float64) {
+	x, y := lng-0.0065, lat-0.006
+	z := math.Sqrt(x*x+y*y) - 0.00002*math.Sin(y*bdOffset)
+	theta := math.Atan2(y, x) - 0.000003*math.Cos(x*bdOffset)
+	return z * math.Sin(theta), z * math.Cos(theta)
+}
+
+// gcj02Delta returns the GCJ-02 offset of a WGS84 point in degrees
+func gcj02Delta(lat, lng float64) (float64, float64) {
+	dLat := transformLat(lng-105.0, lat-35.0)
+	dLng := transformLng(lng-105.0, lat-35.0)
+	radLat := lat / 180.0 * math.Pi
+	magic := math.Sin(radLat)
+	magic = 1 - krasovskyEE*magic*magic
+	sqrtMagic := math.Sqrt(magic)
+	dLat = (dLat * 180.0) / ((krasovskyA * (1 - krasovskyEE)) / (magic * sqrtMagic) * math.Pi)
+	dLng = (dLng * 180.0) / (krasovskyA / sqrtMagic * math.Cos(radLat) * math.Pi)
+	return dLat, dLng
+}
+
+func transformLat(x, y float64) float64 {
+	ret := -100.0 + 2.0*x + 3.0*y + 0.2*y*y + 0.1*x*y + 0.2*math.Sqrt(math.Abs(x))
+	ret += (20.0*math.Sin(6.0*x*math.Pi) + 20.0*math.Sin(2.0*x*math.Pi)) * 2.0 / 3.0
+	ret += (20.0*math.Sin(y*math.Pi) + 40.0*math.Sin(y/3.0*math.Pi)) * 2.0 / 3.0
+	ret += (160.0*math.Sin(y/12.0*math.Pi) + 320*math.Sin(y*math.Pi/30.0)) * 2.0 / 3.0
+	return ret
+}
+
+func transformLng(x, y float64) float64 {
+	ret := 300.0 + x + 2.0*y + 0.1*x*x + 0.1*x*y + 0.1*math.Sqrt(math.Abs(x))
+	ret += (20.0*math.Sin(6.0*x*math.Pi) + 20.0*math.Sin(2.0*x*math.Pi)) * 2.0 / 3.0
+	ret += (20.0*math.Sin(x*math.Pi) + 40.0*math.Sin(x/3.0*math.Pi)) * 2.0 / 3.0
+	ret += (150.0*math.Sin(x/12.0*math.Pi) + 300.0*math.Sin(x/30.0*math.Pi)) * 2.0 / 3.0
+	return ret
+}
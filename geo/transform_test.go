@@ -0,0 +1,118 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+// Reference values of the widely used coordtransform and eviltransform
+// libraries, for Tiananmen Square in Beijing
+func TestTransformReference(t *testing.T) {
+	tests := []struct {
+		name             string
+		convert          func(lat, lng float64) (float64, float64)
+		lat, lng         float64
+		wantLat, wantLng float64
+	}{
+		{"WGS84 to GCJ-02", wgs84ToGCJ02, 39.915, 116.404, 39.91640428150164, 116.41024449916938},
+		{"GCJ-02 to BD-09", gcj02ToBD09, 39.915, 116.404, 39.92133699351021, 116.41036949371029},
+		{"BD-09 to GCJ-02", bd09ToGCJ02, 39.915, 116.404, 39.90865673957631, 116.39762729119315},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lat, lng := tt.convert(tt.lat, tt.lng)
+			if math.Abs(lat-tt.wantLat) > 1e-9 || math.Abs(lng-tt.wantLng) > 1e-9 {
+				t.Errorf("got %.9f, %.9f, want %.9f, %.9f", lat, lng, tt.wantLat, tt.wantLng)
+			}
+		})
+	}
+}
+
+// metersBetween is the distance of two points of the same datum
+func metersBetween(lat1, lng1, lat2, lng2 float64) float64 {
+	return Distance(Coord{Lat: lat1, Lng: lng1}, Coord{Lat: lat2, Lng: lng2})
+}
+
+func TestTransformRoundTrip(t *testing.T) {
+	points := []struct {
+		name     string
+		lat, lng float64
+	}{
+		{"Beijing", 39.915, 116.404},
+		{"Shanghai", 31.2304, 121.4737},
+		{"Shenzhen", 22.5431, 114.0579},
+		{"Urumqi", 43.8256, 87.6168},
+		{"Harbin", 45.8038, 126.5349},
+		{"Haikou", 20.0440, 110.1999},
+	}
+	for _, p := range points {
+		t.Run(p.name, func(t *testing.T) {
+			gLat, gLng := wgs84ToGCJ02(p.lat, p.lng)
+			// The GCJ-02 offset is a few hundred meters inside China
+			if d := metersBetween(p.lat, p.lng, gLat, gLng); d < 1 || d > 1000 {
+				t.Errorf("GCJ-02 offset %.1f m, want up to 1 km", d)
+			}
+			wLat, wLng := gcj02ToWGS84(gLat, gLng)
+			if d := metersBetween(p.lat, p.lng, wLat, wLng); d > 0.01 {
+				t.Errorf("WGS84 -> GCJ-02 -> WGS84 is %.4f m off, want under 1 cm", d)
+			}
+
+			bLat, bLng := gcj02ToBD09(p.lat, p.lng)
+			cLat, cLng := bd09ToGCJ02(bLat, bLng)
+			if d := metersBetween(p.lat, p.lng, cLat, cLng); d > 1 {
+				t.Errorf("GCJ-02 -> BD-09 -> GCJ-02 is %.4f m off, want under 1 m", d)
+			}
+
+			// Coord.To goes through GCJ-02 between WGS84 and BD-09
+			c := Coord{Lat: p.lat, Lng: p.lng, Datum: WGS84}
+			back := c.To(BD09).To(WGS84)
+			if d := Distance(c, back); d > 1 || back.Datum != WGS84 {
+				t.Errorf("WGS84 -> BD-09 -> WGS84 is %.4f m off (%s), want under 1 m", d, back.Datum)
+			}
+		})
+	}
+}
+
+func TestOutOfChina(t *testing.T) {
+	tests := []struct {
+		name     string
+		lat, lng float64
+		out      bool
+	}{
+		{"Beijing", 39.915, 116.404, false},
+		{"Berlin", 52.52, 13.405, true},
+		{"New York", 40.7128, -74.006, true},
+		{"Sydney", -33.8688, 151.2093, true},
+		{"west of the box", 39.915, 71.9, true},
+		{"north of the box", 56, 116.404, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := OutOfChina(tt.lat, tt.lng); got != tt.out {
+				t.Fatalf("OutOfChina = %v, want %v", got, tt.out)
+			}
+			if !tt.out {
+				return
+			}
+			// GCJ-02 equals WGS84 outside China, in both directions
+			for _, convert := range []func(lat, lng float64) (float64, float64){wgs84ToGCJ02, gcj02ToWGS84} {
+				if lat, lng := convert(tt.lat, tt.lng); lat != tt.lat || lng != tt.lng {
+					t.Errorf("converted to %v, %v, want the point unchanged", lat, lng)
+				}
+			}
+			c := Coord{Lat: tt.lat, Lng: tt.lng, Datum: GCJ02}
+			if w := c.WGS84(); w.Lat != tt.lat || w.Lng != tt.lng || w.Datum != WGS84 {
+				t.Errorf("WGS84() = %v %s, want the point unchanged", w, w.Datum)
+			}
+		})
+	}
+}
+
+func TestZeroPositionIsNotShifted(t *testing.T) {
+	for _, d := range []Datum{WGS84, GCJ02, BD09} {
+		c := Coord{Datum: BD09}.To(d)
+		if !c.IsZero() || c.Datum != d {
+			t.Errorf("To(%s) of 0,0 = %v %s", d, c, c.Datum)
+		}
+	}
+}
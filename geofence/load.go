@@ -0,0 +1,367 @@
+package geofence
+
+import (
+	"bytes"
+	"cmsv_api/geo"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Zone files describe the zone with these properties (GeoJSON) or
+// ExtendedData fields (KML):
+//
+//	id      unique zone ID (default: the name)
+//	name    display name (KML: the placemark name)
+//	datum   datum of the coordinates: wgs84, gcj02 or bd09
+//	dwell   dwell time before a dwell event, e.g. "15m" or seconds
+//	radius  circle radius in meters, turns a Point into a circular zone
+
+// LoadFiles reads the zones of several files. defaultDatum applies to files
+// that do not name the datum of their coordinates.
+func LoadFiles(paths []string, defaultDatum geo.Datum) ([]Zone, error) {
+	var zones []Zone
+	ids := make(map[string]string)
+	for _, path := range paths {
+		fileZones, err := LoadFile(path, defaultDatum)
+		if err != nil {
+			return nil, err
+		}
+		for _, z := range fileZones {
+			if other, ok := ids[z.ID]; ok {
+				return nil, fmt.Errorf("%s: zone %s is already defined in %s", path, z.ID, other)
+			}
+			ids[z.ID] = path
+		}
+		zones = append(zones, fileZones...)
+	}
+	return zones, nil
+}
+
+// LoadFile reads the zones of a GeoJSON (.geojson, .json) or KML (.kml) file
+func LoadFile(path string, defaultDatum geo.Datum) ([]Zone, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var zones []Zone
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".geojson", ".json":
+		zones, err = parseGeoJSON(data, defaultDatum)
+	case ".kml":
+		zones, err = parseKML(data, defaultDatum)
+	default:
+		return nil, fmt.Errorf("%s: unknown zone file type (use .geojson or .kml)", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("%s: no zones found", path)
+	}
+	for _, z := range zones {
+		if err := z.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return zones, nil
+}
+
+// zoneProps are the zone settings read from a file
+type zoneProps struct {
+	id, name, datum, dwell, radius string
+}
+
+// newZone creates a zone from its settings; index numbers unnamed zones
+func (p zoneProps) newZone(index int, defaultDatum geo.Datum) (Zone, geo.Datum, error) {
+	z := Zone{ID: p.id, Name: p.name}
+	if z.Name == "" {
+		z.Name = z.ID
+	}
+	if z.ID == "" {
+		z.ID = z.Name
+	}
+	if z.ID == "" {
+		z.ID = fmt.Sprintf("zone-%d", index+1)
+		z.Name = z.ID
+	}
+
+	datum := defaultDatum
+	if p.datum != "" {
+		d, err := geo.ParseDatum(p.datum)
+		if err != nil {
+			return Zone{}, 0, fmt.Errorf("zone %s: %v", z.ID, err)
+		}
+		datum = d
+	}
+
+	if p.dwell != "" {
+		d, err := parseDwell(p.dwell)
+		if err != nil {
+			return Zone{}, 0, fmt.Errorf("zone %s: %v", z.ID, err)
+		}
+		z.Dwell = d
+	}
+	return z, datum, nil
+}
+
+// parseDwell parses a duration such as "15m", or a number of seconds
+func parseDwell(s string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dwell time %q", s)
+	}
+	return d, nil
+}
+
+func parseRadius(id, s string) (float64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("zone %s: a point needs a radius", id)
+	}
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("zone %s: invalid radius %q", id, s)
+	}
+	return r, nil
+}
+
+// GeoJSON
+
+type geoJSONObject struct {
+	Type       string           `json:"type"`
+	Datum      string           `json:"datum"` // Foreign member, as written by the export package
+	Features   []geoJSONObject  `json:"features"`
+	ID         any              `json:"id"`
+	Geometry   *geoJSONGeometry `json:"geometry"`
+	Properties map[string]any   `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+func parseGeoJSON(data []byte, defaultDatum geo.Datum) ([]Zone, error) {
+	var root geoJSONObject
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	features := []geoJSONObject{root}
+	switch root.Type {
+	case "FeatureCollection":
+		features = root.Features
+		if root.Datum != "" {
+			d, err := geo.ParseDatum(root.Datum)
+			if err != nil {
+				return nil, err
+			}
+			defaultDatum = d
+		}
+	case "Feature":
+	default:
+		return nil, fmt.Errorf("expected a Feature or FeatureCollection, got %q", root.Type)
+	}
+
+	var zones []Zone
+	for i, f := range features {
+		if f.Geometry == nil {
+			return nil, fmt.Errorf("feature %d has no geometry", i+1)
+		}
+		props := zoneProps{
+			id:     propString(f.Properties["id"]),
+			name:   propString(f.Properties["name"]),
+			datum:  propString(f.Properties["datum"]),
+			dwell:  propString(f.Properties["dwell"]),
+			radius: propString(f.Properties["radius"]),
+		}
+		if props.id == "" {
+			props.id = propString(f.ID)
+		}
+		z, datum, err := props.newZone(i, defaultDatum)
+		if err != nil {
+			return nil, err
+		}
+
+		coords := f.Geometry.Coordinates
+		switch f.Geometry.Type {
+		case "Polygon":
+			var rings [][][]float64
+			if err := json.Unmarshal(coords, &rings); err != nil {
+				return nil, fmt.Errorf("zone %s: %v", z.ID, err)
+			}
+			z.Polygons = []Polygon{geoJSONPolygon(rings, datum)}
+		case "MultiPolygon":
+			var polygons [][][][]float64
+			if err := json.Unmarshal(coords, &polygons); err != nil {
+				return nil, fmt.Errorf("zone %s: %v", z.ID, err)
+			}
+			for _, rings := range polygons {
+				z.Polygons = append(z.Polygons, geoJSONPolygon(rings, datum))
+			}
+		case "Point":
+			var point []float64
+			if err := json.Unmarshal(coords, &point); err != nil || len(point) < 2 {
+				return nil, fmt.Errorf("zone %s: invalid point", z.ID)
+			}
+			radius, err := parseRadius(z.ID, props.radius)
+			if err != nil {
+				return nil, err
+			}
+			z.Circle = &Circle{Center: geo.Coord{Lat: point[1], Lng: point[0], Datum: datum}, RadiusMeters: radius}
+		default:
+			return nil, fmt.Errorf("zone %s: unsupported geometry %s (use Polygon, MultiPolygon or Point)", z.ID, f.Geometry.Type)
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// geoJSONPolygon converts [lng, lat] rings; the first ring is the outer boundary
+func geoJSONPolygon(rings [][][]float64, datum geo.Datum) Polygon {
+	var p Polygon
+	for i, positions := range rings {
+		var ring Ring
+		for _, pos := range positions {
+			if len(pos) >= 2 {
+				ring = append(ring, geo.Coord{Lat: pos[1], Lng: pos[0], Datum: datum})
+			}
+		}
+		if i == 0 {
+			p.Outer = ring
+		} else {
+			p.Holes = append(p.Holes, ring)
+		}
+	}
+	return p
+}
+
+// propString formats a string or number property
+func propString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// KML
+
+type kmlPlacemark struct {
+	ID       string       `xml:"id,attr"`
+	Name     string       `xml:"name"`
+	Data     []kmlData    `xml:"ExtendedData>Data"`
+	Polygons []kmlPolygon `xml:"Polygon"`
+	Multi    []kmlPolygon `xml:"MultiGeometry>Polygon"`
+	Point    *struct {
+		Coordinates string `xml:"coordinates"`
+	} `xml:"Point"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlPolygon struct {
+	Outer string   `xml:"outerBoundaryIs>LinearRing>coordinates"`
+	Inner []string `xml:"innerBoundaryIs>LinearRing>coordinates"`
+}
+
+// parseKML reads every Placemark with a Polygon, MultiGeometry of polygons
+// or Point with a radius, at any folder depth
+func parseKML(data []byte, defaultDatum geo.Datum) ([]Zone, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var zones []Zone
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "Placemark" {
+			continue
+		}
+
+		var pm kmlPlacemark
+		if err := dec.DecodeElement(&pm, &start); err != nil {
+			return nil, err
+		}
+		props := zoneProps{id: pm.ID, name: strings.TrimSpace(pm.Name)}
+		for _, d := range pm.Data {
+			value := strings.TrimSpace(d.Value)
+			switch d.Name {
+			case "id":
+				props.id = value
+			case "datum":
+				props.datum = value
+			case "dwell":
+				props.dwell = value
+			case "radius":
+				props.radius = value
+			}
+		}
+		z, datum, err := props.newZone(len(zones), defaultDatum)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kp := range append(pm.Polygons, pm.Multi...) {
+			p := Polygon{Outer: kmlRing(kp.Outer, datum)}
+			for _, inner := range kp.Inner {
+				p.Holes = append(p.Holes, kmlRing(inner, datum))
+			}
+			z.Polygons = append(z.Polygons, p)
+		}
+		if len(z.Polygons) == 0 && pm.Point != nil {
+			ring := kmlRing(pm.Point.Coordinates, datum)
+			if len(ring) != 1 {
+				return nil, fmt.Errorf("zone %s: invalid point", z.ID)
+			}
+			radius, err := parseRadius(z.ID, props.radius)
+			if err != nil {
+				return nil, err
+			}
+			z.Circle = &Circle{Center: ring[0], RadiusMeters: radius}
+		}
+		if len(z.Polygons) == 0 && z.Circle == nil {
+			continue // Lines and other placemarks are not zones
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// kmlRing parses KML coordinates: "lng,lat[,alt]" tuples separated by spaces
+func kmlRing(s string, datum geo.Datum) Ring {
+	var ring Ring
+	for _, tuple := range strings.Fields(s) {
+		parts := strings.Split(tuple, ",")
+		if len(parts) < 2 {
+			continue
+		}
+		lng, err1 := strconv.ParseFloat(parts[0], 64)
+		lat, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		ring = append(ring, geo.Coord{Lat: lat, Lng: lng, Datum: datum})
+	}
+	return ring
+}
@@ -0,0 +1,212 @@
+package geofence
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/geo"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of zone event
+type EventType string
+
+const (
+	Enter EventType = "enter"
+	Exit  EventType = "exit"
+	Dwell EventType = "dwell"
+)
+
+// Position is one device position to check
+type Position struct {
+	Device   string
+	Vehicle  string
+	Coord    geo.Coord
+	SpeedKmh float64
+	Heading  int
+	Time     time.Time
+}
+
+// PositionFromStatus returns the position of a device status, timed at t.
+// ok is false when the status has no valid position.
+func PositionFromStatus(s cmsv.DeviceStatus, t time.Time) (pos Position, ok bool) {
+	if !s.HasPosition() {
+		return Position{}, false
+	}
+	return Position{
+		Device:   s.ID,
+		Vehicle:  s.VID,
+		Coord:    s.Coord(),
+		SpeedKmh: s.SpeedKmh(),
+		Heading:  s.HX,
+		Time:     t,
+	}, true
+}
+
+// Event is a device entering, leaving or staying in a zone
+type Event struct {
+	Type     EventType
+	Zone     *Zone
+	Position Position
+	Inside   time.Duration // Time spent inside, for exit and dwell events
+}
+
+// String describes the event, e.g. "S66666 entered Depot"
+func (e Event) String() string {
+	who := e.Position.Vehicle
+	if who == "" {
+		who = e.Position.Device
+	}
+	switch e.Type {
+	case Enter:
+		return fmt.Sprintf("%s entered %s", who, e.Zone.Name)
+	case Exit:
+		return fmt.Sprintf("%s left %s after %s", who, e.Zone.Name, e.Inside.Round(time.Second))
+	case Dwell:
+		return fmt.Sprintf("%s has been in %s for %s", who, e.Zone.Name, e.Inside.Round(time.Second))
+	}
+	return fmt.Sprintf("%s: %s %s", who, e.Type, e.Zone.Name)
+}
+
+// AlarmType returns the alarm type code of the event
+func (e Event) AlarmType() int {
+	switch e.Type {
+	case Exit:
+		return cmsv.AlarmGeofenceExit
+	case Dwell:
+		return cmsv.AlarmGeofenceDwell
+	}
+	return cmsv.AlarmGeofenceEnter
+}
+
+// Alarm converts the event to an alarm, so it can be journaled and sent to
+// webhooks like the alarms from the server. The GUID is derived from the
+// device, zone, event and time, so the same event always gets the same GUID.
+func (e Event) Alarm() cmsv.Alarm {
+	p := e.Position
+	when := p.Time.Format(cmsv.TimeLayout)
+	sum := sha1.Sum([]byte(fmt.Sprintf("geofence|%s|%s|%s|%s", p.Device, e.Zone.ID, e.Type, when)))
+	lat, lng := p.Coord.WGS84().MicroDegrees()
+	return cmsv.Alarm{
+		DevIDNO: p.Device,
+		Desc:    e.String(),
+		GUID:    hex.EncodeToString(sum[:16]),
+		SrcTm:   when,
+		Time:    when,
+		Type:    e.AlarmType(),
+		P1:      int(e.Inside.Seconds()),
+		Gps: cmsv.AlarmGPS{
+			GT:  when,
+			HX:  p.Heading,
+			Lat: lat,
+			Lng: lng,
+			SP:  int(math.Round(p.SpeedKmh * 10)),
+		},
+	}
+}
+
+// presence is what the monitor knows about one device in one zone
+type presence struct {
+	inside  bool
+	since   time.Time // When the device was first seen inside
+	dwelled bool      // Dwell event reported for this stay
+}
+
+type presenceKey struct {
+	device string
+	zone   string
+}
+
+// Monitor tracks which devices are in which zones. The first position of a
+// device only sets its starting state: a device already inside a zone does
+// not produce an enter event, but its dwell time counts from then. It is
+// safe for concurrent use.
+type Monitor struct {
+	zones []Zone
+
+	mu    sync.Mutex
+	state map[presenceKey]*presence
+}
+
+// NewMonitor creates a monitor for zones
+func NewMonitor(zones []Zone) *Monitor {
+	return &Monitor{zones: zones, state: make(map[presenceKey]*presence)}
+}
+
+// Zones returns the monitored zones
+func (m *Monitor) Zones() []Zone {
+	return m.zones
+}
+
+// Update checks one position and returns the resulting events
+func (m *Monitor) Update(p Position) []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []Event
+	for i := range m.zones {
+		z := &m.zones[i]
+		key := presenceKey{device: p.Device, zone: z.ID}
+		inside := z.Contains(p.Coord)
+
+		s, known := m.state[key]
+		if !known {
+			s = &presence{inside: inside}
+			if inside {
+				s.since = p.Time
+			}
+			m.state[key] = s
+			continue
+		}
+
+		switch {
+		case inside && !s.inside:
+			*s = presence{inside: true, since: p.Time}
+			events = append(events, Event{Type: Enter, Zone: z, Position: p})
+		case !inside && s.inside:
+			events = append(events, Event{Type: Exit, Zone: z, Position: p, Inside: p.Time.Sub(s.since)})
+			*s = presence{}
+		case inside && z.Dwell > 0 && !s.dwelled && p.Time.Sub(s.since) >= z.Dwell:
+			s.dwelled = true
+			events = append(events, Event{Type: Dwell, Zone: z, Position: p, Inside: p.Time.Sub(s.since)})
+		}
+	}
+	return events
+}
+
+// UpdateStatuses checks the positions of device statuses taken at t.
+// Statuses without a valid position are skipped and keep their zone state.
+func (m *Monitor) UpdateStatuses(statuses []cmsv.DeviceStatus, t time.Time) []Event {
+	var events []Event
+	for _, s := range statuses {
+		if p, ok := PositionFromStatus(s, t); ok {
+			events = append(events, m.Update(p)...)
+		}
+	}
+	return events
+}
+
+// Inside returns the zones a device was in at its last update
+func (m *Monitor) Inside(device string) []*Zone {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var zones []*Zone
+	for i := range m.zones {
+		if s, ok := m.state[presenceKey{device: device, zone: m.zones[i].ID}]; ok && s.inside {
+			zones = append(zones, &m.zones[i])
+		}
+	}
+	return zones
+}
+
+// Alarms converts events to alarms
+func Alarms(events []Event) []cmsv.Alarm {
+	alarms := make([]cmsv.Alarm, 0, len(events))
+	for _, e := range events {
+		alarms = append(alarms, e.Alarm())
+	}
+	return alarms
+}
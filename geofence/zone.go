@@ -0,0 +1,102 @@
+// Package geofence checks device positions against client-defined zones and
+// reports enter, exit and dwell events. Zones are polygons or circles loaded
+// from GeoJSON or KML files, in any datum: positions are converted to the
+// datum of each zone before they are compared, so WGS84 device positions
+// work with zones drawn on GCJ-02 or BD-09 maps.
+package geofence
+
+import (
+	"cmsv_api/geo"
+	"fmt"
+	"time"
+)
+
+// Ring is a closed polygon boundary. The closing point may be omitted.
+type Ring []geo.Coord
+
+// Polygon is an outer boundary with optional holes
+type Polygon struct {
+	Outer Ring
+	Holes []Ring
+}
+
+// Circle is a center point and a radius
+type Circle struct {
+	Center       geo.Coord
+	RadiusMeters float64
+}
+
+// Zone is a named area made of one or more polygons, or a circle
+type Zone struct {
+	ID       string
+	Name     string
+	Polygons []Polygon
+	Circle   *Circle
+	Dwell    time.Duration // Report a dwell event after this long inside; 0 disables dwell events
+}
+
+// Validate checks that the zone has a usable shape
+func (z Zone) Validate() error {
+	if z.ID == "" {
+		return fmt.Errorf("zone %q: missing id", z.Name)
+	}
+	if z.Circle == nil && len(z.Polygons) == 0 {
+		return fmt.Errorf("zone %s: no polygon or circle", z.ID)
+	}
+	if z.Circle != nil && z.Circle.RadiusMeters <= 0 {
+		return fmt.Errorf("zone %s: circle radius must be positive", z.ID)
+	}
+	for _, p := range z.Polygons {
+		if len(p.Outer) < 3 {
+			return fmt.Errorf("zone %s: polygon needs at least 3 points", z.ID)
+		}
+	}
+	if z.Dwell < 0 {
+		return fmt.Errorf("zone %s: negative dwell time", z.ID)
+	}
+	return nil
+}
+
+// Contains reports whether a position lies inside the zone. Points on a
+// polygon edge may fall on either side.
+func (z Zone) Contains(c geo.Coord) bool {
+	if z.Circle != nil {
+		return geo.Distance(z.Circle.Center, c) <= z.Circle.RadiusMeters
+	}
+	for _, p := range z.Polygons {
+		if p.contains(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Polygon) contains(c geo.Coord) bool {
+	if !p.Outer.contains(c) {
+		return false
+	}
+	for _, hole := range p.Holes {
+		if hole.contains(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// contains is the even-odd ray casting test. Zones are small enough to
+// treat degrees as planar coordinates.
+func (r Ring) contains(c geo.Coord) bool {
+	if len(r) == 0 {
+		return false
+	}
+	c = c.To(r[0].Datum)
+	inside := false
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		a, b := r[i], r[j]
+		if (a.Lat > c.Lat) != (b.Lat > c.Lat) &&
+			c.Lng < (b.Lng-a.Lng)*(c.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,1672 @@
+//go:build !nogui
+
+package main
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/export"
+	"cmsv_api/geo"
+	"cmsv_api/geofence"
+	"cmsv_api/playlist"
+	"cmsv_api/probe"
+	"cmsv_api/recorder"
+	"context"
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/app"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func appIcon() fyne.Resource {
+	// Return the default Fyne icon instead of trying to load a custom one
+	// This avoids the PNG decoding error
+	return theme.FyneLogo()
+}
+
+// runGUI opens the main application window and blocks until it is closed
+func runGUI(client *cmsv.Client) error {
+	ctx := context.Background()
+
+	myApp := app.New()
+	myWindow := myApp.NewWindow("CMSV Video Generator Link")
+	myWindow.SetIcon(appIcon())
+
+	accountEntry := widget.NewEntry()
+	accountEntry.SetPlaceHolder("Enter Account")
+	passwordEntry := widget.NewPasswordEntry()
+	passwordEntry.SetPlaceHolder("Enter Password")
+
+	output := widget.NewMultiLineEntry()
+	output.SetPlaceHolder("Results will appear here...")
+	output.SetMinRowsVisible(15)
+
+	// Create a dropdown for device selection
+	deviceSelector := widget.NewSelect([]string{"Login first to see devices"}, func(selected string) {
+		// This will be handled when a device is selected
+	})
+	deviceSelector.PlaceHolder = "Select Device IDNO"
+	deviceSelector.Disable() // Disable until logged in
+
+	// Create a dropdown for coordinate system selection
+	coordSystems := []string{
+		"0 - WGS84 (Default)",
+		"1 - Google (GJ02)",
+		"2 - Baidu (BD09)",
+	}
+	coordSystemSelector := widget.NewSelect(coordSystems, nil)
+	coordSystemSelector.SetSelected(coordSystems[0])
+
+	var allLinks map[string]map[string]string
+	var exportPoints []export.Point // Positions of the alarms or statuses shown last
+	var exportName string
+	var shownAlarms []cmsv.Alarm         // Alarms shown last, newest first, for the alarm video action
+	var deviceMap map[string]cmsv.Device // Map to store device names to their IDs
+	var session *cmsv.Session            // Shared session, reused until the credentials change
+	var vehicles *cmsv.VehicleResponse   // Vehicle information for the channels of the devices
+
+	// sessionFor returns the current session if it belongs to account, or a new one
+	sessionFor := func(account, password string) *cmsv.Session {
+		if session == nil || session.Account() != account {
+			session = client.NewSession(account, password)
+		}
+		return session
+	}
+
+	// loadVehicles returns the vehicle information, fetching it once per
+	// login; it is nil before the login or when the fetch fails
+	loadVehicles := func() *cmsv.VehicleResponse {
+		if vehicles == nil && session != nil {
+			if info, err := session.VehicleInfo(ctx); err == nil {
+				vehicles = info
+			}
+		}
+		return vehicles
+	}
+
+	// channelsOf returns the channels of a device with their names
+	channelsOf := func(devIDNO string) []cmsv.Channel {
+		return cmsv.DeviceChannels(loadVehicles(), devIDNO)
+	}
+
+	loginBtn := widget.NewButton("Login and Fetch Devices", func() {
+		account := strings.TrimSpace(accountEntry.Text)
+		password := strings.TrimSpace(passwordEntry.Text)
+
+		if account == "" || password == "" {
+			dialog.ShowError(fmt.Errorf("please enter both account and password"), myWindow)
+			return
+		}
+
+		session = client.NewSession(account, password)
+		vehicles = nil
+		jsession, err := session.Login(ctx)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("Login failed: %v", err), myWindow)
+			return
+		}
+
+		devices, err := session.Devices(ctx)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("Device fetch failed: %v", err), myWindow)
+			return
+		}
+
+		// Update the device selector with actual devices
+		deviceOptions := []string{"All Devices"}
+		deviceMap = make(map[string]cmsv.Device)
+
+		for _, d := range devices {
+			deviceName := deviceKey(d)
+			deviceOptions = append(deviceOptions, deviceName)
+			deviceMap[deviceName] = d
+		}
+
+		deviceSelector.Options = deviceOptions
+		deviceSelector.Enable()
+		deviceSelector.SetSelected("All Devices")
+
+		allLinks = deviceLinks(client, jsession, devices, account, password)
+		output.SetText(formatDeviceLinks(devices, allLinks))
+	})
+
+	saveBtn := widget.NewButton("Save to File", func() {
+		var choices []string
+		if allLinks != nil {
+			choices = append(choices, "Device links (.txt)")
+		}
+		if len(exportPoints) > 0 {
+			choices = append(choices, "GeoJSON (.geojson)", "KML (.kml)", "GPX (.gpx)")
+		}
+		if session != nil {
+			choices = append(choices, "Stream playlist (.m3u)", "Stream playlist (.xspf)", "Stream links (.csv)", "Stream links (.json)")
+		}
+		if len(choices) == 0 {
+			dialog.ShowInformation("Info", "No data to save yet", myWindow)
+			return
+		}
+
+		formatSelector := widget.NewSelect(choices, nil)
+		formatSelector.SetSelected(choices[0])
+		datumSelector := widget.NewSelect(coordSystems, nil)
+		datumSelector.SetSelected(coordSystems[0])
+		tracksCheck := widget.NewCheck("Connect the points of each device into a track", nil)
+
+		items := []*widget.FormItem{widget.NewFormItem("Format", formatSelector)}
+		if len(exportPoints) > 0 {
+			items = append(items,
+				widget.NewFormItem("Coordinates", datumSelector),
+				widget.NewFormItem("", tracksCheck),
+			)
+		}
+
+		// Stream links cover the selected device, or every device of a company
+		companyOptions := []string{"All Companies"}
+		if info := loadVehicles(); info != nil {
+			for _, c := range info.Companys {
+				companyOptions = append(companyOptions, c.Name)
+			}
+		}
+		companySelector := widget.NewSelect(companyOptions, nil)
+		companySelector.SetSelected(companyOptions[0])
+		streamGroup := widget.NewCheckGroup(playlist.StreamNames, nil)
+		streamGroup.SetSelected(playlist.StreamNames)
+		streamGroup.Horizontal = true
+		protocolGroup := widget.NewCheckGroup(playlist.Protocols, nil)
+		protocolGroup.SetSelected(playlist.Protocols)
+		protocolGroup.Horizontal = true
+		if session != nil {
+			items = append(items,
+				widget.NewFormItem("Company", companySelector),
+				widget.NewFormItem("Streams", streamGroup),
+				widget.NewFormItem("Protocols", protocolGroup),
+			)
+		}
+		dialog.ShowForm("Save to File", "Save", "Cancel", items, func(save bool) {
+			if !save {
+				return
+			}
+			if strings.HasPrefix(formatSelector.Selected, "Device links") {
+				if err := saveToFile(accountEntry.Text, allLinks); err != nil {
+					dialog.ShowError(err, myWindow)
+				} else {
+					dialog.ShowInformation("Success", "File saved successfully", myWindow)
+				}
+				return
+			}
+
+			if strings.HasPrefix(formatSelector.Selected, "Stream") {
+				// "Stream playlist (.m3u)" -> m3u
+				format, _ := playlist.ParseFormat(strings.Trim(strings.Fields(formatSelector.Selected)[2], "()"))
+				sel := playlist.Selection{Protocols: protocolGroup.Selected}
+				if companySelector.Selected != "All Companies" {
+					sel.Companies = []string{companySelector.Selected}
+				}
+				if d, ok := deviceMap[deviceSelector.Selected]; ok {
+					sel.Devices = []string{d.DID}
+				}
+				for _, name := range streamGroup.Selected {
+					stream, _ := parseStreamType(name)
+					sel.Streams = append(sel.Streams, stream)
+				}
+				if len(sel.Streams) == 0 || len(sel.Protocols) == 0 {
+					dialog.ShowInformation("Error", "Please select at least one stream and protocol", myWindow)
+					return
+				}
+				cameras, err := fleetLinks(ctx, session, "", sel)
+				if err != nil {
+					dialog.ShowError(err, myWindow)
+					return
+				}
+				if len(cameras) == 0 {
+					dialog.ShowInformation("Info", "No cameras match the selection", myWindow)
+					return
+				}
+
+				saveDialog := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+					if err != nil {
+						dialog.ShowError(err, myWindow)
+						return
+					}
+					if w == nil {
+						return // Cancelled
+					}
+					if err := playlist.Write(w, format, cameras, playlist.Options{Name: "CMSV live streams"}); err != nil {
+						w.Close()
+						dialog.ShowError(fmt.Errorf("export failed: %v", err), myWindow)
+						return
+					}
+					if err := w.Close(); err != nil {
+						dialog.ShowError(err, myWindow)
+						return
+					}
+					dialog.ShowInformation("Saved", fmt.Sprintf("Exported the links of %d camera streams to %s", len(cameras), w.URI().Name()), myWindow)
+				}, myWindow)
+				saveDialog.SetFileName(fmt.Sprintf("stream-links-%s%s", time.Now().Format("2006-01-02"), format.Ext()))
+				saveDialog.Show()
+				return
+			}
+
+			// "GeoJSON (.geojson)" -> geojson
+			format, err := export.ParseFormat(strings.Fields(formatSelector.Selected)[0])
+			if err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+			datum, _ := geo.ParseDatum(datumSelector.Selected[:1])
+			points, name := exportPoints, exportName
+			opts := export.Options{Name: name, Datum: datum, Tracks: tracksCheck.Checked}
+
+			saveDialog := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+				if err != nil {
+					dialog.ShowError(err, myWindow)
+					return
+				}
+				if w == nil {
+					return // Cancelled
+				}
+				if err := export.Write(w, format, points, opts); err != nil {
+					w.Close()
+					dialog.ShowError(fmt.Errorf("export failed: %v", err), myWindow)
+					return
+				}
+				if err := w.Close(); err != nil {
+					dialog.ShowError(err, myWindow)
+					return
+				}
+				dialog.ShowInformation("Saved", fmt.Sprintf("Exported %d points to %s", len(points), w.URI().Name()), myWindow)
+			}, myWindow)
+			saveDialog.SetFileName(exportFileName(name, format))
+			saveDialog.Show()
+		}, myWindow)
+	})
+
+	vehicleInfoBtn := widget.NewButton("VEHICLE INFORMATION", func() {
+		account := strings.TrimSpace(accountEntry.Text)
+		password := strings.TrimSpace(passwordEntry.Text)
+
+		if account == "" || password == "" {
+			dialog.ShowError(fmt.Errorf("please enter both account and password"), myWindow)
+			return
+		}
+
+		vehicleInfo, err := sessionFor(account, password).VehicleInfo(ctx)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("Vehicle info fetch failed: %v", err), myWindow)
+			return
+		}
+		vehicles = vehicleInfo
+
+		vehicleInfoText := formatVehicleInfo(vehicleInfo, config.ShowCompanyHierarchy)
+		output.SetText(vehicleInfoText)
+
+		// Show additional options dialog
+		dialog.ShowCustomConfirm("Vehicle Information Options", "OK", "Cancel",
+			container.NewVBox(
+				widget.NewLabel("Vehicle information has been displayed."),
+				widget.NewLabel("Choose an action:"),
+				container.NewGridWithColumns(2,
+					widget.NewButton("Save to File", func() {
+						filename := fmt.Sprintf("vehicle_info_%s_%s.txt", account, time.Now().Format("2006-01-02_15-04-05"))
+						err := os.WriteFile(filename, []byte(vehicleInfoText), 0644)
+						if err != nil {
+							dialog.ShowError(fmt.Errorf("failed to save file: %v", err), myWindow)
+						} else {
+							dialog.ShowInformation("Saved", fmt.Sprintf("Vehicle information saved to %s", filename), myWindow)
+						}
+					}),
+					widget.NewButton("Copy to Clipboard", func() {
+						myWindow.Clipboard().SetContent(vehicleInfoText)
+						dialog.ShowInformation("Copied", "Vehicle information copied to clipboard", myWindow)
+					}),
+				),
+			),
+			func(confirmed bool) {
+				// Dialog closed, no action needed
+			},
+			myWindow)
+	})
+
+	// Paging state of the alarm views. loadAlarmPage fetches and renders one
+	// page of the current alarm or alarm history query.
+	var loadAlarmPage func(page int) (string, cmsv.Pagination, error)
+	currentPage := 0
+	pageLabel := widget.NewLabel("")
+	prevPageBtn := widget.NewButton("◀ Previous Page", nil)
+	nextPageBtn := widget.NewButton("Next Page ▶", nil)
+	prevPageBtn.Disable()
+	nextPageBtn.Disable()
+
+	// showAlarmPage displays one page of the current query and updates the pager
+	showAlarmPage := func(page int) {
+		text, pagination, err := loadAlarmPage(page)
+		if err != nil {
+			dialog.ShowError(err, myWindow)
+			return
+		}
+		currentPage = page
+
+		output.SetText(text)
+
+		totalPages := max(pagination.TotalPages, 1)
+		pageLabel.SetText(fmt.Sprintf("Page %d of %d (%d alarms)", page, totalPages, pagination.TotalRecords))
+		if page > 1 {
+			prevPageBtn.Enable()
+		} else {
+			prevPageBtn.Disable()
+		}
+		if page < pagination.TotalPages {
+			nextPageBtn.Enable()
+		} else {
+			nextPageBtn.Disable()
+		}
+	}
+	prevPageBtn.OnTapped = func() { showAlarmPage(currentPage - 1) }
+	nextPageBtn.OnTapped = func() { showAlarmPage(currentPage + 1) }
+
+	alarmBtn := widget.NewButton("GET DEVICE ALARMS", func() {
+		if session == nil {
+			dialog.ShowError(fmt.Errorf("please login first"), myWindow)
+			return
+		}
+
+		selectedDevice := deviceSelector.Selected
+		if selectedDevice == "" {
+			dialog.ShowError(fmt.Errorf("please select a device"), myWindow)
+			return
+		}
+
+		// Get the device ID based on selection
+		var deviceID string
+		if selectedDevice == "All Devices" {
+			deviceID = "" // Empty string means all devices
+		} else if device, ok := deviceMap[selectedDevice]; ok {
+			deviceID = device.DID
+		} else {
+			dialog.ShowError(fmt.Errorf("invalid device selection"), myWindow)
+			return
+		}
+
+		// Get coordinate system selection
+		toMap := 0 // Default to WGS84
+		selectedCoordSystem := coordSystemSelector.Selected
+		if strings.HasPrefix(selectedCoordSystem, "1 -") {
+			toMap = 1 // Google
+		} else if strings.HasPrefix(selectedCoordSystem, "2 -") {
+			toMap = 2 // Baidu
+		}
+
+		query := cmsv.AlarmQuery{DevIDNO: deviceID, ToMap: toMap, PageSize: config.AlarmPageSize}
+		loadAlarmPage = func(page int) (string, cmsv.Pagination, error) {
+			query.Page = page
+			alarmData, err := session.AlarmPage(ctx, query)
+			if err != nil {
+				return "", cmsv.Pagination{}, fmt.Errorf("alarm fetch failed: %v", err)
+			}
+
+			// Log alarms to file for future reference
+			recordAlarms(alarmData.AlarmList)
+
+			exportPoints, exportName = export.FromAlarms(alarmData.AlarmList, config.AlarmTypes), "Alarms"
+			shownAlarms = alarmData.AlarmList
+			return formatAlarms(alarmData.AlarmList), alarmData.Pagination, nil
+		}
+		showAlarmPage(1)
+	})
+
+	alarmHistoryBtn := widget.NewButton("ALARM HISTORY", func() {
+		if session == nil {
+			dialog.ShowError(fmt.Errorf("please login first"), myWindow)
+			return
+		}
+
+		// Prefill the selected device, or every device for "All Devices"
+		var deviceIDs []string
+		if device, ok := deviceMap[deviceSelector.Selected]; ok {
+			deviceIDs = []string{device.DID}
+		} else {
+			for _, device := range deviceMap {
+				deviceIDs = append(deviceIDs, device.DID)
+			}
+		}
+
+		now := time.Now()
+		beginEntry := widget.NewEntry()
+		beginEntry.SetText(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).Format(cmsv.TimeLayout))
+		endEntry := widget.NewEntry()
+		endEntry.SetText(now.Format(cmsv.TimeLayout))
+		devicesEntry := widget.NewEntry()
+		devicesEntry.SetText(strings.Join(deviceIDs, ","))
+		typesEntry := widget.NewEntry()
+		typesEntry.SetPlaceHolder("All types (e.g. 11,12)")
+		handledSelector := widget.NewSelect([]string{"All", "Unprocessed", "Processed"}, nil)
+		handledSelector.SetSelected("All")
+
+		items := []*widget.FormItem{
+			widget.NewFormItem("Begin", beginEntry),
+			widget.NewFormItem("End", endEntry),
+			widget.NewFormItem("Devices", devicesEntry),
+			widget.NewFormItem("Alarm Types", typesEntry),
+			widget.NewFormItem("Handled", handledSelector),
+		}
+		dialog.ShowForm("Alarm History Search", "Search", "Cancel", items, func(search bool) {
+			if !search {
+				return
+			}
+
+			query := cmsv.AlarmHistoryQuery{
+				DevIDNO:  splitList(devicesEntry.Text),
+				PageSize: config.AlarmPageSize,
+			}
+			var err error
+			if query.Begin, err = parseHistoryTime(beginEntry.Text, false); err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+			if query.End, err = parseHistoryTime(endEntry.Text, true); err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+			if query.Types, err = parseAlarmTypes(typesEntry.Text); err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+			if query.Handled, err = parseHandleStatus(handledSelector.Selected); err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+
+			// Get coordinate system selection
+			selectedCoordSystem := coordSystemSelector.Selected
+			if strings.HasPrefix(selectedCoordSystem, "1 -") {
+				query.ToMap = 1 // Google
+			} else if strings.HasPrefix(selectedCoordSystem, "2 -") {
+				query.ToMap = 2 // Baidu
+			}
+
+			loadAlarmPage = func(page int) (string, cmsv.Pagination, error) {
+				query.Page = page
+				history, err := session.AlarmHistoryPage(ctx, query)
+				if err != nil {
+					return "", cmsv.Pagination{}, fmt.Errorf("alarm history search failed: %v", err)
+				}
+				exportPoints, exportName = export.FromAlarmDetails(history.Alarms, config.AlarmTypes), "Alarm history"
+				shownAlarms = nil
+				for _, d := range history.Alarms {
+					shownAlarms = append(shownAlarms, d.Alarm())
+				}
+				return formatAlarmHistory(history.Alarms), history.Pagination, nil
+			}
+			showAlarmPage(1)
+		}, myWindow)
+	})
+
+	trackBtn := widget.NewButton("TRACK PLAYBACK", func() {
+		if session == nil {
+			dialog.ShowError(fmt.Errorf("please login first"), myWindow)
+			return
+		}
+		device, ok := deviceMap[deviceSelector.Selected]
+		if !ok {
+			dialog.ShowError(fmt.Errorf("please select a specific device"), myWindow)
+			return
+		}
+
+		now := time.Now()
+		beginEntry := widget.NewEntry()
+		beginEntry.SetText(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).Format(cmsv.TimeLayout))
+		endEntry := widget.NewEntry()
+		endEntry.SetText(now.Format(cmsv.TimeLayout))
+		distanceEntry := widget.NewEntry()
+		distanceEntry.SetPlaceHolder("0 (every point)")
+
+		items := []*widget.FormItem{
+			widget.NewFormItem("Begin", beginEntry),
+			widget.NewFormItem("End", endEntry),
+			widget.NewFormItem("Min. Distance (km)", distanceEntry),
+		}
+		dialog.ShowForm("Track Playback: "+deviceKey(device), "Load", "Cancel", items, func(load bool) {
+			if !load {
+				return
+			}
+
+			query := cmsv.TrackQuery{DevIDNO: device.DID, PageSize: cmsv.DefaultPageSize}
+			var err error
+			if query.Begin, err = parseHistoryTime(beginEntry.Text, false); err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+			if query.End, err = parseHistoryTime(endEntry.Text, true); err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+			if text := strings.TrimSpace(distanceEntry.Text); text != "" {
+				if query.DistanceKm, err = strconv.ParseFloat(text, 64); err != nil {
+					dialog.ShowError(fmt.Errorf("invalid distance %q", text), myWindow)
+					return
+				}
+			}
+
+			// Get coordinate system selection
+			selectedCoordSystem := coordSystemSelector.Selected
+			if strings.HasPrefix(selectedCoordSystem, "1 -") {
+				query.ToMap = 1 // Google
+			} else if strings.HasPrefix(selectedCoordSystem, "2 -") {
+				query.ToMap = 2 // Baidu
+			}
+
+			track, err := session.Track(ctx, query)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("track fetch failed: %v", err), myWindow)
+				return
+			}
+			output.SetText(formatTrack(track))
+			if len(track.Points) == 0 {
+				dialog.ShowInformation("Track Playback", "No positions recorded in this time range", myWindow)
+				return
+			}
+			exportPoints, exportName = export.FromTrack(track), "Track "+trackTitle(track)
+			showTrackPlayback(myApp, track)
+		}, myWindow)
+	})
+
+	deviceStatusBtn := widget.NewButton("DEVICE STATUS", func() {
+		if session == nil {
+			dialog.ShowError(fmt.Errorf("please login first"), myWindow)
+			return
+		}
+
+		// Query the selected device, or every device for "All Devices"
+		query := cmsv.DeviceStatusQuery{Language: "en"}
+		selectedDevice := deviceSelector.Selected
+		if device, ok := deviceMap[selectedDevice]; ok {
+			query.DevIDNO = []string{device.DID}
+		} else if selectedDevice != "All Devices" {
+			dialog.ShowError(fmt.Errorf("please select a device"), myWindow)
+			return
+		}
+
+		// Get coordinate system selection
+		selectedCoordSystem := coordSystemSelector.Selected
+		if strings.HasPrefix(selectedCoordSystem, "1 -") {
+			query.ToMap = 1 // Google
+		} else if strings.HasPrefix(selectedCoordSystem, "2 -") {
+			query.ToMap = 2 // Baidu
+		}
+
+		statuses, err := session.DeviceStatus(ctx, query)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("device status fetch failed: %v", err), myWindow)
+			return
+		}
+
+		exportPoints, exportName = export.FromStatuses(statuses), "Vehicle positions"
+		output.SetText(formatDeviceStatus(statuses))
+	})
+
+	// Add refresh button to continuously fetch alarms
+	var refreshTicker *time.Ticker
+	var stopRefresh chan bool
+	var refreshBtn *widget.Button
+	refreshBtn = widget.NewButton("AUTO REFRESH ALARMS", func() {
+		if refreshTicker != nil {
+			// Stop auto-refresh
+			stopRefresh <- true
+			refreshTicker = nil
+			refreshBtn.SetText("AUTO REFRESH ALARMS")
+			dialog.ShowInformation("Auto-refresh", "Auto-refresh stopped", myWindow)
+			return
+		}
+
+		// Start auto-refresh
+		const timeoutSec = 5
+		message := fmt.Sprintf("Start auto-refreshing alarms every %d seconds?", timeoutSec)
+
+		dialog.ShowConfirm("Auto-refresh", message, func(start bool) {
+			if !start {
+				return
+			}
+
+			// Configured zones are checked against the device positions on
+			// every refresh, and their events are shown with the alarms
+			var zoneMonitor *geofence.Monitor
+			if len(config.GeofenceZones) > 0 {
+				zones, err := geofence.LoadFiles(config.GeofenceZones, config.GeofenceDatum)
+				if err != nil {
+					dialog.ShowError(fmt.Errorf("geofence zones: %v", err), myWindow)
+					return
+				}
+				zoneMonitor = geofence.NewMonitor(zones)
+			}
+
+			// Setup channels
+			refreshTicker = time.NewTicker(time.Duration(timeoutSec) * time.Second)
+			stopRefresh = make(chan bool)
+			refreshBtn.SetText("STOP AUTO REFRESH")
+
+			// The poller remembers the alarm GUIDs it has seen, so each poll
+			// only returns new alarms
+			poller := session.NewAlarmPoller(cmsv.AlarmQuery{PageSize: config.AlarmPageSize})
+			var history string // Alarms shown so far, newest first
+			started := false
+			exportPoints, exportName = nil, "Auto-refresh alarms"
+			shownAlarms = nil
+
+			// Start refresh goroutine
+			go func() {
+				for {
+					select {
+					case <-refreshTicker.C:
+						// Get device ID based on selection
+						var deviceID string
+						if deviceSelector.Selected == "All Devices" {
+							deviceID = "" // Empty string means all devices
+						} else if device, ok := deviceMap[deviceSelector.Selected]; ok {
+							deviceID = device.DID
+						} else {
+							continue
+						}
+
+						// Get coordinate system
+						toMap := 0 // Default to WGS84
+						selectedCoordSystem := coordSystemSelector.Selected
+						if strings.HasPrefix(selectedCoordSystem, "1 -") {
+							toMap = 1 // Google
+						} else if strings.HasPrefix(selectedCoordSystem, "2 -") {
+							toMap = 2 // Baidu
+						}
+
+						// Fetch alarms not seen in earlier polls
+						poller.SetQuery(cmsv.AlarmQuery{DevIDNO: deviceID, ToMap: toMap, PageSize: config.AlarmPageSize})
+						// A failed poll still checks the zones, so geofence events are not lost
+						newAlarms, pollErr := poller.Poll(ctx)
+						if zoneMonitor != nil {
+							statusQuery := cmsv.DeviceStatusQuery{Language: "en"}
+							if deviceID != "" {
+								statusQuery.DevIDNO = []string{deviceID}
+							}
+							if statuses, err := session.DeviceStatus(ctx, statusQuery); err == nil {
+								events := zoneMonitor.UpdateStatuses(statuses, time.Now())
+								newAlarms = append(geofence.Alarms(events), newAlarms...)
+							}
+						}
+						if len(newAlarms) == 0 && (started || pollErr != nil) {
+							continue // Nothing new, keep the current output
+						}
+
+						// Log only the new alarms
+						recordAlarms(newAlarms)
+						points := export.FromAlarms(newAlarms, config.AlarmTypes)
+						fyne.Do(func() {
+							exportPoints = append(exportPoints, points...)
+							shownAlarms = append(slices.Clone(newAlarms), shownAlarms...)
+						})
+
+						// Put the new alarms above the ones shown earlier
+						builder := strings.Builder{}
+						now := time.Now().Format("15:04:05")
+						if !started {
+							builder.WriteString(fmt.Sprintf("=== AUTO REFRESH ALARMS (%s) ===\n", now))
+							if len(newAlarms) == 0 {
+								builder.WriteString("No alarms found for this device\n")
+							} else {
+								builder.WriteString(fmt.Sprintf("Found %d alarms\n\n", len(newAlarms)))
+							}
+							started = true
+						} else {
+							builder.WriteString(fmt.Sprintf("=== %d NEW ALARMS (%s) ===\n\n", len(newAlarms), now))
+						}
+						for _, alarm := range newAlarms {
+							writeAlarm(&builder, alarm)
+						}
+						builder.WriteString("\n")
+						history = builder.String() + history
+
+						// Update UI on main thread
+						output.SetText(fmt.Sprintf("Auto-refresh running, last new alarms at %s\n\n%s", now, history))
+						output.Refresh()
+
+					case <-stopRefresh:
+						if refreshTicker != nil {
+							refreshTicker.Stop()
+						}
+						return
+					}
+				}
+			}()
+		}, myWindow)
+	})
+
+	// Recorded video around one of the alarms shown last
+	alarmVideoBtn := widget.NewButton("ALARM VIDEO", func() {
+		if session == nil {
+			dialog.ShowError(fmt.Errorf("please login first"), myWindow)
+			return
+		}
+		if len(shownAlarms) == 0 {
+			dialog.ShowError(fmt.Errorf("show the device alarms or alarm history first"), myWindow)
+			return
+		}
+
+		var choices []string
+		for _, a := range shownAlarms {
+			choices = append(choices, fmt.Sprintf("%s  %s  %s", a.Time, a.DevIDNO, config.AlarmTypes.Describe(a.Type)))
+		}
+		alarmSelector := widget.NewSelect(choices, nil)
+		alarmSelector.SetSelected(choices[0])
+		locationSelector := widget.NewSelect([]string{"device", "server", "download"}, nil)
+		locationSelector.SetSelected(config.VideoLocation.String())
+		serverEntry := widget.NewEntry()
+		serverEntry.SetText(client.Hostname())
+
+		window := fmt.Sprintf("Show video from %ds before to %ds after the alarm",
+			config.AlarmVideoBeforeSeconds, config.AlarmVideoAfterSeconds)
+		items := []*widget.FormItem{
+			widget.NewFormItem("Alarm", alarmSelector),
+			widget.NewFormItem("Stored On", locationSelector),
+			widget.NewFormItem("Server", serverEntry),
+		}
+		dialog.ShowForm(window, "Search", "Cancel", items, func(search bool) {
+			if !search {
+				return
+			}
+			alarm := shownAlarms[slices.Index(choices, alarmSelector.Selected)]
+			query, err := alarmVideoQuery(alarm)
+			if err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+			if query.Location, err = cmsv.ParseVideoLocation(locationSelector.Selected); err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+
+			clips, err := searchVideo(ctx, session, serverEntry.Text, query)
+			if err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+			title := fmt.Sprintf("%s: %s at %s", alarm.DevIDNO, formatAlarmType(alarm.Type), alarm.Time)
+			output.SetText(formatVideoClips(title, clips))
+			if len(clips) == 0 {
+				dialog.ShowInformation("Alarm Video", "No recordings found around this alarm", myWindow)
+				return
+			}
+
+			// One row per recording, with buttons to play or copy its link
+			rows := container.NewVBox()
+			for _, c := range clips {
+				link := c.URL
+				label := widget.NewLabel(fmt.Sprintf("Channel %d: %s to %s",
+					c.File.Channel, c.Begin.Format("15:04:05"), c.End.Format("15:04:05")))
+				rows.Add(container.NewBorder(nil, nil, label, container.NewHBox(
+					widget.NewButton("Play", func() {
+						if u, err := url.Parse(link); err == nil {
+							myApp.OpenURL(u)
+						}
+					}),
+					widget.NewButton("Copy Link", func() {
+						myWindow.Clipboard().SetContent(link)
+					}),
+				)))
+			}
+			scroll := container.NewVScroll(rows)
+			scroll.SetMinSize(fyne.NewSize(480, 240))
+			dialog.ShowCustom("Alarm Video: "+title, "Close", scroll, myWindow)
+		}, myWindow)
+	})
+
+	downloadsBtn := widget.NewButton("DOWNLOADS", func() {
+		if session == nil {
+			dialog.ShowError(fmt.Errorf("please login first"), myWindow)
+			return
+		}
+		device := ""
+		if d, ok := deviceMap[deviceSelector.Selected]; ok {
+			device = d.DID
+		}
+		showDownloads(ctx, myApp, session, device)
+	})
+
+	// RECORD records the live stream of a channel of the selected device to
+	// record_dir until it is clicked again
+	var stopRecording context.CancelFunc
+	var recordBtn *widget.Button
+	recordBtn = widget.NewButton("RECORD", func() {
+		if stopRecording != nil {
+			stopRecording()
+			stopRecording = nil
+			recordBtn.SetText("RECORD")
+			dialog.ShowInformation("Recording Stopped", "Recordings are saved in "+config.RecordDir, myWindow)
+			return
+		}
+		if session == nil {
+			dialog.ShowError(fmt.Errorf("please login first"), myWindow)
+			return
+		}
+		device, ok := deviceMap[deviceSelector.Selected]
+		if !ok {
+			dialog.ShowInformation("Error", "Please select a specific device", myWindow)
+			return
+		}
+
+		serverEntry := widget.NewEntry()
+		serverEntry.SetText(client.Hostname())
+		streamSelector := widget.NewSelect([]string{"Main Stream (0)", "Sub Stream (1)"}, nil)
+		streamSelector.SetSelected("Main Stream (0)")
+		channelLabels, channelByLabel := channelOptions(channelsOf(device.DID))
+		channelSelector := widget.NewSelect(channelLabels, nil)
+		channelSelector.SetSelected(channelLabels[0])
+		form := container.NewGridWithColumns(2,
+			widget.NewLabel("Server:"), serverEntry,
+			widget.NewLabel("Stream Type:"), streamSelector,
+			widget.NewLabel("Channel:"), channelSelector,
+		)
+
+		dialog.ShowCustomConfirm("Record "+device.VID, "Record", "Cancel", form, func(start bool) {
+			if !start {
+				return
+			}
+			channel := channelByLabel[channelSelector.Selected].Number
+			stream := 0
+			if strings.Contains(streamSelector.Selected, "(1)") {
+				stream = 1
+			}
+
+			opts := recorderOptions()
+			opts.Logger = log.New(os.Stderr, "", log.LstdFlags)
+			rec, err := recorder.NewRecorder(opts)
+			if err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+			recordCtx, cancel := context.WithCancel(ctx)
+			stopRecording = cancel
+			recordBtn.SetText(fmt.Sprintf("STOP RECORDING (%s CH%d)", device.VID, channel))
+			go rec.Record(recordCtx, recordSource(session, serverEntry.Text, device.DID, channel, stream))
+		}, myWindow)
+	})
+
+	// Add RTSP link generation button
+	rtspBtn := widget.NewButton("Generate RTSP Link", func() {
+		// Ensure we have a valid session and selected device
+		if session == nil {
+			dialog.ShowInformation("Error", "Please login first", myWindow)
+			return
+		}
+
+		selectedDevice := deviceSelector.Selected
+		if selectedDevice == "" || selectedDevice == "All Devices" {
+			dialog.ShowInformation("Error", "Please select a specific device", myWindow)
+			return
+		}
+
+		device, ok := deviceMap[selectedDevice]
+		if !ok {
+			dialog.ShowError(fmt.Errorf("invalid device selection"), myWindow)
+			return
+		}
+
+		// Show config dialog for RTSP parameters
+		serverEntry := widget.NewEntry()
+		serverEntry.SetText(client.Hostname())
+
+		streamOptions := []string{"Main Stream (0)", "Sub Stream (1)"}
+		streamSelector := widget.NewSelect(streamOptions, nil)
+		streamSelector.SetSelected(streamOptions[1]) // Default to sub stream
+
+		channelGroup, selectedChannels := channelCheckGroup(channelsOf(device.DID))
+
+		configContainer := container.NewVBox(
+			widget.NewLabel("Configure RTSP Stream:"),
+			container.NewGridWithColumns(2,
+				widget.NewLabel("Server:"),
+				serverEntry,
+				widget.NewLabel("Stream Type:"),
+				streamSelector,
+				widget.NewLabel("Channels:"),
+				channelGroup,
+			),
+		)
+
+		dialog.ShowCustomConfirm("RTSP Configuration", "Generate", "Cancel", configContainer, func(generate bool) {
+			if !generate {
+				return
+			}
+
+			channels := selectedChannels()
+			if len(channels) == 0 {
+				dialog.ShowInformation("Error", "Please select at least one channel", myWindow)
+				return
+			}
+
+			// Parse stream type from selection
+			streamStr := streamSelector.Selected
+			streamType := 1 // Default to sub stream
+			if strings.Contains(streamStr, "(0)") {
+				streamType = 0 // Main stream
+			}
+
+			// Generate the RTSP links
+			jsession, err := session.JSession(ctx)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("Login failed: %v", err), myWindow)
+				return
+			}
+			links, err := channelLinks(client, "rtsp", serverEntry.Text, jsession, device.DID, channels, streamType)
+			if err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+
+			// Show the generated links
+			dialog.ShowCustom("RTSP Link", "Close", channelLinksView(ctx, myWindow, client, "RTSP", links, nil), myWindow)
+		}, myWindow)
+	})
+
+	// Add RTMP link generation button
+	rtmpBtn := widget.NewButton("Generate RTMP Link", func() {
+		// Ensure we have a valid session and selected device
+		if session == nil {
+			dialog.ShowInformation("Error", "Please login first", myWindow)
+			return
+		}
+
+		selectedDevice := deviceSelector.Selected
+		if selectedDevice == "" || selectedDevice == "All Devices" {
+			dialog.ShowInformation("Error", "Please select a specific device", myWindow)
+			return
+		}
+
+		device, ok := deviceMap[selectedDevice]
+		if !ok {
+			dialog.ShowError(fmt.Errorf("invalid device selection"), myWindow)
+			return
+		}
+
+		// Show config dialog for RTMP parameters
+		serverEntry := widget.NewEntry()
+		serverEntry.SetText(client.Hostname())
+
+		streamOptions := []string{"Main Stream (0)", "Sub Stream (1)"}
+		streamSelector := widget.NewSelect(streamOptions, nil)
+		streamSelector.SetSelected(streamOptions[1]) // Default to sub stream
+
+		channelGroup, selectedChannels := channelCheckGroup(channelsOf(device.DID))
+
+		configContainer := container.NewVBox(
+			widget.NewLabel("Configure RTMP Stream:"),
+			container.NewGridWithColumns(2,
+				widget.NewLabel("Server:"),
+				serverEntry,
+				widget.NewLabel("Channels:"),
+				channelGroup,
+				widget.NewLabel("Stream Type:"),
+				streamSelector,
+			),
+		)
+
+		dialog.ShowCustomConfirm("RTMP Configuration", "Generate", "Cancel", configContainer, func(generate bool) {
+			if !generate {
+				return
+			}
+
+			channels := selectedChannels()
+			if len(channels) == 0 {
+				dialog.ShowInformation("Error", "Please select at least one channel", myWindow)
+				return
+			}
+
+			// Parse stream type from selection
+			streamStr := streamSelector.Selected
+			streamType := 1 // Default to sub stream
+			if strings.Contains(streamStr, "(0)") {
+				streamType = 0 // Main stream
+			}
+
+			// Generate the RTMP links
+			jsession, err := session.JSession(ctx)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("Login failed: %v", err), myWindow)
+				return
+			}
+			links, err := channelLinks(client, "rtmp", serverEntry.Text, jsession, device.DID, channels, streamType)
+			if err != nil {
+				dialog.ShowError(err, myWindow)
+				return
+			}
+
+			// Show the generated links
+			dialog.ShowCustom("RTMP Link", "Close", channelLinksView(ctx, myWindow, client, "RTMP", links, nil), myWindow)
+		}, myWindow)
+	})
+
+	// Add HLS link generation button
+	hlsBtn := widget.NewButton("Generate HLS Link", func() {
+		// Ensure we have a valid session and selected device
+		if session == nil {
+			dialog.ShowInformation("Error", "Please login first", myWindow)
+			return
+		}
+
+		selectedDevice := deviceSelector.Selected
+		if selectedDevice == "" || selectedDevice == "All Devices" {
+			dialog.ShowInformation("Error", "Please select a specific device", myWindow)
+			return
+		}
+
+		device, ok := deviceMap[selectedDevice]
+		if !ok {
+			dialog.ShowError(fmt.Errorf("invalid device selection"), myWindow)
+			return
+		}
+
+		// Show config dialog for HLS parameters
+		serverEntry := widget.NewEntry()
+		serverEntry.SetText(client.Hostname())
+
+		streamOptions := []string{"Main Stream (0)", "Sub Stream (1)"}
+		streamSelector := widget.NewSelect(streamOptions, nil)
+		streamSelector.SetSelected(streamOptions[1]) // Default to sub stream
+
+		channelGroup, selectedChannels := channelCheckGroup(channelsOf(device.DID))
+
+		configContainer := container.NewVBox(
+			widget.NewLabel("Configure HLS Stream:"),
+			container.NewGridWithColumns(2,
+				widget.NewLabel("Server:"),
+				serverEntry,
+				widget.NewLabel("Channels:"),
+				channelGroup,
+				widget.NewLabel("Stream Type:"),
+				streamSelector,
+			),
+		)
+
+		// With a proxy secret, links go through the HLS proxy and carry an
+		// expiring token instead of the jsession
+		shareCheck := widget.NewCheck(fmt.Sprintf("Share through the HLS proxy (no session in the link, valid %d minutes)", config.HLSProxyTokenMinutes), nil)
+		if config.HLSProxySecret != "" {
+			shareCheck.SetChecked(true)
+			configContainer.Add(shareCheck)
+		}
+
+		dialog.ShowCustomConfirm("HLS Configuration", "Generate", "Cancel", configContainer, func(generate bool) {
+			if !generate {
+				return
+			}
+
+			channels := selectedChannels()
+			if len(channels) == 0 {
+				dialog.ShowInformation("Error", "Please select at least one channel", myWindow)
+				return
+			}
+
+			// Parse stream type from selection
+			streamStr := streamSelector.Selected
+			streamType := 1 // Default to sub stream
+			if strings.Contains(streamStr, "(0)") {
+				streamType = 0 // Main stream
+			}
+
+			// Generate the HLS links
+			var links []channelLink
+			if shareCheck.Checked {
+				ttl := time.Duration(config.HLSProxyTokenMinutes) * time.Minute
+				for _, ch := range channels {
+					_, link, err := hlsShareLink(device.DID, ch.Number, streamType, ttl)
+					if err != nil {
+						dialog.ShowError(err, myWindow)
+						return
+					}
+					links = append(links, channelLink{Channel: ch, URL: link})
+				}
+			} else {
+				jsession, err := session.JSession(ctx)
+				if err != nil {
+					dialog.ShowError(fmt.Errorf("Login failed: %v", err), myWindow)
+					return
+				}
+				if links, err = channelLinks(client, "hls", serverEntry.Text, jsession, device.DID, channels, streamType); err != nil {
+					dialog.ShowError(err, myWindow)
+					return
+				}
+			}
+
+			// Show the generated links, each with HTML video player code
+			playerCode := func(l channelLink) []fyne.CanvasObject {
+				htmlCode := hlsPlayerHTML(l.URL)
+				htmlEntry := widget.NewMultiLineEntry()
+				htmlEntry.SetText(htmlCode)
+				htmlEntry.TextStyle = fyne.TextStyle{Monospace: true}
+				return []fyne.CanvasObject{
+					widget.NewLabel("HTML Video Player Code:"),
+					htmlEntry,
+					widget.NewButton("Copy HTML Code to Clipboard", func() {
+						myWindow.Clipboard().SetContent(htmlCode)
+						dialog.ShowInformation("Copied", "HTML video player code copied to clipboard", myWindow)
+					}),
+				}
+			}
+			dialog.ShowCustom("HLS Link", "Close", channelLinksView(ctx, myWindow, client, "HLS", links, playerCode), myWindow)
+		}, myWindow)
+	})
+
+	// Create the final UI layout with conditional visibility
+	var uiElements []fyne.CanvasObject
+
+	// Add basic login form
+	uiElements = append(uiElements,
+		container.NewGridWithColumns(2,
+			widget.NewLabel("Account:"),
+			accountEntry,
+			widget.NewLabel("Password:"),
+			passwordEntry,
+		),
+	)
+
+	// Add login button if enabled
+	if config.ShowLoginButton {
+		uiElements = append(uiElements, loginBtn)
+	}
+
+	// Add device selector
+	uiElements = append(uiElements, deviceSelector)
+
+	// Create button row with only enabled buttons
+	var buttons []fyne.CanvasObject
+	if config.ShowVehicleInfoButton {
+		buttons = append(buttons, vehicleInfoBtn)
+	}
+	if config.ShowDeviceAlarmsButton {
+		buttons = append(buttons, alarmBtn)
+	}
+	if config.ShowAlarmHistoryButton {
+		buttons = append(buttons, alarmHistoryBtn)
+	}
+	if config.ShowDeviceStatusButton {
+		buttons = append(buttons, deviceStatusBtn)
+	}
+	if config.ShowTrackButton {
+		buttons = append(buttons, trackBtn)
+	}
+	if config.ShowAutoRefreshButton {
+		buttons = append(buttons, refreshBtn)
+	}
+	if config.ShowAlarmVideoButton {
+		buttons = append(buttons, alarmVideoBtn)
+	}
+	if config.ShowDownloadsButton {
+		buttons = append(buttons, downloadsBtn)
+	}
+	if config.ShowRecordButton {
+		buttons = append(buttons, recordBtn)
+	}
+	if config.ShowRTSPButton {
+		buttons = append(buttons, rtspBtn)
+	}
+	if config.ShowHLSButton {
+		buttons = append(buttons, hlsBtn)
+	}
+	if config.ShowRTMPButton {
+		buttons = append(buttons, rtmpBtn)
+	}
+
+	// Add button row if there are any buttons to show
+	if len(buttons) > 0 {
+		// Dynamically adjust columns based on number of buttons
+		cols := len(buttons)
+		if cols > 6 {
+			cols = 6 // Maximum 6 columns
+		}
+		uiElements = append(uiElements, container.NewGridWithColumns(cols, buttons...))
+	}
+
+	// Add coordinate system selector
+	uiElements = append(uiElements,
+		widget.NewLabel("Coordinate System:"),
+		coordSystemSelector,
+	)
+
+	// Add save button if enabled
+	if config.ShowSaveButton {
+		uiElements = append(uiElements, saveBtn)
+	}
+
+	// Add alarm paging controls
+	if config.ShowDeviceAlarmsButton || config.ShowAlarmHistoryButton {
+		uiElements = append(uiElements, container.NewHBox(prevPageBtn, pageLabel, nextPageBtn))
+	}
+
+	// Add output area
+	uiElements = append(uiElements, output)
+
+	content := container.NewVBox(uiElements...)
+
+	myWindow.SetContent(content)
+	myWindow.Resize(fyne.NewSize(800, 600))
+	myWindow.ShowAndRun()
+	return nil
+}
+
+// channelOptions returns the labels of channels for a select, and the
+// channels by label
+func channelOptions(channels []cmsv.Channel) ([]string, map[string]cmsv.Channel) {
+	labels := make([]string, 0, len(channels))
+	byLabel := make(map[string]cmsv.Channel, len(channels))
+	for _, ch := range channels {
+		labels = append(labels, ch.Label())
+		byLabel[ch.Label()] = ch
+	}
+	return labels, byLabel
+}
+
+// channelCheckGroup lets several channels be selected, the first one by
+// default. The returned function gives the selected ones in channel order.
+func channelCheckGroup(channels []cmsv.Channel) (*widget.CheckGroup, func() []cmsv.Channel) {
+	labels, _ := channelOptions(channels)
+	group := widget.NewCheckGroup(labels, nil)
+	if len(labels) > 0 {
+		group.SetSelected(labels[:1])
+	}
+	return group, func() []cmsv.Channel {
+		var selected []cmsv.Channel
+		for _, ch := range channels {
+			if slices.Contains(group.Selected, ch.Label()) {
+				selected = append(selected, ch)
+			}
+		}
+		return selected
+	}
+}
+
+// channelLinksView shows generated links, each with copy and test buttons
+// and the objects extra returns for it, and a button copying all of them
+// when there are several
+func channelLinksView(ctx context.Context, w fyne.Window, client *cmsv.Client, protocol string, links []channelLink, extra func(channelLink) []fyne.CanvasObject) fyne.CanvasObject {
+	box := container.NewVBox()
+	for _, l := range links {
+		linkEntry := widget.NewMultiLineEntry()
+		linkEntry.SetText(l.URL)
+		linkEntry.TextStyle = fyne.TextStyle{Monospace: true}
+		box.Add(widget.NewLabel(fmt.Sprintf("%s URL of %s:", protocol, l.Label())))
+		box.Add(linkEntry)
+		box.Add(container.NewGridWithColumns(2,
+			widget.NewButton("Copy to Clipboard", func() {
+				w.Clipboard().SetContent(l.URL)
+				dialog.ShowInformation("Copied", protocol+" URL of "+l.Label()+" copied to clipboard", w)
+			}),
+			testLinkButton(ctx, w, client, l.URL),
+		))
+		if extra != nil {
+			for _, obj := range extra(l) {
+				box.Add(obj)
+			}
+		}
+	}
+	if len(links) < 2 {
+		return box
+	}
+	copyAll := widget.NewButton("Copy All Links to Clipboard", func() {
+		w.Clipboard().SetContent(formatChannelLinks(links))
+		dialog.ShowInformation("Copied", fmt.Sprintf("%d %s URLs copied to clipboard", len(links), protocol), w)
+	})
+	scroll := container.NewVScroll(box)
+	scroll.SetMinSize(fyne.NewSize(560, 400))
+	return container.NewBorder(nil, copyAll, nil, nil, scroll)
+}
+
+// testLinkButton returns a button that checks that a link plays and shows
+// the codec, picture size and latency, or why it does not play
+func testLinkButton(ctx context.Context, w fyne.Window, client *cmsv.Client, link string) *widget.Button {
+	var btn *widget.Button
+	btn = widget.NewButton("Test Link", func() {
+		btn.Disable()
+		btn.SetText("Testing...")
+		go func() {
+			res := probe.Probe(ctx, link, probeOptions(client, probe.DefaultTimeout))
+			fyne.Do(func() {
+				btn.Enable()
+				btn.SetText("Test Link")
+				title := "Link Plays"
+				if !res.OK {
+					title = "Link Does Not Play"
+				}
+				dialog.ShowInformation(title, describeProbe(res), w)
+			})
+		}()
+	})
+	return btn
+}
+
+// showTrackPlayback opens a window that steps through the points of a track
+// with a timeline slider, showing the speed, heading and decoded status of
+// every point
+func showTrackPlayback(a fyne.App, track *cmsv.Track) {
+	w := a.NewWindow("Track Playback: " + trackTitle(track))
+	points := track.Points
+
+	summary := widget.NewLabel(formatTrackSummary(track))
+	summary.Wrapping = fyne.TextWrapWord
+	positionLabel := widget.NewLabel("")
+	detail := widget.NewLabel("")
+	detail.TextStyle = fyne.TextStyle{Monospace: true}
+
+	current := 0
+	slider := widget.NewSlider(0, float64(max(len(points)-1, 1)))
+	slider.Step = 1
+	show := func(i int) {
+		current = min(max(i, 0), len(points)-1)
+		p := points[current]
+		positionLabel.SetText(fmt.Sprintf("Point %d of %d, %s", current+1, len(points), p.Time().Format(cmsv.TimeLayout)))
+		detail.SetText(formatTrackPoint(p))
+	}
+	slider.OnChanged = func(v float64) { show(int(v)) }
+
+	prevBtn := widget.NewButtonWithIcon("", theme.MediaSkipPreviousIcon(), func() { slider.SetValue(float64(current - 1)) })
+	nextBtn := widget.NewButtonWithIcon("", theme.MediaSkipNextIcon(), func() { slider.SetValue(float64(current + 1)) })
+
+	// Playback advances the slider from a goroutine until it reaches the
+	// end, is paused or the window is closed
+	speeds := map[string]time.Duration{
+		"1 point/s":   time.Second,
+		"5 points/s":  200 * time.Millisecond,
+		"20 points/s": 50 * time.Millisecond,
+	}
+	speedSelector := widget.NewSelect([]string{"1 point/s", "5 points/s", "20 points/s"}, nil)
+	speedSelector.SetSelected("5 points/s")
+
+	var stopPlayback chan struct{}
+	var playBtn *widget.Button
+	pause := func() {
+		if stopPlayback != nil {
+			close(stopPlayback)
+			stopPlayback = nil
+		}
+		playBtn.SetIcon(theme.MediaPlayIcon())
+	}
+	playBtn = widget.NewButtonWithIcon("", theme.MediaPlayIcon(), func() {
+		if stopPlayback != nil {
+			pause()
+			return
+		}
+		if current >= len(points)-1 {
+			slider.SetValue(0) // Start over
+		}
+		stop := make(chan struct{})
+		stopPlayback = stop
+		playBtn.SetIcon(theme.MediaPauseIcon())
+
+		ticker := time.NewTicker(speeds[speedSelector.Selected])
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					fyne.Do(func() {
+						if stopPlayback != stop {
+							return
+						}
+						if current >= len(points)-1 {
+							pause()
+							return
+						}
+						slider.SetValue(float64(current + 1))
+					})
+				}
+			}
+		}()
+	})
+	w.SetOnClosed(func() {
+		if stopPlayback != nil {
+			close(stopPlayback)
+			stopPlayback = nil
+		}
+	})
+
+	show(0)
+	controls := container.NewBorder(nil, nil,
+		container.NewHBox(prevBtn, playBtn, nextBtn),
+		speedSelector,
+		slider,
+	)
+	w.SetContent(container.NewVBox(summary, controls, positionLabel, detail))
+	w.Resize(fyne.NewSize(640, 420))
+	w.Show()
+}
+
+// downloadRow is the line of one download task in the downloads panel
+type downloadRow struct {
+	task     cmsv.DownloadTask
+	label    *widget.Label
+	progress *widget.ProgressBar
+	saveBtn  *widget.Button
+	box      fyne.CanvasObject
+	saving   bool   // The file is being downloaded
+	saved    string // Local path once downloaded
+}
+
+// showDownloads opens the panel of the video download tasks of device, or of
+// every device when it is empty. Tasks are polled every download_poll_seconds
+// while the window is open; finished files can be saved to download_dir with
+// a progress bar.
+func showDownloads(ctx context.Context, a fyne.App, session *cmsv.Session, device string) {
+	title := "Video Downloads"
+	if device != "" {
+		title += ": " + device
+	}
+	w := a.NewWindow(title)
+	status := widget.NewLabel("")
+	list := container.NewVBox()
+	rows := make(map[string]*downloadRow)
+
+	// update refreshes the rows from the task list; it runs on the UI thread
+	update := func(tasks []cmsv.DownloadTask, err error) {
+		if err != nil {
+			status.SetText(fmt.Sprintf("Download task fetch failed: %v", err))
+			return
+		}
+		status.SetText(fmt.Sprintf("%d tasks, updated %s", len(tasks), time.Now().Format("15:04:05")))
+
+		seen := make(map[string]bool)
+		for _, t := range tasks {
+			seen[t.ID] = true
+			row, ok := rows[t.ID]
+			if !ok {
+				row = newDownloadRow(ctx, w, session, t, rows, list)
+				rows[t.ID] = row
+				list.Add(row.box)
+			}
+			row.task = t
+			row.refresh()
+		}
+		for id, row := range rows {
+			if !seen[id] {
+				list.Remove(row.box)
+				delete(rows, id)
+			}
+		}
+	}
+
+	poll := func() {
+		go func() {
+			var tasks []cmsv.DownloadTask
+			var err error
+			for t, e := range session.DownloadTasks(ctx, cmsv.DownloadTaskQuery{DevIDNO: device, PageSize: cmsv.DefaultPageSize}) {
+				if err = e; err != nil {
+					break
+				}
+				tasks = append(tasks, t)
+			}
+			fyne.Do(func() { update(tasks, err) })
+		}()
+	}
+
+	newTaskBtn := widget.NewButton("New Task", func() {
+		channels, err := session.Channels(ctx, device)
+		if err != nil {
+			channels = cmsv.DeviceChannels(nil, device)
+		}
+		showNewDownloadForm(ctx, w, session, device, channels, poll)
+	})
+	if device == "" {
+		newTaskBtn.Disable() // Tasks are created for the selected device
+	}
+	refreshBtn := widget.NewButton("Refresh", poll)
+
+	stop := make(chan struct{})
+	ticker := time.NewTicker(time.Duration(config.DownloadPollSeconds) * time.Second)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				poll()
+			}
+		}
+	}()
+	w.SetOnClosed(func() { close(stop) })
+
+	scroll := container.NewVScroll(list)
+	w.SetContent(container.NewBorder(
+		container.NewHBox(newTaskBtn, refreshBtn, status), nil, nil, nil, scroll))
+	w.Resize(fyne.NewSize(720, 420))
+	w.Show()
+	poll()
+}
+
+// newDownloadRow creates the widgets of a task row
+func newDownloadRow(ctx context.Context, w fyne.Window, session *cmsv.Session, t cmsv.DownloadTask, rows map[string]*downloadRow, list *fyne.Container) *downloadRow {
+	row := &downloadRow{task: t, label: widget.NewLabel(""), progress: widget.NewProgressBar()}
+	row.saveBtn = widget.NewButton("Save", func() {
+		row.saving = true
+		row.refresh()
+		task := row.task
+		go func() {
+			path, err := fetchDownload(ctx, session.Client(), task, func(done, total int64) {
+				if total > 0 {
+					fyne.Do(func() { row.progress.SetValue(float64(done) / float64(total)) })
+				}
+			})
+			fyne.Do(func() {
+				row.saving = false
+				if err != nil {
+					dialog.ShowError(err, w)
+				} else {
+					row.saved = path
+				}
+				row.refresh()
+			})
+		}()
+	})
+	cancelBtn := widget.NewButton("Cancel", func() {
+		id := row.task.ID
+		dialog.ShowConfirm("Cancel Download", "Cancel and remove task "+id+"?", func(ok bool) {
+			if !ok {
+				return
+			}
+			if err := session.CancelDownloadTasks(ctx, []string{id}); err != nil {
+				dialog.ShowError(fmt.Errorf("download task cancel failed: %v", err), w)
+				return
+			}
+			list.Remove(row.box)
+			delete(rows, id)
+		}, w)
+	})
+	row.box = container.NewBorder(nil, nil, nil, container.NewHBox(row.saveBtn, cancelBtn),
+		container.NewVBox(row.label, row.progress))
+	return row
+}
+
+// refresh shows the task state: the upload progress on the server, then the
+// progress of saving the file
+func (r *downloadRow) refresh() {
+	t := r.task
+	text := fmt.Sprintf("%s CH%d  %s to %s  (%.1f MB)  %s", t.DevIDNO, t.Channel+1, t.Begin, t.End,
+		float64(t.Size)/(1<<20), formatDownloadStatus(t))
+	switch {
+	case r.saving:
+		text += ", saving"
+	case r.saved != "":
+		text += ", saved to " + r.saved
+		r.progress.SetValue(1)
+	default:
+		r.progress.SetValue(float64(t.Progress) / 100)
+	}
+	if t.Label != "" {
+		text += "  " + t.Label
+	}
+	r.label.SetText(text)
+	if t.Finished() && !r.saving {
+		r.saveBtn.Enable()
+	} else {
+		r.saveBtn.Disable()
+	}
+}
+
+// showNewDownloadForm creates download tasks for a channel and time range of
+// a device, then calls done
+func showNewDownloadForm(ctx context.Context, w fyne.Window, session *cmsv.Session, device string, channels []cmsv.Channel, done func()) {
+	now := time.Now()
+	beginEntry := widget.NewEntry()
+	beginEntry.SetText(now.Add(-10 * time.Minute).Format(cmsv.TimeLayout))
+	endEntry := widget.NewEntry()
+	endEntry.SetText(now.Format(cmsv.TimeLayout))
+	channelLabels, channelByLabel := channelOptions(channels)
+	channelSelector := widget.NewSelect(append([]string{"All Channels"}, channelLabels...), nil)
+	channelSelector.SetSelected("All Channels")
+	locationSelector := widget.NewSelect([]string{"device", "server", "download"}, nil)
+	locationSelector.SetSelected(config.VideoLocation.String())
+	labelEntry := widget.NewEntry()
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("Begin", beginEntry),
+		widget.NewFormItem("End", endEntry),
+		widget.NewFormItem("Channel", channelSelector),
+		widget.NewFormItem("Stored On", locationSelector),
+		widget.NewFormItem("Label", labelEntry),
+	}
+	dialog.ShowForm("New Download Task: "+device, "Create", "Cancel", items, func(create bool) {
+		if !create {
+			return
+		}
+		query := cmsv.VideoQuery{DevIDNO: device, Channel: cmsv.AllChannels, RecordType: cmsv.RecordAll, Stream: -1}
+		var err error
+		if query.Begin, err = parseHistoryTime(beginEntry.Text, false); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		if query.End, err = parseHistoryTime(endEntry.Text, true); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		if ch, ok := channelByLabel[channelSelector.Selected]; ok {
+			query.Channel = ch.Number
+		}
+		if query.Location, err = cmsv.ParseVideoLocation(locationSelector.Selected); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		created, err := createDownloads(ctx, session, query, labelEntry.Text)
+		if err != nil {
+			dialog.ShowError(err, w)
+		} else {
+			dialog.ShowInformation("New Download Task", formatCreatedDownloads(created), w)
+		}
+		done()
+	}, w)
+}
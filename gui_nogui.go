@@ -0,0 +1,14 @@
+//go:build nogui
+
+package main
+
+import (
+	"cmsv_api/cmsv"
+	"errors"
+)
+
+// runGUI is a stub for headless builds (go build -tags nogui), which leave out
+// the Fyne toolkit so the binary runs on servers without a display
+func runGUI(client *cmsv.Client) error {
+	return errors.New("this build has no graphical interface, run 'cmsv_api help' for the available commands")
+}
@@ -0,0 +1,397 @@
+package hlsproxy
+
+import (
+	"cmsv_api/cmsv"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSecret   = "0123456789abcdef-test"
+	testJSession = "9f3c1e5d7b2a4c6e8f01"
+)
+
+func testSigner(t *testing.T) *Signer {
+	t.Helper()
+	s, err := NewSigner(testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNewSigner(t *testing.T) {
+	if _, err := NewSigner("short"); err == nil {
+		t.Error("NewSigner accepts a secret shorter than MinSecretLength")
+	}
+}
+
+func TestSignerVerify(t *testing.T) {
+	signer := testSigner(t)
+	other, _ := NewSigner("another-secret-0123")
+	now := time.Now()
+	token := Token{ID: "1d36572a538922d5", Device: "000000447007", Channel: 1, Stream: 1, Expires: now.Add(time.Hour).Truncate(time.Second)}
+	raw := signer.Sign(token)
+	payload, sig, _ := strings.Cut(raw, ".")
+
+	// A payload for another device carrying the original signature
+	forged := token
+	forged.Device = "000000447008"
+	forgedPayload, _, _ := strings.Cut(signer.Sign(forged), ".")
+
+	// A signature with one byte flipped
+	mac, _ := base64.RawURLEncoding.DecodeString(sig)
+	mac[0] ^= 1
+	flipped := base64.RawURLEncoding.EncodeToString(mac)
+
+	tests := []struct {
+		name     string
+		raw      string
+		now      time.Time
+		parseErr error // From Parse
+		err      error // From Verify
+	}{
+		{"valid", raw, now, nil, nil},
+		{"tampered payload", forgedPayload + "." + sig, now, ErrInvalidToken, ErrInvalidToken},
+		{"tampered signature", payload + "." + flipped, now, ErrInvalidToken, ErrInvalidToken},
+		{"signature not base64", payload + ".!!", now, ErrInvalidToken, ErrInvalidToken},
+		{"other secret", other.Sign(token), now, ErrInvalidToken, ErrInvalidToken},
+		{"no signature", payload, now, ErrInvalidToken, ErrInvalidToken},
+		{"empty", "", now, ErrInvalidToken, ErrInvalidToken},
+		{"expired", raw, token.Expires, nil, ErrTokenExpired},
+		{"long expired", raw, token.Expires.Add(24 * time.Hour), nil, ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := signer.Parse(tt.raw)
+			if !errors.Is(err, tt.parseErr) {
+				t.Errorf("Parse error = %v, want %v", err, tt.parseErr)
+			}
+			if err == nil && parsed != token {
+				t.Errorf("Parse = %+v, want %+v", parsed, token)
+			}
+			if _, err := signer.Verify(tt.raw, tt.now); !errors.Is(err, tt.err) {
+				t.Errorf("Verify error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestIssue(t *testing.T) {
+	signer := testSigner(t)
+	token, raw := signer.Issue("000000447007", 2, 0, time.Hour)
+	got, err := signer.Verify(raw, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != token || got.Channel != 2 || got.Stream != 0 {
+		t.Errorf("Verify = %+v, want %+v", got, token)
+	}
+	if _, again := signer.Issue("000000447007", 2, 0, time.Hour); again == raw {
+		t.Error("two tokens for the same stream are identical, they can't be revoked one by one")
+	}
+	if link := Link("http://proxy.example/", raw); link != "http://proxy.example/hls/"+raw+".m3u8" {
+		t.Errorf("Link = %q", link)
+	}
+}
+
+func TestServerVerifyRevoked(t *testing.T) {
+	signer := testSigner(t)
+	revocations, err := OpenRevocationList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{opts: Options{Signer: signer, Revocations: revocations}}
+	revoked, revokedRaw := signer.Issue("000000447007", 0, 1, time.Hour)
+	_, keptRaw := signer.Issue("000000447007", 0, 1, time.Hour)
+	if err := revocations.Revoke(Revocation{ID: revoked.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.verify(revokedRaw); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("revoked token: error = %v, want %v", err, ErrTokenRevoked)
+	}
+	if _, err := s.verify(keptRaw); err != nil {
+		t.Errorf("other token of the same stream: %v", err)
+	}
+}
+
+func TestRevocationListReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	list, err := OpenRevocationList(path)
+	if err != nil {
+		t.Fatalf("missing file: %v, want an empty list", err)
+	}
+	var logged strings.Builder
+	list.Logger = log.New(&logged, "", 0)
+	if err := list.Revoke(Revocation{ID: "aaaaaaaaaaaaaaaa"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revoked by another process
+	other, err := OpenRevocationList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Revoke(Revocation{ID: "bbbbbbbbbbbbbbbb"}); err != nil {
+		t.Fatal(err)
+	}
+	if !list.Revoked("bbbbbbbbbbbbbbbb") {
+		t.Error("a token revoked by another process is not seen")
+	}
+
+	// A deleted file keeps the entries loaded last
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if !list.Revoked("aaaaaaaaaaaaaaaa") || !list.Revoked("bbbbbbbbbbbbbbbb") {
+		t.Error("deleting the file restored the revoked tokens")
+	}
+	if n := strings.Count(logged.String(), "revocation list"); n != 1 {
+		t.Errorf("reload error logged %d times, want once:\n%s", n, logged.String())
+	}
+
+	// Revoking writes the file again, with the entries kept
+	if err := list.Revoke(Revocation{ID: "cccccccccccccccc"}); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, err := OpenRevocationList(path); err != nil || len(reopened.List()) != 3 {
+		t.Errorf("rewritten file: %v, %v; want 3 revocations", reopened.List(), err)
+	}
+
+	// A file that is present and empty clears the list
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if list.Revoked("aaaaaaaaaaaaaaaa") || len(list.List()) != 0 {
+		t.Errorf("empty file: %v, want no revocations", list.List())
+	}
+}
+
+func TestURIMAC(t *testing.T) {
+	s := &Server{opts: Options{Signer: testSigner(t)}}
+	a := Token{ID: "aaaaaaaaaaaaaaaa", Device: "000000447007", Channel: 0, Stream: 1}
+	b := Token{ID: "bbbbbbbbbbbbbbbb", Device: "000000447007", Channel: 0, Stream: 1}
+	const upstream = "https://cmsv.example:16604/hls/1_000000447007_0_1/seg1.ts"
+
+	mac := s.uriMAC(a, upstream)
+	tests := []struct {
+		name     string
+		token    Token
+		upstream string
+	}{
+		{"other token", b, upstream},
+		{"other URL", a, "https://cmsv.example:16604/hls/1_000000447008_0_1/seg1.ts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if string(s.uriMAC(tt.token, tt.upstream)) == string(mac) {
+				t.Error("signature matches the original URI")
+			}
+		})
+	}
+	if string(s.uriMAC(a, upstream)) != string(mac) {
+		t.Error("signature changes between calls")
+	}
+}
+
+// upstream is a CMSV HLS server that requires the jsession and puts it into
+// the URIs of its playlists, as the real server does
+func upstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("jsession") != testJSession {
+			http.Error(w, "no session", http.StatusForbidden)
+			return
+		}
+		q := "?jsession=" + testJSession
+		switch r.URL.Path {
+		case "/hls/1_000000447007_1_1.m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			io.WriteString(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=500000\nlive/index.m3u8"+q+"\n")
+		case "/hls/live/index.m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			io.WriteString(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n"+
+				`#EXT-X-KEY:METHOD=AES-128,URI="key.bin`+q+`"`+"\n"+
+				"#EXTINF:2.0,\nseg0.ts"+q+"\n"+
+				"#EXTINF:2.0,\n"+srv.URL+"/hls/live/seg1.ts"+q+"\n")
+		case "/hls/live/seg0.ts", "/hls/live/seg1.ts", "/hls/live/key.bin":
+			io.WriteString(w, "data of "+r.URL.Path)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testProxy serves a proxy in front of upstream
+func testProxy(t *testing.T, up *httptest.Server) (*httptest.Server, *Signer) {
+	t.Helper()
+	u, _ := url.Parse(up.URL)
+	port, _ := strconv.Atoi(u.Port())
+	client, err := cmsv.NewClient(cmsv.Options{BaseURL: "https://" + u.Hostname(), HLSPort: port, HTTPClient: up.Client()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := client.NewSession("", "")
+	session.SetJSession(testJSession)
+	signer := testSigner(t)
+	proxy, err := New(Options{Session: session, Signer: signer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+	return srv, signer
+}
+
+func get(t *testing.T, rawURL string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// uris returns the URIs of a playlist resolved against its URL
+func uris(t *testing.T, base, playlist string) []string {
+	t.Helper()
+	b, _ := url.Parse(base)
+	var list []string
+	for _, line := range strings.Split(playlist, "\n") {
+		ref := strings.TrimSpace(line)
+		if m := uriAttribute.FindStringSubmatch(ref); m != nil {
+			ref = m[1]
+		} else if ref == "" || strings.HasPrefix(ref, "#") {
+			continue
+		}
+		u, err := b.Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, u.String())
+	}
+	return list
+}
+
+// upstreamOf decodes the upstream URL a rewritten playlist URI points to
+func upstreamOf(t *testing.T, uri string) string {
+	t.Helper()
+	ref := uri[strings.LastIndex(uri, "/")+1:]
+	ref, _, _ = strings.Cut(ref, ".")
+	upstream, err := base64.RawURLEncoding.DecodeString(ref)
+	if err != nil {
+		t.Fatalf("URI %s: %v", uri, err)
+	}
+	return string(upstream)
+}
+
+// leaksSession reports whether a rewritten playlist carries the jsession,
+// in plain text or in the upstream URLs encoded in its URIs
+func leaksSession(t *testing.T, base, playlist string) bool {
+	t.Helper()
+	if strings.Contains(playlist, testJSession) || strings.Contains(playlist, "jsession") {
+		return true
+	}
+	for _, uri := range uris(t, base, playlist) {
+		if strings.Contains(upstreamOf(t, uri), "jsession") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProxyRoundTrip(t *testing.T) {
+	up := upstream(t)
+	proxy, signer := testProxy(t, up)
+	_, raw := signer.Issue("000000447007", 1, 1, time.Hour)
+
+	link := Link(proxy.URL, raw)
+	status, master := get(t, link)
+	if status != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", link, status, master)
+	}
+	if leaksSession(t, link, master) {
+		t.Errorf("master playlist leaks the session:\n%s", master)
+	}
+	variants := uris(t, link, master)
+	if len(variants) != 1 {
+		t.Fatalf("master playlist URIs = %v, want 1", variants)
+	}
+
+	status, media := get(t, variants[0])
+	if status != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", variants[0], status, media)
+	}
+	if leaksSession(t, variants[0], media) {
+		t.Errorf("media playlist leaks the session:\n%s", media)
+	}
+	files := uris(t, variants[0], media)
+	want := []string{"/hls/live/key.bin", "/hls/live/seg0.ts", "/hls/live/seg1.ts"}
+	if len(files) != len(want) {
+		t.Fatalf("media playlist URIs = %v, want %d", files, len(want))
+	}
+	for i, file := range files {
+		if !strings.HasPrefix(file, proxy.URL+"/hls/"+raw+"/") {
+			t.Errorf("URI %s is not served by the proxy under the token", file)
+		}
+		if status, body := get(t, file); status != http.StatusOK || body != "data of "+want[i] {
+			t.Errorf("GET %s = %d %q, want %q", file, status, body, "data of "+want[i])
+		}
+	}
+
+	// The signed URIs only work with the token they were signed for
+	_, otherRaw := signer.Issue("000000447007", 1, 1, time.Hour)
+	stolen := strings.Replace(files[1], "/hls/"+raw+"/", "/hls/"+otherRaw+"/", 1)
+	if status, _ := get(t, stolen); status != http.StatusNotFound {
+		t.Errorf("URI with another token: status %d, want 404", status)
+	}
+
+	// Other upstream URLs can't be fetched with a valid token
+	other := base64.RawURLEncoding.EncodeToString([]byte(up.URL + "/hls/1_000000447008_0_1.m3u8"))
+	sig := base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+	if status, _ := get(t, proxy.URL+"/hls/"+raw+"/"+sig+"/"+other+".m3u8"); status != http.StatusNotFound {
+		t.Errorf("unsigned URI: status %d, want 404", status)
+	}
+}
+
+func TestProxyRefusesTokens(t *testing.T) {
+	proxy, signer := testProxy(t, upstream(t))
+	expired := signer.Sign(Token{ID: "1d36572a538922d5", Device: "000000447007", Channel: 1, Stream: 1, Expires: time.Now().Add(-time.Minute)})
+	_, valid := signer.Issue("000000447007", 1, 1, time.Hour)
+	payload, _, _ := strings.Cut(valid, ".")
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"expired", "/hls/" + expired + ".m3u8", http.StatusForbidden},
+		{"bad signature", "/hls/" + payload + ".AAAA.m3u8", http.StatusForbidden},
+		{"no playlist", "/hls/" + valid, http.StatusNotFound},
+		{"other path", "/streams", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := get(t, proxy.URL+tt.path); status != tt.want {
+				t.Errorf("status %d %q, want %d", status, body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+// Package hlsproxy serves the HLS live streams of a CMSV server without
+// exposing its jsession. Viewers get links with a signed token scoped to one
+// device channel and stream until an expiry time:
+//
+//	/hls/<token>.m3u8
+//
+// The proxy fetches the playlists from the CMSV HLS server with the session
+// of the account, rewrites every URI in them to a signed proxy URL without
+// the jsession, and adds the session again when the segments are fetched.
+// Revoked tokens are refused before they expire.
+package hlsproxy
+
+import (
+	"cmsv_api/cmsv"
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPlaylistSize limits the playlists read into memory for rewriting
+const maxPlaylistSize = 1 << 20
+
+// Options configures a proxy
+type Options struct {
+	Session     *cmsv.Session   // CMSV session whose jsession is added to upstream requests
+	Signer      *Signer         // Verifies the tokens
+	Revocations *RevocationList // Revoked tokens (optional)
+	StreamHost  string          // HLS server host (default: the CMSV server)
+	Logger      *log.Logger     // Refused and failed requests are logged here when set
+}
+
+// Server is the HLS proxy. It implements http.Handler.
+type Server struct {
+	opts Options
+}
+
+// New creates a proxy
+func New(opts Options) (*Server, error) {
+	if opts.Session == nil {
+		return nil, errors.New("hlsproxy: a CMSV session is required")
+	}
+	if opts.Signer == nil {
+		return nil, errors.New("hlsproxy: a signer is required")
+	}
+	return &Server{opts: opts}, nil
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.opts.Logger != nil {
+		s.opts.Logger.Printf(format, args...)
+	}
+}
+
+// ServeHTTP serves /hls/<token>.m3u8 and the URIs of the rewritten
+// playlists, /hls/<token>/<signature>/<upstream URL>
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*") // Web players on other origins
+	rest, ok := strings.CutPrefix(r.URL.Path, "/hls/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	raw, resource, nested := strings.Cut(rest, "/")
+	if !nested {
+		raw, ok = strings.CutSuffix(rest, ".m3u8")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	token, err := s.verify(raw)
+	if err != nil {
+		s.logf("hls-proxy: %s: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !nested {
+		link := s.opts.Session.Client().GenerateHLSLink(cmsv.HLSLinkOptions{
+			ServerHost:  s.opts.StreamHost,
+			DevIDNO:     token.Device,
+			Channel:     token.Channel,
+			Stream:      token.Stream,
+			RequestType: 1, // Real-time video
+		})
+		u, err := url.Parse(link)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.forward(w, r, token, u, raw+"/")
+		return
+	}
+
+	// Nested URIs are only served as signed by this proxy for the token
+	sig, ref, _ := strings.Cut(resource, "/")
+	ref, _, _ = strings.Cut(ref, ".") // File extension
+	upstream, err := base64.RawURLEncoding.DecodeString(ref)
+	mac, err2 := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || err2 != nil || !hmac.Equal(mac, s.uriMAC(token, string(upstream))) {
+		http.NotFound(w, r)
+		return
+	}
+	u, err := url.Parse(string(upstream))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.forward(w, r, token, u, "../")
+}
+
+// verify checks a token, its expiry and the revocation list
+func (s *Server) verify(raw string) (Token, error) {
+	token, err := s.opts.Signer.Verify(raw, time.Now())
+	if err != nil {
+		return token, err
+	}
+	if s.opts.Revocations != nil && s.opts.Revocations.Revoked(token.ID) {
+		return token, ErrTokenRevoked
+	}
+	return token, nil
+}
+
+// forward fetches an upstream URL and sends it to the viewer, rewriting
+// playlists. prefix leads from the requested URL back to /hls/<token>/.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, token Token, u *url.URL, prefix string) {
+	resp, err := s.fetch(r.Context(), u)
+	if err != nil {
+		if r.Context().Err() == nil {
+			s.logf("hls-proxy: %s CH%d: %v", token.Device, token.Channel+1, err)
+		}
+		http.Error(w, "upstream request failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.logf("hls-proxy: %s CH%d: upstream %s", token.Device, token.Channel+1, resp.Status)
+		status := http.StatusBadGateway
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusServiceUnavailable {
+			status = resp.StatusCode
+		}
+		http.Error(w, "upstream "+resp.Status, status)
+		return
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if strings.Contains(strings.ToLower(contentType), "mpegurl") || path.Ext(u.Path) == ".m3u8" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxPlaylistSize))
+		if err != nil {
+			http.Error(w, "upstream request failed", http.StatusBadGateway)
+			return
+		}
+		playlist := rewritePlaylist(string(body), resp.Request.URL, func(target *url.URL) string {
+			return prefix + s.uriPath(token, target)
+		})
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		io.WriteString(w, playlist)
+		return
+	}
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	io.Copy(w, resp.Body)
+}
+
+// fetch requests an upstream URL with the jsession of the account, logging
+// in again once if the server rejects it
+func (s *Server) fetch(ctx context.Context, u *url.URL) (*http.Response, error) {
+	login := s.opts.Session.JSession
+	for attempt := 1; ; attempt++ {
+		jsession, err := login(ctx)
+		if err != nil {
+			return nil, err
+		}
+		withSession := *u
+		query := withSession.Query()
+		query.Set("jsession", jsession)
+		withSession.RawQuery = query.Encode()
+		resp, err := s.opts.Session.Client().Get(ctx, withSession.String())
+		if err != nil {
+			return nil, err
+		}
+		if attempt == 1 && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			resp.Body.Close()
+			login = s.opts.Session.Login
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// uriPath returns the path of an upstream URI below /hls/<token>/: the
+// signature and the URL without its jsession, keeping the file extension
+// for players that look at it
+func (s *Server) uriPath(token Token, target *url.URL) string {
+	clean := *target
+	query := clean.Query()
+	query.Del("jsession")
+	clean.RawQuery = query.Encode()
+	upstream := clean.String()
+	return base64.RawURLEncoding.EncodeToString(s.uriMAC(token, upstream)) + "/" +
+		base64.RawURLEncoding.EncodeToString([]byte(upstream)) + path.Ext(clean.Path)
+}
+
+// uriMAC signs an upstream URL for a token, so viewers can't fetch other
+// streams through the proxy
+func (s *Server) uriMAC(token Token, upstream string) []byte {
+	return s.opts.Signer.mac("uri", token.ID, upstream)[:16]
+}
+
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// rewritePlaylist replaces the URIs of a playlist, on their own lines and
+// in URI attributes of tags such as EXT-X-KEY, by link of their absolute
+// URL resolved against base
+func rewritePlaylist(playlist string, base *url.URL, link func(*url.URL) string) string {
+	resolve := func(ref string) string {
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return ref
+		}
+		return link(u)
+	}
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#"):
+			lines[i] = uriAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				return `URI="` + resolve(uriAttribute.FindStringSubmatch(attr)[1]) + `"`
+			})
+		default:
+			lines[i] = resolve(trimmed)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
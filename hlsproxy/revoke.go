@@ -0,0 +1,167 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Revocation is a revoked token
+type Revocation struct {
+	ID      string     `json:"id"`
+	Expires *time.Time `json:"expires,omitempty"` // Expiry of the token, when known; the entry is dropped after it
+	Revoked time.Time  `json:"revoked"`
+	Note    string     `json:"note,omitempty"`
+}
+
+// RevocationList is a JSON file of revoked tokens. It is reloaded when the
+// file changes, so a running proxy refuses tokens revoked by another
+// process at once. An empty path keeps the list in memory.
+type RevocationList struct {
+	Logger *log.Logger // Errors reloading the file are logged here when set
+
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	entries map[string]Revocation
+	lastErr string // Last reload error logged
+}
+
+// OpenRevocationList loads a revocation list. A missing file is an empty
+// list.
+func OpenRevocationList(path string) (*RevocationList, error) {
+	l := &RevocationList{path: path, entries: map[string]Revocation{}}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reload reads the file if it changed. If the file can't be read, or has
+// gone after it was loaded, the entries stay as they are; only an empty
+// file clears them. Callers hold l.mu.
+func (l *RevocationList) reload() error {
+	if l.path == "" {
+		return nil
+	}
+	info, err := os.Stat(l.path)
+	if errors.Is(err, fs.ErrNotExist) && l.modTime.IsZero() {
+		return nil // Nothing revoked yet
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+		return nil
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	var list []Revocation
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("revocation list %s: %v", l.path, err)
+		}
+	}
+	l.entries = map[string]Revocation{}
+	for _, r := range list {
+		l.entries[r.ID] = r
+	}
+	l.modTime, l.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// refresh reloads the file and logs a failure once until the file can be
+// read again. Callers hold l.mu.
+func (l *RevocationList) refresh() {
+	err := l.reload()
+	if err == nil {
+		l.lastErr = ""
+		return
+	}
+	if err.Error() != l.lastErr && l.Logger != nil {
+		l.Logger.Printf("revocation list: %v; keeping the %d entries loaded last", err, len(l.entries))
+	}
+	l.lastErr = err.Error()
+}
+
+// Revoked reports whether a token ID is revoked. If the file can't be
+// read, the entries loaded last are used.
+func (l *RevocationList) Revoked(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refresh()
+	_, ok := l.entries[id]
+	return ok
+}
+
+// Revoke adds a revocation and saves the list, dropping the entries of
+// tokens that have expired
+func (l *RevocationList) Revoke(r Revocation) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.reload(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err // A deleted file is written again with the entries kept
+	}
+	if r.Revoked.IsZero() {
+		r.Revoked = time.Now()
+	}
+	l.entries[r.ID] = r
+	now := time.Now()
+	for id, e := range l.entries {
+		if e.Expires != nil && e.Expires.Before(now) {
+			delete(l.entries, id)
+		}
+	}
+	return l.save()
+}
+
+// save writes the list through a temporary file. Callers hold l.mu.
+func (l *RevocationList) save() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(l.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(l.path); err == nil {
+		l.modTime, l.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
+
+// List returns the revocations, oldest first
+func (l *RevocationList) List() []Revocation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refresh()
+	return l.list()
+}
+
+func (l *RevocationList) list() []Revocation {
+	list := make([]Revocation, 0, len(l.entries))
+	for _, r := range l.entries {
+		list = append(list, r)
+	}
+	slices.SortFunc(list, func(a, b Revocation) int { return a.Revoked.Compare(b.Revoked) })
+	return list
+}
@@ -0,0 +1,125 @@
+package hlsproxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MinSecretLength is the shortest accepted signing secret
+const MinSecretLength = 16
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// Token grants access to the live HLS stream of one device channel until it
+// expires
+type Token struct {
+	ID      string    `json:"id"` // Random; revocations name it
+	Device  string    `json:"device"`
+	Channel int       `json:"channel"` // Starting from 0
+	Stream  int       `json:"stream"`  // 0 for the main stream, 1 for the sub stream
+	Expires time.Time `json:"expires"`
+}
+
+// claims is the signed part of a token
+type claims struct {
+	ID      string `json:"i"`
+	Device  string `json:"d"`
+	Channel int    `json:"c"`
+	Stream  int    `json:"s"`
+	Expires int64  `json:"e"` // Unix time
+}
+
+// Signer issues and verifies tokens with an HMAC-SHA256 secret. Processes
+// sharing the secret accept each other's tokens.
+type Signer struct {
+	secret []byte
+}
+
+// NewSigner creates a signer. The secret must have at least
+// MinSecretLength characters.
+func NewSigner(secret string) (*Signer, error) {
+	if len(secret) < MinSecretLength {
+		return nil, fmt.Errorf("hlsproxy: the secret must have at least %d characters", MinSecretLength)
+	}
+	return &Signer{secret: []byte(secret)}, nil
+}
+
+// Issue creates a token for a stream, valid for ttl
+func (s *Signer) Issue(device string, channel, stream int, ttl time.Duration) (Token, string) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	t := Token{
+		ID:      hex.EncodeToString(id),
+		Device:  device,
+		Channel: channel,
+		Stream:  stream,
+		Expires: time.Now().Add(ttl).Truncate(time.Second),
+	}
+	return t, s.Sign(t)
+}
+
+// Sign encodes a token as <claims>.<signature>, both base64url
+func (s *Signer) Sign(t Token) string {
+	data, _ := json.Marshal(claims{ID: t.ID, Device: t.Device, Channel: t.Channel, Stream: t.Stream, Expires: t.Expires.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload))
+}
+
+// Parse checks the signature of a token and decodes it, expired or not
+func (s *Signer) Parse(token string) (Token, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if !ok || err != nil || !hmac.Equal(mac, s.mac(payload)) {
+		return Token{}, ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Token{}, ErrInvalidToken
+	}
+	var c claims
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return Token{}, ErrInvalidToken
+	}
+	return Token{ID: c.ID, Device: c.Device, Channel: c.Channel, Stream: c.Stream, Expires: time.Unix(c.Expires, 0)}, nil
+}
+
+// Verify parses a token and checks that it has not expired at now
+func (s *Signer) Verify(token string, now time.Time) (Token, error) {
+	t, err := s.Parse(token)
+	if err != nil {
+		return Token{}, err
+	}
+	if !now.Before(t.Expires) {
+		return t, ErrTokenExpired
+	}
+	return t, nil
+}
+
+// mac returns the HMAC of the parts, separated so they can't be shifted
+func (s *Signer) mac(parts ...string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	for i, p := range parts {
+		if i > 0 {
+			h.Write([]byte{0})
+		}
+		h.Write([]byte(p))
+	}
+	return h.Sum(nil)
+}
+
+// Link returns the playlist URL of a token on a proxy: <base>/hls/<token>.m3u8
+func Link(baseURL, token string) string {
+	return strings.TrimRight(baseURL, "/") + "/hls/" + token + ".m3u8"
+}
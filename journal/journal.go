@@ -0,0 +1,321 @@
+// Package journal stores alarms as JSON lines, one object per alarm, in a
+// file that is rotated by size and age
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"cmsv_api/cmsv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFile is the journal file used when Options.Path is empty
+const DefaultFile = "alarms.jsonl"
+
+// rotatedLayout is the timestamp added to the names of rotated files
+const rotatedLayout = "20060102-150405.000"
+
+// Entry is one journal line: the alarm with every field returned by the
+// server, plus when and where it was recorded
+type Entry struct {
+	LoggedAt time.Time `json:"loggedAt"`
+	Source   string    `json:"source,omitempty"` // e.g. "poll", "history" or "legacy"
+	cmsv.Alarm
+}
+
+// Options configures a journal
+type Options struct {
+	Path         string        // Journal file (default DefaultFile)
+	MaxSize      int64         // Rotate before the file grows beyond this many bytes (0 = no size limit)
+	MaxAge       time.Duration // Rotate once the file has been in use this long (0 = no age limit)
+	MaxBackups   int           // Rotated files to keep (0 = keep all)
+	MaxBackupAge time.Duration // Delete rotated files older than this (0 = keep all)
+}
+
+// Journal appends entries to the journal file. It is safe for concurrent use.
+type Journal struct {
+	opts Options
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time // When the current file was started
+}
+
+// Open opens or creates the journal file
+func Open(opts Options) (*Journal, error) {
+	if opts.Path == "" {
+		opts.Path = DefaultFile
+	}
+	j := &Journal{opts: opts}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Path returns the path of the current journal file
+func (j *Journal) Path() string {
+	return j.opts.Path
+}
+
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.opts.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening journal: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening journal: %v", err)
+	}
+
+	j.file = f
+	j.size = info.Size()
+	j.started = time.Time{}
+	if j.size > 0 {
+		j.started = firstLoggedAt(j.opts.Path, info.ModTime())
+	}
+	return nil
+}
+
+// firstLoggedAt returns the LoggedAt of the first entry of a journal file,
+// or fallback if it cannot be read
+func firstLoggedAt(path string, fallback time.Time) time.Time {
+	f, err := os.Open(path)
+	if err != nil {
+		return fallback
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fallback
+	}
+	var entry Entry
+	if json.Unmarshal(line, &entry) != nil || entry.LoggedAt.IsZero() {
+		return fallback
+	}
+	return entry.LoggedAt
+}
+
+// Write appends entries to the journal, rotating the file first when it is
+// too big or too old. Entries without LoggedAt are stamped with the current time.
+// It returns the number of entries written, which are all of them unless
+// there is an error.
+func (j *Journal) Write(entries ...Entry) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return 0, errors.New("journal is closed")
+	}
+
+	for i, entry := range entries {
+		if entry.LoggedAt.IsZero() {
+			entry.LoggedAt = time.Now()
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return i, err
+		}
+		line = append(line, '\n')
+
+		// Rotation follows the wall clock: imported entries keep their original LoggedAt
+		now := time.Now()
+		if j.needsRotation(now, int64(len(line))) {
+			if err := j.rotate(now); err != nil {
+				return i, err
+			}
+		}
+
+		n, err := j.file.Write(line)
+		j.size += int64(n)
+		if err != nil {
+			return i, fmt.Errorf("writing journal: %v", err)
+		}
+		if j.started.IsZero() {
+			j.started = now
+		}
+	}
+	return len(entries), nil
+}
+
+// WriteAlarms appends alarms recorded now from the given source. It returns
+// the number of alarms written, like Write.
+func (j *Journal) WriteAlarms(source string, alarms []cmsv.Alarm) (int, error) {
+	now := time.Now()
+	entries := make([]Entry, len(alarms))
+	for i, alarm := range alarms {
+		entries[i] = Entry{LoggedAt: now, Source: source, Alarm: alarm}
+	}
+	return j.Write(entries...)
+}
+
+func (j *Journal) needsRotation(now time.Time, next int64) bool {
+	if j.size == 0 {
+		return false
+	}
+	if j.opts.MaxSize > 0 && j.size+next > j.opts.MaxSize {
+		return true
+	}
+	return j.opts.MaxAge > 0 && !j.started.IsZero() && now.Sub(j.started) >= j.opts.MaxAge
+}
+
+// Rotate moves the current file aside and starts a new one
+func (j *Journal) Rotate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return errors.New("journal is closed")
+	}
+	return j.rotate(time.Now())
+}
+
+func (j *Journal) rotate(now time.Time) error {
+	if err := j.file.Close(); err != nil {
+		return fmt.Errorf("rotating journal: %v", err)
+	}
+	j.file = nil
+
+	base, ext := splitExt(j.opts.Path)
+	rotated := fmt.Sprintf("%s-%s%s", base, now.Format(rotatedLayout), ext)
+	for i := 1; fileExists(rotated); i++ {
+		// "_" sorts after the extension's ".", keeping names in rotation order
+		rotated = fmt.Sprintf("%s-%s_%d%s", base, now.Format(rotatedLayout), i, ext)
+	}
+	if err := os.Rename(j.opts.Path, rotated); err != nil {
+		return fmt.Errorf("rotating journal: %v", err)
+	}
+
+	if err := j.open(); err != nil {
+		return err
+	}
+	return j.prune(now)
+}
+
+// prune deletes the rotated files beyond MaxBackups or older than MaxBackupAge
+func (j *Journal) prune(now time.Time) error {
+	if j.opts.MaxBackups <= 0 && j.opts.MaxBackupAge <= 0 {
+		return nil
+	}
+	backups, err := j.Backups()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i, path := range backups {
+		// Backups are sorted newest first
+		remove := j.opts.MaxBackups > 0 && i >= j.opts.MaxBackups
+		if !remove && j.opts.MaxBackupAge > 0 {
+			if info, err := os.Stat(path); err == nil && now.Sub(info.ModTime()) > j.opts.MaxBackupAge {
+				remove = true
+			}
+		}
+		if remove {
+			if err := os.Remove(path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Backups returns the rotated journal files, newest first
+func (j *Journal) Backups() ([]string, error) {
+	base, ext := splitExt(j.opts.Path)
+	dir, prefix := filepath.Dir(base), filepath.Base(base)+"-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ext) {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	// Rotated names embed a sortable timestamp
+	slices.Sort(backups)
+	slices.Reverse(backups)
+	return backups, nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// Read iterates over the entries of a journal stream. Blank lines are
+// skipped; a malformed line stops the iteration with an error.
+func Read(r io.Reader) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var entry Entry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				yield(Entry{}, fmt.Errorf("journal line %d: %v", lineNo, err))
+				return
+			}
+			if !yield(entry, nil) {
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			yield(Entry{}, err)
+		}
+	}
+}
+
+// ReadFile iterates over the entries of a journal file
+func ReadFile(path string) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		f, err := os.Open(path)
+		if err != nil {
+			yield(Entry{}, err)
+			return
+		}
+		defer f.Close()
+		for entry, err := range Read(f) {
+			if !yield(entry, err) {
+				return
+			}
+		}
+	}
+}
+
+// splitExt splits "dir/alarms.jsonl" into "dir/alarms" and ".jsonl"
+func splitExt(path string) (string, string) {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext), ext
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,146 @@
+package journal
+
+import (
+	"bufio"
+	"cmsv_api/cmsv"
+	"cmsv_api/geo"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// legacyHeaderLayout is the timestamp format of "=== Alarm log at ... ===" lines
+const legacyHeaderLayout = "2006-01-02 15:04:05"
+
+// ReadLegacy iterates over the alarms of the free-text alarms.log written by
+// earlier versions. Each alarm is a block of "Key: value" lines ended by a
+// dashed separator; the time of the enclosing "=== Alarm log at ... ==="
+// header becomes LoggedAt. Entries have Source "legacy".
+func ReadLegacy(r io.Reader) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		scanner := bufio.NewScanner(r)
+
+		var loggedAt time.Time
+		var current *Entry
+		lineNo := 0
+
+		// flush yields the alarm being read, if any
+		flush := func() bool {
+			if current == nil {
+				return true
+			}
+			entry := *current
+			current = nil
+			return yield(entry, nil)
+		}
+
+		for scanner.Scan() {
+			lineNo++
+			line := strings.TrimSpace(scanner.Text())
+
+			switch {
+			case line == "":
+				continue
+			case strings.HasPrefix(line, "=== Alarm log at ") && strings.HasSuffix(line, " ==="):
+				if !flush() {
+					return
+				}
+				stamp := strings.TrimSuffix(strings.TrimPrefix(line, "=== Alarm log at "), " ===")
+				t, err := time.ParseInLocation(legacyHeaderLayout, stamp, time.Local)
+				if err != nil {
+					yield(Entry{}, fmt.Errorf("legacy log line %d: invalid header time %q", lineNo, stamp))
+					return
+				}
+				loggedAt = t
+				continue
+			case strings.Trim(line, "-") == "":
+				if !flush() {
+					return
+				}
+				continue
+			}
+
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				yield(Entry{}, fmt.Errorf("legacy log line %d: unexpected line %q", lineNo, line))
+				return
+			}
+			value = strings.TrimSpace(value)
+
+			if current == nil {
+				current = &Entry{LoggedAt: loggedAt, Source: "legacy"}
+			}
+			if err := setLegacyField(&current.Alarm, key, value); err != nil {
+				yield(Entry{}, fmt.Errorf("legacy log line %d: %v", lineNo, err))
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			yield(Entry{}, err)
+			return
+		}
+		flush()
+	}
+}
+
+// setLegacyField stores one "Key: value" line of a legacy alarm block
+func setLegacyField(a *cmsv.Alarm, key, value string) error {
+	switch key {
+	case "Device":
+		a.DevIDNO = value
+	case "Time":
+		a.Time = value
+	case "Type":
+		// Newer logs append the catalog name: "620 Smoking [DSM, warning]"
+		code, _, _ := strings.Cut(value, " ")
+		t, err := strconv.Atoi(code)
+		if err != nil {
+			return fmt.Errorf("invalid alarm type %q", value)
+		}
+		a.Type = t
+	case "Description":
+		a.Desc = value
+	case "Location":
+		lat, lng, err := parseLegacyPair(value)
+		if err != nil {
+			return err
+		}
+		a.Gps.Lat = geo.MicroDegrees(lat)
+		a.Gps.Lng = geo.MicroDegrees(lng)
+	case "Mapped Location":
+		mlat, mlng, _ := strings.Cut(value, ",")
+		a.Gps.MLat = strings.TrimSpace(mlat)
+		a.Gps.MLng = strings.TrimSpace(mlng)
+	case "Speed":
+		speed, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "km/h")), 64)
+		if err != nil {
+			return fmt.Errorf("invalid speed %q", value)
+		}
+		a.Gps.SP = int(math.Round(speed * 10))
+	case "Status":
+		if value == "Processed" {
+			a.HD = 1
+		}
+	default:
+		return fmt.Errorf("unknown field %q", key)
+	}
+	return nil
+}
+
+// parseLegacyPair parses a "lat, lng" pair in degrees
+func parseLegacyPair(value string) (float64, float64, error) {
+	first, second, ok := strings.Cut(value, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid location %q", value)
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(first), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(second), 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("invalid location %q", value)
+	}
+	return lat, lng, nil
+}
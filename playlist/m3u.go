@@ -0,0 +1,47 @@
+package playlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteM3U writes an extended M3U playlist with one entry per link, grouped
+// by vehicle. RTSP entries ask VLC for RTP over TCP, which the CMSV media
+// servers expect.
+func WriteM3U(w io.Writer, cameras []Camera, opts Options) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("#EXTM3U\n")
+	if opts.Name != "" {
+		fmt.Fprintf(bw, "#PLAYLIST:%s\n", m3uText(opts.Name))
+	}
+	protocols := protocolsOf(cameras)
+	for _, c := range cameras {
+		for _, p := range protocols {
+			link := c.Links[p]
+			if link == "" {
+				continue
+			}
+			title := c.Title()
+			if len(protocols) > 1 {
+				title += " " + strings.ToUpper(p)
+			}
+			group := c.Vehicle
+			if group == "" {
+				group = c.Device
+			}
+			fmt.Fprintf(bw, "#EXTINF:-1 group-title=\"%s\",%s\n", strings.ReplaceAll(m3uText(group), `"`, "'"), m3uText(title))
+			if p == "rtsp" {
+				bw.WriteString("#EXTVLCOPT:rtsp-tcp\n")
+			}
+			fmt.Fprintf(bw, "%s\n", link)
+		}
+	}
+	return bw.Flush()
+}
+
+// m3uText keeps a value on its line
+func m3uText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,252 @@
+// Package playlist writes the live stream links of a fleet in bulk: M3U and
+// XSPF playlists that open in VLC and other players, and CSV and JSON tables
+// with one row per device channel and stream and a column per protocol, for
+// scripts that import cameras into an NVR. Links generated with a jsession
+// stop working when the session ends.
+package playlist
+
+import (
+	"cmsv_api/cmsv"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Format is a playlist file format
+type Format string
+
+const (
+	M3U  Format = "m3u"
+	XSPF Format = "xspf"
+	CSV  Format = "csv"
+	JSON Format = "json"
+)
+
+// Formats lists the supported formats
+var Formats = []Format{M3U, XSPF, CSV, JSON}
+
+// Protocols lists the stream protocols in the order they are written
+var Protocols = []string{"rtsp", "rtmp", "hls"}
+
+// StreamNames names the stream types: 0 is the main stream, 1 the sub stream
+var StreamNames = []string{"main", "sub"}
+
+// ParseFormat parses a format name or file extension such as "xspf" or ".m3u8"
+func ParseFormat(s string) (Format, error) {
+	name := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(s), "."))
+	if name == "m3u8" {
+		return M3U, nil
+	}
+	for _, f := range Formats {
+		if string(f) == name {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown playlist format %q (use m3u, xspf, csv or json)", s)
+}
+
+// FormatForFile returns the format matching the extension of a file name
+func FormatForFile(name string) (Format, error) {
+	ext := filepath.Ext(name)
+	if ext == "" {
+		return "", fmt.Errorf("cannot tell the playlist format of %q, add an extension", name)
+	}
+	return ParseFormat(ext)
+}
+
+// Ext returns the file extension of the format, including the dot
+func (f Format) Ext() string {
+	return "." + string(f)
+}
+
+// Camera is one stream of a device channel with its links
+type Camera struct {
+	Company     string            `json:"company,omitempty"`
+	Vehicle     string            `json:"vehicle"`
+	Device      string            `json:"device"`
+	Channel     int               `json:"channel"` // Starts from 0
+	ChannelName string            `json:"channelName,omitempty"`
+	Stream      string            `json:"stream"` // main or sub
+	Links       map[string]string `json:"links"`  // By protocol: rtsp, rtmp, hls
+}
+
+// Title names the camera in players, e.g. "DEMO-01 CH2 Cabin sub"
+func (c Camera) Title() string {
+	name := c.Vehicle
+	if name == "" {
+		name = c.Device
+	}
+	ch := cmsv.Channel{Number: c.Channel, Name: c.ChannelName}
+	return fmt.Sprintf("%s %s %s", name, ch.Label(), c.Stream)
+}
+
+// Options configures a playlist
+type Options struct {
+	Name string // Playlist title
+}
+
+// Write writes the cameras in the given format
+func Write(w io.Writer, f Format, cameras []Camera, opts Options) error {
+	switch f {
+	case M3U:
+		return WriteM3U(w, cameras, opts)
+	case XSPF:
+		return WriteXSPF(w, cameras, opts)
+	case CSV:
+		return WriteCSV(w, cameras)
+	case JSON:
+		return WriteJSON(w, cameras)
+	}
+	return fmt.Errorf("unknown playlist format %q", f)
+}
+
+// Selection chooses the cameras of a playlist. Empty fields select
+// everything.
+type Selection struct {
+	Companies []string // Company names or IDs; their sub-companies are included
+	Devices   []string // Device IDs
+	Channels  []int    // Channel numbers; none for every channel of each device
+	Streams   []int    // 0 for the main stream, 1 for the sub stream
+	Protocols []string // rtsp, rtmp, hls
+	// Filter, if set, drops the devices it returns false for, e.g. offline
+	// ones
+	Filter func(devIDNO string) bool
+}
+
+// LinkFunc returns the link of a device channel and stream over a protocol
+type LinkFunc func(devIDNO string, channel, stream int, protocol string) (string, error)
+
+// Cameras lists the selected channels and streams of the devices in the
+// vehicle information, in vehicle order, with their links
+func Cameras(info *cmsv.VehicleResponse, sel Selection, link LinkFunc) ([]Camera, error) {
+	streams := sel.Streams
+	if len(streams) == 0 {
+		streams = []int{0, 1}
+	}
+	for _, s := range streams {
+		if s < 0 || s >= len(StreamNames) {
+			return nil, fmt.Errorf("invalid stream type %d", s)
+		}
+	}
+	protocols := sel.Protocols
+	if len(protocols) == 0 {
+		protocols = Protocols
+	}
+	for _, p := range protocols {
+		if !slices.Contains(Protocols, p) {
+			return nil, fmt.Errorf("unknown stream protocol %q (use rtsp, rtmp or hls)", p)
+		}
+	}
+	companies, err := selectCompanies(info.Companys, sel.Companies)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range sel.Devices {
+		if _, ok := info.FindDevice(id); !ok {
+			return nil, fmt.Errorf("device %s is not in the vehicle list of the account", id)
+		}
+	}
+	names := make(map[int]string, len(info.Companys))
+	for _, c := range info.Companys {
+		names[c.ID] = c.Name
+	}
+
+	var cameras []Camera
+	for _, v := range info.Vehicles {
+		if companies != nil && !companies[v.PID] {
+			continue
+		}
+		company := v.PName
+		if company == "" {
+			company = names[v.PID]
+		}
+		for _, d := range v.DeviceList {
+			if len(sel.Devices) > 0 && !slices.Contains(sel.Devices, d.ID) {
+				continue
+			}
+			if sel.Filter != nil && !sel.Filter(d.ID) {
+				continue
+			}
+			channels := d.ChannelList()
+			if len(sel.Channels) > 0 {
+				var selected []cmsv.Channel
+				for _, n := range sel.Channels {
+					if n < len(channels) {
+						selected = append(selected, channels[n])
+					}
+				}
+				channels = selected
+			}
+			for _, ch := range channels {
+				for _, s := range streams {
+					c := Camera{
+						Company:     company,
+						Vehicle:     v.Name,
+						Device:      d.ID,
+						Channel:     ch.Number,
+						ChannelName: ch.Name,
+						Stream:      StreamNames[s],
+						Links:       make(map[string]string, len(protocols)),
+					}
+					for _, p := range protocols {
+						if c.Links[p], err = link(d.ID, ch.Number, s, p); err != nil {
+							return nil, err
+						}
+					}
+					cameras = append(cameras, c)
+				}
+			}
+		}
+	}
+	return cameras, nil
+}
+
+// selectCompanies returns the IDs of the named companies and of their
+// sub-companies, or nil when none are named
+func selectCompanies(all []cmsv.Company, names []string) (map[int]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	selected := make(map[int]bool)
+	for _, name := range names {
+		found := false
+		for _, c := range all {
+			if strings.EqualFold(c.Name, strings.TrimSpace(name)) || strconv.Itoa(c.ID) == strings.TrimSpace(name) {
+				selected[c.ID] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown company %q", name)
+		}
+	}
+	// Add sub-companies until no more are found
+	for added := true; added; {
+		added = false
+		for _, c := range all {
+			if !selected[c.ID] && selected[c.PID] {
+				selected[c.ID] = true
+				added = true
+			}
+		}
+	}
+	return selected, nil
+}
+
+// protocolsOf returns the protocols the cameras have links for, in the order
+// of Protocols
+func protocolsOf(cameras []Camera) []string {
+	var protocols []string
+	for _, p := range Protocols {
+		for _, c := range cameras {
+			if c.Links[p] != "" {
+				protocols = append(protocols, p)
+				break
+			}
+		}
+	}
+	return protocols
+}
@@ -0,0 +1,41 @@
+package playlist
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// WriteCSV writes a header and one row per camera, with a column for the
+// link of each protocol. Channels start from 0.
+func WriteCSV(w io.Writer, cameras []Camera) error {
+	protocols := protocolsOf(cameras)
+	cw := csv.NewWriter(w)
+	header := append([]string{"company", "vehicle", "device", "channel", "channel_name", "stream"}, protocols...)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, c := range cameras {
+		row := []string{c.Company, c.Vehicle, c.Device, strconv.Itoa(c.Channel), c.ChannelName, c.Stream}
+		for _, p := range protocols {
+			row = append(row, c.Links[p])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes the cameras as a JSON array
+func WriteJSON(w io.Writer, cameras []Camera) error {
+	if cameras == nil {
+		cameras = []Camera{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cameras)
+}
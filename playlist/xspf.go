@@ -0,0 +1,80 @@
+package playlist
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const vlcExtension = "http://www.videolan.org/vlc/playlist/0"
+
+type xspfPlaylist struct {
+	XMLName   xml.Name    `xml:"playlist"`
+	Version   string      `xml:"version,attr"`
+	XMLNS     string      `xml:"xmlns,attr"`
+	VLC       string      `xml:"xmlns:vlc,attr"`
+	Title     string      `xml:"title,omitempty"`
+	TrackList []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location   string         `xml:"location"`
+	Title      string         `xml:"title"`
+	Creator    string         `xml:"creator,omitempty"`
+	Album      string         `xml:"album,omitempty"`
+	Annotation string         `xml:"annotation,omitempty"`
+	Extension  *xspfExtension `xml:"extension,omitempty"`
+}
+
+type xspfExtension struct {
+	Application string   `xml:"application,attr"`
+	Options     []string `xml:"vlc:option"`
+}
+
+// WriteXSPF writes an XSPF playlist with one track per link. The vehicle is
+// the creator and the company the album of a track, so players can sort by
+// them; RTSP tracks ask VLC for RTP over TCP.
+func WriteXSPF(w io.Writer, cameras []Camera, opts Options) error {
+	pl := xspfPlaylist{
+		Version: "1",
+		XMLNS:   "http://xspf.org/ns/0/",
+		VLC:     "http://www.videolan.org/vlc/playlist/ns/0/",
+		Title:   opts.Name,
+	}
+	protocols := protocolsOf(cameras)
+	for _, c := range cameras {
+		for _, p := range protocols {
+			link := c.Links[p]
+			if link == "" {
+				continue
+			}
+			title := c.Title()
+			if len(protocols) > 1 {
+				title += " " + strings.ToUpper(p)
+			}
+			track := xspfTrack{
+				Location:   link,
+				Title:      title,
+				Creator:    c.Vehicle,
+				Album:      c.Company,
+				Annotation: fmt.Sprintf("Device %s, channel %d, %s stream, %s", c.Device, c.Channel+1, c.Stream, strings.ToUpper(p)),
+			}
+			if p == "rtsp" {
+				track.Extension = &xspfExtension{Application: vlcExtension, Options: []string{"rtsp-tcp"}}
+			}
+			pl.TrackList = append(pl.TrackList, track)
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(pl); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
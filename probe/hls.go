@@ -0,0 +1,332 @@
+package probe
+
+import (
+	"cmsv_api/rtsp"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxPlaylistSize and maxSegmentSize limit what is read into memory
+	maxPlaylistSize = 1 << 20
+	maxSegmentSize  = 64 << 20
+)
+
+// playlist is the part of an HLS playlist the probe looks at
+type playlist struct {
+	variants []string // Variant playlist URIs of a master playlist
+	target   time.Duration
+	sequence int
+	segments []segment
+	ended    bool // EXT-X-ENDLIST: not live
+}
+
+type segment struct {
+	uri      string
+	duration time.Duration
+	time     time.Time // EXT-X-PROGRAM-DATE-TIME, if given
+}
+
+// probeHLS fetches the playlist and its newest segment, and checks that the
+// playlist moves on
+func probeHLS(ctx context.Context, u *url.URL, opts Options) Result {
+	res := Result{Protocol: "hls"}
+	start := time.Now()
+	pl, base, err := fetchPlaylist(ctx, u, opts)
+	res.ConnectMs = time.Since(start).Milliseconds()
+	if err == nil && len(pl.variants) > 0 {
+		// Master playlist: probe the first variant
+		variant, perr := base.Parse(pl.variants[0])
+		if perr != nil {
+			res.Reason = "invalid variant playlist URI " + pl.variants[0]
+			return res
+		}
+		pl, base, err = fetchPlaylist(ctx, variant, opts)
+	}
+	if err != nil {
+		res.fail(ctx, "", err)
+		return res
+	}
+	if len(pl.segments) == 0 {
+		res.Reason = "the playlist lists no segments: the device may not send video yet"
+		return res
+	}
+
+	last := pl.segments[len(pl.segments)-1]
+	segURL, err := base.Parse(last.uri)
+	if err != nil {
+		res.Reason = "invalid segment URI " + last.uri
+		return res
+	}
+	data, err := fetch(ctx, segURL, opts, maxSegmentSize)
+	if err != nil {
+		res.fail(ctx, "the newest segment could not be downloaded: ", err)
+		return res
+	}
+	res.FirstFrameMs = time.Since(start).Milliseconds()
+	if codec, sps := tsVideo(data); codec != 0 {
+		res.Codec = codec.String()
+		if sps != nil {
+			res.Width, res.Height, _ = codec.PictureSize([][]byte{sps})
+		}
+	} else if len(data) > 0 && data[0] == 0x47 {
+		res.Reason = "the newest segment has no H.264 or H.265 video"
+		return res
+	}
+
+	// Freshness: the time of the newest segment when the playlist gives it,
+	// otherwise whether the playlist is updated within a target duration
+	if pl.ended {
+		res.Reason = "the playlist has ended (EXT-X-ENDLIST): it is a recording, not a live stream"
+		return res
+	}
+	target := max(pl.target, time.Second)
+	if !last.time.IsZero() {
+		age := time.Since(last.time.Add(last.duration))
+		res.SegmentAgeMs = max(age, 0).Milliseconds()
+		if age > 3*target {
+			res.Reason = fmt.Sprintf("the newest segment is %s old: the stream is stale", age.Round(time.Second))
+			return res
+		}
+		res.OK = true
+		return res
+	}
+
+	wait := target + target/2
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait+2*time.Second {
+		// Too little time left to see an update
+		res.OK = true
+		return res
+	}
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+	}
+	again, _, err := fetchPlaylist(ctx, base, opts)
+	if err != nil {
+		res.fail(ctx, "the playlist could not be reloaded: ", err)
+		return res
+	}
+	if n := len(again.segments); again.sequence == pl.sequence && n > 0 && again.segments[n-1].uri == last.uri {
+		res.Reason = fmt.Sprintf("the playlist was not updated in %s: the stream is stale", wait.Round(100*time.Millisecond))
+		return res
+	}
+	res.OK = true
+	return res
+}
+
+// httpStatusError is an HTTP response with an error status
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return "HTTP " + e.status
+}
+
+// fetch requests a URL and reads the body, up to limit bytes
+func fetch(ctx context.Context, u *url.URL, opts Options, limit int64) ([]byte, error) {
+	resp, err := opts.Get(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+// fetchPlaylist requests and parses a playlist, returning its URL after
+// redirects for resolving its URIs
+func fetchPlaylist(ctx context.Context, u *url.URL, opts Options) (*playlist, *url.URL, error) {
+	resp, err := opts.Get(ctx, u.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPlaylistSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	pl, err := parsePlaylist(string(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	base := u
+	if resp.Request != nil && resp.Request.URL != nil {
+		base = resp.Request.URL
+	}
+	return pl, base, nil
+}
+
+// parsePlaylist parses a master or media playlist
+func parsePlaylist(body string) (*playlist, error) {
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	if strings.TrimSpace(strings.TrimPrefix(lines[0], "\ufeff")) != "#EXTM3U" {
+		return nil, fmt.Errorf("the response is not an HLS playlist")
+	}
+	pl := &playlist{}
+	var next segment
+	variant := false
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		tag, value, _ := strings.Cut(line, ":")
+		switch {
+		case line == "":
+		case tag == "#EXT-X-STREAM-INF":
+			variant = true
+		case tag == "#EXT-X-TARGETDURATION":
+			if n, err := strconv.Atoi(value); err == nil {
+				pl.target = time.Duration(n) * time.Second
+			}
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			pl.sequence, _ = strconv.Atoi(value)
+		case tag == "#EXTINF":
+			duration, _, _ := strings.Cut(value, ",")
+			if secs, err := strconv.ParseFloat(duration, 64); err == nil {
+				next.duration = time.Duration(secs * float64(time.Second))
+			}
+		case tag == "#EXT-X-PROGRAM-DATE-TIME":
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999Z0700"} {
+				if t, err := time.Parse(layout, value); err == nil {
+					next.time = t
+					break
+				}
+			}
+		case tag == "#EXT-X-ENDLIST":
+			pl.ended = true
+		case strings.HasPrefix(line, "#"):
+		case variant:
+			pl.variants = append(pl.variants, line)
+			variant = false
+		default:
+			next.uri = line
+			pl.segments = append(pl.segments, next)
+			next = segment{}
+		}
+	}
+	return pl, nil
+}
+
+// tsVideo returns the video codec of an MPEG-TS segment and the first SPS in
+// it, or 0 when the segment has no H.264 or H.265 stream
+func tsVideo(data []byte) (rtsp.Codec, []byte) {
+	const packetSize = 188
+	pmtPID, videoPID := -1, -1
+	var codec rtsp.Codec
+	var pes []byte
+	for pos := 0; pos+packetSize <= len(data); pos += packetSize {
+		p := data[pos : pos+packetSize]
+		if p[0] != 0x47 {
+			return codec, nil
+		}
+		pid := int(p[1]&0x1f)<<8 | int(p[2])
+		start := p[1]&0x40 != 0
+		payload := p[4:]
+		if p[3]&0x20 != 0 { // Adaptation field
+			if int(payload[0])+1 > len(payload) {
+				continue
+			}
+			payload = payload[1+int(payload[0]):]
+		}
+		if p[3]&0x10 == 0 {
+			continue // No payload
+		}
+
+		switch {
+		case pid == 0 && start && pmtPID < 0:
+			// PAT: the first program
+			if sec := psiSection(payload); len(sec) >= 12 {
+				pmtPID = int(sec[10]&0x1f)<<8 | int(sec[11])
+			}
+		case pid == pmtPID && start && videoPID < 0:
+			sec := psiSection(payload)
+			if len(sec) < 12 {
+				continue
+			}
+			sectionEnd := min(3+(int(sec[1]&0x0f)<<8|int(sec[2]))-4, len(sec))
+			i := 12 + (int(sec[10]&0x0f)<<8 | int(sec[11]))
+			for i+5 <= sectionEnd {
+				streamType := sec[i]
+				epid := int(sec[i+1]&0x1f)<<8 | int(sec[i+2])
+				switch streamType {
+				case 0x1b:
+					codec, videoPID = rtsp.H264, epid
+				case 0x24:
+					codec, videoPID = rtsp.H265, epid
+				}
+				if videoPID >= 0 {
+					break
+				}
+				i += 5 + (int(sec[i+3]&0x0f)<<8 | int(sec[i+4]))
+			}
+		case pid == videoPID:
+			if start && len(pes) > 0 {
+				if sps := findSPS(codec, pes); sps != nil {
+					return codec, sps
+				}
+				pes = pes[:0]
+			}
+			if start && len(payload) >= 9 {
+				payload = payload[min(9+int(payload[8]), len(payload)):] // PES header
+			}
+			pes = append(pes, payload...)
+		}
+	}
+	return codec, findSPS(codec, pes)
+}
+
+// psiSection returns the section of a PAT or PMT packet payload, after its
+// pointer field
+func psiSection(payload []byte) []byte {
+	if len(payload) == 0 || 1+int(payload[0]) > len(payload) {
+		return nil
+	}
+	return payload[1+int(payload[0]):]
+}
+
+// findSPS returns the first SPS in Annex B data
+func findSPS(codec rtsp.Codec, data []byte) []byte {
+	for _, nalu := range splitAnnexB(data) {
+		t := codec.NALType(nalu)
+		if codec == rtsp.H264 && t == 7 || codec == rtsp.H265 && t == 33 {
+			return nalu
+		}
+	}
+	return nil
+}
+
+// splitAnnexB splits data at start codes
+func splitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+3 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && data[end-1] == 0 {
+				end--
+			}
+			nalus = append(nalus, data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
@@ -0,0 +1,200 @@
+// Package probe checks that streaming links play. It opens an RTSP or RTMP
+// link until the first key frame, or fetches an HLS playlist and its newest
+// segment and checks that the playlist is live, and reports the codec, the
+// picture size and how long the stream took to start. Failures get a reason
+// a user can act on, e.g. that the device is offline rather than a status
+// code.
+package probe
+
+import (
+	"cmsv_api/rtmp"
+	"cmsv_api/rtsp"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultTimeout limits a probe when Options.Timeout is not set
+const DefaultTimeout = 20 * time.Second
+
+// Options configures a probe
+type Options struct {
+	Timeout time.Duration // Whole probe (default DefaultTimeout)
+	// Get requests HLS playlists and segments (default http.DefaultClient).
+	// cmsv.Client.Get accepts the self-signed certificates of CMSV servers.
+	Get func(ctx context.Context, rawURL string) (*http.Response, error)
+}
+
+// Result is the outcome of a probe. Durations are in milliseconds from the
+// start of the probe.
+type Result struct {
+	Protocol string `json:"protocol"` // rtsp, rtmp or hls
+	OK       bool   `json:"ok"`
+	Reason   string `json:"reason,omitempty"` // Why the link does not play
+	Status   int    `json:"status,omitempty"` // RTSP or HTTP status of a refusal, also when relayed over RTMP
+	Codec    string `json:"codec,omitempty"`  // H264 or H265
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	// ConnectMs is the time until the stream was set up: the RTSP PLAY or
+	// RTMP play response, or the HLS playlist
+	ConnectMs int64 `json:"connectMs"`
+	// FirstFrameMs is the time until the first key frame, or until the
+	// newest HLS segment was downloaded
+	FirstFrameMs int64 `json:"firstFrameMs,omitempty"`
+	// SegmentAgeMs is how long ago the newest HLS segment ended, when the
+	// playlist gives its time
+	SegmentAgeMs int64 `json:"segmentAgeMs,omitempty"`
+}
+
+// Resolution returns the picture size as WIDTHxHEIGHT, or "" when unknown
+func (r Result) Resolution() string {
+	if r.Width == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", r.Width, r.Height)
+}
+
+// Probe checks a link. rtsp:// and rtmp:// links are played, http:// and
+// https:// links are taken as HLS playlists.
+func Probe(ctx context.Context, rawURL string, opts Options) Result {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Get == nil {
+		opts.Get = func(ctx context.Context, rawURL string) (*http.Response, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			return http.DefaultClient.Do(req)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return Result{Reason: "not a valid link"}
+	}
+	switch u.Scheme {
+	case "rtsp":
+		return probeStream(ctx, "rtsp", func(ctx context.Context) (rtsp.Stream, error) {
+			return rtsp.Dial(ctx, rawURL)
+		})
+	case "rtmp":
+		return probeStream(ctx, "rtmp", func(ctx context.Context) (rtsp.Stream, error) {
+			return rtmp.Dial(ctx, rawURL)
+		})
+	case "http", "https":
+		return probeHLS(ctx, u, opts)
+	}
+	return Result{Reason: fmt.Sprintf("unsupported link type %q (use rtsp, rtmp or an HLS playlist)", u.Scheme)}
+}
+
+// probeStream plays a stream until its first key frame
+func probeStream(ctx context.Context, protocol string, dial func(context.Context) (rtsp.Stream, error)) Result {
+	res := Result{Protocol: protocol}
+	start := time.Now()
+	stream, err := dial(ctx)
+	res.ConnectMs = time.Since(start).Milliseconds()
+	if err != nil {
+		res.fail(ctx, "", err)
+		return res
+	}
+	defer stream.Close()
+	media := stream.Media()
+	res.Codec = media.Codec.String()
+	res.Width, res.Height, _ = media.Codec.PictureSize(media.ParameterSets)
+
+	for {
+		au, err := stream.ReadAccessUnit()
+		if err != nil {
+			if ctx.Err() != nil {
+				res.Reason = "the stream started but no key frame arrived in time: the device may be on a slow or lost connection"
+			} else {
+				res.fail(ctx, "the stream ended before the first key frame: ", err)
+			}
+			return res
+		}
+		if au.Key {
+			res.FirstFrameMs = time.Since(start).Milliseconds()
+			if res.Width == 0 {
+				res.Width, res.Height, _ = media.Codec.PictureSize(au.NALUs)
+			}
+			res.OK = true
+			return res
+		}
+	}
+}
+
+// fail sets the reason and status of a failure
+func (r *Result) fail(ctx context.Context, prefix string, err error) {
+	reason, status := explain(ctx, err)
+	r.Reason, r.Status = prefix+reason, status
+}
+
+// explain turns an error into a reason a user can act on, and the status
+// code of a refusal
+func explain(ctx context.Context, err error) (string, int) {
+	var dnsErr *net.DNSError
+	var rtspErr *rtsp.StatusError
+	var rtmpErr *rtmp.StatusError
+	var certErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var netErr net.Error
+	var httpErr *httpStatusError
+	switch {
+	case errors.As(err, &httpErr):
+		return statusReason(httpErr.code, http.StatusText(httpErr.code)), httpErr.code
+	case errors.As(err, &rtspErr):
+		return statusReason(rtspErr.Code, rtspErr.Reason), rtspErr.Code
+	case errors.As(err, &rtmpErr):
+		// Servers relaying another protocol may give its status
+		if code, reason, ok := strings.Cut(rtmpErr.Description, " "); ok {
+			if n, err := strconv.Atoi(code); err == nil && n >= 400 && n < 600 {
+				return statusReason(n, reason), n
+			}
+		}
+		if rtmpErr.Code == "NetStream.Play.StreamNotFound" {
+			return "device or channel not found (" + rtmpErr.Code + ")", 404
+		}
+		return rtmpErr.Error(), 0
+	case errors.As(err, &dnsErr):
+		return fmt.Sprintf("the server name %s could not be resolved", dnsErr.Name), 0
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused: nothing listens on the port of the link; check the port in the configuration and the firewall", 0
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "the server cannot be reached from this network", 0
+	case errors.As(err, &certErr), errors.As(err, &hostErr):
+		return "the certificate of the server is not trusted: " + err.Error(), 0
+	case errors.Is(err, context.DeadlineExceeded), ctx.Err() != nil,
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "no answer from the server in time: a firewall may drop the connection, or the device does not send video", 0
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "the server closed the connection: the link may be for another protocol or port", 0
+	}
+	return err.Error(), 0
+}
+
+// statusReason explains an RTSP or HTTP status of the CMSV media servers
+func statusReason(code int, reason string) string {
+	status := fmt.Sprintf("%d %s", code, reason)
+	switch code {
+	case 401, 403:
+		return "the server rejected the session (" + status + "): log in again for a fresh link"
+	case 404:
+		return "device or channel not found (" + status + ")"
+	case 503:
+		return "the device is offline or not sending video (" + status + ")"
+	}
+	return "the server answered " + status
+}
@@ -0,0 +1,211 @@
+package recorder
+
+import (
+	"cmsv_api/rtsp"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// mp4Timescale is the track timescale, the RTP clock rate
+const mp4Timescale = 90000
+
+// mp4Muxer writes a fragmented MP4 file with one H.264 track. Every GOP is
+// a fragment, so a file cut short by a crash plays up to its last GOP.
+type mp4Muxer struct {
+	w        io.Writer
+	sps, pps []byte
+	sequence uint32
+	start    time.Duration // PTS of the first frame
+	pending  []*rtsp.AccessUnit
+	lastDur  uint32
+}
+
+func newMP4Muxer(w io.Writer, codec rtsp.Codec, params [][]byte) (*mp4Muxer, error) {
+	if codec != rtsp.H264 {
+		return nil, errors.New("mp4 recording supports H.264 only, use the ts format for H.265")
+	}
+	m := &mp4Muxer{w: w, lastDur: mp4Timescale / 25}
+	for _, p := range params {
+		switch rtsp.H264.NALType(p) {
+		case 7:
+			m.sps = p
+		case 8:
+			m.pps = p
+		}
+	}
+	if m.sps == nil || m.pps == nil {
+		return nil, errors.New("stream has no SPS and PPS")
+	}
+	width, height, err := rtsp.H264.PictureSize(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(m.header(width, height)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WriteAccessUnit queues a frame. Frames are written as a fragment when the
+// next key frame arrives, when their durations are known.
+func (m *mp4Muxer) WriteAccessUnit(au *rtsp.AccessUnit) error {
+	if len(m.pending) == 0 {
+		if m.sequence == 0 {
+			m.start = au.PTS
+		}
+	} else if au.Key {
+		if err := m.flush(au.PTS); err != nil {
+			return err
+		}
+	}
+	m.pending = append(m.pending, au)
+	return nil
+}
+
+// Close writes the queued frames
+func (m *mp4Muxer) Close() error {
+	if len(m.pending) == 0 {
+		return nil
+	}
+	last := m.pending[len(m.pending)-1].PTS
+	return m.flush(last + time.Duration(m.lastDur)*time.Second/mp4Timescale)
+}
+
+// flush writes the queued frames as a fragment; next is the PTS of the
+// frame after them
+func (m *mp4Muxer) flush(next time.Duration) error {
+	m.sequence++
+	type sample struct {
+		duration, size, flags uint32
+	}
+	var samples []sample
+	var data []byte
+	for i, au := range m.pending {
+		end := next
+		if i+1 < len(m.pending) {
+			end = m.pending[i+1].PTS
+		}
+		duration := uint32(max(end-au.PTS, 0) * mp4Timescale / time.Second)
+		if duration == 0 {
+			duration = m.lastDur
+		}
+		m.lastDur = duration
+
+		size := 0
+		for _, n := range au.NALUs {
+			if t := rtsp.H264.NALType(n); t == 7 || t == 8 || t == 9 {
+				continue // Parameter sets are in the header
+			}
+			data = binary.BigEndian.AppendUint32(data, uint32(len(n)))
+			data = append(data, n...)
+			size += 4 + len(n)
+		}
+		flags := uint32(0x01010000) // Depends on others, not a sync sample
+		if au.Key {
+			flags = 0x02000000
+		}
+		samples = append(samples, sample{duration, uint32(size), flags})
+	}
+
+	base := uint64((m.pending[0].PTS - m.start) * mp4Timescale / time.Second)
+	m.pending = nil
+
+	trun := fullBox("trun", 0, 0x000701, // data offset, duration, size and flags per sample
+		u32(uint32(len(samples))), u32(0))
+	for _, s := range samples {
+		trun = append(trun, u32(s.duration)...)
+		trun = append(trun, u32(s.size)...)
+		trun = append(trun, u32(s.flags)...)
+	}
+	setBoxSize(trun)
+	traf := box("traf",
+		fullBox("tfhd", 0, 0x020000, u32(1)), // default-base-is-moof
+		fullBox("tfdt", 1, 0, u64(base)),
+		trun,
+	)
+	moof := box("moof", fullBox("mfhd", 0, 0, u32(m.sequence)), traf)
+
+	// The data offset is from the start of moof to the first sample
+	offset := len(moof) + 8
+	trunAt := len(moof) - len(trun)
+	binary.BigEndian.PutUint32(moof[trunAt+16:], uint32(offset))
+
+	mdat := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(mdat, uint32(8+len(data)))
+	copy(mdat[4:], "mdat")
+	if _, err := m.w.Write(moof); err != nil {
+		return err
+	}
+	_, err := m.w.Write(append(mdat, data...))
+	return err
+}
+
+// header returns the ftyp and moov boxes
+func (m *mp4Muxer) header(width, height int) []byte {
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41avc1"))
+
+	matrix := []byte{}
+	for _, v := range []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000} {
+		matrix = append(matrix, u32(v)...)
+	}
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation and modification time
+		u32(1000), u32(0), // timescale, duration
+		u32(0x10000), []byte{1, 0}, make([]byte, 10), // rate, volume, reserved
+		matrix, make([]byte, 24), u32(2)) // next_track_ID
+	tkhd := fullBox("tkhd", 0, 3, // enabled, in movie
+		u32(0), u32(0), u32(1), u32(0), u32(0), // times, track_ID, reserved, duration
+		make([]byte, 8), []byte{0, 0, 0, 0, 0, 0, 0, 0}, // reserved, layer, group, volume, reserved
+		matrix, u32(uint32(width)<<16), u32(uint32(height)<<16))
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(mp4Timescale), u32(0),
+		[]byte{0x55, 0xc4, 0, 0}) // language "und"
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+
+	avcC := box("avcC", []byte{1, m.sps[1], m.sps[2], m.sps[3], 0xff, 0xe1},
+		u16(uint16(len(m.sps))), m.sps, []byte{1}, u16(uint16(len(m.pps))), m.pps)
+	avc1 := box("avc1", make([]byte, 6), u16(1), // reserved, data_reference_index
+		make([]byte, 16), u16(uint16(width)), u16(uint16(height)),
+		u32(0x480000), u32(0x480000), u32(0), u16(1), // resolution 72 dpi, frame_count
+		make([]byte, 32), u16(0x18), []byte{0xff, 0xff}, // compressorname, depth, pre_defined
+		avcC)
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), avc1),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)),
+	)
+	minf := box("minf",
+		fullBox("vmhd", 0, 1, make([]byte, 8)),
+		box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1))),
+		stbl,
+	)
+	trak := box("trak", tkhd, box("mdia", mdhd, hdlr, minf))
+	mvex := box("mvex", fullBox("trex", 0, 0, u32(1), u32(1), u32(0), u32(0), u32(0)))
+	return append(ftyp, box("moov", mvhd, trak, mvex)...)
+}
+
+func box(kind string, parts ...[]byte) []byte {
+	b := make([]byte, 8)
+	copy(b[4:], kind)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	setBoxSize(b)
+	return b
+}
+
+func fullBox(kind string, version byte, flags uint32, parts ...[]byte) []byte {
+	header := u32(uint32(version)<<24 | flags&0xffffff)
+	return box(kind, append([][]byte{header}, parts...)...)
+}
+
+func setBoxSize(b []byte) {
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
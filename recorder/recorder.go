@@ -0,0 +1,494 @@
+// Package recorder records live RTSP streams to segmented MPEG-TS or MP4
+// files, one directory per device and channel. Recording can run all the
+// time, in daily schedule windows, or around triggers such as alarms, with
+// video from before the trigger kept in memory. Old files are deleted to
+// stay under a disk quota.
+package recorder
+
+import (
+	"bufio"
+	"cmsv_api/rtsp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of Options.Format
+const (
+	FormatTS  = "ts"
+	FormatMP4 = "mp4"
+)
+
+const (
+	DefaultSegment    = 5 * time.Minute
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 30 * time.Second
+
+	// lateTrigger is how much older than Pre a trigger may be and still get
+	// its full pre-trigger video, as alarms arrive after a polling delay
+	lateTrigger = 30 * time.Second
+)
+
+// Options configures a recorder
+type Options struct {
+	Dir         string        // Root directory of the recordings
+	Format      string        // FormatTS (default) or FormatMP4
+	Segment     time.Duration // Length of the files (default DefaultSegment)
+	Schedule    Schedule      // Daily windows of continuous recording
+	TriggerOnly bool          // Without a schedule, record only around triggers instead of all the time
+	Pre         time.Duration // Video kept from before a trigger
+	Post        time.Duration // Recording after a trigger
+	QuotaBytes  int64         // Total size of the recordings under Dir; 0 for no limit
+	Logger      *log.Logger   // Connection failures and deleted files are logged here when set
+	OnSegment   func(Segment) // Called when a file is finished
+}
+
+// Source is a stream to record
+type Source struct {
+	Device  string
+	Channel int
+	// URL returns the RTSP URL of the stream, e.g. from
+	// cmsv.Client.GenerateRTSPLink. It is called on every connection
+	// attempt with the error that ended the previous one (nil at first),
+	// so a session rejected with a 401 *rtsp.StatusError can be renewed.
+	URL func(ctx context.Context, failure error) (string, error)
+}
+
+// Segment is a finished recording file
+type Segment struct {
+	Device  string    `json:"device"`
+	Channel int       `json:"channel"`
+	Path    string    `json:"path"`
+	Begin   time.Time `json:"begin"`
+	End     time.Time `json:"end"`
+	Size    int64     `json:"size"`
+}
+
+// Duration returns the length of the recording
+func (s Segment) Duration() time.Duration {
+	return s.End.Sub(s.Begin)
+}
+
+// Recorder records any number of sources with the same options
+type Recorder struct {
+	opts Options
+
+	mu       sync.Mutex
+	triggers map[string]trigger // By device
+	open     map[string]bool    // Files being written
+}
+
+// trigger is the time range recorded around the triggers of a device
+type trigger struct {
+	from, until time.Time
+}
+
+// NewRecorder checks the options and creates the root directory
+func NewRecorder(opts Options) (*Recorder, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("recorder: no directory")
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = FormatTS
+	case FormatTS, FormatMP4:
+	default:
+		return nil, fmt.Errorf("recorder: unknown format %q (use ts or mp4)", opts.Format)
+	}
+	if opts.Segment <= 0 {
+		opts.Segment = DefaultSegment
+	}
+	if opts.Pre < 0 || opts.Post < 0 || opts.QuotaBytes < 0 {
+		return nil, errors.New("recorder: negative pre, post or quota")
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("recorder: %v", err)
+	}
+	return &Recorder{
+		opts:     opts,
+		triggers: map[string]trigger{},
+		open:     map[string]bool{},
+	}, nil
+}
+
+// Trigger records every channel of a device from Pre before until Post
+// after the time of an event. Triggers that overlap extend the recording.
+func (r *Recorder) Trigger(device string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.triggers[device]
+	from, until := at.Add(-r.opts.Pre), at.Add(r.opts.Post)
+	if t.until.IsZero() || t.until.Before(from) {
+		t = trigger{from: from, until: until}
+	} else {
+		if from.Before(t.from) {
+			t.from = from
+		}
+		if until.After(t.until) {
+			t.until = until
+		}
+	}
+	r.triggers[device] = t
+}
+
+// active reports whether a frame of a device taken at t is recorded, and
+// the earliest time to record when recording starts
+func (r *Recorder) active(device string, t time.Time) (bool, time.Time) {
+	if r.opts.Schedule.Active(t) {
+		return true, t
+	}
+	if len(r.opts.Schedule) == 0 && !r.opts.TriggerOnly {
+		return true, t
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tr := r.triggers[device]
+	if !t.Before(tr.from) && t.Before(tr.until) {
+		return true, tr.from
+	}
+	if !t.Before(tr.until) && !tr.until.IsZero() {
+		delete(r.triggers, device)
+	}
+	return false, time.Time{}
+}
+
+// Record records a source until ctx is cancelled, reconnecting with backoff
+// when the stream fails
+func (r *Recorder) Record(ctx context.Context, src Source) error {
+	ch := &channelRecorder{r: r, src: src}
+	defer ch.closeSegment()
+
+	backoff := DefaultMinBackoff
+	var err error
+	for {
+		var frames int
+		frames, err = ch.run(ctx, err)
+		ch.closeSegment()
+		ch.gops = nil
+		if ctx.Err() != nil {
+			return nil
+		}
+		if frames > 0 {
+			backoff = DefaultMinBackoff
+		}
+		r.logf("recorder: %s CH%d: %v, reconnecting in %v", src.Device, src.Channel+1, err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, DefaultMaxBackoff)
+	}
+}
+
+func (r *Recorder) logf(format string, args ...any) {
+	if r.opts.Logger != nil {
+		r.opts.Logger.Printf(format, args...)
+	}
+}
+
+// muxer writes frames to a file
+type muxer interface {
+	WriteAccessUnit(au *rtsp.AccessUnit) error
+	Close() error
+}
+
+// segment is a file being written
+type segment struct {
+	file  *os.File
+	buf   *bufio.Writer
+	mux   muxer
+	path  string
+	begin time.Time
+	last  time.Time
+	pts   time.Duration // PTS of the first frame
+}
+
+// channelRecorder is the state of one source
+type channelRecorder struct {
+	r      *Recorder
+	src    Source
+	media  rtsp.Media
+	params [][]byte // Latest parameter sets
+	seg    *segment
+	gops   [][]*rtsp.AccessUnit // Frames kept for pre-trigger video, by GOP
+}
+
+// run records one connection. It returns the number of frames received.
+func (c *channelRecorder) run(ctx context.Context, failure error) (int, error) {
+	u, err := c.src.URL(ctx, failure)
+	if err != nil {
+		return 0, err
+	}
+	stream, err := rtsp.Dial(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	c.media = stream.Media()
+	if c.r.opts.Format == FormatMP4 && c.media.Codec != rtsp.H264 {
+		return 0, fmt.Errorf("%s stream can't be recorded as mp4, use ts", c.media.Codec)
+	}
+	c.params = c.media.ParameterSets
+
+	frames := 0
+	for {
+		au, err := stream.ReadAccessUnit()
+		if err != nil {
+			return frames, err
+		}
+		frames++
+		if err := c.handle(au); err != nil {
+			return frames, err
+		}
+	}
+}
+
+// handle writes or buffers a frame
+func (c *channelRecorder) handle(au *rtsp.AccessUnit) error {
+	if au.Key {
+		var params [][]byte
+		for _, n := range au.NALUs {
+			if c.media.Codec.IsParameterSet(n) {
+				params = append(params, n)
+			}
+		}
+		if len(params) > 0 {
+			c.params = params
+		}
+	}
+
+	active, from := c.r.active(c.src.Device, au.Time)
+	if !active {
+		c.closeSegment()
+		c.buffer(au)
+		return nil
+	}
+
+	if c.seg == nil {
+		// Start with the buffered video from the start of the range
+		c.buffer(au)
+		var frames []*rtsp.AccessUnit
+		for i, gop := range c.gops {
+			if i+1 < len(c.gops) && !c.gops[i+1][0].Time.After(from) {
+				continue // Ends before the range
+			}
+			frames = append(frames, gop...)
+		}
+		c.gops = nil
+		if len(frames) == 0 {
+			return nil // Waiting for a key frame
+		}
+		for _, f := range frames {
+			if err := c.write(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if au.Key && au.PTS-c.seg.pts >= c.r.opts.Segment {
+		c.closeSegment()
+	}
+	return c.write(au)
+}
+
+// buffer keeps a frame for pre-trigger video, dropping GOPs that are too
+// old to be recorded
+func (c *channelRecorder) buffer(au *rtsp.AccessUnit) {
+	if au.Key {
+		c.gops = append(c.gops, []*rtsp.AccessUnit{au})
+	} else if len(c.gops) > 0 {
+		c.gops[len(c.gops)-1] = append(c.gops[len(c.gops)-1], au)
+	}
+	keep := au.Time.Add(-c.r.opts.Pre - lateTrigger)
+	for len(c.gops) > 1 && !c.gops[1][0].Time.After(keep) {
+		c.gops = c.gops[1:]
+	}
+}
+
+// write writes a frame to the current segment, opening one at key frames
+func (c *channelRecorder) write(au *rtsp.AccessUnit) error {
+	if c.seg == nil {
+		if !au.Key {
+			return nil
+		}
+		if err := c.openSegment(au.Time, au.PTS); err != nil {
+			return err
+		}
+	}
+	if err := c.seg.mux.WriteAccessUnit(au); err != nil {
+		return fmt.Errorf("writing %s: %v", c.seg.path, err)
+	}
+	c.seg.last = au.Time
+	if au.Key {
+		return c.seg.buf.Flush() // A crash loses at most one GOP
+	}
+	return nil
+}
+
+// Path returns the file name of a recording started at t:
+// <dir>/<device>/CH<n>/<device>_CH<n>_<YYYYMMDD-HHMMSS>.<format>
+func (r *Recorder) Path(device string, channel int, t time.Time) string {
+	ch := fmt.Sprintf("CH%d", channel+1)
+	name := fmt.Sprintf("%s_%s_%s.%s", safeName(device), ch, t.Format("20060102-150405"), r.opts.Format)
+	return filepath.Join(r.opts.Dir, safeName(device), ch, name)
+}
+
+func safeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func (c *channelRecorder) openSegment(begin time.Time, pts time.Duration) error {
+	path := c.r.Path(c.src.Device, c.src.Channel, begin)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		// Reconnected within the same second
+		path = strings.TrimSuffix(path, "."+c.r.opts.Format) + fmt.Sprintf("_%d.%s", begin.Nanosecond()/1e6, c.r.opts.Format)
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriterSize(file, 256*1024)
+	var mux muxer
+	if c.r.opts.Format == FormatMP4 {
+		mux, err = newMP4Muxer(buf, c.media.Codec, c.params)
+	} else {
+		mux = NewTSMuxer(buf, c.media.Codec, c.params)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	c.r.mu.Lock()
+	c.r.open[path] = true
+	c.r.mu.Unlock()
+	c.seg = &segment{file: file, buf: buf, mux: mux, path: path, begin: begin, last: begin, pts: pts}
+	c.r.enforceQuota()
+	return nil
+}
+
+func (c *channelRecorder) closeSegment() {
+	seg := c.seg
+	if seg == nil {
+		return
+	}
+	c.seg = nil
+	err := seg.mux.Close()
+	if ferr := seg.buf.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := seg.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.r.logf("recorder: closing %s: %v", seg.path, err)
+	}
+
+	c.r.mu.Lock()
+	delete(c.r.open, seg.path)
+	c.r.mu.Unlock()
+
+	if c.r.opts.OnSegment != nil {
+		var size int64
+		if info, err := os.Stat(seg.path); err == nil {
+			size = info.Size()
+		}
+		c.r.opts.OnSegment(Segment{
+			Device:  c.src.Device,
+			Channel: c.src.Channel,
+			Path:    seg.path,
+			Begin:   seg.begin,
+			End:     seg.last,
+			Size:    size,
+		})
+	}
+	c.r.enforceQuota()
+}
+
+// Files returns the recordings under the root directory, oldest first
+func (r *Recorder) Files() ([]string, error) {
+	type file struct {
+		path string
+		mod  time.Time
+	}
+	var files []file
+	err := filepath.WalkDir(r.opts.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if ext := filepath.Ext(path); ext != "."+FormatTS && ext != "."+FormatMP4 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // Deleted meanwhile
+		}
+		files = append(files, file{path, info.ModTime()})
+		return nil
+	})
+	slices.SortFunc(files, func(a, b file) int { return a.mod.Compare(b.mod) })
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	return paths, err
+}
+
+// enforceQuota deletes the oldest finished recordings until the total size
+// is within the quota
+func (r *Recorder) enforceQuota() {
+	if r.opts.QuotaBytes <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	paths, err := r.Files()
+	if err != nil {
+		r.logf("recorder: quota: %v", err)
+	}
+	sizes := make([]int64, len(paths))
+	var total int64
+	for i, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i, p := range paths {
+		if total <= r.opts.QuotaBytes {
+			return
+		}
+		if r.open[p] {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			r.logf("recorder: quota: %v", err)
+			continue
+		}
+		total -= sizes[i]
+		r.logf("recorder: quota: deleted %s", p)
+	}
+}
@@ -0,0 +1,225 @@
+package recorder
+
+import (
+	"cmsv_api/rtsp"
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testFPS = 25
+	testGOP = 5 // Frames, a key frame every 200 ms
+	// gopDuration is the time from one key frame of the test pattern to the next
+	gopDuration = testGOP * time.Second / testFPS
+	// slack absorbs the delivery jitter of frames timed on reception
+	slack = 100 * time.Millisecond
+)
+
+// testSource serves a test pattern over RTSP and returns a source for it
+func testSource(t *testing.T) Source {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &rtsp.Server{Handler: func(*url.URL) (rtsp.Stream, error) {
+		return rtsp.NewTestPattern(rtsp.TestPatternOptions{Width: 64, Height: 64, FPS: testFPS, GOP: testGOP}), nil
+	}}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	u := "rtsp://" + l.Addr().String() + "/000000447007/0"
+	return Source{
+		Device:  "000000447007",
+		Channel: 0,
+		URL:     func(context.Context, error) (string, error) { return u, nil },
+	}
+}
+
+// segments collects the finished segments of a recorder
+type segments struct {
+	mu   sync.Mutex
+	list []Segment
+	done chan struct{}
+}
+
+func newSegments() *segments {
+	return &segments{done: make(chan struct{}, 100)}
+}
+
+func (s *segments) add(seg Segment) {
+	s.mu.Lock()
+	s.list = append(s.list, seg)
+	s.mu.Unlock()
+	s.done <- struct{}{}
+}
+
+func (s *segments) get() []Segment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Segment(nil), s.list...)
+}
+
+// wait waits for n finished segments
+func (s *segments) wait(t *testing.T, n int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for len(s.get()) < n {
+		select {
+		case <-s.done:
+		case <-deadline:
+			t.Fatalf("got %d segments, want %d", len(s.get()), n)
+		}
+	}
+}
+
+// record runs a recorder on src until the returned stop function is called
+func record(r *Recorder, src Source) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Record(ctx, src)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestSegmentRollover(t *testing.T) {
+	const segment = 2 * gopDuration
+	segs := newSegments()
+	r, err := NewRecorder(Options{Dir: t.TempDir(), Segment: segment, OnSegment: segs.add})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := record(r, testSource(t))
+	segs.wait(t, 3, 10*time.Second)
+	stop()
+
+	list := segs.get()
+	for i, seg := range list[:3] {
+		if seg.Device != "000000447007" || seg.Channel != 0 {
+			t.Errorf("segment %d: device %s CH%d, want 000000447007 CH1", i, seg.Device, seg.Channel+1)
+		}
+		info, err := os.Stat(seg.Path)
+		if err != nil {
+			t.Fatalf("segment %d: %v", i, err)
+		}
+		if info.Size() == 0 || info.Size() != seg.Size {
+			t.Errorf("segment %d: size %d on disk, %d reported", i, info.Size(), seg.Size)
+		}
+		if filepath.Dir(seg.Path) != filepath.Join(r.opts.Dir, "000000447007", "CH1") {
+			t.Errorf("segment %d: written to %s", i, seg.Path)
+		}
+		if d := seg.Duration(); d <= 0 || d > segment+slack {
+			t.Errorf("segment %d: %v long, want up to %v", i, d, segment)
+		}
+		if i > 0 && seg.Begin.Before(list[i-1].End) {
+			t.Errorf("segment %d begins at %v before the previous one ends at %v", i, seg.Begin, list[i-1].End)
+		}
+	}
+	// Only the last segment may be cut short by stopping
+	for i, seg := range list[1 : len(list)-1] {
+		if d := seg.Duration(); d < segment-gopDuration-slack {
+			t.Errorf("segment %d: %v long, want about %v", i+1, d, segment)
+		}
+	}
+}
+
+func TestTriggerPrePost(t *testing.T) {
+	const pre, post = 3 * gopDuration, 3 * gopDuration
+	segs := newSegments()
+	r, err := NewRecorder(Options{Dir: t.TempDir(), TriggerOnly: true, Pre: pre, Post: post, OnSegment: segs.add})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := record(r, testSource(t))
+	defer stop()
+
+	// Let the stream run longer than Pre, nothing is written before the trigger
+	time.Sleep(pre + 3*gopDuration)
+	if files, _ := r.Files(); len(files) != 0 {
+		t.Fatalf("files before the trigger: %v", files)
+	}
+
+	at := time.Now()
+	r.Trigger("000000447007", at)
+	segs.wait(t, 1, 10*time.Second)
+
+	seg := segs.get()[0]
+	from, until := at.Add(-pre), at.Add(post)
+	// The file starts at the key frame before from, as frames can't be decoded
+	// without it, and ends with the last frame before until
+	if seg.Begin.After(from) || seg.Begin.Before(from.Add(-gopDuration-slack)) {
+		t.Errorf("recording begins %v after the trigger, want %v up to one GOP earlier", seg.Begin.Sub(at), -pre)
+	}
+	if seg.End.After(until) || seg.End.Before(until.Add(-slack)) {
+		t.Errorf("recording ends %v after the trigger, want just before %v", seg.End.Sub(at), post)
+	}
+
+	// Nothing more is recorded after the trigger range
+	time.Sleep(3 * gopDuration)
+	if files, _ := r.Files(); len(files) != 1 {
+		t.Errorf("files after the trigger: %v, want 1", files)
+	}
+}
+
+func TestEnforceQuota(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(Options{Dir: dir, QuotaBytes: 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Four 100 byte recordings, oldest first, and a file that isn't one
+	base := time.Now().Add(-time.Hour)
+	var paths []string
+	for i := range 4 {
+		p := r.Path("000000447007", 0, base.Add(time.Duration(i)*time.Minute))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mod := base.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(p, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	other := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(other, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest file is still being written and must be kept
+	r.open[paths[0]] = true
+	r.enforceQuota()
+
+	for i, want := range []bool{true, false, false, true} {
+		_, err := os.Stat(paths[i])
+		if exists := err == nil; exists != want {
+			t.Errorf("file %d exists: %v, want %v", i, exists, want)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("a file that isn't a recording was deleted: %v", err)
+	}
+
+	// Once closed, the oldest file goes first
+	delete(r.open, paths[0])
+	r.opts.QuotaBytes = 100
+	r.enforceQuota()
+	if files, _ := r.Files(); len(files) != 1 || files[0] != paths[3] {
+		t.Errorf("files = %v, want only the newest", files)
+	}
+}
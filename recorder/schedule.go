@@ -0,0 +1,83 @@
+package recorder
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily time window, as offsets from midnight. Windows whose
+// end is before their start run overnight.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Schedule is a set of daily windows of continuous recording
+type Schedule []Window
+
+// ParseSchedule parses comma separated windows such as
+// "08:00-12:00,13:00-18:00" or "22:00-06:00". An empty string is an empty
+// schedule.
+func ParseSchedule(s string) (Schedule, error) {
+	var schedule Schedule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(item, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule window %q (use HH:MM-HH:MM)", item)
+		}
+		start, err1 := parseClock(from)
+		end, err2 := parseClock(to)
+		if err1 != nil || err2 != nil || start == end {
+			return nil, fmt.Errorf("invalid schedule window %q (use HH:MM-HH:MM)", item)
+		}
+		schedule = append(schedule, Window{Start: start, End: end})
+	}
+	return schedule, nil
+}
+
+// parseClock parses HH:MM, allowing 24:00
+func parseClock(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active reports whether t falls into a window
+func (s Schedule) Active(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	for _, w := range s {
+		if w.Start < w.End {
+			if offset >= w.Start && offset < w.End {
+				return true
+			}
+		} else if offset >= w.Start || offset < w.End {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the schedule like ParseSchedule expects it
+func (s Schedule) String() string {
+	var items []string
+	for _, w := range s {
+		items = append(items, clock(w.Start)+"-"+clock(w.End))
+	}
+	return strings.Join(items, ",")
+}
+
+func clock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
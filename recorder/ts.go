@@ -0,0 +1,228 @@
+package recorder
+
+import (
+	"cmsv_api/rtsp"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	tsPacketSize = 188
+	patPID       = 0
+	pmtPID       = 0x1000
+	videoPID     = 0x100
+
+	// Timestamps start late enough for the PCR to run ahead of them
+	tsTimestampOffset = 126000 // 1.4s
+	tsPCROffset       = 90000  // 1s
+)
+
+// TSMuxer writes an MPEG transport stream with one video stream. It is
+// used for recordings and for HLS segments.
+type TSMuxer struct {
+	w          io.Writer
+	codec      rtsp.Codec
+	params     [][]byte
+	continuity map[uint16]byte
+	start      time.Duration // PTS of the first frame
+	started    bool
+}
+
+// NewTSMuxer creates a muxer for a stream. The parameter sets are repeated
+// on key frames that do not carry them.
+func NewTSMuxer(w io.Writer, codec rtsp.Codec, params [][]byte) *TSMuxer {
+	return &TSMuxer{w: w, codec: codec, params: params, continuity: map[uint16]byte{}}
+}
+
+// WriteAccessUnit writes a frame as one PES packet. The PAT and PMT are
+// repeated before every key frame, so a player can start at any of them.
+func (m *TSMuxer) WriteAccessUnit(au *rtsp.AccessUnit) error {
+	if !m.started {
+		m.start, m.started = au.PTS, true
+	}
+	if au.Key {
+		if err := m.writePSI(); err != nil {
+			return err
+		}
+	}
+
+	// Access unit delimiter, then the parameter sets on key frames if the
+	// frame does not carry them
+	var nalus [][]byte
+	if m.codec == rtsp.H265 {
+		nalus = append(nalus, []byte{0x46, 0x01, 0x50})
+	} else {
+		nalus = append(nalus, []byte{0x09, 0xf0})
+	}
+	if au.Key && !hasParameterSets(m.codec, au.NALUs) {
+		nalus = append(nalus, m.params...)
+	}
+	for _, n := range au.NALUs {
+		if t := m.codec.NALType(n); (m.codec == rtsp.H264 && t == 9) || (m.codec == rtsp.H265 && t == 35) {
+			continue // Existing delimiters
+		}
+		nalus = append(nalus, n)
+	}
+
+	pts := uint64((au.PTS-m.start)*90000/time.Second) + tsTimestampOffset
+	pes := make([]byte, 14, 14+len(nalus)*4)
+	copy(pes, []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5}) // Video stream, length unbounded, PTS only
+	putTimestamp(pes[9:], 0x20, pts)
+	pes = append(pes, rtsp.AnnexB(nalus)...)
+
+	pcr := pts - tsTimestampOffset + tsPCROffset
+	return m.writePackets(videoPID, pes, &pcr, au.Key)
+}
+
+func hasParameterSets(codec rtsp.Codec, nalus [][]byte) bool {
+	for _, n := range nalus {
+		if codec.IsParameterSet(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// putTimestamp writes a 33-bit PES timestamp with its 4-bit prefix
+func putTimestamp(b []byte, prefix byte, ts uint64) {
+	b[0] = prefix | byte(ts>>29)&0x0e | 1
+	binary.BigEndian.PutUint16(b[1:], uint16(ts>>14)|1)
+	binary.BigEndian.PutUint16(b[3:], uint16(ts<<1)|1)
+}
+
+// writePSI writes the program association and program map tables
+func (m *TSMuxer) writePSI() error {
+	pat := []byte{
+		0x00,       // table_id
+		0xb0, 0x0d, // section_syntax_indicator, section_length 13
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section numbers
+		0x00, 0x01, // program_number 1
+		0xe0 | pmtPID>>8, pmtPID & 0xff,
+	}
+	if err := m.writePackets(patPID, section(pat), nil, false); err != nil {
+		return err
+	}
+
+	streamType := byte(0x1b) // H.264
+	if m.codec == rtsp.H265 {
+		streamType = 0x24
+	}
+	pmt := []byte{
+		0x02,       // table_id
+		0xb0, 0x12, // section_length 18
+		0x00, 0x01, // program_number
+		0xc1,
+		0x00, 0x00,
+		0xe0 | videoPID>>8, videoPID & 0xff, // PCR_PID
+		0xf0, 0x00, // program_info_length
+		streamType,
+		0xe0 | videoPID>>8, videoPID & 0xff,
+		0xf0, 0x00, // ES_info_length
+	}
+	return m.writePackets(pmtPID, section(pmt), nil, false)
+}
+
+// section adds the pointer field and CRC to a PSI section
+func section(data []byte) []byte {
+	out := append([]byte{0}, data...)
+	return binary.BigEndian.AppendUint32(out, crc32MPEG(data))
+}
+
+// writePackets splits a payload into transport packets. The first packet
+// carries the PCR, if given, and the random access indicator of key frames.
+func (m *TSMuxer) writePackets(pid uint16, payload []byte, pcr *uint64, key bool) error {
+	buf := make([]byte, 0, (len(payload)/(tsPacketSize-4)+2)*tsPacketSize)
+	first := true
+	for first || len(payload) > 0 {
+		packet := make([]byte, 4, tsPacketSize)
+		packet[0] = 0x47
+		packet[1] = byte(pid >> 8 & 0x1f)
+		if first {
+			packet[1] |= 0x40 // payload_unit_start_indicator
+		}
+		packet[2] = byte(pid)
+		packet[3] = 0x10 | m.continuity[pid]&0x0f // Payload only
+		m.continuity[pid]++
+
+		var adaptation []byte
+		if first && (pcr != nil || key) {
+			flags := byte(0)
+			if key {
+				flags |= 0x40 // random_access_indicator
+			}
+			adaptation = []byte{flags}
+			if pcr != nil {
+				adaptation[0] |= 0x10
+				base := *pcr
+				adaptation = append(adaptation,
+					byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1),
+					byte(base<<7)|0x7e, 0x00)
+			}
+		}
+
+		room := tsPacketSize - 4
+		if adaptation != nil {
+			room -= 1 + len(adaptation)
+		}
+		if len(payload) < room {
+			// Stuff the adaptation field so the payload ends the packet
+			if adaptation == nil {
+				adaptation = []byte{}
+				room--
+				if room > len(payload) {
+					adaptation = append(adaptation, 0x00)
+					room--
+				}
+			}
+			for room > len(payload) {
+				adaptation = append(adaptation, 0xff)
+				room--
+			}
+		}
+		if adaptation != nil {
+			packet[3] |= 0x20
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		}
+		n := min(room, len(payload))
+		packet = append(packet, payload[:n]...)
+		payload = payload[n:]
+		buf = append(buf, packet...)
+		first = false
+	}
+	_, err := m.w.Write(buf)
+	return err
+}
+
+// Close does nothing; a transport stream needs no trailer
+func (m *TSMuxer) Close() error {
+	return nil
+}
+
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32MPEG is the CRC of PSI sections (CRC-32/MPEG-2)
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
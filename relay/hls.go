@@ -0,0 +1,283 @@
+package relay
+
+import (
+	"cmsv_api/recorder"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hlsSegments is the number of segments kept and listed in playlists
+	hlsSegments = 6
+	// hlsIdle is how long a stream is segmented after the last request,
+	// at least three segments
+	hlsIdle = 20 * time.Second
+)
+
+// hlsStream segments a stream into MPEG-TS files while it is requested
+type hlsStream struct {
+	key       Key
+	ready     chan struct{} // Closed at the first segment or a failure
+	readyOnce sync.Once
+
+	mu       sync.Mutex
+	err      error
+	segments []hlsSegment
+	request  time.Time // Last request
+}
+
+type hlsSegment struct {
+	seq      int
+	duration time.Duration
+	data     []byte
+}
+
+// segmentWriter collects the output of the muxer for the current segment
+type segmentWriter struct {
+	data []byte
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	w.data = append(w.data, p...)
+	return len(p), nil
+}
+
+func (w *segmentWriter) take() []byte {
+	data := w.data
+	w.data = nil
+	return data
+}
+
+// ServeHTTP serves the HLS playlists and segments of the streams, and the
+// list of relayed streams as JSON on /streams
+func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*") // Web players on other origins
+	if req.URL.Path == "/streams" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Streams())
+		return
+	}
+
+	key, file, err := ParseKey(req.URL.Path)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	switch {
+	case file == "index.m3u8":
+		playlist, err := r.Playlist(req.Context(), key)
+		if err != nil {
+			http.Error(w, err.Error(), hlsStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(playlist))
+
+	case strings.HasSuffix(file, ".ts"):
+		seq, err := strconv.Atoi(strings.TrimSuffix(file, ".ts"))
+		var data []byte
+		if err == nil {
+			data = r.Segment(key, seq)
+		}
+		if data == nil {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// Playlist returns the HLS playlist of a stream, starting to segment it if
+// needed. Its segments are named <seq>.ts; see Segment. The stream is
+// segmented until the playlist is not requested for a while.
+func (r *Relay) Playlist(ctx context.Context, key Key) (string, error) {
+	s := r.openHLS(key)
+	ctx, cancel := context.WithTimeout(ctx, openTimeout+2*r.opts.HLSSegment)
+	defer cancel()
+	select {
+	case <-s.ready:
+	case <-ctx.Done():
+		return "", fmt.Errorf("no video from the device: %w", ctx.Err())
+	}
+	return s.playlist()
+}
+
+// Segment returns an HLS segment of a stream, nil when it is unknown or
+// expired
+func (r *Relay) Segment(key Key, seq int) []byte {
+	r.mu.Lock()
+	s := r.hls[key]
+	r.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.segment(seq)
+}
+
+// hlsStatus returns the HTTP status of an upstream failure
+func hlsStatus(err error) int {
+	switch st := upstreamStatus(err); st.Code {
+	case http.StatusNotFound, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return st.Code
+	}
+	return http.StatusBadGateway
+}
+
+// openHLS returns the segmenter of a stream, starting it if needed, and
+// records the request
+func (r *Relay) openHLS(key Key) *hlsStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.hls[key]
+	if s == nil {
+		s = &hlsStream{key: key, ready: make(chan struct{})}
+		r.hls[key] = s
+		go r.segment(s)
+	}
+	s.mu.Lock()
+	s.request = time.Now()
+	s.mu.Unlock()
+	return s
+}
+
+// segment cuts the stream into segments at the first key frame after each
+// HLSSegment, until no player requested the playlist for a while
+func (r *Relay) segment(s *hlsStream) {
+	defer func() {
+		r.mu.Lock()
+		if r.hls[s.key] == s {
+			delete(r.hls, s.key)
+		}
+		r.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+	v, err := r.Subscribe(ctx, s.key)
+	cancel()
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	defer v.Close()
+
+	idle := max(hlsIdle, 3*r.opts.HLSSegment)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				last := s.request
+				s.mu.Unlock()
+				if time.Since(last) > idle {
+					v.Close() // Ends ReadAccessUnit
+					return
+				}
+			}
+		}
+	}()
+
+	media := v.Media()
+	w := &segmentWriter{}
+	mux := recorder.NewTSMuxer(w, media.Codec, media.ParameterSets)
+	var start time.Duration
+	open := false
+	for {
+		au, err := v.ReadAccessUnit()
+		if err != nil {
+			s.fail(errors.New("stream ended"))
+			return
+		}
+		if au.Key && open && au.PTS-start >= r.opts.HLSSegment {
+			s.add(au.PTS-start, w.take())
+			open = false
+		}
+		if !open {
+			if !au.Key {
+				continue
+			}
+			open, start = true, au.PTS
+		}
+		mux.WriteAccessUnit(au) // Writing to memory does not fail
+	}
+}
+
+// add appends a finished segment, dropping the oldest
+func (s *hlsStream) add(duration time.Duration, data []byte) {
+	s.mu.Lock()
+	seq := 0
+	if n := len(s.segments); n > 0 {
+		seq = s.segments[n-1].seq + 1
+	}
+	s.segments = append(s.segments, hlsSegment{seq: seq, duration: duration, data: data})
+	if len(s.segments) > hlsSegments {
+		s.segments = s.segments[len(s.segments)-hlsSegments:]
+	}
+	s.mu.Unlock()
+	s.readyOnce.Do(func() { close(s.ready) })
+}
+
+// fail ends the stream; requests waiting for a first segment get err
+func (s *hlsStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.readyOnce.Do(func() { close(s.ready) })
+}
+
+// playlist returns the live playlist of the segments
+func (s *hlsStream) playlist() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 {
+		return "", s.err
+	}
+	var target time.Duration
+	for _, seg := range s.segments {
+		target = max(target, seg.duration)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n",
+		int(math.Ceil(target.Seconds())), s.segments[0].seq)
+	for _, seg := range s.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.ts\n", seg.duration.Seconds(), seg.seq)
+	}
+	return b.String(), nil
+}
+
+// segment returns the data of a segment, nil when it is unknown
+func (s *hlsStream) segment(seq int) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range s.segments {
+		if seg.seq == seq {
+			return seg.data
+		}
+	}
+	return nil
+}
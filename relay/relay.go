@@ -0,0 +1,498 @@
+// Package relay re-serves live device streams to any number of local
+// viewers over RTSP and HLS. Each device channel is pulled from the media
+// server once, when its first viewer arrives, and the upstream connection is
+// closed when the last viewer leaves. Local URLs carry no CMSV session:
+//
+//	rtsp://<relay>/<device>/<channel>/<main|sub>
+//	http://<relay>/<device>/<channel>/<main|sub>/index.m3u8
+package relay
+
+import (
+	"cmsv_api/rtsp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLinger     = 5 * time.Second
+	DefaultHLSSegment = 2 * time.Second
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 30 * time.Second
+
+	// openTimeout is how long a new viewer waits for the upstream
+	openTimeout = 15 * time.Second
+	// viewerBuffer is the number of frames queued for a viewer before it is
+	// considered too slow and skips to the next key frame
+	viewerBuffer = 256
+	// defaultFrameDuration spaces the timestamps across a reconnection
+	defaultFrameDuration = 40 * time.Millisecond
+)
+
+// Key identifies a relayed stream
+type Key struct {
+	Device  string
+	Channel int // Starting from 0
+	Stream  int // 0 for the main stream, 1 for the sub stream
+}
+
+// Path returns the URL path of the stream: /<device>/<channel>/<main|sub>
+func (k Key) Path() string {
+	return fmt.Sprintf("/%s/%d/%s", url.PathEscape(k.Device), k.Channel, streamName(k.Stream))
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%s CH%d %s", k.Device, k.Channel+1, streamName(k.Stream))
+}
+
+func streamName(stream int) string {
+	if stream == 1 {
+		return "sub"
+	}
+	return "main"
+}
+
+// ParseKey parses a URL path starting with /<device>/<channel>, optionally
+// followed by /main or /sub. It returns the rest of the path without its
+// leading slash, such as an HLS file name.
+func ParseKey(path string) (Key, string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || parts[0] == "" {
+		return Key{}, "", fmt.Errorf("invalid stream path %q (use /<device>/<channel>/<main|sub>)", path)
+	}
+	device, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return Key{}, "", fmt.Errorf("invalid stream path %q: %v", path, err)
+	}
+	channel, err := strconv.Atoi(parts[1])
+	if err != nil || channel < 0 {
+		return Key{}, "", fmt.Errorf("invalid channel %q", parts[1])
+	}
+	key := Key{Device: device, Channel: channel}
+	rest := parts[2:]
+	if len(rest) > 0 {
+		switch rest[0] {
+		case "main":
+			rest = rest[1:]
+		case "sub":
+			key.Stream = 1
+			rest = rest[1:]
+		}
+	}
+	return key, strings.Join(rest, "/"), nil
+}
+
+// Options configures a relay
+type Options struct {
+	// URL returns the upstream RTSP URL of a stream, e.g. from
+	// cmsv.Client.GenerateRTSPLink. It is called on every connection
+	// attempt with the error that ended the previous one (nil at first),
+	// so a session rejected with a 401 *rtsp.StatusError can be renewed.
+	URL func(ctx context.Context, key Key, failure error) (string, error)
+	// Open opens the upstream stream directly instead of dialing URL, e.g.
+	// a test pattern
+	Open func(ctx context.Context, key Key) (rtsp.Stream, error)
+
+	Linger     time.Duration // How long an upstream stays open without viewers (default DefaultLinger, negative for none)
+	HLSSegment time.Duration // Target length of HLS segments (default DefaultHLSSegment)
+	Logger     *log.Logger   // Upstream connections and failures are logged here when set
+}
+
+// Relay shares upstream connections between viewers. Its OpenStream method
+// is an rtsp.Handler and it serves HLS as an http.Handler.
+type Relay struct {
+	opts Options
+
+	mu   sync.Mutex
+	hubs map[Key]*hub
+	hls  map[Key]*hlsStream
+}
+
+// hub is the upstream connection of a stream and its viewers
+type hub struct {
+	key    Key
+	cancel context.CancelFunc
+	ready  chan struct{} // Closed when the first connection is up or failed
+	done   chan struct{} // Closed when the upstream stops
+
+	// Guarded by Relay.mu
+	viewers   map[*Viewer]bool
+	started   bool
+	err       error // Failure of the first connection
+	media     rtsp.Media
+	gop       []*rtsp.AccessUnit // Frames since the last key frame, for new viewers
+	connected time.Time          // Zero while reconnecting
+	linger    *time.Timer
+
+	// Used by the upstream goroutine only
+	lastPTS, frameDuration time.Duration
+}
+
+// New creates a relay
+func New(opts Options) (*Relay, error) {
+	if opts.URL == nil && opts.Open == nil {
+		return nil, errors.New("relay: no upstream URL or Open function")
+	}
+	if opts.Linger == 0 {
+		opts.Linger = DefaultLinger
+	}
+	if opts.HLSSegment <= 0 {
+		opts.HLSSegment = DefaultHLSSegment
+	}
+	return &Relay{
+		opts: opts,
+		hubs: map[Key]*hub{},
+		hls:  map[Key]*hlsStream{},
+	}, nil
+}
+
+func (r *Relay) logf(format string, args ...any) {
+	if r.opts.Logger != nil {
+		r.opts.Logger.Printf(format, args...)
+	}
+}
+
+// Subscribe adds a viewer of a stream, connecting to the upstream if the
+// stream has no other viewers. Viewers start at the latest key frame.
+func (r *Relay) Subscribe(ctx context.Context, key Key) (*Viewer, error) {
+	r.mu.Lock()
+	h := r.hubs[key]
+	if h == nil {
+		upstreamCtx, cancel := context.WithCancel(context.Background())
+		h = &hub{
+			key:           key,
+			cancel:        cancel,
+			ready:         make(chan struct{}),
+			done:          make(chan struct{}),
+			viewers:       map[*Viewer]bool{},
+			frameDuration: defaultFrameDuration,
+		}
+		r.hubs[key] = h
+		go r.run(upstreamCtx, h)
+	}
+	if h.linger != nil {
+		h.linger.Stop()
+		h.linger = nil
+	}
+	v := &Viewer{
+		r:       r,
+		hub:     h,
+		frames:  make(chan *rtsp.AccessUnit, viewerBuffer+len(h.gop)),
+		closed:  make(chan struct{}),
+		needKey: true,
+	}
+	h.viewers[v] = true
+	for _, au := range h.gop {
+		v.send(au)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-h.ready:
+	case <-ctx.Done():
+		v.Close()
+		return nil, ctx.Err()
+	}
+	r.mu.Lock()
+	err := h.err
+	r.mu.Unlock()
+	if err != nil {
+		v.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// OpenStream is the rtsp.Handler of the relay. Upstream failures are
+// answered with the status of the media server when there is one.
+func (r *Relay) OpenStream(u *url.URL) (rtsp.Stream, error) {
+	key, rest, err := ParseKey(u.Path)
+	if err != nil || rest != "" {
+		return nil, &rtsp.StatusError{Code: 404, Reason: "Not Found"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+	defer cancel()
+	v, err := r.Subscribe(ctx, key)
+	if err != nil {
+		return nil, upstreamStatus(err)
+	}
+	return v, nil
+}
+
+// upstreamStatus returns the status answered to viewers for an upstream
+// failure. A rejected session is the relay's problem, not the viewer's.
+func upstreamStatus(err error) *rtsp.StatusError {
+	var se *rtsp.StatusError
+	if errors.As(err, &se) && se.Code != 401 && se.Code != 403 {
+		return &rtsp.StatusError{Code: se.Code, Reason: se.Reason}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &rtsp.StatusError{Code: 504, Reason: "Gateway Timeout"}
+	}
+	return &rtsp.StatusError{Code: 502, Reason: "Bad Gateway"}
+}
+
+// run pulls a stream until its hub is stopped, reconnecting with backoff.
+// A failure of the first connection ends it, so viewers get the error.
+func (r *Relay) run(ctx context.Context, h *hub) {
+	defer close(h.done)
+	backoff := DefaultMinBackoff
+	var failure error
+	for attempt := 1; ; attempt++ {
+		frames, err := r.pull(ctx, h, failure)
+		if ctx.Err() != nil {
+			return
+		}
+		r.mu.Lock()
+		started := h.started
+		h.connected = time.Time{}
+		if !started {
+			var se *rtsp.StatusError
+			if attempt == 1 && errors.As(err, &se) && se.Code == 401 {
+				r.mu.Unlock()
+				failure = err // Retry at once with a new session
+				continue
+			}
+			h.err = err
+			close(h.ready)
+		}
+		r.mu.Unlock()
+		if !started {
+			r.logf("relay: %s: %v", h.key, err)
+			return
+		}
+
+		if frames > 0 {
+			backoff = DefaultMinBackoff
+		}
+		failure = err
+		r.logf("relay: %s: %v, reconnecting in %v", h.key, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, DefaultMaxBackoff)
+	}
+}
+
+// pull forwards the frames of one upstream connection. It returns the
+// number of frames received.
+func (r *Relay) pull(ctx context.Context, h *hub, failure error) (int, error) {
+	stream, err := r.open(ctx, h.key, failure)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	r.mu.Lock()
+	h.media = stream.Media()
+	h.gop = nil
+	h.connected = time.Now()
+	for v := range h.viewers {
+		v.needKey = true // The new connection starts a new GOP
+	}
+	if !h.started {
+		h.started = true
+		close(h.ready)
+	}
+	r.mu.Unlock()
+	r.logf("relay: %s: upstream connected (%s)", h.key, h.media.Codec)
+
+	// Timestamps continue from the previous connection
+	offset := h.lastPTS + h.frameDuration
+	frames := 0
+	for {
+		au, err := stream.ReadAccessUnit()
+		if err != nil {
+			return frames, err
+		}
+		if frames == 0 {
+			offset -= au.PTS
+		}
+		au.PTS += offset
+		if d := au.PTS - h.lastPTS; frames > 0 && d > 0 && d < time.Second {
+			h.frameDuration = d
+		}
+		h.lastPTS = au.PTS
+		frames++
+		r.publish(h, au)
+	}
+}
+
+// open opens the upstream of a stream
+func (r *Relay) open(ctx context.Context, key Key, failure error) (rtsp.Stream, error) {
+	if r.opts.Open != nil {
+		return r.opts.Open(ctx, key)
+	}
+	u, err := r.opts.URL(ctx, key, failure)
+	if err != nil {
+		return nil, err
+	}
+	return rtsp.Dial(ctx, u)
+}
+
+// publish sends a frame to the viewers of a hub
+func (r *Relay) publish(h *hub, au *rtsp.AccessUnit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if au.Key {
+		h.gop = h.gop[:0:0]
+	}
+	if au.Key || len(h.gop) > 0 {
+		h.gop = append(h.gop, au)
+	}
+	for v := range h.viewers {
+		v.send(au)
+	}
+}
+
+// leave removes a viewer, stopping the upstream after the linger time when
+// it was the last one. Called with r.mu held.
+func (r *Relay) leave(v *Viewer) {
+	h := v.hub
+	delete(h.viewers, v)
+	if len(h.viewers) > 0 || r.hubs[h.key] != h {
+		return
+	}
+	if r.opts.Linger < 0 || !h.started || h.err != nil {
+		r.stop(h)
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(r.opts.Linger, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if h.linger == t {
+			r.stop(h)
+		}
+	})
+	h.linger = t
+}
+
+// stop closes the upstream of a hub. Called with r.mu held.
+func (r *Relay) stop(h *hub) {
+	if r.hubs[h.key] != h {
+		return
+	}
+	delete(r.hubs, h.key)
+	h.linger = nil
+	h.cancel()
+	if h.started && h.err == nil {
+		r.logf("relay: %s: no viewers left, upstream closed", h.key)
+	}
+}
+
+// Close stops all upstream connections and disconnects the viewers
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, h := range r.hubs {
+		r.stop(h)
+	}
+	return nil
+}
+
+// Info describes a relayed stream
+type Info struct {
+	Device    string     `json:"device"`
+	Channel   int        `json:"channel"`
+	Stream    string     `json:"stream"`
+	Path      string     `json:"path"`
+	Viewers   int        `json:"viewers"` // RTSP viewers, plus one for HLS
+	HLS       bool       `json:"hls"`
+	Connected bool       `json:"connected"`
+	Since     *time.Time `json:"since,omitempty"` // Start of the upstream connection
+}
+
+// Streams returns the streams with an upstream connection, sorted by path
+func (r *Relay) Streams() []Info {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	infos := make([]Info, 0, len(r.hubs))
+	for key, h := range r.hubs {
+		info := Info{
+			Device:    key.Device,
+			Channel:   key.Channel,
+			Stream:    streamName(key.Stream),
+			Path:      key.Path(),
+			Viewers:   len(h.viewers),
+			HLS:       r.hls[key] != nil,
+			Connected: !h.connected.IsZero(),
+		}
+		if info.Connected {
+			since := h.connected
+			info.Since = &since
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b Info) int { return strings.Compare(a.Path, b.Path) })
+	return infos
+}
+
+// Viewer is a subscription to a relayed stream. It is an rtsp.Stream.
+type Viewer struct {
+	r      *Relay
+	hub    *hub
+	frames chan *rtsp.AccessUnit
+	closed chan struct{}
+
+	// Guarded by Relay.mu
+	needKey  bool
+	isClosed bool
+}
+
+// send queues a frame, skipping to the next key frame when the viewer
+// does not keep up. Called with r.mu held.
+func (v *Viewer) send(au *rtsp.AccessUnit) {
+	if v.needKey && !au.Key {
+		return
+	}
+	select {
+	case v.frames <- au:
+		v.needKey = false
+	default:
+		v.needKey = true
+	}
+}
+
+// Media returns the track of the upstream
+func (v *Viewer) Media() rtsp.Media {
+	v.r.mu.Lock()
+	defer v.r.mu.Unlock()
+	return v.hub.media
+}
+
+// ReadAccessUnit returns the next frame. Frames are shared between viewers
+// and must not be modified.
+func (v *Viewer) ReadAccessUnit() (*rtsp.AccessUnit, error) {
+	select {
+	case au := <-v.frames:
+		return au, nil
+	case <-v.closed:
+		return nil, io.EOF
+	case <-v.hub.done:
+		return nil, io.EOF
+	}
+}
+
+// Close leaves the stream
+func (v *Viewer) Close() error {
+	v.r.mu.Lock()
+	defer v.r.mu.Unlock()
+	if v.isClosed {
+		return nil
+	}
+	v.isClosed = true
+	close(v.closed)
+	v.r.leave(v)
+	return nil
+}
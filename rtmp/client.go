@@ -0,0 +1,296 @@
+package rtmp
+
+import (
+	"cmsv_api/rtsp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client is a connection playing one video stream
+type Client struct {
+	conn    net.Conn
+	cr      *chunkReader
+	wmu     sync.Mutex
+	timeout time.Duration
+
+	stream     uint32 // Message stream ID of the play stream
+	window     uint32 // Acknowledgement window of the server
+	acked      uint64
+	media      rtsp.Media
+	lengthSize int
+	first      int64 // Timestamp of the first frame, -1 before it
+	stop       func() bool
+	closeOnce  sync.Once
+}
+
+// Dial connects to an RTMP URL, such as one from cmsv.GenerateRTMPLink, and
+// plays it until the video sequence header arrives. The first path element
+// of the URL is the application and the rest, with the query, the stream
+// name. Cancelling ctx closes the client.
+func Dial(ctx context.Context, rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "rtmp" || u.Host == "" {
+		return nil, fmt.Errorf("invalid RTMP URL %q", rawURL)
+	}
+	app, name, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if u.RawQuery != "" {
+		name += "?" + u.RawQuery
+	}
+	if app == "" || name == "" {
+		return nil, fmt.Errorf("invalid RTMP URL %q: no application and stream name", rawURL)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "1935")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, cr: newChunkReader(conn), timeout: DefaultTimeout, first: -1}
+	c.stop = context.AfterFunc(ctx, func() { conn.Close() })
+	tcURL := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + app}).String()
+	if err := c.start(app, tcURL, name); err != nil {
+		c.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// start runs the handshake, connect, createStream and play, and waits for
+// the video configuration
+func (c *Client) start(app, tcURL, name string) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	c1 := handshakePacket()
+	if _, err := c.conn.Write(append([]byte{3}, c1...)); err != nil {
+		return err
+	}
+	s0s1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(c.cr.br, s0s1); err != nil {
+		return fmt.Errorf("rtmp handshake: %w", err)
+	}
+	if s0s1[0] != 3 {
+		return fmt.Errorf("rtmp handshake: unsupported version %d", s0s1[0])
+	}
+	if _, err := c.cr.br.Discard(handshakeSize); err != nil { // S2
+		return fmt.Errorf("rtmp handshake: %w", err)
+	}
+	if _, err := c.conn.Write(s0s1[1:]); err != nil { // C2 echoes S1
+		return err
+	}
+
+	if err := c.write(csControl, controlMessage(msgSetChunkSize, outChunkSize)); err != nil {
+		return err
+	}
+	connect := []amfProperty{
+		{"app", app},
+		{"flashVer", "LNX 9,0,124,2"},
+		{"tcUrl", tcURL},
+		{"fpad", false},
+		{"capabilities", 15},
+		{"audioCodecs", 0x0fff},
+		{"videoCodecs", 0x00ff},
+		{"videoFunction", 1},
+	}
+	if _, err := c.call("connect", 1, connect); err != nil {
+		return err
+	}
+	res, err := c.call("createStream", 2, nil)
+	if err != nil {
+		return err
+	}
+	id, ok := res[len(res)-1].(float64)
+	if !ok {
+		return errors.New("rtmp createStream: no stream ID in the response")
+	}
+	c.stream = uint32(id)
+
+	if err := c.write(csControl, userControl(eventSetBuffer, c.stream, 1000)); err != nil {
+		return err
+	}
+	play := &message{typ: msgCommandAMF0, stream: c.stream, data: amfEncode("play", 0, nil, name, -1000)}
+	if err := c.write(csCommand, play); err != nil {
+		return err
+	}
+	for {
+		m, err := c.next()
+		if err != nil {
+			return err
+		}
+		if m.typ != msgVideo {
+			continue
+		}
+		tag, err := parseVideoTag(m.data, 4)
+		if err != nil {
+			return fmt.Errorf("rtmp: %v", err)
+		}
+		if tag.config {
+			c.media = rtsp.Media{Codec: tag.codec, ParameterSets: tag.params}
+			c.lengthSize = tag.length
+			return nil
+		}
+	}
+}
+
+// call sends a command and waits for its _result, returning the values
+// after the transaction ID
+func (c *Client) call(command string, transaction int, object []amfProperty) ([]any, error) {
+	var obj any
+	if object != nil {
+		obj = object
+	}
+	if err := c.write(csCommand, &message{typ: msgCommandAMF0, data: amfEncode(command, transaction, obj)}); err != nil {
+		return nil, err
+	}
+	for {
+		m, err := c.next()
+		if err != nil {
+			return nil, fmt.Errorf("rtmp %s: %w", command, err)
+		}
+		if m.typ != msgCommandAMF0 {
+			continue
+		}
+		values, _ := amfDecode(m.data)
+		if len(values) < 3 {
+			continue
+		}
+		name, _ := values[0].(string)
+		txn, _ := values[1].(float64)
+		if int(txn) != transaction {
+			continue
+		}
+		switch name {
+		case "_result":
+			return values[2:], nil
+		case "_error":
+			code, description := statusOf(values[len(values)-1])
+			return nil, &StatusError{Command: command, Code: code, Description: description}
+		}
+	}
+}
+
+// next reads the next message, answering pings and acknowledging the data
+// read. Errors of the play stream end it.
+func (c *Client) next() (*message, error) {
+	for {
+		if c.window > 0 && c.cr.read-c.acked >= uint64(c.window)/2 {
+			c.acked = c.cr.read
+			if err := c.write(csControl, controlMessage(msgAcknowledgement, uint32(c.acked))); err != nil {
+				return nil, err
+			}
+		}
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		m, err := c.cr.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch m.typ {
+		case msgWindowAckSize:
+			if len(m.data) >= 4 {
+				c.window = binary.BigEndian.Uint32(m.data)
+			}
+			continue
+		case msgUserControl:
+			if len(m.data) >= 6 && binary.BigEndian.Uint16(m.data) == eventPingRequest {
+				reply := userControl(eventPingReply, binary.BigEndian.Uint32(m.data[2:]))
+				if err := c.write(csControl, reply); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case msgCommandAMF0:
+			values, _ := amfDecode(m.data)
+			if len(values) > 0 && values[0] == "onStatus" {
+				code, description := statusOf(values[len(values)-1])
+				switch {
+				case strings.HasPrefix(code, "NetStream.Play.Failed"),
+					strings.HasPrefix(code, "NetStream.Play.StreamNotFound"),
+					strings.HasPrefix(code, "NetStream.Failed"):
+					return nil, &StatusError{Command: "play", Code: code, Description: description}
+				case code == "NetStream.Play.Stop", code == "NetStream.Play.UnpublishNotify":
+					return nil, io.EOF
+				}
+				continue
+			}
+		}
+		return m, nil
+	}
+}
+
+func (c *Client) write(csid byte, m *message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return writeMessage(c.conn, csid, m)
+}
+
+// Media returns the video track being played
+func (c *Client) Media() rtsp.Media {
+	return c.media
+}
+
+// ReadAccessUnit returns the next video frame. Its PTS counts from the
+// first frame.
+func (c *Client) ReadAccessUnit() (*rtsp.AccessUnit, error) {
+	for {
+		m, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		if m.typ != msgVideo {
+			continue
+		}
+		tag, err := parseVideoTag(m.data, c.lengthSize)
+		if err != nil {
+			return nil, fmt.Errorf("rtmp: %v", err)
+		}
+		if tag.config {
+			c.media.ParameterSets = tag.params
+			c.lengthSize = tag.length
+			continue
+		}
+		if len(tag.nalus) == 0 {
+			continue
+		}
+		if c.first < 0 {
+			c.first = int64(m.timestamp)
+		}
+		pts := int64(m.timestamp) - c.first + int64(tag.cts)
+		return &rtsp.AccessUnit{
+			PTS:   time.Duration(pts) * time.Millisecond,
+			Time:  time.Now(),
+			NALUs: tag.nalus,
+			Key:   tag.key,
+		}, nil
+	}
+}
+
+// Close stops the stream and closes the connection
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.stop()
+		if c.stream != 0 {
+			c.wmu.Lock()
+			c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			writeMessage(c.conn, csCommand, &message{typ: msgCommandAMF0, data: amfEncode("deleteStream", 0, nil, int(c.stream))})
+			c.wmu.Unlock()
+		}
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,493 @@
+// Package rtmp is a small RTMP client and server for H.264 and H.265 video.
+// The client plays the live streams of the links from cmsv.GenerateRTMPLink
+// and returns their frames as rtsp.AccessUnit, so RTMP and RTSP streams can
+// be used alike. The server streams rtsp.Stream sources the same way and is
+// meant for local testing.
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// DefaultTimeout is how long the client waits for a response or a packet
+const DefaultTimeout = 10 * time.Second
+
+// Message types
+const (
+	msgSetChunkSize     = 1
+	msgAbort            = 2
+	msgAcknowledgement  = 3
+	msgUserControl      = 4
+	msgWindowAckSize    = 5
+	msgSetPeerBandwidth = 6
+	msgAudio            = 8
+	msgVideo            = 9
+	msgDataAMF0         = 18
+	msgCommandAMF0      = 20
+)
+
+// User control events
+const (
+	eventStreamBegin = 0
+	eventSetBuffer   = 3
+	eventPingRequest = 6
+	eventPingReply   = 7
+)
+
+// Chunk stream IDs used for sending
+const (
+	csControl = 2
+	csCommand = 3
+	csVideo   = 6
+)
+
+const (
+	handshakeSize = 1536
+	// outChunkSize is the chunk size announced for sending
+	outChunkSize = 4096
+	// maxMessageSize limits the messages read into memory
+	maxMessageSize = 16 << 20
+)
+
+// StatusError is an error status of an RTMP command, such as
+// NetStream.Play.StreamNotFound
+type StatusError struct {
+	Command     string
+	Code        string
+	Description string
+}
+
+func (e *StatusError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("rtmp %s: %s", e.Command, e.Code)
+	}
+	return fmt.Sprintf("rtmp %s: %s (%s)", e.Command, e.Code, e.Description)
+}
+
+// message is an RTMP message
+type message struct {
+	typ       byte
+	stream    uint32
+	timestamp uint32 // Milliseconds
+	data      []byte
+}
+
+// chunkState is the header of the last chunk of a chunk stream, which
+// following chunks may leave out
+type chunkState struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typ       byte
+	stream    uint32
+	extended  bool
+	buf       []byte // Message being reassembled
+}
+
+// chunkReader reassembles messages from chunks. It applies the chunk size
+// set by the peer and counts the bytes read for acknowledgements.
+type chunkReader struct {
+	br      *bufio.Reader
+	size    int
+	streams map[uint32]*chunkState
+	read    uint64
+}
+
+func newChunkReader(r io.Reader) *chunkReader {
+	cr := &chunkReader{size: 128, streams: map[uint32]*chunkState{}}
+	cr.br = bufio.NewReaderSize(countingReader{r, &cr.read}, 64*1024)
+	return cr
+}
+
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += uint64(n)
+	return n, err
+}
+
+// readMessage returns the next complete message. Set Chunk Size and Abort
+// messages are handled here.
+func (cr *chunkReader) readMessage() (*message, error) {
+	for {
+		m, err := cr.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			continue // Message not complete yet
+		}
+		switch m.typ {
+		case msgSetChunkSize:
+			if len(m.data) < 4 {
+				return nil, errors.New("rtmp: invalid chunk size message")
+			}
+			size := int(binary.BigEndian.Uint32(m.data) & 0x7fffffff)
+			if size < 1 || size > maxMessageSize {
+				return nil, fmt.Errorf("rtmp: invalid chunk size %d", size)
+			}
+			cr.size = size
+			continue
+		case msgAbort:
+			if len(m.data) >= 4 {
+				if st := cr.streams[binary.BigEndian.Uint32(m.data)]; st != nil {
+					st.buf = nil
+				}
+			}
+			continue
+		}
+		return m, nil
+	}
+}
+
+// readChunk reads one chunk, returning the message it completes, if any
+func (cr *chunkReader) readChunk() (*message, error) {
+	b, err := cr.br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	format := b >> 6
+	csid := uint32(b & 0x3f)
+	switch csid {
+	case 0:
+		b, err := cr.br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b)
+	case 1:
+		var id [2]byte
+		if _, err := io.ReadFull(cr.br, id[:]); err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(id[0]) + uint32(id[1])<<8
+	}
+
+	st := cr.streams[csid]
+	if st == nil {
+		if format != 0 {
+			return nil, fmt.Errorf("rtmp: chunk stream %d starts without a full header", csid)
+		}
+		st = &chunkState{}
+		cr.streams[csid] = st
+	}
+
+	var header [11]byte
+	headerSize := [4]int{11, 7, 3, 0}[format]
+	if _, err := io.ReadFull(cr.br, header[:headerSize]); err != nil {
+		return nil, err
+	}
+	var ts uint32
+	if format < 3 {
+		ts = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+		st.extended = ts == 0xffffff
+	}
+	if format < 2 {
+		st.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+		st.typ = header[6]
+		if st.length > maxMessageSize {
+			return nil, fmt.Errorf("rtmp: message of %d bytes is too large", st.length)
+		}
+	}
+	if format == 0 {
+		st.stream = binary.LittleEndian.Uint32(header[7:11])
+	}
+	if st.extended {
+		var ext [4]byte
+		if _, err := io.ReadFull(cr.br, ext[:]); err != nil {
+			return nil, err
+		}
+		if format < 3 {
+			ts = binary.BigEndian.Uint32(ext[:])
+		}
+	}
+
+	// The timestamp applies when a message starts; continuation chunks
+	// repeat it
+	if len(st.buf) == 0 {
+		switch format {
+		case 0:
+			st.timestamp, st.delta = ts, 0
+		case 1, 2:
+			st.timestamp += ts
+			st.delta = ts
+		case 3:
+			st.timestamp += st.delta
+		}
+		st.buf = make([]byte, 0, st.length)
+	}
+
+	n := min(cr.size, int(st.length)-len(st.buf))
+	start := len(st.buf)
+	st.buf = st.buf[:start+n]
+	if _, err := io.ReadFull(cr.br, st.buf[start:]); err != nil {
+		return nil, err
+	}
+	if len(st.buf) < int(st.length) {
+		return nil, nil
+	}
+	m := &message{typ: st.typ, stream: st.stream, timestamp: st.timestamp, data: st.buf}
+	st.buf = nil
+	return m, nil
+}
+
+// writeMessage splits a message into chunks of outChunkSize. Headers are
+// never compressed.
+func writeMessage(w io.Writer, csid byte, m *message) error {
+	ts := m.timestamp
+	extended := ts >= 0xffffff
+	if extended {
+		ts = 0xffffff
+	}
+	buf := make([]byte, 0, len(m.data)+len(m.data)/outChunkSize*5+16)
+	buf = append(buf, csid, byte(ts>>16), byte(ts>>8), byte(ts),
+		byte(len(m.data)>>16), byte(len(m.data)>>8), byte(len(m.data)), m.typ)
+	buf = binary.LittleEndian.AppendUint32(buf, m.stream)
+	if extended {
+		buf = binary.BigEndian.AppendUint32(buf, m.timestamp)
+	}
+	for data := m.data; ; {
+		n := min(outChunkSize, len(data))
+		buf = append(buf, data[:n]...)
+		data = data[n:]
+		if len(data) == 0 {
+			break
+		}
+		buf = append(buf, 0xc0|csid)
+		if extended {
+			buf = binary.BigEndian.AppendUint32(buf, m.timestamp)
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// controlMessage returns a protocol control message of 32-bit values
+func controlMessage(typ byte, values ...uint32) *message {
+	m := &message{typ: typ}
+	for _, v := range values {
+		m.data = binary.BigEndian.AppendUint32(m.data, v)
+	}
+	return m
+}
+
+// userControl returns a user control message
+func userControl(event uint16, values ...uint32) *message {
+	m := &message{typ: msgUserControl, data: binary.BigEndian.AppendUint16(nil, event)}
+	for _, v := range values {
+		m.data = binary.BigEndian.AppendUint32(m.data, v)
+	}
+	return m
+}
+
+// handshakePacket returns C1 or S1: time, zero and random bytes
+func handshakePacket() []byte {
+	p := make([]byte, handshakeSize)
+	binary.BigEndian.PutUint32(p, uint32(time.Now().UnixMilli()))
+	rand.Read(p[8:])
+	return p
+}
+
+// AMF0 type markers
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+// amfProperty is a property of an object to encode, which keeps its order
+type amfProperty struct {
+	Name  string
+	Value any
+}
+
+// amfEncode encodes values as AMF0: float64 and int as numbers, bool,
+// string, nil as null and []amfProperty as objects
+func amfEncode(values ...any) []byte {
+	var b []byte
+	for _, v := range values {
+		b = amfAppend(b, v)
+	}
+	return b
+}
+
+func amfAppend(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case float64:
+		return binary.BigEndian.AppendUint64(append(b, amfNumber), math.Float64bits(v))
+	case int:
+		return binary.BigEndian.AppendUint64(append(b, amfNumber), math.Float64bits(float64(v)))
+	case bool:
+		if v {
+			return append(b, amfBoolean, 1)
+		}
+		return append(b, amfBoolean, 0)
+	case string:
+		return amfAppendString(append(b, amfString), v)
+	case []amfProperty:
+		b = append(b, amfObject)
+		for _, p := range v {
+			b = amfAppend(amfAppendString(b, p.Name), p.Value)
+		}
+		return append(b, 0, 0, amfObjectEnd)
+	}
+	return append(b, amfNull)
+}
+
+func amfAppendString(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(s))), s...)
+}
+
+// amfDecode decodes AMF0 values: numbers as float64, bool, strings, null
+// and undefined as nil, objects and ECMA arrays as map[string]any and strict
+// arrays as []any
+func amfDecode(data []byte) ([]any, error) {
+	d := &amfDecoder{data: data}
+	var values []any
+	for d.pos < len(d.data) {
+		v, err := d.value()
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+type amfDecoder struct {
+	data []byte
+	pos  int
+}
+
+var errAMF = errors.New("rtmp: invalid AMF0 data")
+
+func (d *amfDecoder) take(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errAMF
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *amfDecoder) string(long bool) (string, error) {
+	var n int
+	if long {
+		b, err := d.take(4)
+		if err != nil {
+			return "", err
+		}
+		n = int(binary.BigEndian.Uint32(b))
+	} else {
+		b, err := d.take(2)
+		if err != nil {
+			return "", err
+		}
+		n = int(binary.BigEndian.Uint16(b))
+	}
+	b, err := d.take(n)
+	return string(b), err
+}
+
+func (d *amfDecoder) value() (any, error) {
+	marker, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	switch marker[0] {
+	case amfNumber:
+		b, err := d.take(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case amfBoolean:
+		b, err := d.take(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case amfString:
+		return d.string(false)
+	case amfLongString:
+		return d.string(true)
+	case amfNull, amfUndefined:
+		return nil, nil
+	case amfECMAArray:
+		if _, err := d.take(4); err != nil { // Approximate count
+			return nil, err
+		}
+		return d.object()
+	case amfObject:
+		return d.object()
+	case amfStrictArray:
+		b, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		var list []any
+		for range binary.BigEndian.Uint32(b) {
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case amfDate:
+		b, err := d.take(10)
+		if err != nil {
+			return nil, err
+		}
+		ms := math.Float64frombits(binary.BigEndian.Uint64(b))
+		return time.UnixMilli(int64(ms)), nil
+	}
+	return nil, fmt.Errorf("rtmp: unsupported AMF0 type %#x", marker[0])
+}
+
+func (d *amfDecoder) object() (map[string]any, error) {
+	obj := map[string]any{}
+	for {
+		name, err := d.string(false)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" && d.pos < len(d.data) && d.data[d.pos] == amfObjectEnd {
+			d.pos++
+			return obj, nil
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		obj[name] = v
+	}
+}
+
+// statusOf returns the code and description of an onStatus or _error
+// information object
+func statusOf(v any) (code, description string) {
+	obj, _ := v.(map[string]any)
+	code, _ = obj["code"].(string)
+	description, _ = obj["description"].(string)
+	return code, description
+}
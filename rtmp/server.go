@@ -0,0 +1,273 @@
+package rtmp
+
+import (
+	"cmsv_api/rtsp"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server serves streams over RTMP to players. Publishing is not supported.
+// Like rtsp.Server, it opens the streams with a handler, which gets the
+// tcUrl of the connection joined with the stream name, so the links of
+// cmsv.GenerateRTMPLink reach it unchanged.
+type Server struct {
+	Handler rtsp.Handler // A *rtsp.StatusError fails play: 404 with StreamNotFound
+	Logger  *log.Logger  // Optional
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+// ListenAndServe listens on the TCP address and serves connections until the
+// server is closed
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves connections from the listener until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, l)
+	if s.conns == nil {
+		s.conns = map[net.Conn]bool{}
+	}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go func() {
+			s.serveConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops the listeners and closes all connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+// serverConn is the state of one client connection
+type serverConn struct {
+	conn   net.Conn
+	wmu    sync.Mutex
+	tcURL  string
+	stream rtsp.Stream
+}
+
+func (c *serverConn) write(csid byte, m *message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
+	return writeMessage(c.conn, csid, m)
+}
+
+func (c *serverConn) command(stream uint32, values ...any) error {
+	return c.write(csCommand, &message{typ: msgCommandAMF0, stream: stream, data: amfEncode(values...)})
+}
+
+func (c *serverConn) status(stream uint32, level, code, description string) error {
+	return c.command(stream, "onStatus", 0, nil, []amfProperty{
+		{"level", level},
+		{"code", code},
+		{"description", description},
+	})
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	c := &serverConn{conn: conn}
+	defer func() {
+		conn.Close()
+		if c.stream != nil {
+			c.stream.Close()
+		}
+	}()
+
+	cr := newChunkReader(conn)
+	if err := serverHandshake(conn, cr); err != nil {
+		return
+	}
+	for {
+		// Players send little more than acknowledgements while playing
+		if c.stream == nil {
+			conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		m, err := cr.readMessage()
+		if err != nil {
+			return
+		}
+		if m.typ != msgCommandAMF0 {
+			continue
+		}
+		values, err := amfDecode(m.data)
+		if err != nil || len(values) < 2 {
+			continue
+		}
+		name, _ := values[0].(string)
+		txn, _ := values[1].(float64)
+		switch name {
+		case "connect":
+			var app string
+			if len(values) > 2 {
+				obj, _ := values[2].(map[string]any)
+				c.tcURL, _ = obj["tcUrl"].(string)
+				app, _ = obj["app"].(string)
+			}
+			if c.tcURL == "" {
+				c.tcURL = "rtmp://" + conn.LocalAddr().String() + "/" + app
+			}
+			c.write(csControl, controlMessage(msgWindowAckSize, 2500000))
+			c.write(csControl, &message{typ: msgSetPeerBandwidth, data: []byte{0, 0x26, 0x25, 0xa0, 2}})
+			c.write(csControl, controlMessage(msgSetChunkSize, outChunkSize))
+			c.command(0, "_result", txn,
+				[]amfProperty{{"fmsVer", "FMS/3,0,1,123"}, {"capabilities", 31}},
+				[]amfProperty{
+					{"level", "status"},
+					{"code", "NetConnection.Connect.Success"},
+					{"description", "Connection succeeded."},
+					{"objectEncoding", 0},
+				})
+		case "createStream":
+			c.command(0, "_result", txn, nil, 1)
+		case "play":
+			if c.stream != nil || len(values) < 4 {
+				continue
+			}
+			streamName, _ := values[3].(string)
+			s.play(c, m.stream, streamName)
+		case "deleteStream", "closeStream":
+			return
+		case "publish":
+			c.status(m.stream, "error", "NetStream.Publish.BadName", "publishing is not supported")
+		}
+	}
+}
+
+// serverHandshake reads C0 and C1, sends S0, S1 and S2 and reads C2
+func serverHandshake(conn net.Conn, cr *chunkReader) error {
+	conn.SetDeadline(time.Now().Add(DefaultTimeout))
+	defer conn.SetDeadline(time.Time{})
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(cr.br, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", c0c1[0])
+	}
+	s := append([]byte{3}, handshakePacket()...)
+	if _, err := conn.Write(append(s, c0c1[1:]...)); err != nil { // S2 echoes C1
+		return err
+	}
+	_, err := cr.br.Discard(handshakeSize)
+	return err
+}
+
+// play opens the stream and starts sending it
+func (s *Server) play(c *serverConn, stream uint32, name string) {
+	u, err := url.Parse(strings.TrimSuffix(c.tcURL, "/") + "/" + name)
+	if err != nil {
+		c.status(stream, "error", "NetStream.Play.StreamNotFound", "invalid stream name")
+		return
+	}
+	src, err := s.Handler(u)
+	if err != nil {
+		s.logf("rtmp: %s: %v", u.Path, err)
+		code, description := "NetStream.Play.Failed", err.Error()
+		var se *rtsp.StatusError
+		if errors.As(err, &se) {
+			description = fmt.Sprintf("%d %s", se.Code, se.Reason)
+			if se.Code == 404 {
+				code = "NetStream.Play.StreamNotFound"
+			}
+		}
+		c.status(stream, "error", code, description)
+		return
+	}
+	media := src.Media()
+	header, err := avcSequenceHeader(media.ParameterSets)
+	if media.Codec != rtsp.H264 {
+		err = errors.New("the server streams H.264 only")
+	}
+	if err != nil {
+		src.Close()
+		s.logf("rtmp: %s: %v", u.Path, err)
+		c.status(stream, "error", "NetStream.Play.Failed", err.Error())
+		return
+	}
+	c.stream = src
+
+	c.write(csControl, userControl(eventStreamBegin, stream))
+	c.status(stream, "status", "NetStream.Play.Reset", "Playing and resetting "+name+".")
+	c.status(stream, "status", "NetStream.Play.Start", "Started playing "+name+".")
+	go func() {
+		video := &message{typ: msgVideo, stream: stream, data: header}
+		if c.write(csVideo, video) != nil {
+			return
+		}
+		for {
+			au, err := src.ReadAccessUnit()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					s.logf("rtmp: stream ended: %v", err)
+				}
+				c.status(stream, "status", "NetStream.Play.Stop", "Stopped playing "+name+".")
+				c.conn.Close()
+				return
+			}
+			video := &message{typ: msgVideo, stream: stream, timestamp: uint32(au.PTS.Milliseconds()), data: avcFrame(au)}
+			if c.write(csVideo, video) != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,215 @@
+package rtmp
+
+import (
+	"cmsv_api/rtsp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// FLV video codec IDs. 12 is the H.265 extension of Chinese CDNs and
+// device servers; Enhanced RTMP signals H.265 with the hvc1 FourCC instead.
+const (
+	flvCodecH264 = 7
+	flvCodecH265 = 12
+)
+
+// videoTag is a parsed FLV video tag body
+type videoTag struct {
+	codec  rtsp.Codec
+	config bool     // Decoder configuration record (sequence header)
+	params [][]byte // Parameter sets of a configuration record
+	length int      // NAL unit length size given by a configuration record
+	nalus  [][]byte // NAL units of a frame
+	key    bool
+	cts    int32 // Composition time offset in milliseconds
+}
+
+// parseVideoTag parses the body of a video message. lengthSize is the NAL
+// unit length size of the last configuration record.
+func parseVideoTag(data []byte, lengthSize int) (*videoTag, error) {
+	if len(data) < 1 {
+		return nil, errors.New("empty video tag")
+	}
+	tag := &videoTag{key: data[0]>>4&7 == 1}
+	var packetType byte
+	var body []byte
+	if data[0]&0x80 != 0 {
+		// Enhanced RTMP: packet type in the low bits, then a FourCC
+		if len(data) < 5 {
+			return nil, errors.New("short video tag")
+		}
+		switch fourCC := string(data[1:5]); fourCC {
+		case "avc1":
+			tag.codec = rtsp.H264
+		case "hvc1":
+			tag.codec = rtsp.H265
+		default:
+			return nil, fmt.Errorf("unsupported video codec %q", fourCC)
+		}
+		switch data[0] & 0x0f {
+		case 0: // SequenceStart
+			packetType, body = 0, data[5:]
+		case 1: // CodedFrames, with a composition time
+			if len(data) < 8 {
+				return nil, errors.New("short video tag")
+			}
+			packetType, body = 1, data[5:]
+		case 3: // CodedFramesX, without
+			packetType, body = 1, append([]byte{0, 0, 0}, data[5:]...)
+		default:
+			return tag, nil // Sequence end, metadata
+		}
+	} else {
+		switch data[0] & 0x0f {
+		case flvCodecH264:
+			tag.codec = rtsp.H264
+		case flvCodecH265:
+			tag.codec = rtsp.H265
+		default:
+			return nil, fmt.Errorf("unsupported FLV video codec %d", data[0]&0x0f)
+		}
+		if len(data) < 5 {
+			return nil, errors.New("short video tag")
+		}
+		switch packetType = data[1]; packetType {
+		case 0:
+			body = data[5:] // After the composition time, which is zero
+		case 1:
+			body = data[2:]
+		default:
+			return tag, nil // End of sequence
+		}
+	}
+
+	if packetType == 0 {
+		tag.config = true
+		var err error
+		if tag.codec == rtsp.H265 {
+			tag.params, tag.length, err = parseHVCC(body)
+		} else {
+			tag.params, tag.length, err = parseAVCC(body)
+		}
+		return tag, err
+	}
+
+	cts := int32(body[0])<<16 | int32(body[1])<<8 | int32(body[2])
+	if cts&0x800000 != 0 {
+		cts -= 1 << 24
+	}
+	tag.cts = cts
+	for data := body[3:]; len(data) >= lengthSize; {
+		var n int
+		for _, b := range data[:lengthSize] {
+			n = n<<8 | int(b)
+		}
+		data = data[lengthSize:]
+		if n > len(data) {
+			return nil, errors.New("truncated NAL unit")
+		}
+		if n > 0 {
+			tag.nalus = append(tag.nalus, data[:n])
+		}
+		data = data[n:]
+	}
+	for _, n := range tag.nalus {
+		if tag.codec.IsKey(n) {
+			tag.key = true
+		}
+	}
+	return tag, nil
+}
+
+// parseAVCC returns the SPS and PPS of an AVCDecoderConfigurationRecord and
+// its NAL unit length size
+func parseAVCC(b []byte) ([][]byte, int, error) {
+	if len(b) < 6 {
+		return nil, 0, errors.New("short AVC configuration record")
+	}
+	var params [][]byte
+	pos := 5
+	for _, countMask := range []byte{0x1f, 0xff} { // SPS, then PPS
+		if pos >= len(b) {
+			return nil, 0, errors.New("short AVC configuration record")
+		}
+		count := int(b[pos] & countMask)
+		pos++
+		for range count {
+			if pos+2 > len(b) {
+				return nil, 0, errors.New("short AVC configuration record")
+			}
+			n := int(binary.BigEndian.Uint16(b[pos:]))
+			pos += 2
+			if pos+n > len(b) {
+				return nil, 0, errors.New("short AVC configuration record")
+			}
+			params = append(params, b[pos:pos+n])
+			pos += n
+		}
+	}
+	return params, int(b[4]&3) + 1, nil
+}
+
+// parseHVCC returns the VPS, SPS and PPS of an HEVCDecoderConfigurationRecord
+// and its NAL unit length size
+func parseHVCC(b []byte) ([][]byte, int, error) {
+	if len(b) < 23 {
+		return nil, 0, errors.New("short HEVC configuration record")
+	}
+	var params [][]byte
+	pos := 23
+	for range int(b[22]) {
+		if pos+3 > len(b) {
+			return nil, 0, errors.New("short HEVC configuration record")
+		}
+		count := int(binary.BigEndian.Uint16(b[pos+1:]))
+		pos += 3
+		for range count {
+			if pos+2 > len(b) {
+				return nil, 0, errors.New("short HEVC configuration record")
+			}
+			n := int(binary.BigEndian.Uint16(b[pos:]))
+			pos += 2
+			if pos+n > len(b) {
+				return nil, 0, errors.New("short HEVC configuration record")
+			}
+			params = append(params, b[pos:pos+n])
+			pos += n
+		}
+	}
+	return params, int(b[21]&3) + 1, nil
+}
+
+// avcSequenceHeader returns the video tag body with the configuration
+// record of H.264 parameter sets
+func avcSequenceHeader(params [][]byte) ([]byte, error) {
+	var sps, pps []byte
+	for _, p := range params {
+		switch rtsp.H264.NALType(p) {
+		case 7:
+			sps = p
+		case 8:
+			pps = p
+		}
+	}
+	if len(sps) < 4 || pps == nil {
+		return nil, errors.New("stream has no SPS and PPS")
+	}
+	b := []byte{0x17, 0, 0, 0, 0, 1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+	b = append(binary.BigEndian.AppendUint16(b, uint16(len(sps))), sps...)
+	b = append(b, 1)
+	b = append(binary.BigEndian.AppendUint16(b, uint16(len(pps))), pps...)
+	return b, nil
+}
+
+// avcFrame returns the video tag body of an H.264 access unit
+func avcFrame(au *rtsp.AccessUnit) []byte {
+	b := []byte{0x27, 1, 0, 0, 0}
+	if au.Key {
+		b[0] = 0x17
+	}
+	for _, n := range au.NALUs {
+		b = append(binary.BigEndian.AppendUint32(b, uint32(len(n))), n...)
+	}
+	return b
+}
@@ -0,0 +1,335 @@
+package rtsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long the client waits for a response or a packet
+	DefaultTimeout = 10 * time.Second
+	userAgent      = "cmsv_api"
+)
+
+// StatusError is an RTSP response with an error status
+type StatusError struct {
+	Method string
+	Code   int
+	Reason string
+}
+
+func (e *StatusError) Error() string {
+	if e.Method == "" {
+		return fmt.Sprintf("rtsp: %d %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("rtsp %s: %d %s", e.Method, e.Code, e.Reason)
+}
+
+// Client is a connection playing one video stream
+type Client struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	wmu     sync.Mutex // Serializes writes of keepalives and TEARDOWN
+	url     *url.URL
+	control string
+	session string
+	cseq    int
+	media   Media
+	timeout time.Duration
+
+	keepalive time.Duration
+	lastSent  time.Time
+	dep       depacketizer
+	stop      func() bool
+	closeOnce sync.Once
+}
+
+// Dial connects to an RTSP URL, such as one from cmsv.GenerateRTSPLink, and
+// starts playing its video track over TCP. Cancelling ctx closes the client.
+func Dial(ctx context.Context, rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "rtsp" || u.Host == "" {
+		return nil, fmt.Errorf("invalid RTSP URL %q", rawURL)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:      conn,
+		br:        bufio.NewReaderSize(conn, 64*1024),
+		url:       u,
+		timeout:   DefaultTimeout,
+		keepalive: 30 * time.Second,
+	}
+	c.stop = context.AfterFunc(ctx, func() { conn.Close() })
+	if err := c.start(); err != nil {
+		c.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// start runs the OPTIONS, DESCRIBE, SETUP and PLAY handshake
+func (c *Client) start() error {
+	if _, err := c.do("OPTIONS", c.url.String(), nil); err != nil {
+		return err
+	}
+
+	res, err := c.do("DESCRIBE", c.url.String(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return err
+	}
+	media, err := parseSDP(string(res.body))
+	if err != nil {
+		return err
+	}
+	c.media = *media
+	c.dep.codec = media.Codec
+
+	base := c.url.String()
+	if cb := res.header["content-base"]; cb != "" {
+		base = cb
+	}
+	c.control = controlURL(base, media.Control)
+
+	res, err = c.do("SETUP", c.control, map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"})
+	if err != nil {
+		return err
+	}
+	session, params, _ := strings.Cut(res.header["session"], ";")
+	c.session = strings.TrimSpace(session)
+	if _, value, ok := strings.Cut(params, "timeout="); ok {
+		if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && secs > 2 {
+			c.keepalive = time.Duration(secs) * time.Second / 2
+		}
+	}
+	if transport := res.header["transport"]; transport != "" && !strings.Contains(transport, "TCP") {
+		return fmt.Errorf("server does not support RTP over TCP (transport %q)", transport)
+	}
+
+	_, err = c.do("PLAY", playURL(base), map[string]string{"Range": "npt=0.000-"})
+	return err
+}
+
+// controlURL resolves the control attribute of a track against the base URL.
+// The query of the base URL, which holds the jsession of CMSV links, is kept.
+func controlURL(base, control string) string {
+	if control == "" || control == "*" {
+		return base
+	}
+	if strings.HasPrefix(control, "rtsp://") {
+		return control
+	}
+	path, query, hasQuery := strings.Cut(base, "?")
+	u := strings.TrimSuffix(path, "/") + "/" + control
+	if hasQuery {
+		u += "?" + query
+	}
+	return u
+}
+
+// playURL removes the trailing slash of a content base for PLAY
+func playURL(base string) string {
+	path, query, hasQuery := strings.Cut(base, "?")
+	path = strings.TrimSuffix(path, "/")
+	if hasQuery {
+		return path + "?" + query
+	}
+	return path
+}
+
+// Media returns the video track being played
+func (c *Client) Media() Media {
+	return c.media
+}
+
+// ReadAccessUnit returns the next video frame. The stream is kept alive
+// while it is read.
+func (c *Client) ReadAccessUnit() (*AccessUnit, error) {
+	for {
+		if time.Since(c.lastSent) >= c.keepalive {
+			if err := c.send("OPTIONS", c.url.String(), nil); err != nil {
+				return nil, err
+			}
+			c.lastSent = time.Now()
+		}
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		b, err := c.br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			res, err := readMessage(c.br)
+			if err != nil {
+				return nil, err
+			}
+			if res.status != 0 && res.status != 200 {
+				return nil, &StatusError{Code: res.status, Reason: res.reason}
+			}
+			continue // Keepalive response
+		}
+
+		var header [4]byte
+		if _, err := io.ReadFull(c.br, header[:]); err != nil {
+			return nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(c.br, data); err != nil {
+			return nil, err
+		}
+		if header[1] != 0 {
+			continue // RTCP
+		}
+		p, err := parseRTP(data)
+		if err != nil {
+			continue
+		}
+		if au := c.dep.push(p, time.Now()); au != nil {
+			return au, nil
+		}
+	}
+}
+
+// Close stops the stream and closes the connection
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.stop()
+		if c.session != "" {
+			c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			c.send("TEARDOWN", playURL(c.url.String()), nil)
+		}
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// do sends a request and waits for its response
+func (c *Client) do(method, u string, header map[string]string) (*message, error) {
+	if err := c.send(method, u, header); err != nil {
+		return nil, err
+	}
+	c.lastSent = time.Now()
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	for {
+		if b, err := c.br.Peek(1); err == nil && b[0] == '$' {
+			if err := skipInterleaved(c.br); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		res, err := readMessage(c.br)
+		if err != nil {
+			return nil, fmt.Errorf("rtsp %s: %w", method, err)
+		}
+		if res.status != 200 {
+			return nil, &StatusError{Method: method, Code: res.status, Reason: res.reason}
+		}
+		return res, nil
+	}
+}
+
+func (c *Client) send(method, u string, header map[string]string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: %s\r\n", method, u, c.cseq, userAgent)
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", c.session)
+	}
+	for k, v := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	b.WriteString("\r\n")
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// message is an RTSP request or response. Header names are lower case.
+type message struct {
+	method string // Requests
+	url    string
+	status int // Responses
+	reason string
+	header map[string]string
+	body   []byte
+}
+
+// readMessage reads an RTSP request or response
+func readMessage(br *bufio.Reader) (*message, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid RTSP message %q", strings.TrimSpace(line))
+	}
+	m := &message{header: map[string]string{}}
+	if strings.HasPrefix(fields[0], "RTSP/") {
+		if m.status, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, fmt.Errorf("invalid RTSP status line %q", strings.TrimSpace(line))
+		}
+		if len(fields) == 3 {
+			m.reason = fields[2]
+		}
+	} else {
+		m.method, m.url = fields[0], fields[1]
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			m.header[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	if cl := m.header["content-length"]; cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n > 1<<20 {
+			return nil, errors.New("invalid RTSP content length")
+		}
+		m.body = make([]byte, n)
+		if _, err := io.ReadFull(br, m.body); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// skipInterleaved discards one interleaved frame
+func skipInterleaved(br *bufio.Reader) error {
+	var header [4]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return err
+	}
+	_, err := br.Discard(int(binary.BigEndian.Uint16(header[2:])))
+	return err
+}
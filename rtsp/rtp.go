@@ -0,0 +1,228 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// rtpPacket is the part of an RTP packet the depacketizer needs
+type rtpPacket struct {
+	Marker    bool
+	Sequence  uint16
+	Timestamp uint32
+	Payload   []byte
+}
+
+// parseRTP parses an RTP packet, skipping CSRCs, extensions and padding
+func parseRTP(data []byte) (rtpPacket, error) {
+	if len(data) < 12 || data[0]>>6 != 2 {
+		return rtpPacket{}, fmt.Errorf("invalid RTP packet")
+	}
+	p := rtpPacket{
+		Marker:    data[1]&0x80 != 0,
+		Sequence:  binary.BigEndian.Uint16(data[2:]),
+		Timestamp: binary.BigEndian.Uint32(data[4:]),
+	}
+	offset := 12 + 4*int(data[0]&0x0f)
+	if data[0]&0x10 != 0 { // Header extension
+		if len(data) < offset+4 {
+			return rtpPacket{}, fmt.Errorf("invalid RTP packet")
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(data[offset+2:]))
+	}
+	end := len(data)
+	if data[0]&0x20 != 0 && end > 0 { // Padding
+		end -= int(data[end-1])
+	}
+	if offset > end {
+		return rtpPacket{}, fmt.Errorf("invalid RTP packet")
+	}
+	p.Payload = data[offset:end]
+	return p, nil
+}
+
+// marshalRTP builds an RTP packet
+func marshalRTP(pt int, marker bool, seq uint16, ts, ssrc uint32, payload []byte) []byte {
+	data := make([]byte, 12+len(payload))
+	data[0] = 0x80
+	data[1] = byte(pt) & 0x7f
+	if marker {
+		data[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(data[2:], seq)
+	binary.BigEndian.PutUint32(data[4:], ts)
+	binary.BigEndian.PutUint32(data[8:], ssrc)
+	copy(data[12:], payload)
+	return data
+}
+
+// depacketizer reassembles RTP packets into access units (RFC 6184 for
+// H.264, RFC 7798 for H.265)
+type depacketizer struct {
+	codec    Codec
+	started  bool
+	lastSeq  uint16
+	fragment []byte // NAL unit being reassembled from fragments, nil if none
+
+	ts      uint32   // Timestamp of the current access unit
+	nalus   [][]byte // NAL units of the current access unit
+	base    int64    // Unwrapped timestamp of the first access unit
+	unwrap  int64    // Unwrapped timestamp of the current access unit
+	haveTS  bool
+	lastRaw uint32
+}
+
+// push adds an RTP packet. It returns the access unit that the packet
+// completed, if any. Lost packets drop the NAL unit they belong to.
+func (d *depacketizer) push(p rtpPacket, now time.Time) *AccessUnit {
+	var done *AccessUnit
+	if d.started && p.Sequence != d.lastSeq+1 {
+		d.fragment = nil // Lost packets; the fragment can't be completed
+	}
+	d.started, d.lastSeq = true, p.Sequence
+
+	if len(d.nalus) > 0 && p.Timestamp != d.ts {
+		done = d.flush(now) // Timestamp changed without a marker bit
+	}
+	d.ts = p.Timestamp
+	d.depacketize(p.Payload)
+	if p.Marker && done == nil {
+		done = d.flush(now)
+	}
+	return done
+}
+
+func (d *depacketizer) depacketize(payload []byte) {
+	if len(payload) < 2 {
+		return
+	}
+	if d.codec == H265 {
+		d.depacketizeH265(payload)
+	} else {
+		d.depacketizeH264(payload)
+	}
+}
+
+func (d *depacketizer) depacketizeH264(payload []byte) {
+	switch payload[0] & 0x1f {
+	case 24: // STAP-A
+		d.aggregate(payload[1:])
+	case 28: // FU-A
+		header := payload[1]
+		if header&0x80 != 0 { // Start
+			d.fragment = []byte{payload[0]&0xe0 | header&0x1f}
+		}
+		if d.fragment == nil {
+			return
+		}
+		d.fragment = append(d.fragment, payload[2:]...)
+		if header&0x40 != 0 { // End
+			d.nalus = append(d.nalus, d.fragment)
+			d.fragment = nil
+		}
+	default:
+		if t := payload[0] & 0x1f; t >= 1 && t <= 23 {
+			d.nalus = append(d.nalus, append([]byte(nil), payload...))
+		}
+	}
+}
+
+func (d *depacketizer) depacketizeH265(payload []byte) {
+	if len(payload) < 3 {
+		return
+	}
+	switch (payload[0] >> 1) & 0x3f {
+	case 48: // Aggregation packet
+		d.aggregate(payload[2:])
+	case 49: // Fragmentation unit
+		header := payload[2]
+		if header&0x80 != 0 {
+			d.fragment = []byte{payload[0]&0x81 | (header&0x3f)<<1, payload[1]}
+		}
+		if d.fragment == nil {
+			return
+		}
+		d.fragment = append(d.fragment, payload[3:]...)
+		if header&0x40 != 0 {
+			d.nalus = append(d.nalus, d.fragment)
+			d.fragment = nil
+		}
+	default:
+		d.nalus = append(d.nalus, append([]byte(nil), payload...))
+	}
+}
+
+// aggregate splits the 16-bit length prefixed NAL units of STAP-A and
+// aggregation packets
+func (d *depacketizer) aggregate(data []byte) {
+	for len(data) >= 2 {
+		size := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if size == 0 || size > len(data) {
+			return
+		}
+		d.nalus = append(d.nalus, append([]byte(nil), data[:size]...))
+		data = data[size:]
+	}
+}
+
+// flush returns the current access unit
+func (d *depacketizer) flush(now time.Time) *AccessUnit {
+	if len(d.nalus) == 0 {
+		return nil
+	}
+	if !d.haveTS {
+		d.haveTS, d.base, d.unwrap = true, int64(d.ts), int64(d.ts)
+	} else {
+		d.unwrap += int64(int32(d.ts - d.lastRaw))
+	}
+	d.lastRaw = d.ts
+
+	au := &AccessUnit{
+		PTS:   time.Duration(d.unwrap-d.base) * time.Second / ClockRate,
+		Time:  now,
+		NALUs: d.nalus,
+	}
+	for _, n := range d.nalus {
+		if d.codec.IsKey(n) {
+			au.Key = true
+		}
+	}
+	d.nalus = nil
+	return au
+}
+
+// packetize splits an access unit into RTP payloads of at most size bytes,
+// using FU-A (H.264) or FU (H.265) fragments for large NAL units
+func packetize(codec Codec, nalus [][]byte, size int) [][]byte {
+	var payloads [][]byte
+	for _, n := range nalus {
+		if len(n) <= size {
+			payloads = append(payloads, n)
+			continue
+		}
+		var header []byte
+		var body []byte
+		if codec == H265 {
+			header = []byte{n[0]&0x81 | 49<<1, n[1], n[0] >> 1 & 0x3f}
+			body = n[2:]
+		} else {
+			header = []byte{n[0]&0xe0 | 28, n[0] & 0x1f}
+			body = n[1:]
+		}
+		chunk := size - len(header)
+		for i := 0; i < len(body); i += chunk {
+			end := min(i+chunk, len(body))
+			fu := append([]byte(nil), header...)
+			if i == 0 {
+				fu[len(fu)-1] |= 0x80
+			}
+			if end == len(body) {
+				fu[len(fu)-1] |= 0x40
+			}
+			payloads = append(payloads, append(fu, body[i:end]...))
+		}
+	}
+	return payloads
+}
@@ -0,0 +1,82 @@
+// Package rtsp is a small RTSP client and server for H.264 and H.265 video.
+// The client pulls the live streams of the links from cmsv.GenerateRTSPLink
+// over TCP (RTP interleaved in the RTSP connection) and reassembles the RTP
+// packets into access units. The server streams the same way and is meant
+// for local testing, together with the synthetic test pattern of
+// NewTestPattern.
+package rtsp
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// Codec is the video codec of a stream
+type Codec int
+
+const (
+	H264 Codec = iota + 1
+	H265
+)
+
+// String returns the codec name used in SDP, e.g. "H264"
+func (c Codec) String() string {
+	switch c {
+	case H264:
+		return "H264"
+	case H265:
+		return "H265"
+	}
+	return fmt.Sprintf("Codec(%d)", int(c))
+}
+
+// ClockRate is the RTP clock rate of video
+const ClockRate = 90000
+
+// AccessUnit is one video frame: the NAL units sharing an RTP timestamp
+type AccessUnit struct {
+	PTS   time.Duration // Presentation time since the first frame of the stream
+	Time  time.Time     // When the frame was received (client) or generated (server)
+	NALUs [][]byte      // NAL units without start codes
+	Key   bool          // The frame can be decoded on its own (IDR or IRAP)
+}
+
+// NALType returns the NAL unit type of a NAL unit
+func (c Codec) NALType(nalu []byte) int {
+	if len(nalu) == 0 {
+		return -1
+	}
+	if c == H265 {
+		return int(nalu[0]>>1) & 0x3f
+	}
+	return int(nalu[0]) & 0x1f
+}
+
+// IsKey reports whether a NAL unit starts a decodable frame
+func (c Codec) IsKey(nalu []byte) bool {
+	t := c.NALType(nalu)
+	if c == H265 {
+		return t >= 16 && t <= 21 // IRAP pictures
+	}
+	return t == 5 // IDR
+}
+
+// IsParameterSet reports whether a NAL unit is a VPS, SPS or PPS
+func (c Codec) IsParameterSet(nalu []byte) bool {
+	t := c.NALType(nalu)
+	if c == H265 {
+		return t >= 32 && t <= 34
+	}
+	return t == 7 || t == 8
+}
+
+// AnnexB joins NAL units with 4-byte start codes
+func AnnexB(nalus [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, n := range nalus {
+		buf.Write([]byte{0, 0, 0, 1})
+		buf.Write(n)
+	}
+	return buf.Bytes()
+}
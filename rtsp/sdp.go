@@ -0,0 +1,145 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Media is the video track of a session description
+type Media struct {
+	Codec         Codec
+	PayloadType   int
+	Control       string   // Track URL, relative to the content base
+	ParameterSets [][]byte // VPS, SPS and PPS from the fmtp line, if given
+}
+
+// parseSDP returns the first H.264 or H.265 video track of an SDP body
+func parseSDP(body string) (*Media, error) {
+	var media *Media
+	inVideo := false
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "m":
+			if media != nil && media.Codec != 0 {
+				return media, nil // First video track found
+			}
+			fields := strings.Fields(value)
+			inVideo = len(fields) >= 4 && fields[0] == "video"
+			media = nil
+			if inVideo {
+				pt, err := strconv.Atoi(fields[3])
+				if err != nil {
+					return nil, fmt.Errorf("invalid media line %q", line)
+				}
+				media = &Media{PayloadType: pt}
+			}
+		case "a":
+			if !inVideo || media == nil {
+				continue
+			}
+			attr, arg, _ := strings.Cut(value, ":")
+			switch attr {
+			case "control":
+				media.Control = arg
+			case "rtpmap":
+				pt, encoding, _ := strings.Cut(arg, " ")
+				if pt != strconv.Itoa(media.PayloadType) {
+					continue
+				}
+				name, _, _ := strings.Cut(encoding, "/")
+				switch strings.ToUpper(name) {
+				case "H264":
+					media.Codec = H264
+				case "H265", "HEVC":
+					media.Codec = H265
+				}
+			case "fmtp":
+				_, params, _ := strings.Cut(arg, " ")
+				media.ParameterSets = append(media.ParameterSets, parseFmtp(params)...)
+			}
+		}
+	}
+	if media == nil || media.Codec == 0 {
+		return nil, fmt.Errorf("no H.264 or H.265 video track in the session description")
+	}
+	return media, nil
+}
+
+// parseFmtp returns the parameter sets of an fmtp line, VPS first
+func parseFmtp(params string) [][]byte {
+	var vps, sps, pps [][]byte
+	for _, p := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+		var target *[][]byte
+		switch strings.ToLower(key) {
+		case "sprop-parameter-sets":
+			for i, item := range strings.Split(value, ",") {
+				if data, err := base64.StdEncoding.DecodeString(item); err == nil && len(data) > 0 {
+					if i == 0 {
+						sps = append(sps, data)
+					} else {
+						pps = append(pps, data)
+					}
+				}
+			}
+			continue
+		case "sprop-vps":
+			target = &vps
+		case "sprop-sps":
+			target = &sps
+		case "sprop-pps":
+			target = &pps
+		default:
+			continue
+		}
+		if data, err := base64.StdEncoding.DecodeString(value); err == nil && len(data) > 0 {
+			*target = append(*target, data)
+		}
+	}
+	return append(append(vps, sps...), pps...)
+}
+
+// sdp writes the session description of a video track
+func (m Media) sdp(host string) string {
+	var fmtp []string
+	switch m.Codec {
+	case H264:
+		var sets []string
+		for _, p := range m.ParameterSets {
+			sets = append(sets, base64.StdEncoding.EncodeToString(p))
+		}
+		fmtp = append(fmtp, "packetization-mode=1")
+		if len(sets) > 0 {
+			fmtp = append(fmtp, "sprop-parameter-sets="+strings.Join(sets, ","))
+		}
+	case H265:
+		names := map[int]string{32: "sprop-vps", 33: "sprop-sps", 34: "sprop-pps"}
+		for _, p := range m.ParameterSets {
+			if name, ok := names[H265.NALType(p)]; ok {
+				fmtp = append(fmtp, name+"="+base64.StdEncoding.EncodeToString(p))
+			}
+		}
+	}
+
+	lines := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 " + host,
+		"s=cmsv_api",
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		fmt.Sprintf("m=video 0 RTP/AVP %d", m.PayloadType),
+		fmt.Sprintf("a=rtpmap:%d %s/%d", m.PayloadType, m.Codec, ClockRate),
+	}
+	if len(fmtp) > 0 {
+		lines = append(lines, fmt.Sprintf("a=fmtp:%d %s", m.PayloadType, strings.Join(fmtp, ";")))
+	}
+	lines = append(lines, "a=control:"+m.Control)
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
@@ -0,0 +1,319 @@
+package rtsp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stream is a live video stream. Client and TestPattern are streams.
+type Stream interface {
+	Media() Media
+	ReadAccessUnit() (*AccessUnit, error)
+	Close() error
+}
+
+// Handler opens the stream of a request URL. Returning a *StatusError
+// answers with its status, e.g. 404 for unknown devices.
+type Handler func(u *url.URL) (Stream, error)
+
+// maxPayload is the largest RTP payload the server sends
+const maxPayload = 1400
+
+// sessionTimeout is announced to clients, which send keepalives within it
+const sessionTimeout = 60
+
+// Server serves streams over RTSP with RTP interleaved over TCP. UDP
+// transport is not supported.
+type Server struct {
+	Handler Handler
+	Logger  *log.Logger // Optional
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+// ListenAndServe listens on the TCP address and serves connections until the
+// server is closed
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves connections from the listener until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, l)
+	if s.conns == nil {
+		s.conns = map[net.Conn]bool{}
+	}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go func() {
+			s.serveConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops the listeners and closes all connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+// serverConn is the state of one client connection
+type serverConn struct {
+	conn    net.Conn
+	wmu     sync.Mutex
+	stream  Stream
+	session string
+	playing bool
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	c := &serverConn{conn: conn}
+	defer func() {
+		conn.Close()
+		if c.stream != nil {
+			c.stream.Close()
+		}
+	}()
+
+	br := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * sessionTimeout * time.Second))
+		if b, err := br.Peek(1); err == nil && b[0] == '$' {
+			if err := skipInterleaved(br); err != nil { // RTCP receiver reports
+				return
+			}
+			continue
+		}
+		req, err := readMessage(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logf("rtsp: %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if req.method == "" {
+			continue
+		}
+		if !s.handle(c, req) {
+			return
+		}
+	}
+}
+
+// handle answers a request. It returns false when the connection should be
+// closed.
+func (s *Server) handle(c *serverConn, req *message) bool {
+	header := map[string]string{}
+	if c.session != "" {
+		header["Session"] = fmt.Sprintf("%s;timeout=%d", c.session, sessionTimeout)
+	}
+
+	switch req.method {
+	case "OPTIONS", "GET_PARAMETER", "SET_PARAMETER":
+		header["Public"] = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"
+		c.respond(req, 200, "OK", header, nil)
+
+	case "DESCRIBE":
+		if !s.open(c, req, req.url) {
+			return true
+		}
+		base := playURL(req.url)
+		path, query, hasQuery := strings.Cut(base, "?")
+		header["Content-Base"] = path + "/"
+		if hasQuery {
+			header["Content-Base"] += "?" + query
+		}
+		header["Content-Type"] = "application/sdp"
+		media := c.stream.Media()
+		media.Control = "trackID=0"
+		host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+		c.respond(req, 200, "OK", header, []byte(media.sdp(host)))
+
+	case "SETUP":
+		if !strings.Contains(req.header["transport"], "TCP") {
+			c.respond(req, 461, "Unsupported Transport", header, nil)
+			return true
+		}
+		if c.stream == nil && !s.open(c, req, trackBase(req.url)) {
+			return true
+		}
+		if c.session == "" {
+			id := make([]byte, 8)
+			rand.Read(id)
+			c.session = hex.EncodeToString(id)
+			header["Session"] = fmt.Sprintf("%s;timeout=%d", c.session, sessionTimeout)
+		}
+		header["Transport"] = "RTP/AVP/TCP;unicast;interleaved=0-1"
+		c.respond(req, 200, "OK", header, nil)
+
+	case "PLAY":
+		if c.stream == nil || c.session == "" {
+			c.respond(req, 455, "Method Not Valid in This State", header, nil)
+			return true
+		}
+		header["Range"] = "npt=0.000-"
+		c.respond(req, 200, "OK", header, nil)
+		if !c.playing {
+			c.playing = true
+			go s.play(c)
+		}
+
+	case "TEARDOWN":
+		c.respond(req, 200, "OK", header, nil)
+		return false
+
+	default:
+		c.respond(req, 501, "Not Implemented", header, nil)
+	}
+	return true
+}
+
+// open calls the handler for the stream of a URL and answers errors
+func (s *Server) open(c *serverConn, req *message, rawURL string) bool {
+	if c.stream != nil {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		c.respond(req, 400, "Bad Request", nil, nil)
+		return false
+	}
+	stream, err := s.Handler(u)
+	if err != nil {
+		var se *StatusError
+		if errors.As(err, &se) {
+			c.respond(req, se.Code, se.Reason, nil, nil)
+		} else {
+			s.logf("rtsp: %s: %v", u.Path, err)
+			c.respond(req, 500, "Internal Server Error", nil, nil)
+		}
+		return false
+	}
+	c.stream = stream
+	return true
+}
+
+// trackBase removes the track control from a SETUP URL
+func trackBase(rawURL string) string {
+	path, query, hasQuery := strings.Cut(rawURL, "?")
+	if i := strings.LastIndex(path, "/trackID="); i >= 0 {
+		path = path[:i]
+	}
+	if hasQuery {
+		return path + "?" + query
+	}
+	return path
+}
+
+// play sends the frames of the stream until it ends or the client goes away
+func (s *Server) play(c *serverConn) {
+	defer c.conn.Close()
+	media := c.stream.Media()
+	var id [6]byte
+	rand.Read(id[:])
+	seq := binary.BigEndian.Uint16(id[:])
+	ssrc := binary.BigEndian.Uint32(id[2:])
+
+	for {
+		au, err := c.stream.ReadAccessUnit()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logf("rtsp: stream ended: %v", err)
+			}
+			return
+		}
+		ts := uint32(au.PTS * ClockRate / time.Second)
+		payloads := packetize(media.Codec, au.NALUs, maxPayload)
+
+		c.wmu.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
+		for i, payload := range payloads {
+			packet := marshalRTP(media.PayloadType, i == len(payloads)-1, seq, ts, ssrc, payload)
+			seq++
+			frame := make([]byte, 4, 4+len(packet))
+			frame[0] = '$'
+			binary.BigEndian.PutUint16(frame[2:], uint16(len(packet)))
+			if _, err = c.conn.Write(append(frame, packet...)); err != nil {
+				break
+			}
+		}
+		c.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// respond writes a response
+func (c *serverConn) respond(req *message, code int, reason string, header map[string]string, body []byte) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\nCSeq: %s\r\nServer: %s\r\n", code, reason, req.header["cseq"], userAgent)
+	for k, v := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
+	io.WriteString(c.conn, b.String())
+}
@@ -0,0 +1,219 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PictureSize returns the picture size given by the SPS among NAL units, such
+// as the parameter sets of Media or the NAL units of a key frame
+func (c Codec) PictureSize(nalus [][]byte) (width, height int, err error) {
+	for _, n := range nalus {
+		switch {
+		case c == H264 && c.NALType(n) == 7 && len(n) > 1:
+			return spsSizeH264(n)
+		case c == H265 && c.NALType(n) == 33 && len(n) > 2:
+			return spsSizeH265(n)
+		}
+	}
+	return 0, 0, errors.New("stream has no SPS")
+}
+
+// spsSizeH264 returns the picture size of an H.264 SPS
+func spsSizeH264(sps []byte) (width, height int, err error) {
+	r := &bitReader{data: unescape(sps[1:])}
+	profile := r.bits(8)
+	r.bits(16) // Constraint flags and level
+	r.ue()     // seq_parameter_set_id
+
+	chroma := 1
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma = r.ue()
+		if chroma == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		r.ue()              // bit_depth_luma_minus8
+		r.ue()              // bit_depth_chroma_minus8
+		r.bits(1)           // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := range lists {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for range size {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		for range r.ue() {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	widthMBs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMBsOnly := r.bits(1)
+	if frameMBsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+
+	width = widthMBs * 16
+	height = (2 - frameMBsOnly) * heightMapUnits * 16
+	if r.bits(1) == 1 { // frame_cropping_flag
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		unitX, unitY := 1, 2-frameMBsOnly
+		if chroma == 1 || chroma == 2 {
+			unitX = 2
+		}
+		if chroma == 1 {
+			unitY *= 2
+		}
+		width -= (left + right) * unitX
+		height -= (top + bottom) * unitY
+	}
+	if r.err || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid SPS")
+	}
+	return width, height, nil
+}
+
+// spsSizeH265 returns the picture size of an H.265 SPS
+func spsSizeH265(sps []byte) (width, height int, err error) {
+	r := &bitReader{data: unescape(sps[2:])}
+	r.bits(4) // sps_video_parameter_set_id
+	subLayers := r.bits(3)
+	r.bits(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level: the general profile and level, then those of the
+	// sub-layers that are present
+	r.bits(88)
+	r.bits(8) // general_level_idc
+	profilePresent := make([]bool, subLayers)
+	levelPresent := make([]bool, subLayers)
+	for i := range subLayers {
+		profilePresent[i] = r.bits(1) == 1
+		levelPresent[i] = r.bits(1) == 1
+	}
+	if subLayers > 0 {
+		for range 8 - subLayers {
+			r.bits(2) // reserved_zero_2bits
+		}
+	}
+	for i := range subLayers {
+		if profilePresent[i] {
+			r.bits(88)
+		}
+		if levelPresent[i] {
+			r.bits(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chroma := r.ue()
+	if chroma == 3 {
+		r.bits(1) // separate_colour_plane_flag
+	}
+	width, height = r.ue(), r.ue()
+	if r.bits(1) == 1 { // conformance_window_flag
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		unitX, unitY := 1, 1
+		if chroma == 1 || chroma == 2 {
+			unitX = 2
+		}
+		if chroma == 1 {
+			unitY = 2
+		}
+		width -= (left + right) * unitX
+		height -= (top + bottom) * unitY
+	}
+	if r.err || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid SPS")
+	}
+	return width, height, nil
+}
+
+// unescape removes the emulation prevention bytes of a NAL unit
+func unescape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// bitReader reads Exp-Golomb coded fields. Reading past the end sets err.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  bool
+}
+
+func (r *bitReader) bits(n int) int {
+	v := 0
+	for range n {
+		if r.pos >= len(r.data)*8 {
+			r.err = true
+			return 0
+		}
+		v = v<<1 | int(r.data[r.pos/8]>>(7-r.pos%8))&1
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.bits(1) == 0 && !r.err {
+		zeros++
+		if zeros > 31 {
+			r.err = true
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 1 {
+		return (v + 1) / 2
+	}
+	return -v / 2
+}
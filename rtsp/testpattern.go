@@ -0,0 +1,253 @@
+package rtsp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// TestPatternOptions configures a synthetic stream
+type TestPatternOptions struct {
+	Width  int // Rounded up to a multiple of 16 (default 320)
+	Height int // Rounded up to a multiple of 16 (default 240)
+	FPS    int // Frames per second (default 25)
+	GOP    int // Frames from one key frame to the next (default FPS)
+	Seed   int // Picks the background color, e.g. the channel number
+}
+
+// TestPattern is a live H.264 stream of a block moving across a colored
+// background. Key frames are uncompressed (I_PCM) and the frames between
+// them repeat the key frame, so any decoder can play the stream without
+// an encoder being needed to produce it. Frames are paced in real time.
+type TestPattern struct {
+	opts     TestPatternOptions
+	sps, pps []byte
+	frame    int
+	idr      int
+	start    time.Time
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewTestPattern creates a synthetic stream
+func NewTestPattern(opts TestPatternOptions) *TestPattern {
+	if opts.Width <= 0 {
+		opts.Width = 320
+	}
+	if opts.Height <= 0 {
+		opts.Height = 240
+	}
+	opts.Width = (opts.Width + 15) / 16 * 16
+	opts.Height = (opts.Height + 15) / 16 * 16
+	if opts.FPS <= 0 {
+		opts.FPS = 25
+	}
+	if opts.GOP <= 0 {
+		opts.GOP = opts.FPS
+	}
+	p := &TestPattern{opts: opts, done: make(chan struct{})}
+	p.sps, p.pps = p.parameterSets()
+	return p
+}
+
+// Media returns the H.264 track of the stream
+func (p *TestPattern) Media() Media {
+	return Media{Codec: H264, PayloadType: 96, ParameterSets: [][]byte{p.sps, p.pps}}
+}
+
+// ReadAccessUnit waits for the next frame and returns it. Key frames carry
+// the SPS and PPS.
+func (p *TestPattern) ReadAccessUnit() (*AccessUnit, error) {
+	if p.start.IsZero() {
+		p.start = time.Now()
+	}
+	pts := time.Duration(p.frame) * time.Second / time.Duration(p.opts.FPS)
+	select {
+	case <-p.done:
+		return nil, io.EOF
+	case <-time.After(time.Until(p.start.Add(pts))):
+	}
+
+	au := &AccessUnit{PTS: pts, Time: p.start.Add(pts)}
+	n := p.frame % p.opts.GOP
+	if n == 0 {
+		au.Key = true
+		au.NALUs = [][]byte{p.sps, p.pps, p.keyFrame()}
+		p.idr++
+	} else {
+		au.NALUs = [][]byte{p.repeatFrame(n)}
+	}
+	p.frame++
+	return au, nil
+}
+
+// Close ends the stream
+func (p *TestPattern) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+func (p *TestPattern) parameterSets() (sps, pps []byte) {
+	var w bitWriter
+	w.bits(66, 8)   // profile_idc: baseline
+	w.bits(0xc0, 8) // constraint_set0_flag and constraint_set1_flag
+	w.bits(30, 8)   // level_idc 3.0
+	w.ue(0)         // seq_parameter_set_id
+	w.ue(0)         // log2_max_frame_num_minus4
+	w.ue(2)         // pic_order_cnt_type: output order is decoding order
+	w.ue(1)         // max_num_ref_frames
+	w.bits(0, 1)    // gaps_in_frame_num_value_allowed_flag
+	w.ue(p.opts.Width/16 - 1)
+	w.ue(p.opts.Height/16 - 1)
+	w.bits(1, 1) // frame_mbs_only_flag
+	w.bits(1, 1) // direct_8x8_inference_flag
+	w.bits(0, 1) // frame_cropping_flag
+	w.bits(0, 1) // vui_parameters_present_flag
+	sps = w.nalu(0x67)
+
+	w = bitWriter{}
+	w.ue(0)      // pic_parameter_set_id
+	w.ue(0)      // seq_parameter_set_id
+	w.bits(0, 1) // entropy_coding_mode_flag: CAVLC
+	w.bits(0, 1) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)      // num_slice_groups_minus1
+	w.ue(0)      // num_ref_idx_l0_default_active_minus1
+	w.ue(0)      // num_ref_idx_l1_default_active_minus1
+	w.bits(0, 1) // weighted_pred_flag
+	w.bits(0, 2) // weighted_bipred_idc
+	w.se(0)      // pic_init_qp_minus26
+	w.se(0)      // pic_init_qs_minus26
+	w.se(0)      // chroma_qp_index_offset
+	w.bits(1, 1) // deblocking_filter_control_present_flag
+	w.bits(0, 1) // constrained_intra_pred_flag
+	w.bits(0, 1) // redundant_pic_cnt_present_flag
+	pps = w.nalu(0x68)
+	return sps, pps
+}
+
+// keyFrame returns an IDR slice of I_PCM macroblocks
+func (p *TestPattern) keyFrame() []byte {
+	var w bitWriter
+	w.ue(0)             // first_mb_in_slice
+	w.ue(7)             // slice_type: I
+	w.ue(0)             // pic_parameter_set_id
+	w.bits(0, 4)        // frame_num
+	w.ue(p.idr % 65536) // idr_pic_id
+	w.bits(0, 1)        // no_output_of_prior_pics_flag
+	w.bits(0, 1)        // long_term_reference_flag
+	w.se(0)             // slice_qp_delta
+	w.ue(1)             // disable_deblocking_filter_idc
+	cols, rows := p.opts.Width/16, p.opts.Height/16
+
+	// The block moves one macroblock per key frame
+	blockX := p.idr % cols
+	blockY := rows / 2
+	bg := [3]byte{
+		byte(60 + (p.opts.Seed*37)%120),
+		byte(80 + (p.opts.Seed*53)%96),
+		byte(80 + (p.opts.Seed*71)%96),
+	}
+	for y := range rows {
+		for x := range cols {
+			w.ue(25) // mb_type: I_PCM
+			w.align()
+			color := bg
+			if x == blockX && (y == blockY || y == blockY-1) {
+				color = [3]byte{235, 128, 128}
+			}
+			for i := range 256 + 64 + 64 {
+				switch {
+				case i < 256:
+					w.bits(uint64(color[0]), 8)
+				case i < 320:
+					w.bits(uint64(color[1]), 8)
+				default:
+					w.bits(uint64(color[2]), 8)
+				}
+			}
+		}
+	}
+	return w.nalu(0x65)
+}
+
+// repeatFrame returns a P slice that skips every macroblock, repeating the
+// previous frame
+func (p *TestPattern) repeatFrame(n int) []byte {
+	var w bitWriter
+	w.ue(0)                                          // first_mb_in_slice
+	w.ue(5)                                          // slice_type: P
+	w.ue(0)                                          // pic_parameter_set_id
+	w.bits(uint64(n%16), 4)                          // frame_num
+	w.bits(0, 1)                                     // num_ref_idx_active_override_flag
+	w.bits(0, 1)                                     // ref_pic_list_modification_flag_l0
+	w.bits(0, 1)                                     // adaptive_ref_pic_marking_mode_flag
+	w.se(0)                                          // slice_qp_delta
+	w.ue(1)                                          // disable_deblocking_filter_idc
+	w.ue((p.opts.Width / 16) * (p.opts.Height / 16)) // mb_skip_run
+	return w.nalu(0x41)
+}
+
+// bitWriter writes the RBSP of a NAL unit
+type bitWriter struct {
+	buf  []byte
+	cur  uint64
+	nbit int
+}
+
+func (w *bitWriter) bits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.cur = w.cur<<1 | (v>>i)&1
+		w.nbit++
+		if w.nbit == 8 {
+			w.buf = append(w.buf, byte(w.cur))
+			w.cur, w.nbit = 0, 0
+		}
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code
+func (w *bitWriter) ue(v int) {
+	x := uint64(v) + 1
+	n := 0
+	for t := x; t > 1; t >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(x, n+1)
+}
+
+// se writes a signed Exp-Golomb code
+func (w *bitWriter) se(v int) {
+	if v > 0 {
+		w.ue(2*v - 1)
+	} else {
+		w.ue(-2 * v)
+	}
+}
+
+func (w *bitWriter) align() {
+	for w.nbit != 0 {
+		w.bits(0, 1)
+	}
+}
+
+// nalu adds the stop bit and returns the NAL unit with emulation prevention
+func (w *bitWriter) nalu(header byte) []byte {
+	w.bits(1, 1)
+	w.align()
+	out := []byte{header}
+	zeros := 0
+	for _, b := range w.buf {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
@@ -0,0 +1,167 @@
+package simulator
+
+import (
+	"cmsv_api/cmsv"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadBytesPerSecond is how fast a device uploads a download task
+const uploadBytesPerSecond = 256 * 1024
+
+// downloadTask is a download task with its upload state
+type downloadTask struct {
+	cmsv.DownloadTask
+	uploaded int64
+}
+
+// handleAddDownload creates a download task for part of a recording. The
+// same part of the same file can only have one task that has not failed.
+func (s *Simulator) handleAddDownload(w http.ResponseWriter, query url.Values) {
+	begin, err1 := time.ParseInLocation(cmsv.TimeLayout, query.Get("sbtm"), s.clock.Location())
+	end, err2 := time.ParseInLocation(cmsv.TimeLayout, query.Get("setm"), s.clock.Location())
+	channel, err3 := strconv.Atoi(query.Get("chn"))
+	if query.Get("did") == "" || query.Get("fph") == "" || err1 != nil || err2 != nil || err3 != nil {
+		writeJSON(w, map[string]int{"result": 7})
+		return
+	}
+	if begin.After(end) {
+		writeJSON(w, map[string]int{"result": 9})
+		return
+	}
+	vehicle := s.vehicle(query.Get("did"))
+	if vehicle == nil {
+		writeJSON(w, map[string]int{"result": 19})
+		return
+	}
+	for _, t := range s.downloads {
+		if t.DevIDNO == vehicle.cfg.Device && t.Channel == channel && t.File == query.Get("fph") &&
+			t.Begin == query.Get("sbtm") && t.End == query.Get("setm") && t.Status != cmsv.DownloadFailed {
+			writeJSON(w, map[string]int{"result": 11})
+			return
+		}
+	}
+
+	t := &downloadTask{DownloadTask: cmsv.DownloadTask{
+		ID:        newGUID()[:16],
+		DevIDNO:   vehicle.cfg.Device,
+		VehiIDNO:  vehicle.cfg.Plate,
+		Channel:   channel,
+		File:      query.Get("fph"),
+		FileBegin: query.Get("fbtm"),
+		FileEnd:   query.Get("fetm"),
+		Begin:     query.Get("sbtm"),
+		End:       query.Get("setm"),
+		Label:     query.Get("lab"),
+		Size:      max(int64(end.Sub(begin).Seconds()), 1) * recordingBytesPerSecond,
+		Status:    cmsv.DownloadWaiting,
+		Created:   s.clock.Format(cmsv.TimeLayout),
+	}}
+	s.downloads = append(s.downloads, t)
+	writeJSON(w, cmsv.AddDownloadTaskResponse{TaskID: t.ID})
+}
+
+// handleQueryDownloads lists the download tasks, oldest first. Finished
+// tasks link to /simulator/downloads/<id> on host.
+func (s *Simulator) handleQueryDownloads(w http.ResponseWriter, query url.Values, host string) {
+	tasks := []cmsv.DownloadTask{}
+	for _, t := range s.downloads {
+		if device := query.Get("devIdno"); device != "" && t.DevIDNO != device {
+			continue
+		}
+		if status := query.Get("status"); status != "" && status != strconv.Itoa(int(t.Status)) {
+			continue
+		}
+		if begin := query.Get("begintime"); begin != "" && t.Created < begin {
+			continue
+		}
+		if end := query.Get("endtime"); end != "" && t.Created > end {
+			continue
+		}
+		task := t.DownloadTask
+		if task.Status == cmsv.DownloadFinished {
+			task.URL = "http://" + host + "/simulator/downloads/" + task.ID
+		}
+		tasks = append(tasks, task)
+	}
+
+	tasks, pagination := pageOf(tasks, query)
+	writeJSON(w, cmsv.DownloadTaskResponse{Tasks: tasks, Pagination: pagination})
+}
+
+// handleDeleteDownloads removes download tasks
+func (s *Simulator) handleDeleteDownloads(w http.ResponseWriter, query url.Values) {
+	ids := splitIDs(query.Get("taskTag"))
+	if len(ids) == 0 {
+		writeJSON(w, map[string]int{"result": 7})
+		return
+	}
+	s.downloads = slices.DeleteFunc(s.downloads, func(t *downloadTask) bool {
+		return slices.Contains(ids, t.ID)
+	})
+	writeJSON(w, map[string]int{"result": 0})
+}
+
+// stepDownloads uploads the tasks of online devices for d
+func (s *Simulator) stepDownloads(d time.Duration) {
+	for _, t := range s.downloads {
+		if t.Done() {
+			continue
+		}
+		if v := s.vehicle(t.DevIDNO); v == nil || !v.online {
+			continue // Waits until the device comes online
+		}
+		t.Status = cmsv.DownloadRunning
+		t.uploaded = min(t.uploaded+int64(d.Seconds()*uploadBytesPerSecond), t.Size)
+		t.Progress = int(t.uploaded * 100 / t.Size)
+		if t.uploaded == t.Size {
+			t.Status = cmsv.DownloadFinished
+		}
+	}
+}
+
+// serveDownload serves the file of a finished download task. Range requests
+// are supported, so interrupted downloads can be resumed.
+func (s *Simulator) serveDownload(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	var size int64 = -1
+	var name string
+	for _, t := range s.downloads {
+		if t.ID == id && t.Status == cmsv.DownloadFinished {
+			size, name = t.Size, t.FileName()
+		}
+	}
+	s.mu.Unlock()
+	if size < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/h264")
+	http.ServeContent(w, r, name, time.Time{}, io.NewSectionReader(videoData{}, 0, size))
+}
+
+// videoData is the content of simulated recordings: a fixed byte pattern,
+// so resumed downloads can be checked
+type videoData struct{}
+
+func (videoData) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = byte((off + int64(i)) % 251)
+	}
+	return len(p), nil
+}
+
+// vehicle returns the vehicle of a device, or nil
+func (s *Simulator) vehicle(device string) *vehicleState {
+	for _, v := range s.vehicles {
+		if v.cfg.Device == strings.TrimSpace(device) {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package simulator
+
+import (
+	"cmsv_api/geo"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Fleet is the fake account served by a simulator
+type Fleet struct {
+	Account   string    `json:"account"`  // Accepted account; empty accepts any account
+	Password  string    `json:"password"` // Accepted password when Account is set
+	Companies []Company `json:"companies"`
+	Vehicles  []Vehicle `json:"vehicles"`
+}
+
+// Company is a node of the company tree
+type Company struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentID int    `json:"parentId"`
+}
+
+// Point is a route point in WGS84 degrees
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+func (p Point) coord() geo.Coord {
+	return geo.Coord{Lat: p.Lat, Lng: p.Lng, Datum: geo.WGS84}
+}
+
+// AlarmRule raises an alarm of one type at a fixed interval
+type AlarmRule struct {
+	Type         int    `json:"type"`         // Alarm type code
+	EverySeconds int    `json:"everySeconds"` // Interval between alarms
+	Desc         string `json:"desc"`         // Alarm description
+}
+
+// Vehicle is a simulated vehicle with one device. It drives its route in a
+// loop, stopping StopSeconds at every route point.
+type Vehicle struct {
+	ID            int         `json:"id"`
+	Plate         string      `json:"plate"`
+	CompanyID     int         `json:"companyId"`
+	Device        string      `json:"device"`
+	SIM           string      `json:"sim"`
+	Channels      int         `json:"channels"`     // Video channels (default 4)
+	ChannelNames  []string    `json:"channelNames"` // Default CH1..CHn
+	Offline       bool        `json:"offline"`
+	Driver        string      `json:"driver"`
+	DriverCertNo  string      `json:"driverCertNo"`
+	SpeedKmh      float64     `json:"speedKmh"`      // Cruising speed (default 50); the actual speed varies by ±20%
+	SpeedLimitKmh float64     `json:"speedLimitKmh"` // Overspeed alarms above this speed (default 80)
+	StopSeconds   int         `json:"stopSeconds"`   // Parking time at every route point
+	FuelLiters    float64     `json:"fuelLiters"`    // Tank size and initial fuel (default 200)
+	Route         []Point     `json:"route"`
+	Alarms        []AlarmRule `json:"alarms"`
+}
+
+// DefaultFleet returns a small fleet of three vehicles around Dongguan: two
+// on the road and one offline
+func DefaultFleet() Fleet {
+	return Fleet{
+		Companies: []Company{
+			{ID: 1, Name: "test", ParentID: 0},
+			{ID: 3, Name: "test11", ParentID: 1},
+		},
+		Vehicles: []Vehicle{
+			{
+				ID: 28979, Plate: "S66666", CompanyID: 1, Device: "013300000001", SIM: "13800000001",
+				Driver: "Li Wei", DriverCertNo: "440300198001010011",
+				SpeedKmh: 50, StopSeconds: 120,
+				Route: []Point{
+					{Lat: 23.004510, Lng: 113.712944},
+					{Lat: 23.011620, Lng: 113.725310},
+					{Lat: 23.020840, Lng: 113.718770},
+					{Lat: 23.013950, Lng: 113.704020},
+				},
+				Alarms: []AlarmRule{
+					{Type: 618, EverySeconds: 600, Desc: "Fatigue driving"},
+					{Type: 600, EverySeconds: 900, Desc: "Forward collision warning"},
+				},
+			},
+			{
+				ID: 28980, Plate: "S66667", CompanyID: 3, Device: "013300000002", SIM: "13800000002",
+				Driver: "Chen Jie", DriverCertNo: "440300198502020022",
+				SpeedKmh: 75, SpeedLimitKmh: 80,
+				Route: []Point{
+					{Lat: 23.046300, Lng: 113.752100},
+					{Lat: 23.071800, Lng: 113.790400},
+					{Lat: 23.098500, Lng: 113.823700},
+				},
+				Alarms: []AlarmRule{
+					{Type: 620, EverySeconds: 1200, Desc: "Smoking"},
+				},
+			},
+			{
+				ID: 28981, Plate: "S66668", CompanyID: 3, Device: "013300000003", SIM: "13800000003",
+				Offline: true,
+				Route:   []Point{{Lat: 23.020400, Lng: 113.751900}},
+			},
+		},
+	}
+}
+
+// LoadFleet reads a fleet from a JSON file
+func LoadFleet(path string) (Fleet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Fleet{}, err
+	}
+	var fleet Fleet
+	if err := json.Unmarshal(data, &fleet); err != nil {
+		return Fleet{}, fmt.Errorf("fleet %s: %v", path, err)
+	}
+	if err := fleet.Validate(); err != nil {
+		return Fleet{}, fmt.Errorf("fleet %s: %v", path, err)
+	}
+	return fleet, nil
+}
+
+// Validate checks that every vehicle has a device and a route and that
+// device numbers and plates are unique
+func (f Fleet) Validate() error {
+	devices := make(map[string]bool)
+	plates := make(map[string]bool)
+	for i, v := range f.Vehicles {
+		if v.Device == "" || v.Plate == "" {
+			return fmt.Errorf("vehicle %d: device and plate are required", i+1)
+		}
+		if devices[v.Device] {
+			return fmt.Errorf("vehicle %s: duplicate device %s", v.Plate, v.Device)
+		}
+		if plates[v.Plate] {
+			return fmt.Errorf("vehicle %s: duplicate plate", v.Plate)
+		}
+		devices[v.Device] = true
+		plates[v.Plate] = true
+
+		if len(v.Route) == 0 {
+			return fmt.Errorf("vehicle %s: route needs at least one point", v.Plate)
+		}
+		for _, rule := range v.Alarms {
+			if rule.EverySeconds <= 0 {
+				return fmt.Errorf("vehicle %s: alarm type %d needs everySeconds > 0", v.Plate, rule.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// withDefaults fills in the optional vehicle settings
+func (v Vehicle) withDefaults(index int) Vehicle {
+	if v.ID == 0 {
+		v.ID = index + 1
+	}
+	if v.Channels <= 0 {
+		v.Channels = 4
+	}
+	for len(v.ChannelNames) < v.Channels {
+		v.ChannelNames = append(v.ChannelNames, fmt.Sprintf("CH%d", len(v.ChannelNames)+1))
+	}
+	if v.SpeedKmh <= 0 {
+		v.SpeedKmh = 50
+	}
+	if v.SpeedLimitKmh <= 0 {
+		v.SpeedLimitKmh = 80
+	}
+	if v.FuelLiters <= 0 {
+		v.FuelLiters = 200
+	}
+	return v
+}
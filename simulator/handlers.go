@@ -0,0 +1,454 @@
+package simulator
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/geo"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServeHTTP answers StandardApiAction requests and the /simulator/ control
+// endpoints
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/simulator/") {
+		s.serveControl(w, r)
+		return
+	}
+
+	name := path.Base(r.URL.Path)
+	action, ok := strings.CutPrefix(name, "StandardApiAction_")
+	action, ok2 := strings.CutSuffix(action, ".action")
+	if !ok || !ok2 {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f := s.fault(action); f != nil {
+		s.logf("%s: injected result %d", action, f.Code)
+		res := map[string]int{"result": f.Code}
+		if f.Server {
+			res["cmsserver"] = 1
+		}
+		writeJSON(w, res)
+		return
+	}
+
+	if action == "login" {
+		s.handleLogin(w, query)
+		return
+	}
+	if !s.validSession(query.Get("jsession")) {
+		s.logf("%s: session does not exist", action)
+		writeJSON(w, map[string]int{"result": 5})
+		return
+	}
+
+	switch action {
+	case "logout":
+		delete(s.sessions, query.Get("jsession"))
+		writeJSON(w, map[string]int{"result": 0})
+	case "queryUserVehicle":
+		s.handleVehicles(w)
+	case "getDeviceOlStatus":
+		s.handleOnlineStatus(w, query)
+	case "getDeviceStatus":
+		s.handleDeviceStatus(w, query)
+	case "vehicleAlarm":
+		s.handleAlarms(w, query)
+	case "queryTrackDetail":
+		s.handleTrack(w, query)
+	case "getVideoFileInfo":
+		s.handleVideoFiles(w, query)
+	case "addDownloadTask":
+		s.handleAddDownload(w, query)
+	case "queryDownloadTask":
+		s.handleQueryDownloads(w, query, r.Host)
+	case "delDownloadTasklist":
+		s.handleDeleteDownloads(w, query)
+	default:
+		s.logf("%s: not simulated", action)
+		http.NotFound(w, r)
+		return
+	}
+	s.logf("%s: ok", action)
+}
+
+func (s *Simulator) handleLogin(w http.ResponseWriter, query url.Values) {
+	account, password := query.Get("account"), query.Get("password")
+	if account == "" || (s.fleet.Account != "" && (account != s.fleet.Account || password != s.fleet.Password)) {
+		s.logf("login: invalid credentials for %q", account)
+		writeJSON(w, map[string]int{"result": 1})
+		return
+	}
+	jsession := s.login()
+	s.logf("login: %s logged in", account)
+	writeJSON(w, map[string]any{
+		"result":       0,
+		"jsession":     jsession,
+		"JSESSIONID":   jsession,
+		"account_name": account,
+		"pri":          ",1,2,3,4,5,",
+	})
+}
+
+// simVehicle adds the channel fields of the vehicle list to cmsv.Vehicle
+type simVehicle struct {
+	cmsv.Vehicle
+	Abbr     string `json:"abbr"`
+	ChnCount int    `json:"chnCount"`
+	ChnName  string `json:"chnName"`
+}
+
+func (s *Simulator) handleVehicles(w http.ResponseWriter) {
+	companies := make([]cmsv.Company, 0, len(s.fleet.Companies))
+	names := make(map[int]string)
+	for _, c := range s.fleet.Companies {
+		companies = append(companies, cmsv.Company{ID: c.ID, Name: c.Name, PID: c.ParentID})
+		names[c.ID] = c.Name
+	}
+	vehicles := make([]simVehicle, 0, len(s.vehicles))
+	for _, v := range s.vehicles {
+		channels := strings.Join(v.cfg.ChannelNames[:v.cfg.Channels], ",")
+		vehicles = append(vehicles, simVehicle{
+			Vehicle: cmsv.Vehicle{
+				ID:    v.cfg.ID,
+				Name:  v.cfg.Plate,
+				PID:   v.cfg.CompanyID,
+				PName: names[v.cfg.CompanyID],
+				DeviceList: []cmsv.VehicleDevice{{
+					ID:          v.cfg.Device,
+					Channels:    v.cfg.Channels,
+					ChanName:    channels,
+					SIM:         v.cfg.SIM,
+					InstallTime: s.opts.Start.Format(cmsv.TimeLayout),
+				}},
+			},
+			ChnCount: v.cfg.Channels,
+			ChnName:  channels,
+		})
+	}
+	writeJSON(w, map[string]any{"result": 0, "companys": companies, "vehicles": vehicles})
+}
+
+func (s *Simulator) handleOnlineStatus(w http.ResponseWriter, query url.Values) {
+	status := query.Get("status")
+	onlines := []cmsv.Device{}
+	for _, v := range s.selectVehicles(query) {
+		online := 0
+		if v.online {
+			online = 1
+		}
+		if status != "" && status != strconv.Itoa(online) {
+			continue
+		}
+		onlines = append(onlines, cmsv.Device{VID: v.cfg.Plate, DID: v.cfg.Device, Online: online})
+	}
+	writeJSON(w, cmsv.StatusResponse{Onlines: onlines})
+}
+
+func (s *Simulator) handleDeviceStatus(w http.ResponseWriter, query url.Values) {
+	datum := mapDatum(query)
+	statuses := []cmsv.DeviceStatus{}
+	for _, v := range s.selectVehicles(query) {
+		st := v.status()
+		st.MLat, st.MLng = mapPosition(st.Lat, st.Lng, datum)
+		if query.Get("geoaddress") == "1" {
+			st.PS = st.MLat + "," + st.MLng
+		}
+		if query.Get("driver") == "1" {
+			st.DriverName = v.cfg.Driver
+			st.DriverCertNo = v.cfg.DriverCertNo
+		}
+		statuses = append(statuses, st)
+	}
+	writeJSON(w, cmsv.DeviceStatusResponse{Status: statuses})
+}
+
+// handleAlarms returns the current alarms, newest first. Without
+// currentPage every alarm is returned on one page.
+func (s *Simulator) handleAlarms(w http.ResponseWriter, query url.Values) {
+	devices := splitIDs(query.Get("DevIDNO"))
+	datum := mapDatum(query)
+	alarms := []cmsv.Alarm{}
+	for i := len(s.alarms) - 1; i >= 0; i-- {
+		a := s.alarms[i]
+		if len(devices) == 0 || slices.Contains(devices, a.DevIDNO) {
+			a.Gps.MLat, a.Gps.MLng = mapPosition(a.Gps.Lat, a.Gps.Lng, datum)
+			alarms = append(alarms, a)
+		}
+	}
+
+	alarms, pagination := pageOf(alarms, query)
+	writeJSON(w, cmsv.AlarmResponse{AlarmList: alarms, Pagination: pagination})
+}
+
+// handleTrack returns the recorded positions of one device in a time range,
+// oldest first
+func (s *Simulator) handleTrack(w http.ResponseWriter, query url.Values) {
+	begin, err1 := time.ParseInLocation(cmsv.TimeLayout, query.Get("begintime"), s.clock.Location())
+	end, err2 := time.ParseInLocation(cmsv.TimeLayout, query.Get("endtime"), s.clock.Location())
+	if query.Get("devIdno") == "" || err1 != nil || err2 != nil {
+		writeJSON(w, map[string]int{"result": 7})
+		return
+	}
+	if begin.After(end) {
+		writeJSON(w, map[string]int{"result": 9})
+		return
+	}
+	vehicle := s.vehicle(query.Get("devIdno"))
+	if vehicle == nil {
+		writeJSON(w, map[string]int{"result": 19})
+		return
+	}
+
+	distance, _ := strconv.ParseFloat(query.Get("distance"), 64)
+	datum := mapDatum(query)
+	from, to := begin.Format(cmsv.TimeLayout), end.Format(cmsv.TimeLayout)+".9"
+	points := []cmsv.TrackPoint{}
+	var last geo.Coord
+	for _, st := range vehicle.track {
+		if st.GT < from || st.GT > to {
+			continue
+		}
+		c := st.Coord()
+		if distance > 0 && len(points) > 0 && geo.Distance(last, c) < distance*1000 {
+			continue
+		}
+		last = c
+		st.MLat, st.MLng = mapPosition(st.Lat, st.Lng, datum)
+		if query.Get("geoaddress") == "1" {
+			st.PS = st.MLat + "," + st.MLng
+		}
+		points = append(points, cmsv.TrackPoint{DeviceStatus: st})
+	}
+
+	points, pagination := pageOf(points, query)
+	writeJSON(w, cmsv.TrackResponse{Tracks: points, Pagination: pagination})
+}
+
+// handleVideoFiles lists the recordings of one device on one day. Online
+// devices record every channel continuously in segments of
+// recordingSegment over the last trackRetention; segments with an alarm of
+// the device are alarm recordings.
+func (s *Simulator) handleVideoFiles(w http.ResponseWriter, query url.Values) {
+	year, err1 := strconv.Atoi(query.Get("YEAR"))
+	month, err2 := strconv.Atoi(query.Get("MON"))
+	day, err3 := strconv.Atoi(query.Get("DAY"))
+	beg, err4 := strconv.Atoi(query.Get("BEG"))
+	end, err5 := strconv.Atoi(query.Get("END"))
+	loc, err6 := strconv.Atoi(query.Get("LOC"))
+	chn, err7 := strconv.Atoi(query.Get("CHN"))
+	if query.Get("DevIDNO") == "" || errors.Join(err1, err2, err3, err4, err5, err6, err7) != nil {
+		writeJSON(w, map[string]int{"result": 7})
+		return
+	}
+	if beg > end {
+		writeJSON(w, map[string]int{"result": 9})
+		return
+	}
+	vehicle := s.vehicle(query.Get("DevIDNO"))
+	if vehicle == nil {
+		writeJSON(w, map[string]int{"result": 19})
+		return
+	}
+
+	files := []cmsv.VideoFile{}
+	if !vehicle.online {
+		writeJSON(w, cmsv.VideoFileResponse{Files: files})
+		return
+	}
+	recType, err := strconv.Atoi(query.Get("RECTYPE"))
+	if err != nil {
+		recType = cmsv.RecordAll
+	}
+	midnight := time.Date(year, time.Month(month), day, 0, 0, 0, 0, s.clock.Location())
+	from := midnight.Add(time.Duration(beg) * time.Second)
+	if oldest := s.clock.Add(-trackRetention); from.Before(oldest) {
+		from = oldest
+	}
+	to := midnight.Add(time.Duration(end+1) * time.Second)
+	if s.clock.Before(to) {
+		to = s.clock
+	}
+
+	for start := from.Truncate(recordingSegment); start.Before(to); start = start.Add(recordingSegment) {
+		stop := start.Add(recordingSegment)
+		if s.clock.Before(stop) {
+			stop = s.clock
+		}
+		typ := cmsv.RecordNormal
+		for _, a := range s.alarms {
+			if a.DevIDNO == vehicle.cfg.Device && a.Time >= start.Format(cmsv.TimeLayout) && a.Time < stop.Format(cmsv.TimeLayout) {
+				typ = cmsv.RecordAlarm
+			}
+		}
+		if recType != cmsv.RecordAll && recType != typ {
+			continue
+		}
+		for c := range vehicle.cfg.Channels {
+			if chn != cmsv.AllChannels && chn != c {
+				continue
+			}
+			dir := "/mnt/hd0/record"
+			if loc != int(cmsv.VideoOnDevice) {
+				dir = "/data/storage/" + vehicle.cfg.Device
+			}
+			seconds := int(stop.Sub(start).Seconds())
+			files = append(files, cmsv.VideoFile{
+				DevIDNO:  vehicle.cfg.Device,
+				VehiIDNO: vehicle.cfg.Plate,
+				File:     fmt.Sprintf("%s/%s/%s-CH%d.264", dir, start.Format("20060102"), start.Format("150405"), c+1),
+				Channel:  c,
+				ChnMask:  1 << c,
+				Year:     start.Year() % 100,
+				Mon:      int(start.Month()),
+				Day:      start.Day(),
+				Beg:      start.Hour()*3600 + start.Minute()*60 + start.Second(),
+				End:      start.Hour()*3600 + start.Minute()*60 + start.Second() + seconds,
+				Len:      int64(seconds) * recordingBytesPerSecond,
+				Loc:      loc,
+				Type:     typ,
+			})
+		}
+	}
+	writeJSON(w, cmsv.VideoFileResponse{Files: files})
+}
+
+// pageOf returns the page selected by currentPage and pageRecords. Without
+// them every item is returned on one page.
+func pageOf[T any](items []T, query url.Values) ([]T, cmsv.Pagination) {
+	page, _ := strconv.Atoi(query.Get("currentPage"))
+	pageSize, _ := strconv.Atoi(query.Get("pageRecords"))
+	if page < 1 || pageSize < 1 {
+		page, pageSize = 1, max(len(items), 1)
+	}
+	total := len(items)
+	begin := min((page-1)*pageSize, total)
+	end := min(begin+pageSize, total)
+	return items[begin:end], cmsv.Pagination{
+		TotalPages:   (total + pageSize - 1) / pageSize,
+		CurrentPage:  page,
+		PageRecords:  pageSize,
+		TotalRecords: total,
+	}
+}
+
+// mapDatum returns the datum requested with toMap
+func mapDatum(query url.Values) geo.Datum {
+	toMap, _ := strconv.Atoi(query.Get("toMap"))
+	if d := geo.Datum(toMap); d.Valid() {
+		return d
+	}
+	return geo.WGS84
+}
+
+// mapPosition converts a WGS84 position in micro-degrees to the mlat and
+// mlng strings of a map datum
+func mapPosition(lat, lng int, d geo.Datum) (string, string) {
+	c := geo.FromMicroDegrees(lat, lng, geo.WGS84).To(d)
+	return geo.FormatDegrees(c.Lat), geo.FormatDegrees(c.Lng)
+}
+
+// selectVehicles applies the devIdno and vehiIdno filters of a request
+func (s *Simulator) selectVehicles(query url.Values) []*vehicleState {
+	devices := splitIDs(query.Get("devIdno"))
+	plates := splitIDs(query.Get("vehiIdno"))
+	var selected []*vehicleState
+	for _, v := range s.vehicles {
+		switch {
+		case len(devices) > 0:
+			if !slices.Contains(devices, v.cfg.Device) {
+				continue
+			}
+		case len(plates) > 0:
+			if !slices.Contains(plates, v.cfg.Plate) {
+				continue
+			}
+		}
+		selected = append(selected, v)
+	}
+	return selected
+}
+
+// serveControl handles the endpoints that drive the simulator over HTTP:
+//
+//	POST   /simulator/faults?action=vehicleAlarm&code=6&count=1&server=0
+//	DELETE /simulator/faults
+//	POST   /simulator/alarms?device=013300000001&type=2&desc=...
+//	POST   /simulator/sessions/expire
+//	POST   /simulator/devices/{id}/online?online=0
+func (s *Simulator) serveControl(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	p := strings.TrimPrefix(r.URL.Path, "/simulator")
+
+	switch {
+	case strings.HasPrefix(p, "/downloads/") && r.Method == http.MethodGet:
+		s.serveDownload(w, r, strings.TrimPrefix(p, "/downloads/"))
+		return
+	case p == "/faults" && r.Method == http.MethodPost:
+		code, err := strconv.Atoi(query.Get("code"))
+		if err != nil {
+			http.Error(w, "invalid code", http.StatusBadRequest)
+			return
+		}
+		count, _ := strconv.Atoi(query.Get("count"))
+		s.InjectFault(Fault{Action: query.Get("action"), Code: code, Count: count, Server: query.Get("server") == "1"})
+	case p == "/faults" && r.Method == http.MethodDelete:
+		s.ClearFaults()
+	case p == "/alarms" && r.Method == http.MethodPost:
+		alarmType, err := strconv.Atoi(query.Get("type"))
+		if err != nil {
+			http.Error(w, "invalid type", http.StatusBadRequest)
+			return
+		}
+		guid, err := s.RaiseAlarm(query.Get("device"), alarmType, query.Get("desc"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]string{"guid": guid})
+		return
+	case p == "/sessions/expire" && r.Method == http.MethodPost:
+		s.ExpireSessions()
+	case strings.HasPrefix(p, "/devices/") && strings.HasSuffix(p, "/online") && r.Method == http.MethodPost:
+		device := strings.TrimSuffix(strings.TrimPrefix(p, "/devices/"), "/online")
+		if err := s.SetOnline(device, query.Get("online") != "0"); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+// splitIDs splits a comma-separated parameter, dropping empty items
+func splitIDs(s string) []string {
+	var ids []string
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
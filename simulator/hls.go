@@ -0,0 +1,129 @@
+package simulator
+
+import (
+	"cmsv_api/relay"
+	"cmsv_api/rtsp"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HLSHandler returns the handler of the simulated HLS server. Playlists of
+// cmsv.GenerateHLSLink, /hls/1_<device>_<channel>_<stream>.m3u8?jsession=,
+// are cut from the test patterns of OpenStream. Like on the real server,
+// their segment URIs carry the jsession, which is checked on every request.
+func (s *Simulator) HLSHandler() http.Handler {
+	rel, _ := relay.New(relay.Options{
+		Open: func(ctx context.Context, key relay.Key) (rtsp.Stream, error) {
+			return s.openLive(key.Device, key.Channel, key.Stream)
+		},
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutPrefix(r.URL.Path, "/hls/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		jsession := r.URL.Query().Get("jsession")
+		s.mu.Lock()
+		valid := s.validSession(jsession)
+		s.mu.Unlock()
+		if !valid {
+			s.logf("hls %s: session does not exist", r.URL.Path)
+			http.Error(w, "session does not exist", http.StatusUnauthorized)
+			return
+		}
+
+		// Playlists are <name>.m3u8 and their segments <name>/<seq>.ts
+		base, segment, isSegment := strings.Cut(name, "/")
+		if !isSegment {
+			base, ok = strings.CutSuffix(name, ".m3u8")
+		}
+		key, err := parseHLSName(base)
+		if !ok || err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if isSegment {
+			seq, err := strconv.Atoi(strings.TrimSuffix(segment, ".ts"))
+			data := rel.Segment(key, seq)
+			if err != nil || data == nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "video/mp2t")
+			w.Write(data)
+			return
+		}
+
+		playlist, err := rel.Playlist(r.Context(), key)
+		if err != nil {
+			status := http.StatusBadGateway
+			var se *rtsp.StatusError
+			if errors.As(err, &se) {
+				status = se.Code
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		lines := strings.Split(playlist, "\n")
+		for i, line := range lines {
+			if strings.HasSuffix(line, ".ts") {
+				lines[i] = base + "/" + line + "?jsession=" + url.QueryEscape(jsession)
+			}
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write([]byte(strings.Join(lines, "\n")))
+	})
+}
+
+// parseHLSName parses <request type>_<device>_<channel>_<stream>
+func parseHLSName(name string) (relay.Key, error) {
+	parts := strings.Split(name, "_")
+	if len(parts) < 4 || parts[0] != "1" {
+		return relay.Key{}, errors.New("invalid HLS stream name")
+	}
+	n := len(parts)
+	channel, err1 := strconv.Atoi(parts[n-2])
+	stream, err2 := strconv.Atoi(parts[n-1])
+	if err1 != nil || err2 != nil {
+		return relay.Key{}, errors.New("invalid HLS stream name")
+	}
+	return relay.Key{Device: strings.Join(parts[1:n-2], "_"), Channel: channel, Stream: stream}, nil
+}
+
+// SelfSignedCertificate returns a certificate for serving HTTPS on any host,
+// such as the HLS server, which cmsv.GenerateHLSLink addresses with https.
+// Clients have to skip verification, as cmsv.Client does after a
+// certificate error.
+func SelfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "CMSV simulator"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
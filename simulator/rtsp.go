@@ -0,0 +1,51 @@
+package simulator
+
+import (
+	"cmsv_api/rtsp"
+	"net/url"
+	"strconv"
+)
+
+// OpenStream is the rtsp.Handler of the simulated media server. Live video
+// links from cmsv.GenerateRTSPLink, or cmsv.GenerateRTMPLink through an
+// rtmp.Server, of online devices with a valid jsession play a test pattern
+// whose color depends on the channel; sub streams are smaller.
+func (s *Simulator) OpenStream(u *url.URL) (rtsp.Stream, error) {
+	query := u.Query()
+	s.mu.Lock()
+	valid := s.validSession(query.Get("jsession"))
+	s.mu.Unlock()
+	if !valid {
+		s.logf("rtsp %s: session does not exist", u.Path)
+		return nil, &rtsp.StatusError{Code: 401, Reason: "Unauthorized"}
+	}
+	channel, err := strconv.Atoi(query.Get("Channel"))
+	if err != nil || query.Get("AVType") == "2" {
+		return nil, &rtsp.StatusError{Code: 404, Reason: "Not Found"}
+	}
+	stream := 0
+	if query.Get("Stream") == "1" {
+		stream = 1
+	}
+	return s.openLive(query.Get("DevIDNO"), channel, stream)
+}
+
+// openLive returns the test pattern of a device channel
+func (s *Simulator) openLive(device string, channel, stream int) (rtsp.Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vehicle := s.vehicle(device)
+	if vehicle == nil || channel < 0 || channel >= vehicle.cfg.Channels {
+		return nil, &rtsp.StatusError{Code: 404, Reason: "Not Found"}
+	}
+	if !vehicle.online {
+		return nil, &rtsp.StatusError{Code: 503, Reason: "Device Offline"}
+	}
+
+	opts := rtsp.TestPatternOptions{Width: 320, Height: 240, Seed: channel}
+	if stream == 1 {
+		opts.Width, opts.Height = 176, 144
+	}
+	s.logf("rtsp: playing %s channel %d", vehicle.cfg.Device, channel)
+	return rtsp.NewTestPattern(opts), nil
+}
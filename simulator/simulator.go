@@ -0,0 +1,289 @@
+// Package simulator is a fake CMSV server for offline development and tests.
+// It answers the login, logout, queryUserVehicle, getDeviceOlStatus,
+// getDeviceStatus, vehicleAlarm, queryTrackDetail, getVideoFileInfo and the
+// download task actions with the response shapes of the real server, for a
+// configurable fleet whose vehicles drive along routes, record their tracks
+// and video, update their s1-s4 status bits and raise alarms. Result codes
+// can be injected to exercise error handling. OpenStream plays live video
+// test patterns through an rtsp.Server or an rtmp.Server, and HLSHandler
+// serves them as HLS.
+//
+// In tests, serve a simulator with httptest and point a cmsv.Client at it:
+//
+//	sim := simulator.New(simulator.Options{})
+//	srv := httptest.NewServer(sim)
+//	defer srv.Close()
+//	client, _ := cmsv.NewClient(cmsv.Options{BaseURL: srv.URL})
+//	sim.Step(time.Minute) // move the fleet forward
+package simulator
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/geo"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	mrand "math/rand/v2"
+	"sync"
+	"time"
+)
+
+// DefaultAlarmTTL is how long a raised alarm stays in the vehicleAlarm list
+const DefaultAlarmTTL = 10 * time.Minute
+
+// Options configures a simulator
+type Options struct {
+	Fleet     *Fleet        // Default: DefaultFleet()
+	Start     time.Time     // Simulated time at start (default now)
+	TimeScale float64       // Simulated seconds per real second in Run (default 1)
+	AlarmTTL  time.Duration // Default DefaultAlarmTTL
+	Seed      uint64        // Seed of the speed variation; 0 picks a random seed
+	Logger    *log.Logger   // Requests are logged here when set
+}
+
+// Fault makes requests fail with a result code
+type Fault struct {
+	Action string // Action name such as "vehicleAlarm"; "*" or empty for every action
+	Code   int    // Result code to return
+	Server bool   // Report the code as a server error ("cmsserver":1)
+	Count  int    // Number of requests to fail; 0 fails until ClearFaults
+}
+
+// Simulator is a fake CMSV server. It implements http.Handler.
+type Simulator struct {
+	opts  Options
+	fleet Fleet
+
+	mu        sync.Mutex
+	clock     time.Time
+	rng       *mrand.Rand
+	vehicles  []*vehicleState
+	alarms    []cmsv.Alarm         // Oldest first
+	downloads []*downloadTask      // Oldest first
+	sessions  map[string]time.Time // jsession to last use
+	faults    []*Fault
+}
+
+// New creates a simulator
+func New(opts Options) *Simulator {
+	fleet := DefaultFleet()
+	if opts.Fleet != nil {
+		fleet = *opts.Fleet
+	}
+	if opts.Start.IsZero() {
+		opts.Start = time.Now()
+	}
+	if opts.TimeScale <= 0 {
+		opts.TimeScale = 1
+	}
+	if opts.AlarmTTL <= 0 {
+		opts.AlarmTTL = DefaultAlarmTTL
+	}
+	if opts.Seed == 0 {
+		opts.Seed = mrand.Uint64()
+	}
+
+	s := &Simulator{
+		opts:     opts,
+		fleet:    fleet,
+		clock:    opts.Start,
+		rng:      mrand.New(mrand.NewPCG(opts.Seed, opts.Seed)),
+		sessions: make(map[string]time.Time),
+	}
+	for i, v := range fleet.Vehicles {
+		s.vehicles = append(s.vehicles, newVehicleState(v.withDefaults(i), s.clock))
+		s.vehicles[i].record(s.clock)
+	}
+	return s
+}
+
+// Now returns the simulated time
+func (s *Simulator) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clock
+}
+
+// Step advances the simulation by d: vehicles move, status bits change and
+// due alarms are raised
+func (s *Simulator) Step(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clock = s.clock.Add(d)
+	for _, v := range s.vehicles {
+		for _, a := range v.step(d, s.clock, s.rng) {
+			s.addAlarm(v, a.typ, a.desc)
+		}
+		v.record(s.clock)
+	}
+	s.stepDownloads(d)
+
+	// Drop expired alarms
+	cutoff := s.clock.Add(-s.opts.AlarmTTL).Format(cmsv.TimeLayout)
+	keep := s.alarms[:0]
+	for _, a := range s.alarms {
+		if a.Time >= cutoff {
+			keep = append(keep, a)
+		}
+	}
+	s.alarms = keep
+	for _, v := range s.vehicles {
+		v.updateAlarmBits(s.alarms)
+	}
+}
+
+// Run steps the simulation every tick until ctx is cancelled, advancing it
+// by tick multiplied by TimeScale
+func (s *Simulator) Run(ctx context.Context, tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	step := time.Duration(float64(tick) * s.opts.TimeScale)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Step(step)
+		}
+	}
+}
+
+// RaiseAlarm adds an alarm for a device at its current position. It
+// returns the alarm GUID.
+func (s *Simulator) RaiseAlarm(device string, alarmType int, desc string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.vehicles {
+		if v.cfg.Device == device {
+			a := s.addAlarm(v, alarmType, desc)
+			v.updateAlarmBits(s.alarms)
+			return a.GUID, nil
+		}
+	}
+	return "", fmt.Errorf("unknown device %q", device)
+}
+
+// Alarms returns the current alarms, oldest first
+func (s *Simulator) Alarms() []cmsv.Alarm {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]cmsv.Alarm(nil), s.alarms...)
+}
+
+// SetOnline switches a device online or offline
+func (s *Simulator) SetOnline(device string, online bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.vehicles {
+		if v.cfg.Device == device {
+			v.online = online
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown device %q", device)
+}
+
+// InjectFault makes matching requests fail until the fault is used up or
+// cleared. Faults are checked in the order they were added.
+func (s *Simulator) InjectFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all injected faults
+func (s *Simulator) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// ExpireSessions invalidates every jsession, so the next requests fail with
+// result code 5 until the client logs in again
+func (s *Simulator) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.sessions)
+}
+
+// fault returns the fault for an action and uses it up. Callers hold s.mu.
+func (s *Simulator) fault(action string) *Fault {
+	for i, f := range s.faults {
+		if f.Action != "" && f.Action != "*" && f.Action != action {
+			continue
+		}
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// login creates a jsession. Callers hold s.mu.
+func (s *Simulator) login() string {
+	jsession := newGUID()[:19]
+	s.sessions[jsession] = s.clock
+	return jsession
+}
+
+// validSession reports whether a jsession exists and has been used within
+// the session lifetime, and extends it. Callers hold s.mu.
+func (s *Simulator) validSession(jsession string) bool {
+	lastUsed, ok := s.sessions[jsession]
+	if !ok {
+		return false
+	}
+	if s.clock.Sub(lastUsed) > cmsv.SessionLifetime {
+		delete(s.sessions, jsession)
+		return false
+	}
+	s.sessions[jsession] = s.clock
+	return true
+}
+
+// addAlarm records an alarm at the current position of v. Callers hold s.mu.
+func (s *Simulator) addAlarm(v *vehicleState, alarmType int, desc string) cmsv.Alarm {
+	now := s.clock.Format(cmsv.TimeLayout)
+	a := cmsv.Alarm{
+		DevIDNO: v.cfg.Device,
+		Desc:    desc,
+		GUID:    newGUID(),
+		SrcTm:   now,
+		Time:    now,
+		Type:    alarmType,
+		Gps: cmsv.AlarmGPS{
+			GT:  now,
+			HX:  v.heading,
+			Lat: geo.MicroDegrees(v.lat),
+			Lng: geo.MicroDegrees(v.lng),
+			LC:  int(v.mileage),
+			SP:  int(math.Round(v.speed * 10)),
+		},
+	}
+	s.alarms = append(s.alarms, a)
+	return a
+}
+
+func (s *Simulator) logf(format string, args ...any) {
+	if s.opts.Logger != nil {
+		s.opts.Logger.Printf(format, args...)
+	}
+}
+
+// newGUID returns a random 32 character hex ID
+func newGUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
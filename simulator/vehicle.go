@@ -0,0 +1,279 @@
+package simulator
+
+import (
+	"cmsv_api/cmsv"
+	"cmsv_api/geo"
+	"fmt"
+	"math"
+	mrand "math/rand/v2"
+	"time"
+)
+
+// Status bits set by the simulation, see cmsv.EquipmentStatus
+const (
+	s1GPSValid       = 1 << 0
+	s1ACC            = 1 << 1
+	s1LeftTurn       = 1 << 2
+	s1RightTurn      = 1 << 3
+	s1FatigueWarning = 1 << 4
+	s1GPSAntenna     = 1 << 7
+	s1HardDrive      = 1 << 8  // Hard drive present
+	s1Module4G       = 3 << 10 // 3G module status 3
+	s1Overspeed      = 1 << 14
+
+	s2DoorOpen = 1 << 13
+	s2Engine   = 1 << 17
+
+	s4Emergency       = 1 << 3
+	s4OvertimeParking = 1 << 14
+)
+
+const (
+	overtimeParking = 5 * time.Minute // Parking time that sets s4OvertimeParking
+	turnDegrees     = 15              // Heading change reported as a turn
+	fuelPerKm       = 0.3             // Liters
+)
+
+// Track recording of the queryTrackDetail action
+const (
+	trackInterval  = 30 * time.Second // Time between recorded positions
+	trackRetention = 24 * time.Hour   // Age of the oldest recorded position
+)
+
+// Video recording of the getVideoFileInfo action
+const (
+	recordingSegment        = 10 * time.Minute // Length of a recorded file
+	recordingBytesPerSecond = 64 * 1024        // Size of a file per second of video
+)
+
+// Alarm types raised by the simulation itself
+const (
+	alarmEmergency = 2
+	alarmOverspeed = 11
+	alarmFatigue   = 618
+)
+
+// raisedAlarm is an alarm produced by a simulation step
+type raisedAlarm struct {
+	typ  int
+	desc string
+}
+
+// vehicleState is the simulated state of one vehicle
+type vehicleState struct {
+	cfg    Vehicle
+	online bool
+
+	segment  int     // Route point the vehicle last left
+	progress float64 // Meters driven since that point
+	lat, lng float64
+	heading  int
+	speed    float64       // km/h
+	mileage  float64       // Meters
+	fuel     float64       // Liters
+	stop     time.Duration // Remaining stop at the current route point
+	parked   time.Duration // Time since the vehicle stopped
+	updated  time.Time
+
+	s1, s2, s3, s4 int
+	overspeed      bool
+	nextAlarm      []time.Time // Next alarm of every rule
+
+	track    []cmsv.DeviceStatus // Recorded positions, oldest first
+	recorded time.Time           // Time of the last recorded position
+}
+
+func newVehicleState(v Vehicle, now time.Time) *vehicleState {
+	st := &vehicleState{
+		cfg:     v,
+		online:  !v.Offline,
+		lat:     v.Route[0].Lat,
+		lng:     v.Route[0].Lng,
+		fuel:    v.FuelLiters,
+		updated: now,
+		s3:      (((1 << v.Channels) - 1) << 8) & 0xff00, // Video channels present
+	}
+	if len(v.Route) > 1 {
+		st.heading = geo.Bearing(v.Route[0].coord(), v.Route[1].coord())
+	}
+	for _, rule := range v.Alarms {
+		st.nextAlarm = append(st.nextAlarm, now.Add(time.Duration(rule.EverySeconds)*time.Second))
+	}
+	st.updateBits(st.heading)
+	return st
+}
+
+// step moves the vehicle forward by d and returns the alarms it raised
+func (v *vehicleState) step(d time.Duration, now time.Time, rng *mrand.Rand) []raisedAlarm {
+	if !v.online {
+		return nil
+	}
+	v.updated = now
+	previousHeading := v.heading
+
+	if v.stop > 0 || len(v.cfg.Route) < 2 {
+		v.stop = max(v.stop-d, 0)
+		v.speed = 0
+		v.parked += d
+	} else {
+		v.speed = v.cfg.SpeedKmh * (0.8 + 0.4*rng.Float64())
+		v.parked = 0
+		v.drive(v.speed / 3.6 * d.Seconds())
+	}
+
+	var alarms []raisedAlarm
+	overspeed := v.speed > v.cfg.SpeedLimitKmh
+	if overspeed && !v.overspeed {
+		alarms = append(alarms, raisedAlarm{alarmOverspeed, fmt.Sprintf("Speed %.1f km/h over limit %.0f km/h", v.speed, v.cfg.SpeedLimitKmh)})
+	}
+	v.overspeed = overspeed
+
+	for i, rule := range v.cfg.Alarms {
+		for !now.Before(v.nextAlarm[i]) {
+			alarms = append(alarms, raisedAlarm{rule.Type, rule.Desc})
+			v.nextAlarm[i] = v.nextAlarm[i].Add(time.Duration(rule.EverySeconds) * time.Second)
+		}
+	}
+
+	v.updateBits(previousHeading)
+	return alarms
+}
+
+// drive moves the vehicle meters along its route, stopping at the next
+// route point when the vehicle has a stop time
+func (v *vehicleState) drive(meters float64) {
+	route := v.cfg.Route
+	start := v.mileage
+	empty := 0 // Zero-length segments passed in a row
+	for meters > 0 && empty < len(route) {
+		from, to := route[v.segment], route[(v.segment+1)%len(route)]
+		length := geo.Distance(from.coord(), to.coord())
+		if length == 0 {
+			empty++
+		} else {
+			empty = 0
+		}
+		if v.progress+meters < length {
+			v.progress += meters
+			v.mileage += meters
+			meters = 0
+		} else {
+			v.mileage += length - v.progress
+			meters -= length - v.progress
+			v.segment = (v.segment + 1) % len(route)
+			v.progress = 0
+			if v.cfg.StopSeconds > 0 {
+				v.stop = time.Duration(v.cfg.StopSeconds) * time.Second
+				meters = 0
+			}
+		}
+		from, to = route[v.segment], route[(v.segment+1)%len(route)]
+		if length := geo.Distance(from.coord(), to.coord()); length > 0 {
+			f := v.progress / length
+			v.lat = from.Lat + (to.Lat-from.Lat)*f
+			v.lng = from.Lng + (to.Lng-from.Lng)*f
+			v.heading = geo.Bearing(from.coord(), to.coord())
+		}
+	}
+
+	v.fuel -= (v.mileage - start) / 1000 * fuelPerKm
+	if v.fuel < v.cfg.FuelLiters*0.1 {
+		// Refuel
+		v.fuel = v.cfg.FuelLiters
+	}
+}
+
+// updateBits derives the s1, s2 and s4 status words from the state
+func (v *vehicleState) updateBits(previousHeading int) {
+	moving := v.speed > 0
+	v.s1 = s1GPSValid | s1GPSAntenna | s1HardDrive | s1Module4G | v.s1&s1FatigueWarning
+	v.s2 = v.s2 &^ (s2DoorOpen | s2Engine)
+	v.s4 = v.s4 & s4Emergency
+
+	if moving {
+		v.s1 |= s1ACC
+		v.s2 |= s2Engine
+		turn := (v.heading-previousHeading+540)%360 - 180
+		switch {
+		case turn >= turnDegrees:
+			v.s1 |= s1RightTurn
+		case turn <= -turnDegrees:
+			v.s1 |= s1LeftTurn
+		}
+	} else {
+		v.s2 |= s2DoorOpen
+	}
+	if v.overspeed {
+		v.s1 |= s1Overspeed
+	}
+	if v.parked >= overtimeParking {
+		v.s4 |= s4OvertimeParking
+	}
+}
+
+// updateAlarmBits sets the status bits of active emergency and fatigue alarms
+func (v *vehicleState) updateAlarmBits(alarms []cmsv.Alarm) {
+	v.s1 &^= s1FatigueWarning
+	v.s4 &^= s4Emergency
+	for _, a := range alarms {
+		if a.DevIDNO != v.cfg.Device {
+			continue
+		}
+		switch a.Type {
+		case alarmEmergency:
+			v.s4 |= s4Emergency
+		case alarmFatigue:
+			v.s1 |= s1FatigueWarning
+		}
+	}
+}
+
+// record adds the current status to the track and drops samples older than
+// trackRetention. A sample is taken at most every trackInterval.
+func (v *vehicleState) record(now time.Time) {
+	if !v.online {
+		return
+	}
+	if len(v.track) > 0 && now.Sub(v.recorded) < trackInterval {
+		return
+	}
+	v.track = append(v.track, v.status())
+	v.recorded = now
+
+	cutoff := now.Add(-trackRetention).Format(cmsv.TimeLayout)
+	drop := 0
+	for drop < len(v.track) && v.track[drop].GT < cutoff {
+		drop++
+	}
+	v.track = v.track[drop:]
+}
+
+// status returns the device status in the server's integer scaling
+func (v *vehicleState) status() cmsv.DeviceStatus {
+	st := cmsv.DeviceStatus{
+		ID:  v.cfg.Device,
+		VID: v.cfg.Plate,
+		Lng: geo.MicroDegrees(v.lng),
+		Lat: geo.MicroDegrees(v.lat),
+		SP:  int(math.Round(v.speed * 10)),
+		TSP: int(math.Round(v.speed * 10)),
+		GT:  v.updated.Format(cmsv.TimeLayout) + ".0",
+		PT:  6,
+		DT:  1,
+		Net: 3,
+		GW:  "G1",
+		S1:  v.s1,
+		S2:  v.s2,
+		S3:  v.s3,
+		S4:  v.s4,
+		HX:  v.heading,
+		PK:  int(v.parked.Seconds()),
+		LC:  int(v.mileage),
+		YL:  int(math.Round(v.fuel * 100)),
+		SN:  12,
+	}
+	if v.online {
+		st.OL = 1
+	}
+	return st
+}
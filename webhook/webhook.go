@@ -0,0 +1,338 @@
+// Package webhook delivers alarms to HTTP endpoints. Alarms are queued on
+// disk first, so nothing is lost while a receiver is down, and delivered
+// with exponential backoff. Requests can be signed with HMAC-SHA256.
+package webhook
+
+import (
+	"bytes"
+	"cmsv_api/cmsv"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SignatureHeader carries "sha256=<hex HMAC of the request body>"
+	SignatureHeader = "X-Cmsv-Signature"
+	// DeliveryHeader carries the payload ID, identical on every retry
+	DeliveryHeader = "X-Cmsv-Delivery"
+
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 5 * time.Minute
+	DefaultTimeout    = 15 * time.Second
+)
+
+// Filter selects the alarms a sink receives. Empty lists match everything.
+type Filter struct {
+	Devices []string // Device numbers
+	Types   []int    // Alarm type codes
+}
+
+// Match reports whether an alarm passes the filter
+func (f Filter) Match(a cmsv.Alarm) bool {
+	if len(f.Devices) > 0 && !slices.Contains(f.Devices, a.DevIDNO) {
+		return false
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, a.Type) {
+		return false
+	}
+	return true
+}
+
+// Alarm is an alarm as delivered, with its catalog entry when the sink has one
+type Alarm struct {
+	cmsv.Alarm
+	TypeInfo *cmsv.AlarmType `json:"typeInfo,omitempty"`
+}
+
+// Payload is the JSON body POSTed to a sink
+type Payload struct {
+	ID        string    `json:"id"`
+	Sink      string    `json:"sink"`
+	CreatedAt time.Time `json:"createdAt"`
+	Alarms    []Alarm   `json:"alarms"`
+}
+
+// Options configures a sink
+type Options struct {
+	Name       string             // Sink name, used in the payload and as the queue subdirectory
+	URL        string             // Receiver URL
+	Secret     string             // HMAC-SHA256 key; empty sends unsigned requests
+	Filter     Filter             // Alarms to deliver
+	QueueDir   string             // Directory holding the on-disk queues of all sinks
+	Catalog    *cmsv.AlarmCatalog // Adds typeInfo to delivered alarms when set
+	HTTPClient *http.Client       // Default: a client with DefaultTimeout
+	MinBackoff time.Duration      // First retry delay (default DefaultMinBackoff)
+	MaxBackoff time.Duration      // Longest retry delay (default DefaultMaxBackoff)
+	Logger     *log.Logger        // Delivery failures are logged here when set
+}
+
+// Sink queues alarms and delivers them to one receiver
+type Sink struct {
+	opts    Options
+	dir     string // Pending payloads, delivered in name order
+	deadDir string // Payloads rejected by the receiver
+
+	mu     sync.Mutex // Serializes deliveries
+	notify chan struct{}
+}
+
+// NewSink creates a sink and its queue directory
+func NewSink(opts Options) (*Sink, error) {
+	if opts.Name == "" {
+		return nil, errors.New("webhook: sink name is required")
+	}
+	if u, err := url.Parse(opts.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("webhook %s: invalid URL %q", opts.Name, opts.URL)
+	}
+	if opts.QueueDir == "" {
+		return nil, fmt.Errorf("webhook %s: queue directory is required", opts.Name)
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(DefaultMaxBackoff, opts.MinBackoff)
+	}
+
+	s := &Sink{
+		opts:    opts,
+		dir:     filepath.Join(opts.QueueDir, opts.Name),
+		deadDir: filepath.Join(opts.QueueDir, opts.Name, "rejected"),
+		notify:  make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(s.deadDir, 0755); err != nil {
+		return nil, fmt.Errorf("webhook %s: %v", opts.Name, err)
+	}
+	return s, nil
+}
+
+// Name returns the sink name
+func (s *Sink) Name() string {
+	return s.opts.Name
+}
+
+// Enqueue stores the alarms that pass the filter in the on-disk queue and
+// wakes up Run. It returns the number of alarms queued.
+func (s *Sink) Enqueue(alarms []cmsv.Alarm) (int, error) {
+	payload := Payload{ID: newID(), Sink: s.opts.Name, CreatedAt: time.Now()}
+	for _, a := range alarms {
+		if !s.opts.Filter.Match(a) {
+			continue
+		}
+		alarm := Alarm{Alarm: a}
+		if s.opts.Catalog != nil {
+			t := s.opts.Catalog.Describe(a.Type)
+			alarm.TypeInfo = &t
+		}
+		payload.Alarms = append(payload.Alarms, alarm)
+	}
+	if len(payload.Alarms) == 0 {
+		return 0, nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	// Write to a temporary name first so a crash never leaves a partial payload
+	name := fmt.Sprintf("%020d-%s.json", payload.CreatedAt.UnixNano(), payload.ID)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := os.WriteFile(tmp, body, 0644); err != nil {
+		return 0, fmt.Errorf("webhook %s: queueing alarms: %v", s.opts.Name, err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return 0, fmt.Errorf("webhook %s: queueing alarms: %v", s.opts.Name, err)
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return len(payload.Alarms), nil
+}
+
+// Pending returns the queued payload files, oldest first
+func (s *Sink) Pending() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			files = append(files, filepath.Join(s.dir, e.Name()))
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// Flush delivers the queued payloads in order. It stops at the first
+// delivery that should be retried and returns its error. Payloads the
+// receiver rejects with a 4xx status are moved aside and not retried.
+func (s *Sink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.Pending()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		err = s.post(ctx, filepath.Base(file), body)
+		var rejected *rejectedError
+		if errors.As(err, &rejected) {
+			s.logf("webhook %s: %v; moved to %s", s.opts.Name, err, s.deadDir)
+			if err := os.Rename(file, filepath.Join(s.deadDir, filepath.Base(file))); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run delivers queued payloads until ctx is cancelled, retrying failed
+// deliveries with exponential backoff. It returns the context error.
+func (s *Sink) Run(ctx context.Context) error {
+	backoff := time.Duration(0)
+	for {
+		err := s.Flush(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			backoff = s.nextBackoff(backoff)
+			s.logf("webhook %s: delivery failed, retrying in %s: %v", s.opts.Name, backoff, err)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+			continue
+		}
+
+		backoff = 0
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.notify:
+		}
+	}
+}
+
+// nextBackoff doubles the previous delay within MinBackoff..MaxBackoff
+func (s *Sink) nextBackoff(previous time.Duration) time.Duration {
+	if previous <= 0 {
+		return s.opts.MinBackoff
+	}
+	return min(previous*2, s.opts.MaxBackoff)
+}
+
+// rejectedError is a delivery refused for good by the receiver
+type rejectedError struct {
+	status int
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("receiver rejected the payload (HTTP %d)", e.status)
+}
+
+func (s *Sink) post(ctx context.Context, name string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cmsv_api-webhook")
+	req.Header.Set(DeliveryHeader, payloadID(name))
+	if s.opts.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(s.opts.Secret, body))
+	}
+
+	resp, err := s.opts.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("receiver returned HTTP %d", resp.StatusCode)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return &rejectedError{status: resp.StatusCode}
+	}
+	return fmt.Errorf("receiver returned HTTP %d", resp.StatusCode)
+}
+
+func (s *Sink) logf(format string, args ...any) {
+	if s.opts.Logger != nil {
+		s.opts.Logger.Printf(format, args...)
+	}
+}
+
+// Sign returns the signature header value of a body: "sha256=" followed by
+// the hex HMAC-SHA256 of the body keyed with secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header value against a body, in constant time
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// newID returns a random payload ID
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// payloadID extracts the payload ID from a queue file name
+func payloadID(name string) string {
+	name = strings.TrimSuffix(name, ".json")
+	if _, id, ok := strings.Cut(name, "-"); ok {
+		return id
+	}
+	return name
+}
@@ -0,0 +1,300 @@
+package webhook
+
+import (
+	"cmsv_api/cmsv"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver records the requests of a test endpoint and answers them with
+// the given statuses in turn, then with 200
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []received
+}
+
+type received struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, received{header: r.Header.Clone(), body: body, at: time.Now()})
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) received() []received {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]received(nil), rc.requests...)
+}
+
+func newTestSink(t *testing.T, url, queueDir string, opts Options) *Sink {
+	t.Helper()
+	opts.Name = "test"
+	opts.URL = url
+	opts.QueueDir = queueDir
+	s, err := NewSink(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testAlarms() []cmsv.Alarm {
+	return []cmsv.Alarm{
+		{DevIDNO: "000000447007", GUID: "a1", Type: 2, Time: "2024-05-01 08:00:00"},
+		{DevIDNO: "000000447008", GUID: "a2", Type: 11, Time: "2024-05-01 08:00:05"},
+	}
+}
+
+func TestSignature(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	const secret = "s3cret"
+	s := newTestSink(t, srv.URL, t.TempDir(), Options{Secret: secret})
+	if n, err := s.Enqueue(testAlarms()); err != nil || n != 2 {
+		t.Fatalf("Enqueue = %d, %v; want 2 alarms", n, err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := rc.received()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	req := reqs[0]
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(req.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.header.Get(SignatureHeader); got != want {
+		t.Errorf("%s = %q, want %q", SignatureHeader, got, want)
+	}
+	if !Verify(secret, req.body, req.header.Get(SignatureHeader)) {
+		t.Error("Verify rejects the signature of the delivered body")
+	}
+	if Verify("other", req.body, req.header.Get(SignatureHeader)) {
+		t.Error("Verify accepts the signature with another secret")
+	}
+
+	var payload Payload
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.header.Get(DeliveryHeader); got != payload.ID {
+		t.Errorf("%s = %q, want the payload ID %q", DeliveryHeader, got, payload.ID)
+	}
+	if payload.Sink != "test" || len(payload.Alarms) != 2 {
+		t.Errorf("payload = %+v, want 2 alarms of sink test", payload)
+	}
+}
+
+func TestUnsigned(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	s := newTestSink(t, srv.URL, t.TempDir(), Options{})
+	s.Enqueue(testAlarms())
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := rc.received(); len(reqs) != 1 || reqs[0].header.Get(SignatureHeader) != "" {
+		t.Errorf("want one request without %s", SignatureHeader)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusBadGateway}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	const minBackoff = 20 * time.Millisecond
+	s := newTestSink(t, srv.URL, t.TempDir(), Options{MinBackoff: minBackoff, MaxBackoff: 40 * time.Millisecond})
+	s.Enqueue(testAlarms())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	for len(rc.received()) < 4 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d requests before the timeout, want 4", len(rc.received()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	reqs := rc.received()
+	// Backoff doubles from MinBackoff and stops at MaxBackoff: 20, 40, 40 ms
+	for i, want := range []time.Duration{minBackoff, 2 * minBackoff, 2 * minBackoff} {
+		if gap := reqs[i+1].at.Sub(reqs[i].at); gap < want {
+			t.Errorf("retry %d after %s, want at least %s", i+1, gap, want)
+		}
+	}
+	id := reqs[0].header.Get(DeliveryHeader)
+	for i, req := range reqs {
+		if got := req.header.Get(DeliveryHeader); got != id {
+			t.Errorf("request %d: %s = %q, want %q on every retry", i, DeliveryHeader, got, id)
+		}
+	}
+	if files, err := s.Pending(); err != nil || len(files) != 0 {
+		t.Errorf("Pending = %v, %v; want an empty queue", files, err)
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	s := &Sink{opts: Options{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}}
+	var got []time.Duration
+	backoff := time.Duration(0)
+	for range 5 {
+		backoff = s.nextBackoff(backoff)
+		got = append(got, backoff)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("backoff sequence = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRejected(t *testing.T) {
+	tests := []struct {
+		status   int
+		rejected bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusNotFound, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			rc := &receiver{statuses: []int{tt.status}}
+			srv := httptest.NewServer(rc)
+			defer srv.Close()
+
+			dir := t.TempDir()
+			s := newTestSink(t, srv.URL, dir, Options{})
+			s.Enqueue(testAlarms())
+			queued, _ := s.Pending()
+
+			err := s.Flush(context.Background())
+			pending, _ := s.Pending()
+			dead, _ := filepath.Glob(filepath.Join(dir, "test", "rejected", "*.json"))
+			if tt.rejected {
+				if err != nil {
+					t.Errorf("Flush = %v, want nil for a rejected payload", err)
+				}
+				if len(pending) != 0 || len(dead) != 1 || filepath.Base(dead[0]) != filepath.Base(queued[0]) {
+					t.Errorf("pending %v, rejected %v; want the payload moved to rejected", pending, dead)
+				}
+				return
+			}
+			if err == nil {
+				t.Error("Flush = nil, want an error so the payload is retried")
+			}
+			if len(pending) != 1 || len(dead) != 0 {
+				t.Errorf("pending %v, rejected %v; want the payload kept in the queue", pending, dead)
+			}
+		})
+	}
+}
+
+func TestQueueReload(t *testing.T) {
+	dir := t.TempDir()
+
+	// Queue while the receiver is down
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+	s := newTestSink(t, downURL, dir, Options{})
+	if _, err := s.Enqueue(testAlarms()[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Enqueue(testAlarms()[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(context.Background()); err == nil {
+		t.Fatal("Flush to a closed server succeeded")
+	}
+
+	// A leftover temporary file of an interrupted Enqueue is not delivered
+	if err := os.WriteFile(filepath.Join(dir, "test", "00000000000000000000-partial.json.tmp"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new sink on the same directory picks up the queue, oldest first
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	reloaded := newTestSink(t, srv.URL, dir, Options{})
+	if files, err := reloaded.Pending(); err != nil || len(files) != 2 {
+		t.Fatalf("Pending = %v, %v; want the 2 queued payloads", files, err)
+	}
+	if err := reloaded.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := rc.received()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(reqs))
+	}
+	for i, want := range []string{"a1", "a2"} {
+		var payload Payload
+		if err := json.Unmarshal(reqs[i].body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if len(payload.Alarms) != 1 || payload.Alarms[0].GUID != want {
+			t.Errorf("request %d delivered %+v, want alarm %s", i, payload.Alarms, want)
+		}
+	}
+	if files, _ := reloaded.Pending(); len(files) != 0 {
+		t.Errorf("Pending = %v after delivery, want empty", files)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	s := newTestSink(t, srv.URL, t.TempDir(), Options{Filter: Filter{Devices: []string{"000000447008"}}})
+	if n, err := s.Enqueue(testAlarms()[:1]); err != nil || n != 0 {
+		t.Errorf("Enqueue of a filtered alarm = %d, %v; want 0", n, err)
+	}
+	if files, _ := s.Pending(); len(files) != 0 {
+		t.Errorf("Pending = %v, want nothing queued", files)
+	}
+	if n, _ := s.Enqueue(testAlarms()); n != 1 {
+		t.Errorf("Enqueue = %d, want 1 alarm past the filter", n)
+	}
+}